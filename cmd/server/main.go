@@ -18,6 +18,7 @@ import (
 	"pay-gateway/internal/cache"
 	"pay-gateway/internal/config"
 	"pay-gateway/internal/database"
+	"pay-gateway/internal/handlers"
 	"pay-gateway/internal/mq"
 	"pay-gateway/internal/routes"
 	"pay-gateway/internal/services"
@@ -58,24 +59,20 @@ func main() {
 	defer redis.Close()
 
 	// 初始化Google Play服务
-	googleService, err := services.NewGooglePlayService(cfg, logger)
+	googleService, err := services.NewGooglePlayService(cfg, logger, db.GetDB())
 	if err != nil {
 		logger.Fatal("初始化Google Play服务失败", zap.Error(err))
 	}
 
-	// 初始化支付宝服务（传入 Redis 用于 Webhook 分布式锁）
-	alipayService, err := services.NewAlipayService(db.GetDB(), &cfg.Alipay, redis)
+	// 初始化各租户支付宝服务（传入 Redis 用于 Webhook 分布式锁）
+	alipayServices, err := services.NewAlipayServices(db.GetDB(), cfg, redis)
 	if err != nil {
 		logger.Fatal("初始化支付宝服务失败", zap.Error(err))
 	}
+	defaultAlipayService, _ := alipayServices.Get(config.DefaultTenantID)
 
-	// 初始化支付宝对账服务（可选，失败时对账接口返回 503）
-	var alipayReconciliationService *services.AlipayReconciliationService
-	if svc, err := services.NewAlipayReconciliationService(db.GetDB(), &cfg.Alipay, logger); err != nil {
-		logger.Warn("初始化支付宝对账服务失败，对账功能将不可用", zap.Error(err))
-	} else {
-		alipayReconciliationService = svc
-	}
+	// 初始化各租户支付宝对账服务（可选，失败的租户对账接口返回 503）
+	alipayReconciliationServices := services.NewAlipayReconciliationServices(db.GetDB(), cfg, alipayServices, redis, logger)
 
 	// 初始化Apple服务
 	appleService, err := services.NewAppleService(cfg, logger, db.GetDB())
@@ -83,16 +80,25 @@ func main() {
 		logger.Fatal("初始化Apple服务失败", zap.Error(err))
 	}
 
-	// 初始化微信支付服务
-	wechatService, err := services.NewWechatService(db.GetDB(), &cfg.Wechat, logger)
-	if err != nil {
-		logger.Warn("初始化微信支付服务失败，微信支付功能将不可用", zap.Error(err))
-		// 微信服务初始化失败不影响其他服务
-		wechatService = nil
-	}
+	// 初始化各租户微信支付服务（初始化失败的租户不影响其他服务）
+	wechatServices := services.NewWechatServices(db.GetDB(), cfg, logger)
+	wechatReconciliationServices := services.NewWechatReconciliationServices(db.GetDB(), wechatServices, redis, logger)
+
+	logger.Info("租户支付服务初始化完成",
+		zap.Strings("alipay_tenants", alipayServices.TenantIDs()),
+		zap.Strings("wechat_tenants", wechatServices.TenantIDs()))
+
+	// 初始化应用商店对账服务（App Store Connect / Google Play 报告导入）
+	storeReconciliationService := services.NewStoreReconciliationService(db.GetDB(), cfg, logger)
+	storeReconciliationService.SetRedis(redis)
 
 	// 初始化支付服务
-	paymentService := services.NewPaymentService(db.GetDB(), cfg, logger, googleService, alipayService, appleService)
+	paymentService := services.NewPaymentService(db.GetDB(), cfg, logger, googleService, defaultAlipayService, appleService)
+
+	// 初始化 Google Webhook 事件调度器，并注册 Webhook 处理器的事件处理函数
+	googleWebhookDispatcher := services.NewWebhookDispatcher(db.GetDB(), &cfg.Google, logger)
+	googleWebhookHandler := handlers.NewGoogleWebhookHandler(db.GetDB(), googleService, paymentService, &cfg.Google, googleWebhookDispatcher, logger)
+	googleWebhookDispatcher.SetProcessor(googleWebhookHandler.ProcessWebhookEvent)
 
 	// 初始化 RocketMQ（订单超时自动取消）
 	var mqClient *mq.Client
@@ -106,12 +112,12 @@ func main() {
 			orderProducer := mq.NewOrderDelayCancelProducer(mqClient, &cfg.RocketMQ, logger)
 			// 注入到各支付服务
 			paymentService.SetOrderDelayCancelProducer(orderProducer)
-			if alipayService != nil {
-				alipayService.SetOrderDelayCancelProducer(orderProducer)
-			}
-			if wechatService != nil {
-				wechatService.SetOrderDelayCancelProducer(orderProducer)
-			}
+			alipayServices.Each(func(_ string, svc *services.AlipayService) {
+				svc.SetOrderDelayCancelProducer(orderProducer)
+			})
+			wechatServices.Each(func(_ string, svc *services.WechatService) {
+				svc.SetOrderDelayCancelProducer(orderProducer)
+			})
 
 			// 启动消费者
 			orderDelayCancelConsumer, err = mq.NewOrderDelayCancelConsumer(&cfg.RocketMQ, db.GetDB(), logger)
@@ -140,7 +146,10 @@ func main() {
 	routes.SetupMiddleware(router, logger)
 
 	// 设置路由
-	routes.SetupRoutes(router, paymentService, googleService, alipayService, alipayReconciliationService, appleService, wechatService, db.GetDB(), cfg, logger)
+	routes.SetupRoutes(router, paymentService, googleService, alipayServices, alipayReconciliationServices, appleService, wechatServices, wechatReconciliationServices, storeReconciliationService, googleWebhookHandler, db.GetDB(), cfg, logger)
+
+	// 启动 Google Webhook 工作协程，并恢复上次退出前未处理完的事件
+	googleWebhookDispatcher.Start()
 
 	// 创建HTTP服务器
 	srv := &http.Server{
@@ -176,24 +185,120 @@ func main() {
 		ticker := time.NewTicker(2 * time.Minute)
 		defer ticker.Stop()
 		for range ticker.C {
-			if count, err := alipayService.SyncPendingOrders(context.Background()); err != nil {
-				logger.Error("支付宝主动查询兜底失败", zap.Error(err))
-			} else if count > 0 {
-				logger.Info("支付宝主动查询兜底完成", zap.Int("queried", count))
-			}
+			alipayServices.Each(func(tenantID string, svc *services.AlipayService) {
+				if count, err := svc.SyncPendingOrders(context.Background()); err != nil {
+					logger.Error("支付宝主动查询兜底失败", zap.String("tenant_id", tenantID), zap.Error(err))
+				} else if count > 0 {
+					logger.Info("支付宝主动查询兜底完成", zap.String("tenant_id", tenantID), zap.Int("queried", count))
+				}
+			})
 		}
 	}()
 
-	// 启动支付宝每日对账定时任务（可选）
-	if alipayReconciliationService != nil && cfg.Alipay.ReconciliationCronEnable {
+	// 启动支付宝周期扣款调度任务（可选，按期主动发起代扣）
+	if cfg.Alipay.DeductSchedulerEnable {
+		interval := cfg.Alipay.DeductSchedulerInterval
+		if interval <= 0 {
+			interval = 5 * time.Minute
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				alipayServices.Each(func(tenantID string, svc *services.AlipayService) {
+					if count, err := svc.RunDueDeductions(context.Background()); err != nil {
+						logger.Error("支付宝周期扣款调度失败", zap.String("tenant_id", tenantID), zap.Error(err))
+					} else if count > 0 {
+						logger.Info("支付宝周期扣款调度完成", zap.String("tenant_id", tenantID), zap.Int("deducted", count))
+					}
+				})
+			}
+		}()
+		logger.Info("已启用支付宝周期扣款调度任务", zap.Duration("interval", interval))
+	}
+
+	// 启动 Google Play 作废购买轮询任务（可选，补漏 RTDN 未通知的退款与拒付）
+	if cfg.Google.VoidedPurchasesSyncEnable {
+		voidedPurchaseService := services.NewGoogleVoidedPurchaseService(db.GetDB(), googleService, logger)
+		voidedPurchaseService.SetRedis(redis)
+		interval := cfg.Google.VoidedPurchasesSyncInterval
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if count, err := voidedPurchaseService.SyncVoidedPurchases(context.Background()); err != nil {
+					logger.Error("Google Play作废购买同步失败", zap.Error(err))
+				} else if count > 0 {
+					logger.Info("Google Play作废购买同步完成", zap.Int("processed", count))
+				}
+			}
+		}()
+		logger.Info("已启用Google Play作废购买轮询任务", zap.Duration("interval", interval))
+	}
+
+	// 启动微信平台证书刷新任务（可选，支持平台证书轮换，各租户商户号分别刷新）
+	if wechatServices.Len() > 0 && cfg.Wechat.PlatformCertAutoRefresh {
+		refreshPlatformCertificates := func() {
+			wechatServices.Each(func(tenantID string, svc *services.WechatService) {
+				if err := svc.RefreshPlatformCertificates(context.Background()); err != nil {
+					logger.Error("刷新微信平台证书失败", zap.String("tenant_id", tenantID), zap.Error(err))
+				}
+			})
+		}
+		refreshPlatformCertificates()
+		interval := cfg.Wechat.PlatformCertRefreshInterval
+		if interval <= 0 {
+			interval = 12 * time.Hour
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				refreshPlatformCertificates()
+			}
+		}()
+		logger.Info("已启用微信平台证书自动刷新", zap.Duration("interval", interval))
+	}
+
+	// 启动支付宝每日对账定时任务（可选，各租户依次对账）
+	if alipayReconciliationServices.Len() > 0 && cfg.Alipay.ReconciliationCronEnable {
 		cronTime := cfg.Alipay.ReconciliationCronTime
 		if cronTime == "" {
 			cronTime = "02:00"
 		}
-		go runReconciliationCron(alipayReconciliationService, cronTime, logger)
+		go runReconciliationCron(cronTime, logger, func(billDate string) {
+			alipayReconciliationServices.Each(func(tenantID string, svc *services.AlipayReconciliationService) {
+				if _, err := svc.RunDailyReconciliation(context.Background(), billDate); err != nil {
+					logger.Error("定时对账执行失败", zap.String("tenant_id", tenantID), zap.String("bill_date", billDate), zap.Error(err))
+				} else {
+					logger.Info("定时对账执行完成", zap.String("tenant_id", tenantID), zap.String("bill_date", billDate))
+				}
+			})
+		})
 		logger.Info("已启用支付宝每日对账定时任务", zap.String("cron_time", cronTime))
 	}
 
+	// 启动微信支付每日对账定时任务（可选，各租户依次对账）
+	if wechatReconciliationServices.Len() > 0 && cfg.Wechat.ReconciliationCronEnable {
+		cronTime := cfg.Wechat.ReconciliationCronTime
+		if cronTime == "" {
+			cronTime = "10:30"
+		}
+		go runReconciliationCron(cronTime, logger, func(billDate string) {
+			wechatReconciliationServices.Each(func(tenantID string, svc *services.WechatReconciliationService) {
+				if _, err := svc.RunDailyReconciliation(context.Background(), billDate); err != nil {
+					logger.Error("微信支付定时对账执行失败", zap.String("tenant_id", tenantID), zap.String("bill_date", billDate), zap.Error(err))
+				} else {
+					logger.Info("微信支付定时对账执行完成", zap.String("tenant_id", tenantID), zap.String("bill_date", billDate))
+				}
+			})
+		})
+		logger.Info("已启用微信支付每日对账定时任务", zap.String("cron_time", cronTime))
+	}
+
 	// 等待中断信号
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -209,6 +314,11 @@ func main() {
 		logger.Error("服务器强制关闭", zap.Error(err))
 	}
 
+	// 等待 Google Webhook 队列中的事件处理完成，超时未完成的事件下次启动时恢复
+	if err := googleWebhookDispatcher.Shutdown(ctx); err != nil {
+		logger.Error("关闭Google Webhook调度器失败", zap.Error(err))
+	}
+
 	// 关闭 RocketMQ
 	if orderDelayCancelConsumer != nil {
 		if err := orderDelayCancelConsumer.Stop(); err != nil {
@@ -225,7 +335,7 @@ func main() {
 }
 
 // runReconciliationCron 每日对账定时任务，在指定时间执行前一日对账
-func runReconciliationCron(svc *services.AlipayReconciliationService, cronTime string, logger *zap.Logger) {
+func runReconciliationCron(cronTime string, logger *zap.Logger, run func(billDate string)) {
 	parts := strings.Split(cronTime, ":")
 	hour, min := 2, 0
 	if len(parts) >= 1 && parts[0] != "" {
@@ -247,12 +357,7 @@ func runReconciliationCron(svc *services.AlipayReconciliationService, cronTime s
 		sleep := time.Until(next)
 		logger.Info("对账定时任务将于下次执行", zap.Time("next_run", next), zap.Duration("sleep", sleep))
 		time.Sleep(sleep)
-		billDate := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
-		if _, err := svc.RunReconciliation(context.Background(), billDate); err != nil {
-			logger.Error("定时对账执行失败", zap.String("bill_date", billDate), zap.Error(err))
-		} else {
-			logger.Info("定时对账执行完成", zap.String("bill_date", billDate))
-		}
+		run(time.Now().AddDate(0, 0, -1).Format("2006-01-02"))
 	}
 }
 
@@ -68,6 +68,22 @@ func (r *Redis) SetNX(ctx context.Context, key string, value interface{}, expira
 	return r.client.SetNX(ctx, key, value, expiration).Result()
 }
 
+// releaseLockScript 值与持有者令牌一致时才删除，避免锁过期后误删其他实例重新获取的锁
+var releaseLockScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// DelIfValue 仅当键的值等于 value 时删除（用于释放 SetNX 获取的分布式锁）
+// 返回 true 表示已删除，false 表示键不存在或已被其他持有者覆盖
+func (r *Redis) DelIfValue(ctx context.Context, key, value string) (bool, error) {
+	n, err := releaseLockScript.Run(ctx, r.client, []string{key}, value).Int()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
 // Get 获取值
 func (r *Redis) Get(ctx context.Context, key string) (string, error) {
 	return r.client.Get(ctx, key).Result()
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -20,18 +21,53 @@ type Config struct {
 	Apple    AppleConfig    // Apple Store配置
 	Wechat   WechatConfig   // 微信支付配置
 	RocketMQ RocketMQConfig // RocketMQ消息队列配置
+
+	Tenants []TenantConfig `toml:"tenants"` // 其他租户（多商户），顶层 [alipay]/[wechat] 为默认租户
+}
+
+// DefaultTenantID 默认租户ID，对应顶层 [alipay]/[wechat] 配置
+const DefaultTenantID = "default"
+
+// TenantConfig 单个租户的支付配置，每个租户拥有独立的支付宝应用与微信商户号
+// 未配置的渠道视为该租户未开通；定时任务开关与间隔沿用顶层配置
+type TenantConfig struct {
+	ID     string        `toml:"id"`     // 租户ID，用于回调路径 /webhook/alipay/:tenant/notify 与请求头 X-Tenant-ID
+	Name   string        `toml:"name"`   // 租户名称
+	Alipay *AlipayConfig `toml:"alipay"` // 支付宝配置（可选）
+	Wechat *WechatConfig `toml:"wechat"` // 微信支付配置（可选）
+}
+
+// AllTenants 返回全部租户，默认租户在前
+func (c *Config) AllTenants() []TenantConfig {
+	tenants := []TenantConfig{{
+		ID:     DefaultTenantID,
+		Name:   "默认租户",
+		Alipay: &c.Alipay,
+		Wechat: &c.Wechat,
+	}}
+	return append(tenants, c.Tenants...)
+}
+
+// HasTenant 判断租户是否已配置
+func (c *Config) HasTenant(tenantID string) bool {
+	for _, tenant := range c.AllTenants() {
+		if tenant.ID == tenantID {
+			return true
+		}
+	}
+	return false
 }
 
 // RocketMQConfig RocketMQ 消息队列配置
 // 用于订单超时自动取消等延迟消息场景
 type RocketMQConfig struct {
-	Endpoint         string        // RocketMQ Proxy 地址，如 localhost:8081
-	AccessKey        string        // 访问密钥（可选，开启 ACL 时必填）
-	SecretKey        string        // 密钥（可选，开启 ACL 时必填）
-	OrderDelayTopic  string        // 订单超时取消延迟消息 Topic
-	ConsumerGroup    string        // 消费者组名
-	OrderTimeout     time.Duration // 订单超时时间，默认30分钟
-	Enabled          bool          // 是否启用 RocketMQ（false 时降级为定时任务轮询）
+	Endpoint        string        // RocketMQ Proxy 地址，如 localhost:8081
+	AccessKey       string        // 访问密钥（可选，开启 ACL 时必填）
+	SecretKey       string        // 密钥（可选，开启 ACL 时必填）
+	OrderDelayTopic string        // 订单超时取消延迟消息 Topic
+	ConsumerGroup   string        // 消费者组名
+	OrderTimeout    time.Duration // 订单超时时间，默认30分钟
+	Enabled         bool          // 是否启用 RocketMQ（false 时降级为定时任务轮询）
 }
 
 // ServerConfig 服务器配置参数
@@ -76,6 +112,32 @@ type GoogleConfig struct {
 	WebhookURL           string // Webhook 完整 URL，用于 Pub/Sub JWT 验证的 audience
 	VerifyPushJWT        bool   `toml:"verify_push_jwt"`       // 是否验证 Pub/Sub 推送的 JWT 签名（需在 Pub/Sub 订阅中启用认证）
 	ExpectedSubscription string `toml:"expected_subscription"` // 期望的 Pub/Sub 订阅全名，如 projects/xxx/subscriptions/yyy，用于校验消息来源
+
+	VoidedPurchasesSyncEnable   bool          `toml:"voided_purchases_sync_enable"`   // 是否启用作废购买（退款/拒付）轮询任务
+	VoidedPurchasesSyncInterval time.Duration `toml:"voided_purchases_sync_interval"` // 轮询间隔，默认1小时
+
+	WebhookWorkers      int           `toml:"webhook_workers"`       // Webhook 处理工作协程数，默认4
+	WebhookQueueSize    int           `toml:"webhook_queue_size"`    // Webhook 内存队列容量，默认100，队列满时由轮询补偿
+	WebhookPollInterval time.Duration `toml:"webhook_poll_interval"` // 扫描待处理/待重试事件的间隔，默认30秒
+
+	Apps []GoogleAppConfig `toml:"apps"` // 其他应用（多包名），顶层 package_name/service_account_file 为默认应用
+
+	EarningsReportDir string `toml:"earnings_report_dir"` // 收入报告目录（从 Cloud Storage 报告存储桶同步的 earnings CSV/ZIP），用于对账
+}
+
+// GoogleAppConfig 单个 Google Play 应用的凭证配置
+type GoogleAppConfig struct {
+	PackageName        string `toml:"package_name"`         // Android应用包名
+	ServiceAccountFile string `toml:"service_account_file"` // 服务账号JSON文件路径或JSON内容
+}
+
+// AllApps 返回全部 Google Play 应用，默认应用在前
+func (g *GoogleConfig) AllApps() []GoogleAppConfig {
+	var apps []GoogleAppConfig
+	if g.PackageName != "" {
+		apps = append(apps, GoogleAppConfig{PackageName: g.PackageName, ServiceAccountFile: g.ServiceAccountFile})
+	}
+	return append(apps, g.Apps...)
 }
 
 // JWTConfig JWT认证配置
@@ -87,19 +149,24 @@ type JWTConfig struct {
 
 // AlipayConfig 支付宝配置
 type AlipayConfig struct {
-	AppID                    string // 支付宝应用ID
-	PrivateKey               string // 应用私钥
-	IsProduction             bool   // 是否为生产环境
-	NotifyURL                string // 支付异步通知URL
-	WithholdNotifyURL        string `toml:"withhold_notify_url"` // 免密签约异步通知URL（可选，为空时从 NotifyURL 派生）
-	ReturnURL                string // 同步返回URL
-	CertMode                 bool   // 是否使用证书模式
-	AlipayPublicKey          string `toml:"alipay_public_key"` // 支付宝公钥（公钥模式验签用，cert_mode=false 时必填）
-	AppCertPath              string // 应用公钥证书路径（证书模式）
-	RootCertPath             string // 支付宝根证书路径（证书模式）
-	AlipayCertPath           string // 支付宝公钥证书路径（证书模式）
-	ReconciliationCronEnable bool   `toml:"reconciliation_cron_enable"` // 是否启用每日对账定时任务
-	ReconciliationCronTime   string `toml:"reconciliation_cron_time"`   // 对账执行时间，如 "02:00" 表示凌晨2点
+	AppID                    string        // 支付宝应用ID
+	PrivateKey               string        // 应用私钥
+	IsProduction             bool          // 是否为生产环境
+	NotifyURL                string        // 支付异步通知URL
+	WithholdNotifyURL        string        `toml:"withhold_notify_url"` // 免密签约异步通知URL（可选，为空时从 NotifyURL 派生）
+	ReturnURL                string        // 同步返回URL
+	CertMode                 bool          // 是否使用证书模式
+	AlipayPublicKey          string        `toml:"alipay_public_key"` // 支付宝公钥（公钥模式验签用，cert_mode=false 时必填）
+	AppCertPath              string        // 应用公钥证书路径（证书模式）
+	RootCertPath             string        // 支付宝根证书路径（证书模式）
+	AlipayCertPath           string        // 支付宝公钥证书路径（证书模式）
+	ReconciliationCronEnable bool          `toml:"reconciliation_cron_enable"` // 是否启用每日对账定时任务
+	ReconciliationCronTime   string        `toml:"reconciliation_cron_time"`   // 对账执行时间，如 "02:00" 表示凌晨2点
+	DeductSchedulerEnable    bool          `toml:"deduct_scheduler_enable"`    // 是否启用服务端周期扣款调度
+	DeductSchedulerInterval  time.Duration `toml:"deduct_scheduler_interval"`  // 周期扣款调度间隔，默认5分钟
+	DunningRetryDays         []int         `toml:"dunning_retry_days"`         // 扣款失败后的重试时间点（距首次失败天数），默认 [1, 3, 7]
+	DunningGraceDays         int           `toml:"dunning_grace_days"`         // 宽限期天数，期间保留权益，默认3天
+	DunningUnsignOnSuspend   bool          `toml:"dunning_unsign_on_suspend"`  // 重试耗尽后是否自动解约
 }
 
 // AppleConfig Apple Store配置
@@ -109,8 +176,64 @@ type AppleConfig struct {
 	BundleID       string // iOS应用Bundle ID
 	PrivateKey     string // Apple私钥内容（.p8文件内容）
 	PrivateKeyPath string // Apple私钥文件路径（如果私钥内容为空，则从文件读取）
-	Sandbox        bool   // 是否使用沙盒环境
+	Sandbox        bool   // 是否为沙盒部署：只接受沙盒环境的交易
 	WebhookSecret  string // Apple Webhook密钥，用于验证通知
+
+	LegacyReceiptVerification bool `toml:"legacy_receipt_verification"` // 是否开启已废弃的 verifyReceipt 收据验证（旧版客户端兼容），默认关闭
+	RejectSandbox             bool `toml:"reject_sandbox"`              // 生产部署是否拒绝沙盒交易，默认接受（App 审核与 TestFlight 使用沙盒环境）
+
+	ReportDir string `toml:"report_dir"` // App Store Connect 销售/财务报告目录（gzip TSV），用于对账
+
+	Apps []AppleAppConfig `toml:"apps"` // 其他应用（多 Bundle ID），顶层 bundle_id 及密钥为默认应用
+
+	Consumption AppleConsumptionConfig `toml:"consumption"` // CONSUMPTION_REQUEST 退款消耗信息上报配置
+}
+
+// AppleConsumptionConfig 响应 CONSUMPTION_REQUEST 通知时向 Apple 发送消耗信息的配置
+// Apple 要求在通知后 12 小时内响应，且用户已同意提供消耗数据（customer_consented）时才会采纳
+type AppleConsumptionConfig struct {
+	Enabled               bool  `toml:"enabled"`                 // 是否自动发送消耗信息
+	CustomerConsented     bool  `toml:"customer_consented"`      // 用户协议中是否已取得提供消耗数据的同意，未同意时不发送
+	RefundPreference      int32 `toml:"refund_preference"`       // 退款偏好：0-未声明，1-倾向批准，2-倾向拒绝，3-无偏好
+	SampleContentProvided bool  `toml:"sample_content_provided"` // 购买前是否提供过试用或样例内容
+}
+
+// AppleAppConfig 单个 Apple 应用的 App Store Server API 凭证配置
+// KeyID/IssuerID/私钥为空时沿用顶层配置（同一开发者账号下的多个应用可共用 API 密钥）
+type AppleAppConfig struct {
+	BundleID       string `toml:"bundle_id"`        // iOS应用Bundle ID
+	KeyID          string `toml:"key_id"`           // Apple私钥ID
+	IssuerID       string `toml:"issuer_id"`        // Apple发行者ID
+	PrivateKey     string `toml:"private_key"`      // Apple私钥内容（.p8文件内容）
+	PrivateKeyPath string `toml:"private_key_path"` // Apple私钥文件路径
+}
+
+// AllApps 返回全部 Apple 应用，默认应用在前，未配置的凭证字段以顶层配置补全
+func (a *AppleConfig) AllApps() []AppleAppConfig {
+	var apps []AppleAppConfig
+	if a.BundleID != "" {
+		apps = append(apps, AppleAppConfig{
+			BundleID:       a.BundleID,
+			KeyID:          a.KeyID,
+			IssuerID:       a.IssuerID,
+			PrivateKey:     a.PrivateKey,
+			PrivateKeyPath: a.PrivateKeyPath,
+		})
+	}
+	for _, app := range a.Apps {
+		if app.KeyID == "" {
+			app.KeyID = a.KeyID
+		}
+		if app.IssuerID == "" {
+			app.IssuerID = a.IssuerID
+		}
+		if app.PrivateKey == "" && app.PrivateKeyPath == "" {
+			app.PrivateKey = a.PrivateKey
+			app.PrivateKeyPath = a.PrivateKeyPath
+		}
+		apps = append(apps, app)
+	}
+	return apps
 }
 
 // WechatConfig 微信支付配置
@@ -124,6 +247,22 @@ type WechatConfig struct {
 	NotifyURL        string // 异步通知URL
 	CertPath         string // 商户证书路径（可选，用于请求签名）
 	PlatformCertPath string // 微信平台证书路径（用于验签回调，可从商户平台下载）
+	PapayPlanID      string `toml:"papay_plan_id"`    // 委托代扣模板ID（商户平台申请，签约时未指定则使用）
+	PapayNotifyURL   string `toml:"papay_notify_url"` // 委托代扣签约/解约通知URL（可选，为空时从 NotifyURL 派生）
+	// AppIDs 同一商户号绑定的多个应用ID，按下单请求的 app_type 选择，如 mp（公众号）、miniprogram（小程序）、app（APP）
+	// 未指定 app_type 时使用 AppID
+	AppIDs           map[string]string `toml:"app_ids"`
+	CombineNotifyURL string            `toml:"combine_notify_url"` // 合单支付通知URL（可选，为空时从 NotifyURL 派生）
+	// 平台证书自动下载：从 /v3/certificates 获取并按序列号缓存，支持证书轮换
+	PlatformCertAutoRefresh     bool          `toml:"platform_cert_auto_refresh"`     // 是否自动下载平台证书
+	PlatformCertRefreshInterval time.Duration `toml:"platform_cert_refresh_interval"` // 平台证书刷新间隔，默认12小时
+	// 微信支付公钥模式（新商户默认）：回调 Wechatpay-Serial 为公钥ID时使用
+	PublicKeyID   string `toml:"public_key_id"`   // 微信支付公钥ID（PUB_KEY_ID_ 开头）
+	PublicKey     string `toml:"public_key"`      // 微信支付公钥内容
+	PublicKeyPath string `toml:"public_key_path"` // 微信支付公钥文件路径
+	// 每日对账：微信支付次日 10 点后生成前一日账单，执行时间需晚于 10 点
+	ReconciliationCronEnable bool   `toml:"reconciliation_cron_enable"` // 是否启用每日对账定时任务
+	ReconciliationCronTime   string `toml:"reconciliation_cron_time"`   // 对账执行时间，如 "10:30"
 }
 
 // Load 从配置文件加载配置，支持环境变量覆盖
@@ -203,6 +342,13 @@ func loadDefaults() *Config {
 			WebhookURL:           "",
 			VerifyPushJWT:        true, // 默认开启，生产环境应验证 Pub/Sub JWT
 			ExpectedSubscription: "",
+
+			VoidedPurchasesSyncEnable:   false,
+			VoidedPurchasesSyncInterval: time.Hour,
+
+			WebhookWorkers:      4,
+			WebhookQueueSize:    100,
+			WebhookPollInterval: 30 * time.Second,
 		},
 		JWT: JWTConfig{
 			Secret:     "your-secret-key",
@@ -222,6 +368,11 @@ func loadDefaults() *Config {
 			AlipayCertPath:           "certs/alipayCertPublicKey_RSA2.crt",
 			ReconciliationCronEnable: false,
 			ReconciliationCronTime:   "02:00",
+			DeductSchedulerEnable:    false,
+			DeductSchedulerInterval:  5 * time.Minute,
+			DunningRetryDays:         []int{1, 3, 7},
+			DunningGraceDays:         3,
+			DunningUnsignOnSuspend:   true,
 		},
 		Apple: AppleConfig{
 			KeyID:          "",
@@ -233,15 +384,17 @@ func loadDefaults() *Config {
 			WebhookSecret:  "",
 		},
 		Wechat: WechatConfig{
-			AppID:            "",
-			MchID:            "",
-			APIv3Key:         "",
-			SerialNo:         "",
-			PrivateKey:       "",
-			PrivateKeyPath:   "",
-			NotifyURL:        "https://your-domain.com/api/wechat/notify",
-			CertPath:         "",
-			PlatformCertPath: "",
+			AppID:                       "",
+			MchID:                       "",
+			APIv3Key:                    "",
+			SerialNo:                    "",
+			PrivateKey:                  "",
+			PrivateKeyPath:              "",
+			NotifyURL:                   "https://your-domain.com/api/wechat/notify",
+			CertPath:                    "",
+			PlatformCertPath:            "",
+			PlatformCertRefreshInterval: 12 * time.Hour,
+			ReconciliationCronTime:      "10:30",
 		},
 		RocketMQ: RocketMQConfig{
 			Endpoint:        "localhost:8081",
@@ -336,6 +489,24 @@ func (c *Config) applyEnvOverrides() {
 	if expectedSub := os.Getenv("GOOGLE_EXPECTED_SUBSCRIPTION"); expectedSub != "" {
 		c.Google.ExpectedSubscription = expectedSub
 	}
+	if voidedSync := os.Getenv("GOOGLE_VOIDED_PURCHASES_SYNC_ENABLE"); voidedSync != "" {
+		c.Google.VoidedPurchasesSyncEnable = voidedSync == "true" || voidedSync == "1"
+	}
+	if interval := getDuration("GOOGLE_VOIDED_PURCHASES_SYNC_INTERVAL", 0); interval > 0 {
+		c.Google.VoidedPurchasesSyncInterval = interval
+	}
+	if workers := getInt("GOOGLE_WEBHOOK_WORKERS", 0); workers > 0 {
+		c.Google.WebhookWorkers = workers
+	}
+	if queueSize := getInt("GOOGLE_WEBHOOK_QUEUE_SIZE", 0); queueSize > 0 {
+		c.Google.WebhookQueueSize = queueSize
+	}
+	if interval := getDuration("GOOGLE_WEBHOOK_POLL_INTERVAL", 0); interval > 0 {
+		c.Google.WebhookPollInterval = interval
+	}
+	if reportDir := os.Getenv("GOOGLE_EARNINGS_REPORT_DIR"); reportDir != "" {
+		c.Google.EarningsReportDir = reportDir
+	}
 
 	// JWT配置覆盖
 	if secret := os.Getenv("JWT_SECRET"); secret != "" {
@@ -379,6 +550,21 @@ func (c *Config) applyEnvOverrides() {
 	if alipayCertPath := os.Getenv("ALIPAY_PUBLIC_CERT_PATH"); alipayCertPath != "" {
 		c.Alipay.AlipayCertPath = alipayCertPath
 	}
+	if deductSchedulerEnable := os.Getenv("ALIPAY_DEDUCT_SCHEDULER_ENABLE"); deductSchedulerEnable != "" {
+		c.Alipay.DeductSchedulerEnable = deductSchedulerEnable == "true" || deductSchedulerEnable == "1"
+	}
+	if interval := getDuration("ALIPAY_DEDUCT_SCHEDULER_INTERVAL", 0); interval > 0 {
+		c.Alipay.DeductSchedulerInterval = interval
+	}
+	if retryDays := getIntList("ALIPAY_DUNNING_RETRY_DAYS"); len(retryDays) > 0 {
+		c.Alipay.DunningRetryDays = retryDays
+	}
+	if graceDays := getInt("ALIPAY_DUNNING_GRACE_DAYS", -1); graceDays >= 0 {
+		c.Alipay.DunningGraceDays = graceDays
+	}
+	if unsign := os.Getenv("ALIPAY_DUNNING_UNSIGN_ON_SUSPEND"); unsign != "" {
+		c.Alipay.DunningUnsignOnSuspend = unsign == "true" || unsign == "1"
+	}
 
 	// Apple配置覆盖
 	if keyID := os.Getenv("APPLE_KEY_ID"); keyID != "" {
@@ -402,6 +588,15 @@ func (c *Config) applyEnvOverrides() {
 	if webhookSecret := os.Getenv("APPLE_WEBHOOK_SECRET"); webhookSecret != "" {
 		c.Apple.WebhookSecret = webhookSecret
 	}
+	if legacyReceipt := os.Getenv("APPLE_LEGACY_RECEIPT_VERIFICATION"); legacyReceipt != "" {
+		c.Apple.LegacyReceiptVerification = legacyReceipt == "true" || legacyReceipt == "1"
+	}
+	if rejectSandbox := os.Getenv("APPLE_REJECT_SANDBOX"); rejectSandbox != "" {
+		c.Apple.RejectSandbox = rejectSandbox == "true" || rejectSandbox == "1"
+	}
+	if reportDir := os.Getenv("APPLE_REPORT_DIR"); reportDir != "" {
+		c.Apple.ReportDir = reportDir
+	}
 
 	// 微信支付配置覆盖
 	if appID := os.Getenv("WECHAT_APP_ID"); appID != "" {
@@ -431,6 +626,30 @@ func (c *Config) applyEnvOverrides() {
 	if platformCertPath := os.Getenv("WECHAT_PLATFORM_CERT_PATH"); platformCertPath != "" {
 		c.Wechat.PlatformCertPath = platformCertPath
 	}
+	if papayPlanID := os.Getenv("WECHAT_PAPAY_PLAN_ID"); papayPlanID != "" {
+		c.Wechat.PapayPlanID = papayPlanID
+	}
+	if papayNotifyURL := os.Getenv("WECHAT_PAPAY_NOTIFY_URL"); papayNotifyURL != "" {
+		c.Wechat.PapayNotifyURL = papayNotifyURL
+	}
+	if combineNotifyURL := os.Getenv("WECHAT_COMBINE_NOTIFY_URL"); combineNotifyURL != "" {
+		c.Wechat.CombineNotifyURL = combineNotifyURL
+	}
+	if autoRefresh := os.Getenv("WECHAT_PLATFORM_CERT_AUTO_REFRESH"); autoRefresh != "" {
+		c.Wechat.PlatformCertAutoRefresh = autoRefresh == "true" || autoRefresh == "1"
+	}
+	if interval := getDuration("WECHAT_PLATFORM_CERT_REFRESH_INTERVAL", 0); interval > 0 {
+		c.Wechat.PlatformCertRefreshInterval = interval
+	}
+	if publicKeyID := os.Getenv("WECHAT_PUBLIC_KEY_ID"); publicKeyID != "" {
+		c.Wechat.PublicKeyID = publicKeyID
+	}
+	if publicKey := os.Getenv("WECHAT_PUBLIC_KEY"); publicKey != "" {
+		c.Wechat.PublicKey = publicKey
+	}
+	if publicKeyPath := os.Getenv("WECHAT_PUBLIC_KEY_PATH"); publicKeyPath != "" {
+		c.Wechat.PublicKeyPath = publicKeyPath
+	}
 
 	// RocketMQ配置覆盖
 	if endpoint := os.Getenv("ROCKETMQ_ENDPOINT"); endpoint != "" {
@@ -478,6 +697,24 @@ func getInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getIntList 获取逗号分隔的整数列表环境变量（如 "1,3,7"），不存在或任一项转换失败时返回 nil
+// key: 环境变量名
+func getIntList(key string) []int {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+	var values []int
+	for _, item := range strings.Split(value, ",") {
+		intValue, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			return nil
+		}
+		values = append(values, intValue)
+	}
+	return values
+}
+
 // getDuration 获取环境变量并转换为时间间隔，如果转换失败或不存在则返回默认值
 // key: 环境变量名
 // defaultValue: 默认值
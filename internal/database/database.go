@@ -92,6 +92,19 @@ func NewDatabase(cfg *config.Config, logger *zap.Logger) (*Database, error) {
 func (d *Database) AutoMigrate() error {
 	d.logger.Info("开始数据库迁移")
 
+	// 对账报告版本唯一索引建立前，为历史重复报告编号
+	if err := d.backfillReconciliationReportVersions(); err != nil {
+		return fmt.Errorf("对账报告版本迁移失败: %w", err)
+	}
+
+	// 作废购买唯一索引加入作废时间，旧索引不会被 AutoMigrate 删除，需先移除
+	if err := d.dropLegacyGoogleVoidedIndex(); err != nil {
+		return fmt.Errorf("作废购买索引迁移失败: %w", err)
+	}
+	if err := d.dropLegacyAlipayDeductTradeNoIndex(); err != nil {
+		return fmt.Errorf("代扣记录索引迁移失败: %w", err)
+	}
+
 	// 迁移所有模型
 	err := d.DB.AutoMigrate(
 		// 基础模型
@@ -105,6 +118,8 @@ func (d *Database) AutoMigrate() error {
 
 		// 各支付方式的详情模型
 		&models.GooglePayment{},
+		&models.GoogleVoidedPurchase{},
+		&models.GoogleVoidedSyncCheckpoint{},
 		&models.AlipayPayment{},
 		&models.AlipayRefund{},
 		&models.AlipayReconciliationReport{},
@@ -114,17 +129,128 @@ func (d *Database) AutoMigrate() error {
 		&models.AlipaySubscription{},
 		&models.ApplePayment{},
 		&models.AppleRefund{},
+		&models.AppleConsumptionRequest{},
+		&models.AppleOrphanTransaction{},
+		&models.StoreReconciliationReport{},
+		&models.StoreReconciliationDetail{},
 		&models.WechatPayment{},
 		&models.WechatRefund{},
+		&models.WechatReconciliationReport{},
+		&models.WechatReconciliationDetail{},
+		&models.WechatPapayContract{},
+		&models.WechatCombineOrder{},
 	)
 	if err != nil {
 		return fmt.Errorf("数据库迁移失败: %w", err)
 	}
 
+	// Webhook 通知字段加前缀后，将旧列中的历史数据复制到新列
+	if err := d.backfillWebhookNotificationColumns(); err != nil {
+		return fmt.Errorf("Webhook通知字段迁移失败: %w", err)
+	}
+
 	d.logger.Info("数据库迁移完成")
 	return nil
 }
 
+// backfillReconciliationReportVersions 为已有的支付宝对账报告添加版本号
+// 同一租户、账单日、账单类型的历史报告按创建顺序编号，除最新一份已完成报告外均标记为已取代，
+// 避免 AutoMigrate 建立 (tenant_id, bill_date, bill_type, version) 唯一索引时因重复数据失败
+// 在 AutoMigrate 之前执行，未启用多租户的旧库先补 tenant_id 列（历史报告归属默认租户）
+func (d *Database) backfillReconciliationReportVersions() error {
+	migrator := d.DB.Migrator()
+	report := &models.AlipayReconciliationReport{}
+	if !migrator.HasTable(report) || migrator.HasColumn(report, "Version") {
+		return nil
+	}
+	hasTenantID := migrator.HasColumn(report, "TenantID")
+
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		if !hasTenantID {
+			if err := tx.Exec(`ALTER TABLE alipay_reconciliation_reports
+				ADD COLUMN tenant_id varchar(64) NOT NULL DEFAULT 'default'`).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec(`ALTER TABLE alipay_reconciliation_reports
+			ADD COLUMN version integer NOT NULL DEFAULT 1,
+			ADD COLUMN superseded boolean NOT NULL DEFAULT false`).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`UPDATE alipay_reconciliation_reports r SET version = v.version
+			FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY tenant_id, bill_date, bill_type ORDER BY id) AS version
+				FROM alipay_reconciliation_reports) v
+			WHERE r.id = v.id`).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`UPDATE alipay_reconciliation_reports r SET superseded = true
+			WHERE status = 'completed' AND EXISTS (
+				SELECT 1 FROM alipay_reconciliation_reports n
+				WHERE n.tenant_id = r.tenant_id AND n.bill_date = r.bill_date AND n.bill_type = r.bill_type
+					AND n.status = 'completed' AND n.version > r.version)`).Error
+	})
+}
+
+// dropLegacyGoogleVoidedIndex 删除旧的 (purchase_token, order_id_google) 唯一索引
+// 同一订单的多次部分数量作废购买令牌与订单号相同，需按作废时间区分
+func (d *Database) dropLegacyGoogleVoidedIndex() error {
+	const legacyIndex = "idx_google_voided_token_order"
+	migrator := d.DB.Migrator()
+	voided := &models.GoogleVoidedPurchase{}
+	if !migrator.HasTable(voided) || !migrator.HasIndex(voided, legacyIndex) {
+		return nil
+	}
+	return migrator.DropIndex(voided, legacyIndex)
+}
+
+// dropLegacyAlipayDeductTradeNoIndex 删除旧的 trade_no 全表唯一索引
+// 扣款失败记录不带支付宝交易号，改为仅对非空交易号生效的部分唯一索引
+func (d *Database) dropLegacyAlipayDeductTradeNoIndex() error {
+	const legacyIndex = "idx_alipay_deduct_records_trade_no"
+	migrator := d.DB.Migrator()
+	record := &models.AlipayDeductRecord{}
+	if !migrator.HasTable(record) || !migrator.HasIndex(record, legacyIndex) {
+		return nil
+	}
+	return migrator.DropIndex(record, legacyIndex)
+}
+
+// backfillWebhookNotificationColumns 将 Webhook 事件旧的共用通知列复制到按类型加前缀的新列
+// 早期版本三种通知共用 version/notification_type/purchase_token/sku/subscription_id 列，
+// 升级前保存的待处理事件需要复制后才能被工作协程正确处理；仅复制新列为空的记录，可重复执行
+func (d *Database) backfillWebhookNotificationColumns() error {
+	migrator := d.DB.Migrator()
+	if !migrator.HasColumn(&models.WebhookEvent{}, "notification_type") {
+		return nil
+	}
+
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`UPDATE webhook_events SET
+				subscription_version = version,
+				subscription_notification_type = notification_type,
+				subscription_purchase_token = purchase_token,
+				subscription_subscription_id = subscription_id
+			WHERE type = ? AND notification_type IS NOT NULL
+				AND (subscription_purchase_token IS NULL OR subscription_purchase_token = '')`,
+			models.WebhookTypeSubscription).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`UPDATE webhook_events SET
+				one_time_version = version,
+				one_time_notification_type = notification_type,
+				one_time_purchase_token = purchase_token,
+				one_time_sku = sku
+			WHERE type = ? AND notification_type IS NOT NULL
+				AND (one_time_purchase_token IS NULL OR one_time_purchase_token = '')`,
+			models.WebhookTypeOneTimeProduct).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`UPDATE webhook_events SET test_version = version
+			WHERE type = ? AND (test_version IS NULL OR test_version = '')`,
+			models.WebhookTypeTest).Error
+	})
+}
+
 // Close 关闭数据库连接
 func (d *Database) Close() error {
 	sqlDB, err := d.DB.DB()
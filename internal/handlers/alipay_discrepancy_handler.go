@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"pay-gateway/internal/models"
+	"pay-gateway/internal/services"
+)
+
+// AssignDiscrepancyRequest 指派差异请求
+type AssignDiscrepancyRequest struct {
+	Assignee string `json:"assignee" binding:"required"` // 财务处理人
+	Note     string `json:"note"`                        // 备注
+}
+
+// CloseDiscrepancyRequest 处理/忽略差异请求
+type CloseDiscrepancyRequest struct {
+	Operator string `json:"operator" binding:"required"` // 处理人
+	Note     string `json:"note"`                        // 处理说明
+}
+
+// ListReconciliationDiscrepancies 查询对账差异
+// @Summary 查询对账差异
+// @Description 跨对账日期查询差异，默认只返回待处理（open）的差异；status=all 返回全部
+// @Tags 支付宝对账
+// @Produce json
+// @Param status query string false "处理状态：open/auto_fixed/resolved/ignored/all，默认 open"
+// @Param diff_type query string false "差异类型：alipay_only/local_only/amount_mismatch"
+// @Param assignee query string false "处理人"
+// @Param start_date query string false "对账日期起 yyyy-MM-dd"
+// @Param end_date query string false "对账日期止 yyyy-MM-dd"
+// @Param page query int false "页码" default(1)
+// @Param page_size query int false "每页数量" default(20)
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} Response{data=object}
+// @Router /api/v1/alipay/reconciliation/discrepancies [get]
+func (h *AlipayHandler) ListReconciliationDiscrepancies(c *gin.Context) {
+	reconciliationService, ok := h.tenantReconciliationService(c)
+	if !ok {
+		return
+	}
+
+	filter := services.ReconciliationDiscrepancyFilter{
+		Status:    c.DefaultQuery("status", models.ReconciliationDiffOpen),
+		DiffType:  c.Query("diff_type"),
+		Assignee:  c.Query("assignee"),
+		StartDate: c.Query("start_date"),
+		EndDate:   c.Query("end_date"),
+	}
+	if filter.Status == "all" {
+		filter.Status = ""
+	}
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	discrepancies, total, err := reconciliationService.ListDiscrepancies(c.Request.Context(), filter, page, pageSize)
+	if err != nil {
+		h.logger.Error("查询对账差异失败", zap.Error(err))
+		h.errorResponse(c, 500, "查询对账差异失败", err)
+		return
+	}
+	h.successResponse(c, gin.H{
+		"discrepancies": discrepancies,
+		"total":         total,
+		"page":          page,
+		"page_size":     pageSize,
+	})
+}
+
+// AssignReconciliationDiscrepancy 指派对账差异
+// @Summary 指派对账差异
+// @Description 将待处理差异指派给财务人员
+// @Tags 支付宝对账
+// @Accept json
+// @Produce json
+// @Param id path int true "差异ID"
+// @Param request body AssignDiscrepancyRequest true "指派请求"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} Response{data=models.AlipayReconciliationDetail}
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /api/v1/alipay/reconciliation/discrepancies/{id}/assign [post]
+func (h *AlipayHandler) AssignReconciliationDiscrepancy(c *gin.Context) {
+	reconciliationService, ok := h.tenantReconciliationService(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		h.errorResponse(c, 400, "无效的差异ID", err)
+		return
+	}
+	var req AssignDiscrepancyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.errorResponse(c, 400, "请求参数错误", err)
+		return
+	}
+
+	detail, err := reconciliationService.AssignDiscrepancy(c.Request.Context(), uint(id), req.Assignee, req.Note)
+	if err != nil {
+		h.respondDiscrepancyError(c, err, uint(id))
+		return
+	}
+	h.successResponse(c, detail)
+}
+
+// ResolveReconciliationDiscrepancy 人工处理对账差异
+// @Summary 人工处理对账差异
+// @Description 财务核实并处理后将差异标记为已处理
+// @Tags 支付宝对账
+// @Accept json
+// @Produce json
+// @Param id path int true "差异ID"
+// @Param request body CloseDiscrepancyRequest true "处理请求"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} Response{data=models.AlipayReconciliationDetail}
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /api/v1/alipay/reconciliation/discrepancies/{id}/resolve [post]
+func (h *AlipayHandler) ResolveReconciliationDiscrepancy(c *gin.Context) {
+	h.closeDiscrepancy(c, models.ReconciliationDiffResolved)
+}
+
+// IgnoreReconciliationDiscrepancy 忽略对账差异
+// @Summary 忽略对账差异
+// @Description 将无需处理的差异（如跨日时间差、测试交易）标记为已忽略
+// @Tags 支付宝对账
+// @Accept json
+// @Produce json
+// @Param id path int true "差异ID"
+// @Param request body CloseDiscrepancyRequest true "处理请求"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} Response{data=models.AlipayReconciliationDetail}
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /api/v1/alipay/reconciliation/discrepancies/{id}/ignore [post]
+func (h *AlipayHandler) IgnoreReconciliationDiscrepancy(c *gin.Context) {
+	h.closeDiscrepancy(c, models.ReconciliationDiffIgnored)
+}
+
+func (h *AlipayHandler) closeDiscrepancy(c *gin.Context, status string) {
+	reconciliationService, ok := h.tenantReconciliationService(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		h.errorResponse(c, 400, "无效的差异ID", err)
+		return
+	}
+	var req CloseDiscrepancyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.errorResponse(c, 400, "请求参数错误", err)
+		return
+	}
+
+	detail, err := reconciliationService.CloseDiscrepancy(c.Request.Context(), uint(id), status, req.Operator, req.Note)
+	if err != nil {
+		h.respondDiscrepancyError(c, err, uint(id))
+		return
+	}
+	h.logger.Info("对账差异已处理",
+		zap.Uint("id", detail.ID),
+		zap.String("status", status),
+		zap.String("operator", req.Operator))
+	h.successResponse(c, detail)
+}
+
+// respondDiscrepancyError 返回处理差异失败的响应
+func (h *AlipayHandler) respondDiscrepancyError(c *gin.Context, err error, id uint) {
+	switch {
+	case errors.Is(err, services.ErrReconciliationDiffNotFound):
+		h.errorResponse(c, 404, "差异不存在", err)
+	case errors.Is(err, services.ErrReconciliationDiffClosed):
+		h.errorResponse(c, 409, "差异已处理", err)
+	default:
+		h.logger.Error("处理对账差异失败", zap.Uint("id", id), zap.Error(err))
+		h.errorResponse(c, 500, "处理对账差异失败", err)
+	}
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"pay-gateway/internal/models"
+	"pay-gateway/internal/services"
+)
+
+// ExportReconciliationReport 导出对账报告
+// @Summary 导出对账报告
+// @Description 导出对账报告汇总及全部差异明细，金额单位为元；CSV 默认 UTF-8（带 BOM），encoding=gbk 时与支付宝账单编码一致
+// @Tags 支付宝对账
+// @Produce octet-stream
+// @Param id path int true "报告ID"
+// @Param format query string false "导出格式：csv/xlsx，默认 csv"
+// @Param encoding query string false "CSV 编码：utf8/gbk，默认 utf8"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {file} file
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /api/v1/alipay/reconciliation/reports/{id}/export [get]
+func (h *AlipayHandler) ExportReconciliationReport(c *gin.Context) {
+	reconciliationService, ok := h.tenantReconciliationService(c)
+	if !ok {
+		return
+	}
+
+	var idParam struct {
+		ID uint `uri:"id" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&idParam); err != nil {
+		h.errorResponse(c, 400, "无效的报告ID", err)
+		return
+	}
+	format, charset, ok := h.exportOptions(c)
+	if !ok {
+		return
+	}
+	report, err := reconciliationService.GetReportForExport(c.Request.Context(), idParam.ID)
+	if err != nil {
+		h.errorResponse(c, 404, "对账报告不存在", err)
+		return
+	}
+
+	fileName := fmt.Sprintf("alipay_reconciliation_%d.%s", report.ID, format)
+	h.writeReconciliationExport(c, reconciliationService, []models.AlipayReconciliationReport{*report}, fileName, format, charset)
+}
+
+// ExportReconciliationRange 按日期区间导出对账报告
+// @Summary 按日期区间导出对账报告
+// @Description 导出区间内各账单当前版本的对账汇总及差异明细，区间最多 92 天
+// @Tags 支付宝对账
+// @Produce octet-stream
+// @Param start_date query string true "对账日期起 yyyy-MM-dd"
+// @Param end_date query string true "对账日期止 yyyy-MM-dd"
+// @Param bill_type query string false "账单类型：trade/signcustomer，默认全部"
+// @Param format query string false "导出格式：csv/xlsx，默认 csv"
+// @Param encoding query string false "CSV 编码：utf8/gbk，默认 utf8"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {file} file
+// @Failure 400 {object} ErrorResponse
+// @Router /api/v1/alipay/reconciliation/export [get]
+func (h *AlipayHandler) ExportReconciliationRange(c *gin.Context) {
+	reconciliationService, ok := h.tenantReconciliationService(c)
+	if !ok {
+		return
+	}
+
+	startDate, endDate := c.Query("start_date"), c.Query("end_date")
+	if startDate == "" || endDate == "" {
+		h.errorResponse(c, 400, "start_date 和 end_date 不能为空", nil)
+		return
+	}
+	format, charset, ok := h.exportOptions(c)
+	if !ok {
+		return
+	}
+	reports, err := reconciliationService.ListReportsForExport(c.Request.Context(), startDate, endDate, c.Query("bill_type"))
+	if err != nil {
+		h.errorResponse(c, 400, "查询对账报告失败", err)
+		return
+	}
+
+	fileName := fmt.Sprintf("alipay_reconciliation_%s_%s.%s",
+		strings.ReplaceAll(startDate, "-", ""), strings.ReplaceAll(endDate, "-", ""), format)
+	h.writeReconciliationExport(c, reconciliationService, reports, fileName, format, charset)
+}
+
+// exportOptions 解析并校验导出格式与编码
+func (h *AlipayHandler) exportOptions(c *gin.Context) (format, charset string, ok bool) {
+	format = strings.ToLower(c.DefaultQuery("format", services.ReconciliationExportCSV))
+	if format != services.ReconciliationExportCSV && format != services.ReconciliationExportXLSX {
+		h.errorResponse(c, 400, "不支持的导出格式", fmt.Errorf("format 仅支持 csv/xlsx: %s", format))
+		return "", "", false
+	}
+	charset = strings.ToLower(c.DefaultQuery("encoding", services.ReconciliationExportUTF8))
+	if charset != services.ReconciliationExportUTF8 && charset != services.ReconciliationExportGBK {
+		h.errorResponse(c, 400, "不支持的编码", fmt.Errorf("encoding 仅支持 utf8/gbk: %s", charset))
+		return "", "", false
+	}
+	return format, charset, true
+}
+
+// writeReconciliationExport 设置下载响应头并流式写出导出文件
+// 开始写出后无法再返回错误响应，失败时仅记录日志
+func (h *AlipayHandler) writeReconciliationExport(c *gin.Context, reconciliationService *services.AlipayReconciliationService,
+	reports []models.AlipayReconciliationReport, fileName, format, charset string) {
+	contentType := "text/csv; charset=utf-8"
+	switch {
+	case format == services.ReconciliationExportXLSX:
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case charset == services.ReconciliationExportGBK:
+		contentType = "text/csv; charset=gbk"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	c.Status(200)
+
+	if err := reconciliationService.ExportReconciliation(c.Request.Context(), c.Writer, reports, format, charset); err != nil {
+		h.logger.Error("导出对账报告失败",
+			zap.String("file", fileName),
+			zap.Int("reports", len(reports)),
+			zap.Error(err))
+	}
+}
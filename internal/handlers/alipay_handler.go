@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -11,24 +12,46 @@ import (
 	"pay-gateway/internal/services"
 )
 
-// AlipayHandler 支付宝处理器
+// AlipayHandler 支付宝处理器，按请求租户选择对应的支付宝应用
 type AlipayHandler struct {
-	alipayService           *services.AlipayService
-	reconciliationService   *services.AlipayReconciliationService
+	alipayServices          *services.TenantRegistry[*services.AlipayService]
+	reconciliationServices  *services.TenantRegistry[*services.AlipayReconciliationService]
 	paymentService          services.PaymentService
 	logger                  *zap.Logger
 }
 
 // NewAlipayHandler 创建支付宝处理器
-func NewAlipayHandler(alipayService *services.AlipayService, reconciliationService *services.AlipayReconciliationService, paymentService services.PaymentService, logger *zap.Logger) *AlipayHandler {
+func NewAlipayHandler(alipayServices *services.TenantRegistry[*services.AlipayService], reconciliationServices *services.TenantRegistry[*services.AlipayReconciliationService], paymentService services.PaymentService, logger *zap.Logger) *AlipayHandler {
 	return &AlipayHandler{
-		alipayService:         alipayService,
-		reconciliationService: reconciliationService,
-		paymentService:        paymentService,
-		logger:                logger,
+		alipayServices:         alipayServices,
+		reconciliationServices: reconciliationServices,
+		paymentService:         paymentService,
+		logger:                 logger,
 	}
 }
 
+// tenantAlipayService 获取请求租户的支付宝服务，租户不存在或未开通支付宝时返回 400
+func (h *AlipayHandler) tenantAlipayService(c *gin.Context) (*services.AlipayService, bool) {
+	tenantID := requestTenantID(c)
+	alipayService, err := h.alipayServices.Get(tenantID)
+	if err != nil {
+		h.logger.Warn("租户未开通支付宝", zap.String("tenant_id", tenantID))
+		h.errorResponse(c, 400, "租户不存在或未开通支付宝", err)
+		return nil, false
+	}
+	return alipayService, true
+}
+
+// tenantReconciliationService 获取请求租户的对账服务，未配置时返回 503
+func (h *AlipayHandler) tenantReconciliationService(c *gin.Context) (*services.AlipayReconciliationService, bool) {
+	reconciliationService, err := h.reconciliationServices.Get(requestTenantID(c))
+	if err != nil {
+		h.errorResponse(c, 503, "对账服务未配置", err)
+		return nil, false
+	}
+	return reconciliationService, true
+}
+
 // CreateAlipayOrderRequest 创建支付宝订单请求
 type CreateAlipayOrderRequest struct {
 	UserID         uint   `json:"user_id" binding:"required"`
@@ -93,11 +116,17 @@ type RefundResponse struct {
 // @Accept json
 // @Produce json
 // @Param request body CreateAlipayOrderRequest true "创建支付宝订单请求"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=CreateAlipayOrderResponse}
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/alipay/orders [post]
 func (h *AlipayHandler) CreateAlipayOrder(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	var req CreateAlipayOrderRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		h.logger.Error("创建支付宝订单请求参数错误", zap.Error(err))
@@ -115,7 +144,7 @@ func (h *AlipayHandler) CreateAlipayOrder(c *gin.Context) {
 		AllowDuplicate: req.AllowDuplicate,
 	}
 
-	result, err := h.alipayService.CreateOrder(c.Request.Context(), serviceReq)
+	result, err := alipayService.CreateOrder(c.Request.Context(), serviceReq)
 	if err != nil {
 		h.logger.Error("创建支付宝订单失败", zap.Error(err))
 		h.errorResponse(c, 500, "创建支付宝订单失败", err)
@@ -141,11 +170,17 @@ func (h *AlipayHandler) CreateAlipayOrder(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param request body CreateAlipayPaymentRequest true "创建支付宝支付请求"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=CreateAlipayPaymentResponse}
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/alipay/payments [post]
 func (h *AlipayHandler) CreateAlipayPayment(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	var req CreateAlipayPaymentRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		h.logger.Error("创建支付宝支付请求参数错误", zap.Error(err))
@@ -159,11 +194,11 @@ func (h *AlipayHandler) CreateAlipayPayment(c *gin.Context) {
 	// 根据不同的支付类型创建支付
 	switch req.PayType {
 	case "WAP":
-		paymentURL, err = h.alipayService.CreateWapPayment(c.Request.Context(), req.OrderNo)
+		paymentURL, err = alipayService.CreateWapPayment(c.Request.Context(), req.OrderNo)
 	case "PAGE":
-		paymentURL, err = h.alipayService.CreatePagePayment(c.Request.Context(), req.OrderNo)
+		paymentURL, err = alipayService.CreatePagePayment(c.Request.Context(), req.OrderNo)
 	case "APP":
-		paymentURL, err = h.alipayService.CreateAppPayment(c.Request.Context(), req.OrderNo)
+		paymentURL, err = alipayService.CreateAppPayment(c.Request.Context(), req.OrderNo)
 	default:
 		h.errorResponse(c, 400, "不支持的支付类型", nil)
 		return
@@ -191,18 +226,24 @@ func (h *AlipayHandler) CreateAlipayPayment(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param order_no query string true "订单号"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=QueryAlipayOrderResponse}
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/alipay/orders/query [get]
 func (h *AlipayHandler) QueryAlipayOrder(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	orderNo := c.Query("order_no")
 	if orderNo == "" {
 		h.errorResponse(c, 400, "订单号不能为空", nil)
 		return
 	}
 
-	result, err := h.alipayService.QueryOrder(c.Request.Context(), orderNo)
+	result, err := alipayService.QueryOrder(c.Request.Context(), orderNo)
 	if err != nil {
 		h.logger.Error("查询支付宝订单失败", zap.Error(err))
 		h.errorResponse(c, 500, "查询支付宝订单失败", err)
@@ -232,11 +273,17 @@ func (h *AlipayHandler) QueryAlipayOrder(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param request body RefundRequest true "退款请求"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=RefundResponse}
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/alipay/refunds [post]
 func (h *AlipayHandler) AlipayRefund(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	var req RefundRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		h.logger.Error("支付宝退款请求参数错误", zap.Error(err))
@@ -251,7 +298,7 @@ func (h *AlipayHandler) AlipayRefund(c *gin.Context) {
 		OutRequestNo:  req.OutRequestNo,
 	}
 
-	result, err := h.alipayService.Refund(c.Request.Context(), serviceReq)
+	result, err := alipayService.Refund(c.Request.Context(), serviceReq)
 	if err != nil {
 		h.logger.Error("支付宝退款失败", zap.Error(err))
 		h.errorResponse(c, 500, "支付宝退款失败", err)
@@ -302,11 +349,17 @@ func (h *AlipayHandler) errorResponse(c *gin.Context, code int, message string,
 // @Accept json
 // @Produce json
 // @Param request body CreateAlipaySubscriptionRequest true "创建周期扣款请求"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=CreateAlipaySubscriptionResponse}
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/alipay/subscriptions [post]
 func (h *AlipayHandler) CreateAlipaySubscription(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	var req CreateAlipaySubscriptionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		h.logger.Error("创建支付宝周期扣款请求参数错误", zap.Error(err))
@@ -330,7 +383,7 @@ func (h *AlipayHandler) CreateAlipaySubscription(c *gin.Context) {
 		SignScene:           req.SignScene,
 	}
 
-	result, err := h.alipayService.CreateSubscription(c.Request.Context(), serviceReq)
+	result, err := alipayService.CreateSubscription(c.Request.Context(), serviceReq)
 	if err != nil {
 		h.logger.Error("创建支付宝周期扣款失败", zap.Error(err))
 		h.errorResponse(c, 500, "创建周期扣款失败", err)
@@ -356,18 +409,24 @@ func (h *AlipayHandler) CreateAlipaySubscription(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param out_request_no query string true "商户签约号"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=QueryAlipaySubscriptionResponse}
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/alipay/subscriptions/query [get]
 func (h *AlipayHandler) QueryAlipaySubscription(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	outRequestNo := c.Query("out_request_no")
 	if outRequestNo == "" {
 		h.errorResponse(c, 400, "商户签约号不能为空", nil)
 		return
 	}
 
-	result, err := h.alipayService.QuerySubscription(c.Request.Context(), outRequestNo)
+	result, err := alipayService.QuerySubscription(c.Request.Context(), outRequestNo)
 	if err != nil {
 		h.logger.Error("查询支付宝周期扣款失败", zap.Error(err))
 		h.errorResponse(c, 500, "查询周期扣款失败", err)
@@ -425,11 +484,17 @@ func (h *AlipayHandler) QueryAlipaySubscription(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param request body CancelAlipaySubscriptionRequest true "取消周期扣款请求"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/alipay/subscriptions/cancel [post]
 func (h *AlipayHandler) CancelAlipaySubscription(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	var req CancelAlipaySubscriptionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		h.logger.Error("取消支付宝周期扣款请求参数错误", zap.Error(err))
@@ -443,7 +508,7 @@ func (h *AlipayHandler) CancelAlipaySubscription(c *gin.Context) {
 		CancelReason: req.CancelReason,
 	}
 
-	err := h.alipayService.CancelSubscription(c.Request.Context(), serviceReq)
+	err := alipayService.CancelSubscription(c.Request.Context(), serviceReq)
 	if err != nil {
 		h.logger.Error("取消支付宝周期扣款失败", zap.Error(err))
 		h.errorResponse(c, 500, "取消周期扣款失败", err)
@@ -463,11 +528,17 @@ func (h *AlipayHandler) CancelAlipaySubscription(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param request body CreateWithholdAgreementRequest true "创建免密签约请求"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=CreateWithholdAgreementResponse}
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/alipay/withhold/agreements [post]
 func (h *AlipayHandler) CreateWithholdAgreement(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	var req CreateWithholdAgreementRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		h.logger.Error("创建免密签约请求参数错误", zap.Error(err))
@@ -481,7 +552,7 @@ func (h *AlipayHandler) CreateWithholdAgreement(c *gin.Context) {
 		SignScene:           req.SignScene,
 	}
 
-	result, err := h.alipayService.CreateWithholdAgreement(c.Request.Context(), serviceReq)
+	result, err := alipayService.CreateWithholdAgreement(c.Request.Context(), serviceReq)
 	if err != nil {
 		h.logger.Error("创建免密签约失败", zap.Error(err))
 		h.errorResponse(c, 500, "创建免密签约失败", err)
@@ -502,18 +573,24 @@ func (h *AlipayHandler) CreateWithholdAgreement(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param out_request_no query string true "商户签约号"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=QueryWithholdAgreementResponse}
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/alipay/withhold/agreements/query [get]
 func (h *AlipayHandler) QueryWithholdAgreement(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	outRequestNo := c.Query("out_request_no")
 	if outRequestNo == "" {
 		h.errorResponse(c, 400, "商户签约号不能为空", nil)
 		return
 	}
 
-	result, err := h.alipayService.QueryWithholdAgreement(c.Request.Context(), outRequestNo)
+	result, err := alipayService.QueryWithholdAgreement(c.Request.Context(), outRequestNo)
 	if err != nil {
 		h.logger.Error("查询免密签约失败", zap.Error(err))
 		h.errorResponse(c, 500, "查询免密签约失败", err)
@@ -535,11 +612,17 @@ func (h *AlipayHandler) QueryWithholdAgreement(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param request body ExecuteWithholdRequest true "代扣请求"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=ExecuteWithholdResponse}
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/alipay/withhold/execute [post]
 func (h *AlipayHandler) ExecuteWithhold(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	var req ExecuteWithholdRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		h.logger.Error("执行代扣请求参数错误", zap.Error(err))
@@ -556,7 +639,7 @@ func (h *AlipayHandler) ExecuteWithhold(c *gin.Context) {
 		TotalAmount: req.TotalAmount,
 	}
 
-	result, err := h.alipayService.ExecuteWithhold(c.Request.Context(), serviceReq)
+	result, err := alipayService.ExecuteWithhold(c.Request.Context(), serviceReq)
 	if err != nil {
 		h.logger.Error("执行代扣失败", zap.Error(err))
 		h.errorResponse(c, 500, "执行代扣失败", err)
@@ -666,27 +749,40 @@ type QueryWithholdAgreementResponse struct {
 
 // RunReconciliation 执行支付宝对账
 // @Summary 执行支付宝对账
-// @Description 下载指定日期的对账文件并与本地订单比对
+// @Description 下载指定日期、指定类型的对账文件，与本地订单、周期扣款和退款记录比对
 // @Tags 支付宝对账
 // @Produce json
 // @Param bill_date query string true "对账日期 yyyy-MM-dd"
+// @Param bill_type query string false "账单类型 trade-交易账单 signcustomer-账务明细，默认 trade"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=models.AlipayReconciliationReport}
 // @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/alipay/reconciliation/run [post]
 func (h *AlipayHandler) RunReconciliation(c *gin.Context) {
-	if h.reconciliationService == nil {
-		h.errorResponse(c, 503, "对账服务未配置", nil)
+	reconciliationService, ok := h.tenantReconciliationService(c)
+	if !ok {
 		return
 	}
+
 	billDate := c.Query("bill_date")
 	if billDate == "" {
 		h.errorResponse(c, 400, "缺少 bill_date 参数（格式：yyyy-MM-dd）", nil)
 		return
 	}
-	report, err := h.reconciliationService.RunReconciliation(c.Request.Context(), billDate)
+	billType := c.DefaultQuery("bill_type", services.AlipayBillTypeTrade)
+	if billType != services.AlipayBillTypeTrade && billType != services.AlipayBillTypeSignCustomer {
+		h.errorResponse(c, 400, "bill_type 仅支持 trade 或 signcustomer", nil)
+		return
+	}
+	report, err := reconciliationService.RunReconciliation(c.Request.Context(), billDate, billType)
+	if errors.Is(err, services.ErrReconciliationInProgress) {
+		h.errorResponse(c, 409, "该账单正在对账", err)
+		return
+	}
 	if err != nil {
-		h.logger.Error("执行对账失败", zap.Error(err), zap.String("bill_date", billDate))
+		h.logger.Error("执行对账失败", zap.Error(err), zap.String("bill_date", billDate), zap.String("bill_type", billType))
 		h.errorResponse(c, 500, "执行对账失败", err)
 		return
 	}
@@ -699,14 +795,16 @@ func (h *AlipayHandler) RunReconciliation(c *gin.Context) {
 // @Tags 支付宝对账
 // @Produce json
 // @Param id path int true "报告ID"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=object}
 // @Failure 404 {object} ErrorResponse
 // @Router /api/v1/alipay/reconciliation/reports/{id} [get]
 func (h *AlipayHandler) GetReconciliationReport(c *gin.Context) {
-	if h.reconciliationService == nil {
-		h.errorResponse(c, 503, "对账服务未配置", nil)
+	reconciliationService, ok := h.tenantReconciliationService(c)
+	if !ok {
 		return
 	}
+
 	var idParam struct {
 		ID uint `uri:"id" binding:"required"`
 	}
@@ -714,7 +812,7 @@ func (h *AlipayHandler) GetReconciliationReport(c *gin.Context) {
 		h.errorResponse(c, 400, "无效的报告ID", err)
 		return
 	}
-	report, details, err := h.reconciliationService.GetReconciliationReport(c.Request.Context(), idParam.ID)
+	report, details, err := reconciliationService.GetReconciliationReport(c.Request.Context(), idParam.ID)
 	if err != nil {
 		h.errorResponse(c, 404, "对账报告不存在", err)
 		return
@@ -725,20 +823,54 @@ func (h *AlipayHandler) GetReconciliationReport(c *gin.Context) {
 	})
 }
 
+// GetReconciliationReportChanges 获取对账报告相对上一版本的变化
+// @Summary 获取对账报告版本变化
+// @Description 对比报告与其取代的上一版本，返回新增与已消失的差异
+// @Tags 支付宝对账
+// @Produce json
+// @Param id path int true "报告ID"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} Response{data=services.ReconciliationReportChanges}
+// @Failure 404 {object} ErrorResponse
+// @Router /api/v1/alipay/reconciliation/reports/{id}/changes [get]
+func (h *AlipayHandler) GetReconciliationReportChanges(c *gin.Context) {
+	reconciliationService, ok := h.tenantReconciliationService(c)
+	if !ok {
+		return
+	}
+
+	var idParam struct {
+		ID uint `uri:"id" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&idParam); err != nil {
+		h.errorResponse(c, 400, "无效的报告ID", err)
+		return
+	}
+	changes, err := reconciliationService.GetReportChanges(c.Request.Context(), idParam.ID)
+	if err != nil {
+		h.errorResponse(c, 404, "对账报告不存在", err)
+		return
+	}
+	h.successResponse(c, changes)
+}
+
 // ListReconciliationReports 列出对账报告
 // @Summary 列出对账报告
 // @Description 按日期或最近记录列出对账报告
 // @Tags 支付宝对账
 // @Produce json
 // @Param bill_date query string false "对账日期 yyyy-MM-dd"
+// @Param all_versions query bool false "是否包含已被重跑取代的版本，默认 false"
 // @Param limit query int false "返回条数，默认20"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=[]models.AlipayReconciliationReport}
 // @Router /api/v1/alipay/reconciliation/reports [get]
 func (h *AlipayHandler) ListReconciliationReports(c *gin.Context) {
-	if h.reconciliationService == nil {
-		h.errorResponse(c, 503, "对账服务未配置", nil)
+	reconciliationService, ok := h.tenantReconciliationService(c)
+	if !ok {
 		return
 	}
+
 	billDate := c.Query("bill_date")
 	limit := 20
 	if l := c.Query("limit"); l != "" {
@@ -746,7 +878,8 @@ func (h *AlipayHandler) ListReconciliationReports(c *gin.Context) {
 			limit = n
 		}
 	}
-	reports, err := h.reconciliationService.ListReconciliationReports(c.Request.Context(), billDate, limit)
+	allVersions := c.Query("all_versions") == "true"
+	reports, err := reconciliationService.ListReconciliationReports(c.Request.Context(), billDate, allVersions, limit)
 	if err != nil {
 		h.logger.Error("列出对账报告失败", zap.Error(err))
 		h.errorResponse(c, 500, "列出对账报告失败", err)
@@ -10,22 +10,35 @@ import (
 )
 
 // AlipayWebhookHandler 支付宝Webhook处理器
+// 多租户回调地址 /webhook/alipay/:tenant/... 按租户选择验签密钥，未带租户的旧地址归属默认租户
 type AlipayWebhookHandler struct {
-	alipayService *services.AlipayService
-	logger        *zap.Logger
+	alipayServices *services.TenantRegistry[*services.AlipayService]
+	logger         *zap.Logger
 }
 
 // NewAlipayWebhookHandler 创建支付宝Webhook处理器
 func NewAlipayWebhookHandler(
-	alipayService *services.AlipayService,
+	alipayServices *services.TenantRegistry[*services.AlipayService],
 	logger *zap.Logger,
 ) *AlipayWebhookHandler {
 	return &AlipayWebhookHandler{
-		alipayService: alipayService,
-		logger:        logger,
+		alipayServices: alipayServices,
+		logger:         logger,
 	}
 }
 
+// tenantAlipayService 获取回调地址对应租户的支付宝服务，租户未开通时返回 fail
+func (h *AlipayWebhookHandler) tenantAlipayService(c *gin.Context) (*services.AlipayService, bool) {
+	tenantID := requestTenantID(c)
+	alipayService, err := h.alipayServices.Get(tenantID)
+	if err != nil {
+		h.logger.Error("支付宝回调租户未开通支付宝", zap.String("tenant_id", tenantID), zap.Error(err))
+		c.String(http.StatusOK, "fail")
+		return nil, false
+	}
+	return alipayService, true
+}
+
 // HandleAlipayNotify 处理支付宝异步通知
 // @Summary 处理支付宝异步通知
 // @Description 接收并处理支付宝的异步通知（支付结果通知）
@@ -35,8 +48,15 @@ func NewAlipayWebhookHandler(
 // @Param notify_data formData string true "支付宝通知数据"
 // @Success 200 {string} string "success"
 // @Failure 400 {string} string "fail"
+// @Param tenant path string false "租户ID（多租户回调地址）"
 // @Router /webhook/alipay/notify [post]
+// @Router /webhook/alipay/{tenant}/notify [post]
 func (h *AlipayWebhookHandler) HandleAlipayNotify(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	// 解析表单数据
 	if err := c.Request.ParseForm(); err != nil {
 		h.logger.Error("解析支付宝通知表单失败", zap.Error(err))
@@ -57,7 +77,7 @@ func (h *AlipayWebhookHandler) HandleAlipayNotify(c *gin.Context) {
 		zap.String("trade_no", notifyData["trade_no"]))
 
 	// 处理通知
-	if err := h.alipayService.HandleNotify(c.Request.Context(), notifyData); err != nil {
+	if err := alipayService.HandleNotify(c.Request.Context(), notifyData); err != nil {
 		h.logger.Error("处理支付宝支付通知失败", zap.Error(err))
 		c.String(http.StatusOK, "fail")
 		return
@@ -76,8 +96,15 @@ func (h *AlipayWebhookHandler) HandleAlipayNotify(c *gin.Context) {
 // @Param notify_data formData string true "支付宝通知数据"
 // @Success 200 {string} string "success"
 // @Failure 400 {string} string "fail"
+// @Param tenant path string false "租户ID（多租户回调地址）"
 // @Router /webhook/alipay/subscription [post]
+// @Router /webhook/alipay/{tenant}/subscription [post]
 func (h *AlipayWebhookHandler) HandleAlipaySubscriptionNotify(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	// 解析表单数据
 	if err := c.Request.ParseForm(); err != nil {
 		h.logger.Error("解析支付宝订阅通知表单失败", zap.Error(err))
@@ -98,7 +125,7 @@ func (h *AlipayWebhookHandler) HandleAlipaySubscriptionNotify(c *gin.Context) {
 		zap.String("status", notifyData["status"]))
 
 	// 处理订阅通知
-	if err := h.alipayService.HandleSubscriptionNotify(c.Request.Context(), notifyData); err != nil {
+	if err := alipayService.HandleSubscriptionNotify(c.Request.Context(), notifyData); err != nil {
 		h.logger.Error("处理支付宝订阅通知失败", zap.Error(err))
 		c.String(http.StatusOK, "fail")
 		return
@@ -116,8 +143,15 @@ func (h *AlipayWebhookHandler) HandleAlipaySubscriptionNotify(c *gin.Context) {
 // @Param notify_data formData string true "支付宝通知数据"
 // @Success 200 {string} string "success"
 // @Failure 400 {string} string "fail"
+// @Param tenant path string false "租户ID（多租户回调地址）"
 // @Router /webhook/alipay/deduct [post]
+// @Router /webhook/alipay/{tenant}/deduct [post]
 func (h *AlipayWebhookHandler) HandleAlipayDeductNotify(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	// 解析表单数据
 	if err := c.Request.ParseForm(); err != nil {
 		h.logger.Error("解析支付宝扣款通知表单失败", zap.Error(err))
@@ -138,7 +172,7 @@ func (h *AlipayWebhookHandler) HandleAlipayDeductNotify(c *gin.Context) {
 		zap.String("status", notifyData["status"]))
 
 	// 处理扣款通知
-	if err := h.alipayService.HandleDeductNotify(c.Request.Context(), notifyData); err != nil {
+	if err := alipayService.HandleDeductNotify(c.Request.Context(), notifyData); err != nil {
 		h.logger.Error("处理支付宝扣款通知失败", zap.Error(err))
 		c.String(http.StatusOK, "fail")
 		return
@@ -155,8 +189,15 @@ func (h *AlipayWebhookHandler) HandleAlipayDeductNotify(c *gin.Context) {
 // @Produce text/plain
 // @Success 200 {string} string "success"
 // @Failure 400 {string} string "fail"
+// @Param tenant path string false "租户ID（多租户回调地址）"
 // @Router /webhook/alipay/withhold [post]
+// @Router /webhook/alipay/{tenant}/withhold [post]
 func (h *AlipayWebhookHandler) HandleAlipayWithholdNotify(c *gin.Context) {
+	alipayService, ok := h.tenantAlipayService(c)
+	if !ok {
+		return
+	}
+
 	if err := c.Request.ParseForm(); err != nil {
 		h.logger.Error("解析支付宝免密签约通知表单失败", zap.Error(err))
 		c.String(http.StatusOK, "fail")
@@ -175,7 +216,7 @@ func (h *AlipayWebhookHandler) HandleAlipayWithholdNotify(c *gin.Context) {
 		zap.String("out_request_no", notifyData["out_request_no"]),
 		zap.String("status", notifyData["status"]))
 
-	if err := h.alipayService.HandleWithholdNotify(c.Request.Context(), notifyData); err != nil {
+	if err := alipayService.HandleWithholdNotify(c.Request.Context(), notifyData); err != nil {
 		h.logger.Error("处理支付宝免密签约通知失败", zap.Error(err))
 		c.String(http.StatusOK, "fail")
 		return
@@ -2,10 +2,13 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 
 	"pay-gateway/internal/models"
 	"pay-gateway/internal/services"
@@ -32,17 +35,56 @@ func NewAppleHandler(
 	}
 }
 
+// resolveBundleID 请求未指定 Bundle ID 时使用订单记录的应用
+func (h *AppleHandler) resolveBundleID(ctx context.Context, bundleID string, orderID uint) string {
+	if bundleID != "" || orderID == 0 {
+		return bundleID
+	}
+	if order, err := h.paymentService.GetOrder(ctx, orderID); err == nil {
+		return order.AppID
+	}
+	return ""
+}
+
+// handleSavePaymentError 返回保存支付信息失败的响应
+// 交易缺少 appAccountToken 时已进入待关联队列，返回 202；令牌与订单不一致时返回 403
+func (h *AppleHandler) handleSavePaymentError(c *gin.Context, err error, orderID uint) {
+	switch {
+	case errors.Is(err, services.ErrAppleTransactionOrphaned):
+		c.JSON(http.StatusAccepted, gin.H{
+			"status":  "pending",
+			"message": "Transaction has no app account token and is queued for manual linking",
+		})
+	case errors.Is(err, services.ErrAppleAppAccountTokenMismatch):
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "App account token does not match the order",
+		})
+	default:
+		h.logger.Error("failed to save Apple payment",
+			zap.Error(err),
+			zap.Uint("order_id", orderID),
+		)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to save payment information",
+		})
+	}
+}
+
 // ApplePurchaseRequest Apple购买验证请求
 type ApplePurchaseRequest struct {
 	ReceiptData string `json:"receipt_data" binding:"required"`
 	OrderID     uint   `json:"order_id" binding:"required"`
-	IsSandbox   bool   `json:"is_sandbox"`
+	IsSandbox   bool   `json:"is_sandbox"` // 已废弃：环境由收据自动识别（生产环境返回 21007 时改用沙盒环境）
+	BundleID    string `json:"bundle_id"`  // 应用Bundle ID，为空时使用订单所属应用
 }
 
 // AppleTransactionRequest Apple交易验证请求
+// signed_transaction 与 transaction_id 至少提供一个，优先使用 signed_transaction 离线验证
 type AppleTransactionRequest struct {
-	TransactionID string `json:"transaction_id" binding:"required"`
-	OrderID       uint   `json:"order_id" binding:"required"`
+	SignedTransaction string `json:"signed_transaction"` // StoreKit 2 签名交易（Transaction.jwsRepresentation）
+	TransactionID     string `json:"transaction_id"`     // 交易ID，未提供签名交易时通过 App Store Server API 查询
+	OrderID           uint   `json:"order_id" binding:"required"`
+	BundleID          string `json:"bundle_id"` // 应用Bundle ID，为空时使用订单所属应用
 }
 
 // AppleCreatePurchaseRequest 创建Apple内购订单请求
@@ -55,6 +97,7 @@ type AppleCreatePurchaseRequest struct {
 	Currency         string `json:"currency" binding:"required,len=3"`
 	Price            int64  `json:"price" binding:"required,min=0"`
 	DeveloperPayload string `json:"developer_payload"`
+	BundleID         string `json:"bundle_id"` // 应用Bundle ID，为空时使用默认应用
 }
 
 // AppleCreateSubscriptionRequest 创建Apple订阅订单请求
@@ -67,13 +110,14 @@ type AppleCreateSubscriptionRequest struct {
 	Price            int64  `json:"price" binding:"required,min=0"`
 	Period           string `json:"period" binding:"required"` // P1W, P1M, P1Y等
 	DeveloperPayload string `json:"developer_payload"`
+	BundleID         string `json:"bundle_id"` // 应用Bundle ID，为空时使用默认应用
 }
 
 // ==================== 订单创建接口 ====================
 
 // CreatePurchaseOrder 创建Apple内购订单
 // @Summary 创建Apple内购订单
-// @Description 创建新的Apple一次性购买订单
+// @Description 创建新的Apple一次性购买订单，返回的 app_account_token 须在购买时传给 StoreKit
 // @Tags Apple
 // @Accept json
 // @Produce json
@@ -90,6 +134,13 @@ func (h *AppleHandler) CreatePurchaseOrder(c *gin.Context) {
 		return
 	}
 
+	appleService, err := h.appleService.ForBundle(req.BundleID)
+	if err != nil {
+		h.logger.Warn("未配置的Apple应用", zap.String("bundle_id", req.BundleID))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不支持的应用Bundle ID", "details": err.Error()})
+		return
+	}
+
 	// 创建内购订单
 	orderReq := &services.CreateOrderRequest{
 		UserID:           req.UserID,
@@ -102,9 +153,11 @@ func (h *AppleHandler) CreatePurchaseOrder(c *gin.Context) {
 		TotalAmount:      req.Price * int64(req.Quantity),
 		PaymentMethod:    models.PaymentMethodAppleStore,
 		DeveloperPayload: req.DeveloperPayload,
+		AppID:            appleService.BundleID(),
+		AppAccountToken:  services.NewAppAccountToken(),
 	}
 
-	order, err := h.paymentService.CreateOrder(c.Request.Context(), orderReq)
+	order, err := h.paymentService.CreateOrder(tenantContext(c), orderReq)
 	if err != nil {
 		h.logger.Error("创建Apple内购订单失败", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建内购订单失败", "details": err.Error()})
@@ -124,7 +177,7 @@ func (h *AppleHandler) CreatePurchaseOrder(c *gin.Context) {
 
 // CreateSubscriptionOrder 创建Apple订阅订单
 // @Summary 创建Apple订阅订单
-// @Description 创建新的Apple订阅订单
+// @Description 创建新的Apple订阅订单，返回的 app_account_token 须在购买时传给 StoreKit
 // @Tags Apple
 // @Accept json
 // @Produce json
@@ -141,6 +194,13 @@ func (h *AppleHandler) CreateSubscriptionOrder(c *gin.Context) {
 		return
 	}
 
+	appleService, err := h.appleService.ForBundle(req.BundleID)
+	if err != nil {
+		h.logger.Warn("未配置的Apple应用", zap.String("bundle_id", req.BundleID))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不支持的应用Bundle ID", "details": err.Error()})
+		return
+	}
+
 	// 创建订阅订单
 	orderReq := &services.CreateOrderRequest{
 		UserID:           req.UserID,
@@ -153,9 +213,11 @@ func (h *AppleHandler) CreateSubscriptionOrder(c *gin.Context) {
 		TotalAmount:      req.Price,
 		PaymentMethod:    models.PaymentMethodAppleStore,
 		DeveloperPayload: req.DeveloperPayload,
+		AppID:            appleService.BundleID(),
+		AppAccountToken:  services.NewAppAccountToken(),
 	}
 
-	order, err := h.paymentService.CreateOrder(c.Request.Context(), orderReq)
+	order, err := h.paymentService.CreateOrder(tenantContext(c), orderReq)
 	if err != nil {
 		h.logger.Error("创建Apple订阅订单失败", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建订阅订单失败", "details": err.Error()})
@@ -176,14 +238,17 @@ func (h *AppleHandler) CreateSubscriptionOrder(c *gin.Context) {
 // ==================== 收据验证接口 ====================
 
 // AppleVerifyReceipt 验证Apple收据
-// @Summary 验证Apple收据
-// @Description 验证Apple应用内购买收据
+// @Summary 验证Apple收据（已废弃）
+// @Description 通过已废弃的 verifyReceipt 验证Apple收据，仅在开启 apple.legacy_receipt_verification 时可用，新客户端请使用 verify-transaction
 // @Tags Apple
 // @Accept json
 // @Produce json
 // @Param request body ApplePurchaseRequest true "购买验证请求"
 // @Success 200 {object} Response
+// @Success 202 {object} Response
 // @Failure 400 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/apple/verify-receipt [post]
 func (h *AppleHandler) VerifyReceipt(c *gin.Context) {
@@ -200,8 +265,23 @@ func (h *AppleHandler) VerifyReceipt(c *gin.Context) {
 		return
 	}
 
+	appleService, err := h.appleService.ForBundle(h.resolveBundleID(ctx, request.BundleID, request.OrderID))
+	if err != nil {
+		h.logger.Warn("unsupported Apple bundle ID", zap.String("bundle_id", request.BundleID))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unsupported bundle ID",
+		})
+		return
+	}
+
 	// 验证收据
-	response, err := h.appleService.VerifyPurchase(ctx, request.ReceiptData, request.OrderID)
+	response, err := appleService.VerifyPurchase(ctx, request.ReceiptData, request.OrderID)
+	if errors.Is(err, services.ErrAppleReceiptVerificationDisabled) {
+		c.JSON(http.StatusGone, gin.H{
+			"error": "Receipt verification is disabled, use verify-transaction with a signed transaction",
+		})
+		return
+	}
 	if err != nil {
 		h.logger.Error("failed to verify Apple receipt",
 			zap.Error(err),
@@ -214,14 +294,8 @@ func (h *AppleHandler) VerifyReceipt(c *gin.Context) {
 	}
 
 	// 保存支付信息
-	if err := h.appleService.SaveApplePayment(ctx, request.OrderID, response); err != nil {
-		h.logger.Error("failed to save Apple payment",
-			zap.Error(err),
-			zap.Uint("order_id", request.OrderID),
-		)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to save payment information",
-		})
+	if err := appleService.SaveApplePayment(ctx, request.OrderID, response); err != nil {
+		h.handleSavePaymentError(c, err, request.OrderID)
 		return
 	}
 
@@ -234,13 +308,15 @@ func (h *AppleHandler) VerifyReceipt(c *gin.Context) {
 
 // AppleVerifyTransaction 验证Apple交易
 // @Summary 验证Apple交易
-// @Description 使用App Store Server API验证Apple交易
+// @Description 验证 StoreKit 2 签名交易（离线校验 Apple 证书链），或通过 App Store Server API 按交易ID查询验证；交易须携带订单的 app_account_token，缺少令牌时进入待关联队列并返回 202
 // @Tags Apple
 // @Accept json
 // @Produce json
 // @Param request body AppleTransactionRequest true "交易验证请求"
 // @Success 200 {object} Response
+// @Success 202 {object} Response
 // @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/apple/verify-transaction [post]
 func (h *AppleHandler) VerifyTransaction(c *gin.Context) {
@@ -256,9 +332,29 @@ func (h *AppleHandler) VerifyTransaction(c *gin.Context) {
 		})
 		return
 	}
+	if request.SignedTransaction == "" && request.TransactionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Signed transaction or transaction ID is required",
+		})
+		return
+	}
+
+	appleService, err := h.appleService.ForBundle(h.resolveBundleID(ctx, request.BundleID, request.OrderID))
+	if err != nil {
+		h.logger.Warn("unsupported Apple bundle ID", zap.String("bundle_id", request.BundleID))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unsupported bundle ID",
+		})
+		return
+	}
 
-	// 验证交易
-	response, err := h.appleService.VerifyTransaction(ctx, request.TransactionID)
+	// 验证交易：优先离线验证签名交易
+	var response *services.ApplePurchaseResponse
+	if request.SignedTransaction != "" {
+		response, err = appleService.VerifySignedTransaction(ctx, request.SignedTransaction)
+	} else {
+		response, err = appleService.VerifyTransaction(ctx, request.TransactionID)
+	}
 	if err != nil {
 		h.logger.Error("failed to verify Apple transaction",
 			zap.Error(err),
@@ -269,19 +365,23 @@ func (h *AppleHandler) VerifyTransaction(c *gin.Context) {
 		})
 		return
 	}
-
-	// 保存支付信息
-	if err := h.appleService.SaveApplePayment(ctx, request.OrderID, response); err != nil {
-		h.logger.Error("failed to save Apple payment",
-			zap.Error(err),
-			zap.Uint("order_id", request.OrderID),
+	if request.TransactionID != "" && response.TransactionID != request.TransactionID {
+		h.logger.Warn("Apple transaction ID mismatch",
+			zap.String("expected", request.TransactionID),
+			zap.String("received", response.TransactionID),
 		)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to save payment information",
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Transaction ID mismatch",
 		})
 		return
 	}
 
+	// 保存支付信息
+	if err := appleService.SaveApplePayment(ctx, request.OrderID, response); err != nil {
+		h.handleSavePaymentError(c, err, request.OrderID)
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"status":  "success",
 		"message": "Transaction verified successfully",
@@ -296,6 +396,7 @@ func (h *AppleHandler) VerifyTransaction(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param original_transaction_id path string true "原始交易ID"
+// @Param bundle_id query string false "应用Bundle ID，为空时使用默认应用"
 // @Success 200 {object} Response
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
@@ -311,8 +412,17 @@ func (h *AppleHandler) GetTransactionHistory(c *gin.Context) {
 		return
 	}
 
+	appleService, err := h.appleService.ForBundle(c.Query("bundle_id"))
+	if err != nil {
+		h.logger.Warn("unsupported Apple bundle ID", zap.String("bundle_id", c.Query("bundle_id")))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unsupported bundle ID",
+		})
+		return
+	}
+
 	// 获取交易历史
-	transactions, err := h.appleService.GetTransactionHistory(ctx, originalTransactionID)
+	transactions, err := appleService.GetTransactionHistory(ctx, originalTransactionID)
 	if err != nil {
 		h.logger.Error("failed to get Apple transaction history",
 			zap.Error(err),
@@ -333,11 +443,14 @@ func (h *AppleHandler) GetTransactionHistory(c *gin.Context) {
 
 // AppleGetSubscriptionStatus 获取订阅状态
 // @Summary 获取Apple订阅状态
-// @Description 获取Apple订阅状态信息
+// @Description 调用 App Store Server API 获取用户全部订阅组的实时状态，包含最新交易和解码后的续订信息；sync=true 时回写本地支付记录和订单状态
 // @Tags Apple
 // @Accept json
 // @Produce json
 // @Param original_transaction_id path string true "原始交易ID"
+// @Param bundle_id query string false "应用Bundle ID，为空时使用默认应用"
+// @Param status query []int false "按状态过滤：1-有效，2-已过期，3-账单重试期，4-账单宽限期，5-已撤销" collectionFormat(multi)
+// @Param sync query bool false "是否将实时状态回写到本地"
 // @Success 200 {object} Response
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
@@ -353,8 +466,29 @@ func (h *AppleHandler) GetSubscriptionStatus(c *gin.Context) {
 		return
 	}
 
-	// 获取交易历史
-	transactions, err := h.appleService.GetTransactionHistory(ctx, originalTransactionID)
+	var statusFilter []int32
+	for _, value := range c.QueryArray("status") {
+		status, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || status < 1 || status > 5 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid status filter",
+			})
+			return
+		}
+		statusFilter = append(statusFilter, int32(status))
+	}
+
+	appleService, err := h.appleService.ForBundle(c.Query("bundle_id"))
+	if err != nil {
+		h.logger.Warn("unsupported Apple bundle ID", zap.String("bundle_id", c.Query("bundle_id")))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unsupported bundle ID",
+		})
+		return
+	}
+
+	// 获取实时订阅状态
+	statuses, err := appleService.GetAllSubscriptionStatuses(ctx, originalTransactionID, statusFilter...)
 	if err != nil {
 		h.logger.Error("failed to get Apple subscription status",
 			zap.Error(err),
@@ -366,32 +500,180 @@ func (h *AppleHandler) GetSubscriptionStatus(c *gin.Context) {
 		return
 	}
 
-	if len(transactions) == 0 {
+	if len(statuses.Groups) == 0 {
 		c.JSON(http.StatusNotFound, gin.H{
 			"error": "No subscription found",
 		})
 		return
 	}
 
-	// 获取最新的交易信息
-	latestTransaction := transactions[len(transactions)-1]
+	// 回写本地支付记录和订单状态
+	if c.Query("sync") == "true" {
+		synced, err := appleService.SyncSubscriptionStatuses(ctx, statuses)
+		if err != nil {
+			h.logger.Error("failed to sync Apple subscription status",
+				zap.Error(err),
+				zap.String("original_transaction_id", originalTransactionID),
+			)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to sync subscription status",
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"message": "Subscription status retrieved and synced successfully",
+			"data":    statuses,
+			"synced":  synced,
+		})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"status":  "success",
 		"message": "Subscription status retrieved successfully",
-		"data":    latestTransaction,
+		"data":    statuses,
+	})
+}
+
+// ==================== 促销优惠接口 ====================
+
+// AppleOfferSignatureRequest 促销优惠签名请求
+type AppleOfferSignatureRequest struct {
+	UserID          uint   `json:"user_id" binding:"required"`
+	ProductID       string `json:"product_id" binding:"required"`
+	OfferID         string `json:"offer_id" binding:"required"`
+	AppAccountToken string `json:"app_account_token" binding:"omitempty,uuid"` // 应用账户令牌，需与客户端购买时传入的一致
+	BundleID        string `json:"bundle_id"`                                  // 应用Bundle ID，为空时使用默认应用
+}
+
+// AppleCreateOfferSignature 生成促销优惠签名
+// @Summary 生成Apple促销优惠签名
+// @Description 校验用户是否订阅过同一订阅组，通过后使用 In-App Purchase 密钥生成促销优惠签名（nonce、时间戳、ECDSA 签名），客户端原样传给 StoreKit
+// @Tags Apple
+// @Accept json
+// @Produce json
+// @Param request body AppleOfferSignatureRequest true "优惠签名请求"
+// @Success 200 {object} Response
+// @Failure 400 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/apple/offers/signature [post]
+func (h *AppleHandler) CreateOfferSignature(c *gin.Context) {
+	var request AppleOfferSignatureRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		h.logger.Error("invalid request",
+			zap.Error(err),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format",
+		})
+		return
+	}
+
+	appleService, err := h.appleService.ForBundle(request.BundleID)
+	if err != nil {
+		h.logger.Warn("unsupported Apple bundle ID", zap.String("bundle_id", request.BundleID))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unsupported bundle ID",
+		})
+		return
+	}
+
+	signature, err := appleService.GeneratePromotionalOfferSignature(c.Request.Context(), &services.AppleOfferSignatureRequest{
+		UserID:          request.UserID,
+		ProductID:       request.ProductID,
+		OfferID:         request.OfferID,
+		AppAccountToken: request.AppAccountToken,
+	})
+	if errors.Is(err, services.ErrAppleOfferNotEligible) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "User is not eligible for this offer",
+		})
+		return
+	}
+	if err != nil {
+		h.logger.Error("failed to generate Apple offer signature",
+			zap.Error(err),
+			zap.Uint("user_id", request.UserID),
+			zap.String("product_id", request.ProductID),
+		)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to generate offer signature",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Offer signature generated successfully",
+		"data":    signature,
+	})
+}
+
+// AppleGetOfferEligibility 查询促销优惠资格
+// @Summary 查询Apple促销优惠资格
+// @Description 根据用户的 Apple 购买记录判断是否可使用订阅商品所在订阅组的促销优惠
+// @Tags Apple
+// @Accept json
+// @Produce json
+// @Param user_id query int true "用户ID"
+// @Param product_id query string true "订阅商品ID"
+// @Param bundle_id query string false "应用Bundle ID，为空时使用默认应用"
+// @Success 200 {object} Response
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/apple/offers/eligibility [get]
+func (h *AppleHandler) GetOfferEligibility(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Query("user_id"), 10, 64)
+	productID := c.Query("product_id")
+	if err != nil || userID == 0 || productID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "User ID and product ID are required",
+		})
+		return
+	}
+
+	appleService, err := h.appleService.ForBundle(c.Query("bundle_id"))
+	if err != nil {
+		h.logger.Warn("unsupported Apple bundle ID", zap.String("bundle_id", c.Query("bundle_id")))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unsupported bundle ID",
+		})
+		return
+	}
+
+	eligibility, err := appleService.CheckOfferEligibility(c.Request.Context(), uint(userID), productID)
+	if err != nil {
+		h.logger.Error("failed to check Apple offer eligibility",
+			zap.Error(err),
+			zap.Uint64("user_id", userID),
+			zap.String("product_id", productID),
+		)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to check offer eligibility",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Offer eligibility retrieved successfully",
+		"data":    eligibility,
 	})
 }
 
 // AppleValidateReceipt 验证Apple收据（简化版本）
 // @Summary 验证Apple收据（简化版本）
-// @Description 验证Apple应用内购买收据并返回验证结果
+// @Description 通过已废弃的 verifyReceipt 验证Apple收据并返回验证结果，仅在开启 apple.legacy_receipt_verification 时可用
 // @Tags Apple
 // @Accept json
 // @Produce json
 // @Param request body ApplePurchaseRequest true "购买验证请求"
 // @Success 200 {object} Response
 // @Failure 400 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/apple/validate-receipt [post]
 func (h *AppleHandler) ValidateReceipt(c *gin.Context) {
@@ -408,8 +690,23 @@ func (h *AppleHandler) ValidateReceipt(c *gin.Context) {
 		return
 	}
 
+	appleService, err := h.appleService.ForBundle(h.resolveBundleID(ctx, request.BundleID, request.OrderID))
+	if err != nil {
+		h.logger.Warn("unsupported Apple bundle ID", zap.String("bundle_id", request.BundleID))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unsupported bundle ID",
+		})
+		return
+	}
+
 	// 验证收据
-	response, err := h.appleService.VerifyPurchase(ctx, request.ReceiptData, request.OrderID)
+	response, err := appleService.VerifyPurchase(ctx, request.ReceiptData, request.OrderID)
+	if errors.Is(err, services.ErrAppleReceiptVerificationDisabled) {
+		c.JSON(http.StatusGone, gin.H{
+			"error": "Receipt verification is disabled, use verify-transaction with a signed transaction",
+		})
+		return
+	}
 	if err != nil {
 		h.logger.Error("failed to verify Apple receipt",
 			zap.Error(err),
@@ -430,3 +727,178 @@ func (h *AppleHandler) ValidateReceipt(c *gin.Context) {
 		},
 	})
 }
+
+// ==================== 待关联交易接口 ====================
+
+// AppleResolveOrphanRequest 处理待关联交易请求
+type AppleResolveOrphanRequest struct {
+	OrderID  uint   `json:"order_id"` // 关联的订单ID（仅关联时必填）
+	Operator string `json:"operator" binding:"required"`
+	Note     string `json:"note"`
+}
+
+// ListOrphanTransactions 查询待关联交易
+// @Summary 查询Apple待关联交易
+// @Description 查询缺少 appAccountToken 或令牌无法匹配订单的 Apple 交易
+// @Tags Apple
+// @Accept json
+// @Produce json
+// @Param status query string false "状态：PENDING/LINKED/IGNORED，为空时返回全部"
+// @Param bundle_id query string false "应用Bundle ID，为空时使用默认应用"
+// @Param page query int false "页码" default(1)
+// @Param page_size query int false "每页数量" default(20)
+// @Success 200 {object} Response
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/apple/orphan-transactions [get]
+func (h *AppleHandler) ListOrphanTransactions(c *gin.Context) {
+	appleService, err := h.appleService.ForBundle(c.Query("bundle_id"))
+	if err != nil {
+		h.logger.Warn("unsupported Apple bundle ID", zap.String("bundle_id", c.Query("bundle_id")))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unsupported bundle ID",
+		})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	orphans, total, err := appleService.ListOrphanTransactions(c.Request.Context(), c.Query("status"), page, pageSize)
+	if err != nil {
+		h.logger.Error("failed to list Apple orphan transactions", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list orphan transactions",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data": gin.H{
+			"transactions": orphans,
+			"total":        total,
+			"page":         page,
+			"page_size":    pageSize,
+		},
+	})
+}
+
+// LinkOrphanTransaction 关联待关联交易到订单
+// @Summary 关联Apple待关联交易
+// @Description 人工核对后将交易关联到指定 Apple 订单，创建或更新支付记录并将未支付订单置为已支付
+// @Tags Apple
+// @Accept json
+// @Produce json
+// @Param id path int true "待关联记录ID"
+// @Param request body AppleResolveOrphanRequest true "关联请求"
+// @Success 200 {object} Response
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/apple/orphan-transactions/{id}/link [post]
+func (h *AppleHandler) LinkOrphanTransaction(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid orphan transaction ID",
+		})
+		return
+	}
+
+	var request AppleResolveOrphanRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.OrderID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Order ID and operator are required",
+		})
+		return
+	}
+
+	orphan, err := h.appleService.LinkOrphanTransaction(c.Request.Context(), uint(id), request.OrderID, request.Operator, request.Note)
+	if err != nil {
+		h.respondOrphanError(c, err, uint(id))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Transaction linked successfully",
+		"data":    orphan,
+	})
+}
+
+// IgnoreOrphanTransaction 忽略待关联交易
+// @Summary 忽略Apple待关联交易
+// @Description 将无需关联的交易（如测试交易或已另行补发权益）标记为已忽略
+// @Tags Apple
+// @Accept json
+// @Produce json
+// @Param id path int true "待关联记录ID"
+// @Param request body AppleResolveOrphanRequest true "处理请求"
+// @Success 200 {object} Response
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/apple/orphan-transactions/{id}/ignore [post]
+func (h *AppleHandler) IgnoreOrphanTransaction(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid orphan transaction ID",
+		})
+		return
+	}
+
+	var request AppleResolveOrphanRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Operator is required",
+		})
+		return
+	}
+
+	orphan, err := h.appleService.IgnoreOrphanTransaction(c.Request.Context(), uint(id), request.Operator, request.Note)
+	if err != nil {
+		h.respondOrphanError(c, err, uint(id))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"message": "Transaction ignored",
+		"data":    orphan,
+	})
+}
+
+// respondOrphanError 返回处理待关联交易失败的响应
+func (h *AppleHandler) respondOrphanError(c *gin.Context, err error, id uint) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Orphan transaction not found",
+		})
+	case errors.Is(err, services.ErrAppleOrphanNotPending):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Orphan transaction has already been resolved",
+		})
+	case errors.Is(err, services.ErrAppleTransactionAlreadyLinked):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Transaction is already linked to another order",
+			"details": err.Error(),
+		})
+	default:
+		h.logger.Error("failed to resolve Apple orphan transaction",
+			zap.Error(err),
+			zap.Uint("orphan_id", id),
+		)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to resolve orphan transaction",
+		})
+	}
+}
@@ -103,8 +103,25 @@ func (h *AppleWebhookHandler) HandleAppleWebhook(c *gin.Context) {
 		zap.String("notification_uuid", notification.NotificationUUID),
 	)
 
+	// 按通知的 Bundle ID 路由到对应应用，拒绝未配置应用的通知
+	bundleID := ""
+	if notification.Data != nil {
+		bundleID = notification.Data.BundleID
+	}
+	appleService, err := h.appleService.ForBundle(bundleID)
+	if err != nil {
+		h.logger.Warn("Apple notification for unconfigured bundle ID",
+			zap.String("bundle_id", bundleID),
+			zap.String("notification_uuid", notification.NotificationUUID),
+		)
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Bundle ID not configured",
+		})
+		return
+	}
+
 	// 处理通知
-	if err := h.appleService.HandleNotification(c.Request.Context(), notification); err != nil {
+	if err := appleService.HandleNotification(c.Request.Context(), notification); err != nil {
 		h.logger.Error("Failed to process Apple notification",
 			zap.Error(err),
 			zap.String("notification_type", notification.NotificationType),
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -8,6 +10,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 
+	"pay-gateway/internal/config"
 	"pay-gateway/internal/models"
 	"pay-gateway/internal/services"
 )
@@ -89,6 +92,7 @@ func NewCommonHandler(paymentService services.PaymentService, logger *zap.Logger
 // @Accept json
 // @Produce json
 // @Param request body CreateOrderRequest true "创建订单请求"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=models.Order}
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
@@ -114,9 +118,13 @@ func (h *CommonHandler) CreateOrder(c *gin.Context) {
 		DeveloperPayload: req.DeveloperPayload,
 	}
 
-	order, err := h.paymentService.CreateOrder(c.Request.Context(), serviceReq)
+	order, err := h.paymentService.CreateOrder(tenantContext(c), serviceReq)
 	if err != nil {
 		h.logger.Error("创建订单失败", zap.Error(err))
+		if errors.Is(err, services.ErrTenantNotFound) {
+			h.errorResponse(c, 400, "租户不存在", err)
+			return
+		}
 		h.errorResponse(c, 500, "创建订单失败", err)
 		return
 	}
@@ -132,6 +140,7 @@ func (h *CommonHandler) CreateOrder(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param id path int true "订单ID"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=models.Order}
 // @Failure 400 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
@@ -145,7 +154,7 @@ func (h *CommonHandler) GetOrder(c *gin.Context) {
 		return
 	}
 
-	order, err := h.paymentService.GetOrder(c.Request.Context(), uint(id))
+	order, err := h.paymentService.GetOrder(tenantContext(c), uint(id))
 	if err != nil {
 		h.logger.Error("获取订单失败", zap.Error(err), zap.Uint64("order_id", id))
 		h.errorResponse(c, 500, "获取订单失败", err)
@@ -162,6 +171,7 @@ func (h *CommonHandler) GetOrder(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param order_no path string true "订单号"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=models.Order}
 // @Failure 400 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
@@ -174,7 +184,7 @@ func (h *CommonHandler) GetOrderByOrderNo(c *gin.Context) {
 		return
 	}
 
-	order, err := h.paymentService.GetOrderByOrderNo(c.Request.Context(), orderNo)
+	order, err := h.paymentService.GetOrderByOrderNo(tenantContext(c), orderNo)
 	if err != nil {
 		h.logger.Error("获取订单失败", zap.Error(err), zap.String("order_no", orderNo))
 		h.errorResponse(c, 500, "获取订单失败", err)
@@ -192,6 +202,7 @@ func (h *CommonHandler) GetOrderByOrderNo(c *gin.Context) {
 // @Produce json
 // @Param id path int true "订单ID"
 // @Param reason query string false "取消原因"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
@@ -206,7 +217,7 @@ func (h *CommonHandler) CancelOrder(c *gin.Context) {
 
 	reason := c.DefaultQuery("reason", "用户取消")
 
-	err = h.paymentService.CancelOrder(c.Request.Context(), uint(id), reason)
+	err = h.paymentService.CancelOrder(tenantContext(c), uint(id), reason)
 	if err != nil {
 		h.logger.Error("取消订单失败", zap.Error(err), zap.Uint64("order_id", id))
 		h.errorResponse(c, 500, "取消订单失败", err)
@@ -245,6 +256,7 @@ func (h *CommonHandler) CancelExpiredOrders(c *gin.Context) {
 // @Param user_id path int true "用户ID"
 // @Param page query int false "页码" default(1)
 // @Param page_size query int false "每页数量" default(10)
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} Response{data=gin.H}
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
@@ -267,7 +279,7 @@ func (h *CommonHandler) GetUserOrders(c *gin.Context) {
 		pageSize = 10
 	}
 
-	orders, total, err := h.paymentService.GetUserOrders(c.Request.Context(), uint(userID), page, pageSize)
+	orders, total, err := h.paymentService.GetUserOrders(tenantContext(c), uint(userID), page, pageSize)
 	if err != nil {
 		h.logger.Error("获取用户订单失败", zap.Error(err), zap.Uint64("user_id", userID))
 		h.errorResponse(c, 500, "获取用户订单失败", err)
@@ -341,3 +353,24 @@ func ErrorJSON(c *gin.Context, code int, message string, err error) {
 	}
 	c.JSON(http.StatusOK, response)
 }
+
+// ==================== 租户辅助函数 ====================
+
+// TenantHeader 指定请求所属租户的请求头
+const TenantHeader = "X-Tenant-ID"
+
+// requestTenantID 获取请求所属租户：路径参数 :tenant 优先（回调地址），其次请求头 X-Tenant-ID，均未设置时为默认租户
+func requestTenantID(c *gin.Context) string {
+	if tenantID := c.Param("tenant"); tenantID != "" {
+		return tenantID
+	}
+	if tenantID := c.GetHeader(TenantHeader); tenantID != "" {
+		return tenantID
+	}
+	return config.DefaultTenantID
+}
+
+// tenantContext 返回携带请求租户的上下文，PaymentService 据此限定订单查询范围
+func tenantContext(c *gin.Context) context.Context {
+	return services.WithTenantID(c.Request.Context(), requestTenantID(c))
+}
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -38,6 +40,7 @@ type GoogleVerifyPurchaseRequest struct {
 	ProductID     string `json:"product_id" binding:"required"`
 	PurchaseToken string `json:"purchase_token" binding:"required"`
 	OrderID       uint   `json:"order_id" binding:"required"`
+	PackageName   string `json:"package_name"` // 应用包名，为空时使用订单所属应用
 }
 
 // GoogleVerifySubscriptionRequest 验证订阅请求
@@ -45,6 +48,7 @@ type GoogleVerifySubscriptionRequest struct {
 	SubscriptionID string `json:"subscription_id" binding:"required"`
 	PurchaseToken  string `json:"purchase_token" binding:"required"`
 	OrderID        uint   `json:"order_id" binding:"required"`
+	PackageName    string `json:"package_name"` // 应用包名，为空时使用订单所属应用
 }
 
 // GoogleAcknowledgePurchaseRequest 确认购买请求
@@ -52,6 +56,7 @@ type GoogleAcknowledgePurchaseRequest struct {
 	ProductID        string `json:"product_id" binding:"required"`
 	PurchaseToken    string `json:"purchase_token" binding:"required"`
 	DeveloperPayload string `json:"developer_payload"`
+	PackageName      string `json:"package_name"` // 应用包名，为空时使用默认应用
 }
 
 // GoogleAcknowledgeSubscriptionRequest 确认订阅请求
@@ -59,12 +64,14 @@ type GoogleAcknowledgeSubscriptionRequest struct {
 	SubscriptionID   string `json:"subscription_id" binding:"required"`
 	PurchaseToken    string `json:"purchase_token" binding:"required"`
 	DeveloperPayload string `json:"developer_payload"`
+	PackageName      string `json:"package_name"` // 应用包名，为空时使用默认应用
 }
 
 // GoogleConsumePurchaseRequest 消费购买请求
 type GoogleConsumePurchaseRequest struct {
 	ProductID     string `json:"product_id" binding:"required"`
 	PurchaseToken string `json:"purchase_token" binding:"required"`
+	PackageName   string `json:"package_name"` // 应用包名，为空时使用默认应用
 }
 
 // GoogleCreateSubscriptionRequest 创建Google订阅请求
@@ -77,6 +84,7 @@ type GoogleCreateSubscriptionRequest struct {
 	Price            int64  `json:"price" binding:"required,min=0"`
 	Period           string `json:"period" binding:"required"` // P1M, P1Y等
 	DeveloperPayload string `json:"developer_payload"`
+	PackageName      string `json:"package_name"` // 应用包名，为空时使用默认应用
 }
 
 // GoogleCreatePurchaseRequest 创建Google内购订单请求
@@ -89,6 +97,7 @@ type GoogleCreatePurchaseRequest struct {
 	Currency         string `json:"currency" binding:"required,len=3"`
 	Price            int64  `json:"price" binding:"required,min=0"`
 	DeveloperPayload string `json:"developer_payload"`
+	PackageName      string `json:"package_name"` // 应用包名，为空时使用默认应用
 }
 
 // ==================== 购买验证接口 ====================
@@ -112,7 +121,14 @@ func (h *GoogleHandler) VerifyPurchase(c *gin.Context) {
 		return
 	}
 
-	purchase, err := h.googleService.VerifyPurchase(c.Request.Context(), req.ProductID, req.PurchaseToken)
+	googleService, err := h.googleService.ForPackage(h.resolvePackageName(c.Request.Context(), req.PackageName, req.OrderID))
+	if err != nil {
+		h.logger.Warn("未配置的Google应用包名", zap.String("package_name", req.PackageName))
+		ErrorJSON(c, 400, "不支持的应用包名", err)
+		return
+	}
+
+	purchase, err := googleService.VerifyPurchase(c.Request.Context(), req.ProductID, req.PurchaseToken)
 	if err != nil {
 		h.logger.Error("验证Google购买失败", zap.Error(err))
 		ErrorJSON(c, 500, "验证购买失败", err)
@@ -121,7 +137,7 @@ func (h *GoogleHandler) VerifyPurchase(c *gin.Context) {
 
 	// 验证成功后立即确认，满足 3 天 Acknowledge 合规要求
 	if purchase.AcknowledgementState == 0 {
-		if ackErr := h.googleService.AcknowledgePurchase(c.Request.Context(), req.ProductID, req.PurchaseToken, ""); ackErr != nil {
+		if ackErr := googleService.AcknowledgePurchase(c.Request.Context(), req.ProductID, req.PurchaseToken, ""); ackErr != nil {
 			h.logger.Error("验证后自动确认购买失败，需客户端重试 Acknowledge",
 				zap.Error(ackErr),
 				zap.String("product_id", req.ProductID),
@@ -133,6 +149,13 @@ func (h *GoogleHandler) VerifyPurchase(c *gin.Context) {
 		}
 	}
 
+	// 许可测试账号的购买不计入收入
+	if purchase.TestPurchase {
+		if err := googleService.MarkTestOrder(c.Request.Context(), req.OrderID); err != nil {
+			h.logger.Error("标记Google测试订单失败", zap.Error(err), zap.Uint("order_id", req.OrderID))
+		}
+	}
+
 	h.logger.Info("Google购买验证成功",
 		zap.String("product_id", req.ProductID),
 		zap.String("order_id", purchase.OrderId))
@@ -149,6 +172,7 @@ func (h *GoogleHandler) VerifyPurchase(c *gin.Context) {
 // @Param request body GoogleVerifySubscriptionRequest true "验证订阅请求"
 // @Success 200 {object} Response{data=services.SubscriptionResponse}
 // @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/google/verify-subscription [post]
 func (h *GoogleHandler) VerifySubscription(c *gin.Context) {
@@ -159,7 +183,14 @@ func (h *GoogleHandler) VerifySubscription(c *gin.Context) {
 		return
 	}
 
-	subscription, err := h.googleService.VerifySubscription(c.Request.Context(), req.SubscriptionID, req.PurchaseToken)
+	googleService, err := h.googleService.ForPackage(h.resolvePackageName(c.Request.Context(), req.PackageName, req.OrderID))
+	if err != nil {
+		h.logger.Warn("未配置的Google应用包名", zap.String("package_name", req.PackageName))
+		ErrorJSON(c, 400, "不支持的应用包名", err)
+		return
+	}
+
+	subscription, err := googleService.VerifySubscription(c.Request.Context(), req.SubscriptionID, req.PurchaseToken)
 	if err != nil {
 		h.logger.Error("验证Google订阅失败", zap.Error(err))
 		ErrorJSON(c, 500, "验证订阅失败", err)
@@ -167,22 +198,34 @@ func (h *GoogleHandler) VerifySubscription(c *gin.Context) {
 	}
 
 	// 验证成功后立即确认，满足 3 天 Acknowledge 合规要求
-	if subscription.AcknowledgementState == 0 {
-		if ackErr := h.googleService.AcknowledgeSubscription(c.Request.Context(), req.SubscriptionID, req.PurchaseToken, ""); ackErr != nil {
+	if !subscription.IsAcknowledged() {
+		if ackErr := googleService.AcknowledgeSubscription(c.Request.Context(), req.SubscriptionID, req.PurchaseToken, ""); ackErr != nil {
 			h.logger.Error("验证后自动确认订阅失败，需客户端重试 Acknowledge",
 				zap.Error(ackErr),
 				zap.String("subscription_id", req.SubscriptionID),
 				zap.String("purchase_token", req.PurchaseToken))
 			// 不阻断流程，验证结果仍返回；客户端可单独调用 acknowledge-subscription 重试
 		} else {
-			subscription.AcknowledgementState = 1
+			subscription.AcknowledgementState = services.GoogleAcknowledgementStateAcknowledged
 			h.logger.Info("验证后已自动确认订阅", zap.String("subscription_id", req.SubscriptionID))
 		}
 	}
 
+	// 绑定购买令牌与订单；带 linkedPurchaseToken 时替代旧订单并转移权益
+	if _, err := googleService.RecordSubscriptionPurchase(c.Request.Context(), req.OrderID, req.PurchaseToken, subscription); err != nil {
+		h.logger.Error("记录Google订阅失败", zap.Error(err), zap.Uint("order_id", req.OrderID))
+		if errors.Is(err, services.ErrGooglePurchaseTokenBound) {
+			ErrorJSON(c, 409, "购买令牌已绑定其他订单", err)
+			return
+		}
+		ErrorJSON(c, 500, "记录订阅失败", err)
+		return
+	}
+
 	h.logger.Info("Google订阅验证成功",
 		zap.String("subscription_id", req.SubscriptionID),
-		zap.Bool("auto_renewing", subscription.AutoRenewing))
+		zap.String("status", string(subscription.Status)),
+		zap.Bool("auto_renewing", subscription.IsAutoRenewing()))
 
 	SuccessJSON(c, subscription)
 }
@@ -208,7 +251,14 @@ func (h *GoogleHandler) AcknowledgePurchase(c *gin.Context) {
 		return
 	}
 
-	err := h.googleService.AcknowledgePurchase(c.Request.Context(), req.ProductID, req.PurchaseToken, req.DeveloperPayload)
+	googleService, err := h.googleService.ForPackage(req.PackageName)
+	if err != nil {
+		h.logger.Warn("未配置的Google应用包名", zap.String("package_name", req.PackageName))
+		ErrorJSON(c, 400, "不支持的应用包名", err)
+		return
+	}
+
+	err = googleService.AcknowledgePurchase(c.Request.Context(), req.ProductID, req.PurchaseToken, req.DeveloperPayload)
 	if err != nil {
 		h.logger.Error("确认Google购买失败", zap.Error(err))
 		ErrorJSON(c, 500, "确认购买失败", err)
@@ -238,7 +288,14 @@ func (h *GoogleHandler) AcknowledgeSubscription(c *gin.Context) {
 		return
 	}
 
-	err := h.googleService.AcknowledgeSubscription(c.Request.Context(), req.SubscriptionID, req.PurchaseToken, req.DeveloperPayload)
+	googleService, err := h.googleService.ForPackage(req.PackageName)
+	if err != nil {
+		h.logger.Warn("未配置的Google应用包名", zap.String("package_name", req.PackageName))
+		ErrorJSON(c, 400, "不支持的应用包名", err)
+		return
+	}
+
+	err = googleService.AcknowledgeSubscription(c.Request.Context(), req.SubscriptionID, req.PurchaseToken, req.DeveloperPayload)
 	if err != nil {
 		h.logger.Error("确认Google订阅失败", zap.Error(err))
 		ErrorJSON(c, 500, "确认订阅失败", err)
@@ -270,7 +327,14 @@ func (h *GoogleHandler) ConsumePurchase(c *gin.Context) {
 		return
 	}
 
-	err := h.googleService.ConsumePurchase(c.Request.Context(), req.ProductID, req.PurchaseToken)
+	googleService, err := h.googleService.ForPackage(req.PackageName)
+	if err != nil {
+		h.logger.Warn("未配置的Google应用包名", zap.String("package_name", req.PackageName))
+		ErrorJSON(c, 400, "不支持的应用包名", err)
+		return
+	}
+
+	err = googleService.ConsumePurchase(c.Request.Context(), req.ProductID, req.PurchaseToken)
 	if err != nil {
 		h.logger.Error("消费Google购买失败", zap.Error(err))
 		ErrorJSON(c, 500, "消费购买失败", err)
@@ -302,6 +366,13 @@ func (h *GoogleHandler) CreatePurchaseOrder(c *gin.Context) {
 		return
 	}
 
+	googleService, err := h.googleService.ForPackage(req.PackageName)
+	if err != nil {
+		h.logger.Warn("未配置的Google应用包名", zap.String("package_name", req.PackageName))
+		ErrorJSON(c, 400, "不支持的应用包名", err)
+		return
+	}
+
 	// 创建内购订单
 	orderReq := &services.CreateOrderRequest{
 		UserID:           req.UserID,
@@ -314,9 +385,10 @@ func (h *GoogleHandler) CreatePurchaseOrder(c *gin.Context) {
 		TotalAmount:      req.Price * int64(req.Quantity),
 		PaymentMethod:    models.PaymentMethodGooglePlay,
 		DeveloperPayload: req.DeveloperPayload,
+		AppID:            googleService.PackageName(),
 	}
 
-	order, err := h.paymentService.CreateOrder(c.Request.Context(), orderReq)
+	order, err := h.paymentService.CreateOrder(tenantContext(c), orderReq)
 	if err != nil {
 		h.logger.Error("创建Google内购订单失败", zap.Error(err))
 		ErrorJSON(c, 500, "创建内购订单失败", err)
@@ -349,6 +421,13 @@ func (h *GoogleHandler) CreateSubscription(c *gin.Context) {
 		return
 	}
 
+	googleService, err := h.googleService.ForPackage(req.PackageName)
+	if err != nil {
+		h.logger.Warn("未配置的Google应用包名", zap.String("package_name", req.PackageName))
+		ErrorJSON(c, 400, "不支持的应用包名", err)
+		return
+	}
+
 	// 创建订阅订单
 	orderReq := &services.CreateOrderRequest{
 		UserID:           req.UserID,
@@ -361,9 +440,10 @@ func (h *GoogleHandler) CreateSubscription(c *gin.Context) {
 		TotalAmount:      req.Price,
 		PaymentMethod:    models.PaymentMethodGooglePlay,
 		DeveloperPayload: req.DeveloperPayload,
+		AppID:            googleService.PackageName(),
 	}
 
-	order, err := h.paymentService.CreateOrder(c.Request.Context(), orderReq)
+	order, err := h.paymentService.CreateOrder(tenantContext(c), orderReq)
 	if err != nil {
 		h.logger.Error("创建Google订阅订单失败", zap.Error(err))
 		ErrorJSON(c, 500, "创建订阅订单失败", err)
@@ -379,12 +459,13 @@ func (h *GoogleHandler) CreateSubscription(c *gin.Context) {
 
 // GetSubscriptionStatus 获取Google订阅状态
 // @Summary 获取Google订阅状态
-// @Description 获取Google Play订阅的当前状态
+// @Description 获取Google Play订阅的当前状态，包含升降级/重新订阅链路（lineage）
 // @Tags Google Play
 // @Accept json
 // @Produce json
 // @Param subscription_id query string true "订阅ID"
 // @Param purchase_token query string true "购买令牌"
+// @Param package_name query string false "应用包名，为空时使用默认应用"
 // @Success 200 {object} Response{data=services.SubscriptionResponse}
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
@@ -398,13 +479,28 @@ func (h *GoogleHandler) GetSubscriptionStatus(c *gin.Context) {
 		return
 	}
 
-	subscription, err := h.googleService.VerifySubscription(c.Request.Context(), subscriptionID, purchaseToken)
+	googleService, err := h.googleService.ForPackage(c.Query("package_name"))
+	if err != nil {
+		ErrorJSON(c, 400, "不支持的应用包名", err)
+		return
+	}
+
+	subscription, err := googleService.VerifySubscription(c.Request.Context(), subscriptionID, purchaseToken)
 	if err != nil {
 		h.logger.Error("获取Google订阅状态失败", zap.Error(err))
 		ErrorJSON(c, 500, "获取订阅状态失败", err)
 		return
 	}
 
+	// 升降级/重新订阅链路
+	lineage, err := googleService.GetSubscriptionLineage(c.Request.Context(), purchaseToken, subscription.LinkedPurchaseToken)
+	if err != nil {
+		h.logger.Error("获取Google订阅链路失败", zap.Error(err))
+		ErrorJSON(c, 500, "获取订阅链路失败", err)
+		return
+	}
+	subscription.Lineage = lineage
+
 	SuccessJSON(c, subscription)
 }
 
@@ -430,7 +526,7 @@ func (h *GoogleHandler) GetUserSubscriptions(c *gin.Context) {
 		return
 	}
 
-	orders, _, err := h.paymentService.GetUserOrders(c.Request.Context(), uint(userID), 1, 100)
+	orders, _, err := h.paymentService.GetUserOrders(tenantContext(c), uint(userID), 1, 100)
 	if err != nil {
 		h.logger.Error("获取用户订阅失败", zap.Error(err))
 		ErrorJSON(c, 500, "获取用户订阅失败", err)
@@ -448,6 +544,17 @@ func (h *GoogleHandler) GetUserSubscriptions(c *gin.Context) {
 	SuccessJSON(c, subscriptions)
 }
 
+// resolvePackageName 请求未指定包名时使用订单记录的应用
+func (h *GoogleHandler) resolvePackageName(ctx context.Context, packageName string, orderID uint) string {
+	if packageName != "" || orderID == 0 {
+		return packageName
+	}
+	if order, err := h.paymentService.GetOrder(ctx, orderID); err == nil {
+		return order.AppID
+	}
+	return ""
+}
+
 // ==================== 响应辅助方法 ====================
 
 func (h *GoogleHandler) successResponse(c *gin.Context, data interface{}) {
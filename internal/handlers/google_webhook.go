@@ -26,15 +26,18 @@ type GoogleWebhookHandler struct {
 	googleService  *services.GooglePlayService
 	paymentService services.PaymentService
 	config         *config.GoogleConfig
+	dispatcher     *services.WebhookDispatcher
 	logger         *zap.Logger
 }
 
 // NewGoogleWebhookHandler 创建Google Play Webhook处理器
+// 事件由 dispatcher 的工作协程异步处理，需将 ProcessWebhookEvent 注册为 dispatcher 的处理函数
 func NewGoogleWebhookHandler(
 	db *gorm.DB,
 	googleService *services.GooglePlayService,
 	paymentService services.PaymentService,
 	cfg *config.GoogleConfig,
+	dispatcher *services.WebhookDispatcher,
 	logger *zap.Logger,
 ) *GoogleWebhookHandler {
 	return &GoogleWebhookHandler{
@@ -42,6 +45,7 @@ func NewGoogleWebhookHandler(
 		googleService:  googleService,
 		paymentService: paymentService,
 		config:         cfg,
+		dispatcher:     dispatcher,
 		logger:         logger,
 	}
 }
@@ -172,10 +176,11 @@ func (h *GoogleWebhookHandler) HandleGooglePlayWebhook(c *gin.Context) {
 		return
 	}
 
-	// 2. 包名校验：确保通知来自本应用
-	expectedPkg := h.googleService.PackageName()
-	if expectedPkg != "" && webhookData.PackageName != "" && webhookData.PackageName != expectedPkg {
-		h.logger.Warn("Google Webhook 包名不匹配", zap.String("expected", expectedPkg), zap.String("received", webhookData.PackageName))
+	// 2. 包名校验：确保通知来自已配置的应用
+	if webhookData.PackageName != "" && !h.googleService.HasPackage(webhookData.PackageName) {
+		h.logger.Warn("Google Webhook 包名未配置",
+			zap.Strings("configured", h.googleService.Packages()),
+			zap.String("received", webhookData.PackageName))
 		ErrorJSON(c, 403, "包名不匹配", nil)
 		return
 	}
@@ -239,8 +244,10 @@ func (h *GoogleWebhookHandler) HandleGooglePlayWebhook(c *gin.Context) {
 		return
 	}
 
-	// 异步处理Webhook事件
-	go h.processWebhookEvent(context.Background(), webhookEvent)
+	// 交给工作协程异步处理；队列已满时事件保持 PENDING，由调度器轮询补偿
+	if !h.dispatcher.Enqueue(webhookEvent.ID) {
+		h.logger.Warn("Google Webhook处理队列已满，等待轮询处理", zap.String("event_id", webhookEvent.EventID))
+	}
 
 	h.logger.Info("Google Webhook事件接收成功",
 		zap.String("event_id", webhookEvent.EventID),
@@ -252,44 +259,34 @@ func (h *GoogleWebhookHandler) HandleGooglePlayWebhook(c *gin.Context) {
 	})
 }
 
-// processWebhookEvent 处理Webhook事件
-func (h *GoogleWebhookHandler) processWebhookEvent(ctx context.Context, event *models.WebhookEvent) {
-	defer func() {
-		if r := recover(); r != nil {
-			h.logger.Error("处理Google Webhook事件时发生panic", zap.Any("panic", r))
-			event.MarkAsFailed(fmt.Sprintf("Panic: %v", r))
-			h.db.Save(event)
-		}
-	}()
-
+// ProcessWebhookEvent 处理Webhook事件
+// 由 WebhookDispatcher 工作协程调用；失败时标记 event.MarkAsFailed，状态落库与重试由调度器负责
+func (h *GoogleWebhookHandler) ProcessWebhookEvent(ctx context.Context, event *models.WebhookEvent) {
 	h.logger.Info("开始处理Google Webhook事件",
 		zap.String("event_id", event.EventID),
-		zap.String("type", string(event.Type)))
+		zap.String("type", string(event.Type)),
+		zap.String("package_name", event.PackageName))
+
+	// 按通知包名选择对应应用的 API 客户端
+	googleService, err := h.googleService.ForPackage(event.PackageName)
+	if err != nil {
+		h.logger.Error("Google Webhook 包名未配置", zap.String("event_id", event.EventID), zap.Error(err))
+		event.MarkAsFailed(fmt.Sprintf("未配置的应用包名: %s", event.PackageName))
+		return
+	}
 
 	// 根据事件类型处理
 	switch {
 	case event.IsTestEvent():
 		h.processTestEvent(ctx, event)
 	case event.IsOneTimeProductEvent():
-		h.processOneTimeProductEvent(ctx, event)
+		h.processOneTimeProductEvent(ctx, googleService, event)
 	case event.IsSubscriptionEvent():
-		h.processSubscriptionEvent(ctx, event)
+		h.processSubscriptionEvent(ctx, googleService, event)
 	default:
 		h.logger.Warn("未知的Google Webhook事件类型", zap.String("event_id", event.EventID))
 		event.MarkAsFailed("未知的事件类型")
-		h.db.Save(event)
-		return
 	}
-
-	// 标记为已处理
-	event.MarkAsProcessed()
-	if err := h.db.Save(event).Error; err != nil {
-		h.logger.Error("更新Google Webhook事件状态失败", zap.Error(err))
-	}
-
-	h.logger.Info("Google Webhook事件处理完成",
-		zap.String("event_id", event.EventID),
-		zap.String("status", string(event.Status)))
 }
 
 // processTestEvent 处理测试事件
@@ -303,7 +300,7 @@ func (h *GoogleWebhookHandler) processTestEvent(_ context.Context, event *models
 }
 
 // processOneTimeProductEvent 处理一次性产品事件
-func (h *GoogleWebhookHandler) processOneTimeProductEvent(ctx context.Context, event *models.WebhookEvent) {
+func (h *GoogleWebhookHandler) processOneTimeProductEvent(ctx context.Context, googleService *services.GooglePlayService, event *models.WebhookEvent) {
 	notification := event.OneTimeProductNotification
 	h.logger.Info("处理Google一次性产品事件",
 		zap.String("event_id", event.EventID),
@@ -312,9 +309,9 @@ func (h *GoogleWebhookHandler) processOneTimeProductEvent(ctx context.Context, e
 
 	switch notification.NotificationType {
 	case models.OneTimeProductNotificationTypePurchased:
-		h.handleOneTimeProductPurchased(ctx, event, notification)
+		h.handleOneTimeProductPurchased(ctx, googleService, event, notification)
 	case models.OneTimeProductNotificationTypeCanceled:
-		h.handleOneTimeProductCanceled(ctx, event, notification)
+		h.handleOneTimeProductCanceled(ctx, googleService, event, notification)
 	default:
 		h.logger.Warn("未知的一次性产品通知类型",
 			zap.Int("notification_type", notification.NotificationType))
@@ -323,7 +320,7 @@ func (h *GoogleWebhookHandler) processOneTimeProductEvent(ctx context.Context, e
 }
 
 // processSubscriptionEvent 处理订阅事件
-func (h *GoogleWebhookHandler) processSubscriptionEvent(ctx context.Context, event *models.WebhookEvent) {
+func (h *GoogleWebhookHandler) processSubscriptionEvent(ctx context.Context, googleService *services.GooglePlayService, event *models.WebhookEvent) {
 	notification := event.SubscriptionNotification
 	h.logger.Info("处理Google订阅事件",
 		zap.String("event_id", event.EventID),
@@ -332,17 +329,21 @@ func (h *GoogleWebhookHandler) processSubscriptionEvent(ctx context.Context, eve
 
 	switch notification.NotificationType {
 	case models.SubscriptionNotificationTypePurchased:
-		h.handleSubscriptionPurchased(ctx, event, notification)
+		h.handleSubscriptionPurchased(ctx, googleService, event, notification)
 	case models.SubscriptionNotificationTypeRenewed:
-		h.handleSubscriptionRenewed(ctx, event, notification)
+		h.handleSubscriptionRenewed(ctx, googleService, event, notification)
 	case models.SubscriptionNotificationTypeCanceled:
-		h.handleSubscriptionCanceled(ctx, event, notification)
+		h.handleSubscriptionCanceled(ctx, googleService, event, notification)
 	case models.SubscriptionNotificationTypeExpired:
-		h.handleSubscriptionExpired(ctx, event, notification)
+		h.handleSubscriptionExpired(ctx, googleService, event, notification)
 	case models.SubscriptionNotificationTypeInGracePeriod:
-		h.handleSubscriptionInGracePeriod(ctx, event, notification)
+		h.handleSubscriptionInGracePeriod(ctx, googleService, event, notification)
+	case models.SubscriptionNotificationTypeAccountHold:
+		h.handleSubscriptionOnHold(ctx, googleService, event, notification)
+	case models.SubscriptionNotificationTypeRecovered:
+		h.handleSubscriptionRecovered(ctx, googleService, event, notification)
 	case models.SubscriptionNotificationTypeRevoked:
-		h.handleSubscriptionRevoked(ctx, event, notification)
+		h.handleSubscriptionRevoked(ctx, googleService, event, notification)
 	default:
 		h.logger.Warn("未知的订阅通知类型",
 			zap.Int("notification_type", notification.NotificationType))
@@ -352,9 +353,9 @@ func (h *GoogleWebhookHandler) processSubscriptionEvent(ctx context.Context, eve
 
 // ==================== 一次性产品事件处理 ====================
 
-func (h *GoogleWebhookHandler) handleOneTimeProductPurchased(ctx context.Context, event *models.WebhookEvent, notification *models.OneTimeProductNotification) {
+func (h *GoogleWebhookHandler) handleOneTimeProductPurchased(ctx context.Context, googleService *services.GooglePlayService, event *models.WebhookEvent, notification *models.OneTimeProductNotification) {
 	// 二次验证：调用 Google API 确认购买状态
-	purchase, err := h.googleService.VerifyPurchase(ctx, notification.SKU, notification.PurchaseToken)
+	purchase, err := googleService.VerifyPurchase(ctx, notification.SKU, notification.PurchaseToken)
 	if err != nil {
 		h.logger.Error("二次验证购买失败", zap.Error(err), zap.String("sku", notification.SKU))
 		event.MarkAsFailed("验证购买失败")
@@ -369,7 +370,7 @@ func (h *GoogleWebhookHandler) handleOneTimeProductPurchased(ctx context.Context
 
 	// Webhook 兜底：若 Verify 流程中 Acknowledge 失败，此处再次尝试，满足 3 天合规
 	if purchase.AcknowledgementState == 0 {
-		if ackErr := h.googleService.AcknowledgePurchase(ctx, notification.SKU, notification.PurchaseToken, ""); ackErr != nil {
+		if ackErr := googleService.AcknowledgePurchase(ctx, notification.SKU, notification.PurchaseToken, ""); ackErr != nil {
 			h.logger.Error("Webhook 兜底 Acknowledge 失败", zap.Error(ackErr), zap.String("sku", notification.SKU))
 			// 不阻断流程，订单状态仍更新；可依赖定时扫描进一步兜底
 		} else {
@@ -410,9 +411,9 @@ func (h *GoogleWebhookHandler) handleOneTimeProductPurchased(ctx context.Context
 		zap.String("sku", notification.SKU))
 }
 
-func (h *GoogleWebhookHandler) handleOneTimeProductCanceled(ctx context.Context, event *models.WebhookEvent, notification *models.OneTimeProductNotification) {
+func (h *GoogleWebhookHandler) handleOneTimeProductCanceled(ctx context.Context, googleService *services.GooglePlayService, event *models.WebhookEvent, notification *models.OneTimeProductNotification) {
 	// 二次验证：调用 Google API 确认购买已取消
-	purchase, err := h.googleService.VerifyPurchase(ctx, notification.SKU, notification.PurchaseToken)
+	purchase, err := googleService.VerifyPurchase(ctx, notification.SKU, notification.PurchaseToken)
 	if err != nil {
 		h.logger.Error("二次验证购买取消失败", zap.Error(err), zap.String("sku", notification.SKU))
 		event.MarkAsFailed("验证购买失败")
@@ -459,9 +460,9 @@ func (h *GoogleWebhookHandler) handleOneTimeProductCanceled(ctx context.Context,
 
 // ==================== 订阅事件处理 ====================
 
-func (h *GoogleWebhookHandler) handleSubscriptionPurchased(ctx context.Context, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
+func (h *GoogleWebhookHandler) handleSubscriptionPurchased(ctx context.Context, googleService *services.GooglePlayService, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
 	// 二次验证：调用 Google API 确认订阅状态
-	subscription, err := h.googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
+	subscription, err := googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
 	if err != nil {
 		h.logger.Error("二次验证订阅购买失败", zap.Error(err), zap.String("subscription_id", notification.SubscriptionID))
 		event.MarkAsFailed("验证订阅失败")
@@ -475,8 +476,8 @@ func (h *GoogleWebhookHandler) handleSubscriptionPurchased(ctx context.Context,
 	}
 
 	// Webhook 兜底：若 Verify 流程中 Acknowledge 失败，此处再次尝试，满足 3 天合规
-	if subscription.AcknowledgementState == 0 {
-		if ackErr := h.googleService.AcknowledgeSubscription(ctx, notification.SubscriptionID, notification.PurchaseToken, ""); ackErr != nil {
+	if !subscription.IsAcknowledged() {
+		if ackErr := googleService.AcknowledgeSubscription(ctx, notification.SubscriptionID, notification.PurchaseToken, ""); ackErr != nil {
 			h.logger.Error("Webhook 兜底 Acknowledge 订阅失败", zap.Error(ackErr), zap.String("subscription_id", notification.SubscriptionID))
 			// 不阻断流程
 		} else {
@@ -484,6 +485,15 @@ func (h *GoogleWebhookHandler) handleSubscriptionPurchased(ctx context.Context,
 		}
 	}
 
+	// 升降级/重新订阅：替代旧令牌的订单，并将权益转移到新令牌
+	if subscription.LinkedPurchaseToken != "" {
+		if _, err := googleService.ApplyLinkedPurchase(ctx, notification.PurchaseToken, subscription); err != nil {
+			h.logger.Error("处理订阅链路失败", zap.Error(err), zap.String("linked_purchase_token", subscription.LinkedPurchaseToken))
+			event.MarkAsFailed("处理订阅链路失败")
+			return
+		}
+	}
+
 	var order models.Order
 	err = h.db.Where("google_payments.purchase_token = ?", notification.PurchaseToken).
 		Joins("JOIN google_payments ON orders.id = google_payments.order_id").
@@ -507,9 +517,10 @@ func (h *GoogleWebhookHandler) handleSubscriptionPurchased(ctx context.Context,
 	}
 
 	event.ProcessedData = models.JSON{
-		"order_id": order.ID,
-		"action":   "subscription_activated",
-		"status":   "ACTIVE",
+		"order_id":              order.ID,
+		"action":                "subscription_activated",
+		"status":                "ACTIVE",
+		"linked_purchase_token": subscription.LinkedPurchaseToken,
 	}
 
 	h.logger.Info("订阅购买处理完成",
@@ -517,7 +528,7 @@ func (h *GoogleWebhookHandler) handleSubscriptionPurchased(ctx context.Context,
 		zap.String("subscription_id", notification.SubscriptionID))
 }
 
-func (h *GoogleWebhookHandler) handleSubscriptionRenewed(ctx context.Context, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
+func (h *GoogleWebhookHandler) handleSubscriptionRenewed(ctx context.Context, googleService *services.GooglePlayService, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
 	var order models.Order
 	err := h.db.Where("google_payments.purchase_token = ?", notification.PurchaseToken).
 		Joins("JOIN google_payments ON orders.id = google_payments.order_id").
@@ -535,17 +546,22 @@ func (h *GoogleWebhookHandler) handleSubscriptionRenewed(ctx context.Context, ev
 	}
 
 	// 从Google获取最新的订阅信息
-	subscription, err := h.googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
+	subscription, err := googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
 	if err != nil {
 		h.logger.Error("验证订阅失败", zap.Error(err))
 		event.MarkAsFailed("验证订阅失败")
 		return
 	}
 
+	// 续订成功后清除催缴状态
+	if err := h.updateGoogleDunningState(notification.PurchaseToken, models.DunningStateNone); err != nil {
+		h.logger.Error("清除订阅催缴状态失败", zap.Error(err))
+	}
+
 	event.ProcessedData = models.JSON{
 		"order_id":      order.ID,
 		"action":        "subscription_renewed",
-		"auto_renewing": subscription.AutoRenewing,
+		"auto_renewing": subscription.IsAutoRenewing(),
 	}
 
 	h.logger.Info("订阅续订处理完成",
@@ -553,15 +569,15 @@ func (h *GoogleWebhookHandler) handleSubscriptionRenewed(ctx context.Context, ev
 		zap.String("subscription_id", notification.SubscriptionID))
 }
 
-func (h *GoogleWebhookHandler) handleSubscriptionCanceled(ctx context.Context, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
+func (h *GoogleWebhookHandler) handleSubscriptionCanceled(ctx context.Context, googleService *services.GooglePlayService, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
 	// 二次验证：调用 Google API 确认订阅已取消
-	subscription, err := h.googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
+	subscription, err := googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
 	if err != nil {
 		h.logger.Error("二次验证订阅取消失败", zap.Error(err), zap.String("subscription_id", notification.SubscriptionID))
 		event.MarkAsFailed("验证订阅失败")
 		return
 	}
-	if subscription.CancelReason == 0 && subscription.AutoRenewing {
+	if subscription.CanceledReason == "" && subscription.IsAutoRenewing() {
 		h.logger.Warn("订阅仍处于续费状态，与取消通知不符", zap.String("subscription_id", notification.SubscriptionID))
 		event.MarkAsFailed("订阅状态异常")
 		return
@@ -583,6 +599,10 @@ func (h *GoogleWebhookHandler) handleSubscriptionCanceled(ctx context.Context, e
 		return
 	}
 
+	if h.skipSupersededSubscription(event, &order, notification) {
+		return
+	}
+
 	if err := h.paymentService.CancelOrder(ctx, order.ID, "Google Play取消订阅"); err != nil {
 		h.logger.Error("取消订阅失败", zap.Error(err))
 		event.MarkAsFailed("取消订阅失败")
@@ -600,9 +620,9 @@ func (h *GoogleWebhookHandler) handleSubscriptionCanceled(ctx context.Context, e
 		zap.String("subscription_id", notification.SubscriptionID))
 }
 
-func (h *GoogleWebhookHandler) handleSubscriptionExpired(ctx context.Context, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
+func (h *GoogleWebhookHandler) handleSubscriptionExpired(ctx context.Context, googleService *services.GooglePlayService, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
 	// 二次验证：调用 Google API 确认订阅已过期
-	subscription, err := h.googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
+	subscription, err := googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
 	if err != nil {
 		h.logger.Error("二次验证订阅过期失败", zap.Error(err), zap.String("subscription_id", notification.SubscriptionID))
 		event.MarkAsFailed("验证订阅失败")
@@ -630,6 +650,17 @@ func (h *GoogleWebhookHandler) handleSubscriptionExpired(ctx context.Context, ev
 		return
 	}
 
+	if h.skipSupersededSubscription(event, &order, notification) {
+		return
+	}
+
+	// 账户保留期间未恢复付款即过期，视为催缴重试耗尽
+	if err := h.db.Model(&models.GooglePayment{}).
+		Where("purchase_token = ? AND dunning_state = ?", notification.PurchaseToken, models.DunningStateRetrying).
+		Update("dunning_state", models.DunningStateSuspended).Error; err != nil {
+		h.logger.Error("更新订阅催缴状态失败", zap.Error(err))
+	}
+
 	event.ProcessedData = models.JSON{
 		"order_id": order.ID,
 		"action":   "subscription_expired",
@@ -641,9 +672,9 @@ func (h *GoogleWebhookHandler) handleSubscriptionExpired(ctx context.Context, ev
 		zap.String("subscription_id", notification.SubscriptionID))
 }
 
-func (h *GoogleWebhookHandler) handleSubscriptionInGracePeriod(ctx context.Context, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
+func (h *GoogleWebhookHandler) handleSubscriptionInGracePeriod(ctx context.Context, googleService *services.GooglePlayService, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
 	// 二次验证：调用 Google API 确认订阅处于宽限期
-	subscription, err := h.googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
+	subscription, err := googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
 	if err != nil {
 		h.logger.Error("二次验证订阅宽限期失败", zap.Error(err), zap.String("subscription_id", notification.SubscriptionID))
 		event.MarkAsFailed("验证订阅失败")
@@ -673,6 +704,13 @@ func (h *GoogleWebhookHandler) handleSubscriptionInGracePeriod(ctx context.Conte
 		return
 	}
 
+	// 宽限期内保留权益，仅记录催缴状态
+	if err := h.updateGoogleDunningState(notification.PurchaseToken, services.GoogleDunningState(notification.NotificationType)); err != nil {
+		h.logger.Error("更新订阅催缴状态失败", zap.Error(err))
+		event.MarkAsFailed("更新订阅催缴状态失败")
+		return
+	}
+
 	event.ProcessedData = models.JSON{
 		"order_id": order.ID,
 		"action":   "subscription_in_grace_period",
@@ -684,9 +722,9 @@ func (h *GoogleWebhookHandler) handleSubscriptionInGracePeriod(ctx context.Conte
 		zap.String("subscription_id", notification.SubscriptionID))
 }
 
-func (h *GoogleWebhookHandler) handleSubscriptionRevoked(ctx context.Context, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
+func (h *GoogleWebhookHandler) handleSubscriptionRevoked(ctx context.Context, googleService *services.GooglePlayService, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
 	// 二次验证：调用 Google API 确认订阅已撤销
-	subscription, err := h.googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
+	subscription, err := googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
 	if err != nil {
 		h.logger.Error("二次验证订阅撤销失败", zap.Error(err), zap.String("subscription_id", notification.SubscriptionID))
 		event.MarkAsFailed("验证订阅失败")
@@ -727,8 +765,147 @@ func (h *GoogleWebhookHandler) handleSubscriptionRevoked(ctx context.Context, ev
 		zap.String("subscription_id", notification.SubscriptionID))
 }
 
+func (h *GoogleWebhookHandler) handleSubscriptionOnHold(ctx context.Context, googleService *services.GooglePlayService, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
+	// 二次验证：调用 Google API 确认订阅处于账户保留状态
+	subscription, err := googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
+	if err != nil {
+		h.logger.Error("二次验证订阅账户保留失败", zap.Error(err), zap.String("subscription_id", notification.SubscriptionID))
+		event.MarkAsFailed("验证订阅失败")
+		return
+	}
+	if services.GetSubscriptionStatus(subscription, time.Now()) == models.SubscriptionStateActive {
+		h.logger.Warn("订阅仍活跃，与账户保留通知不符", zap.String("subscription_id", notification.SubscriptionID))
+		event.MarkAsFailed("订阅状态异常")
+		return
+	}
+
+	var order models.Order
+	err = h.db.Where("google_payments.purchase_token = ?", notification.PurchaseToken).
+		Joins("JOIN google_payments ON orders.id = google_payments.order_id").
+		First(&order).Error
+
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			h.logger.Warn("未找到对应的订阅订单", zap.String("purchase_token", notification.PurchaseToken))
+			event.MarkAsFailed("未找到对应的订阅订单")
+			return
+		}
+		h.logger.Error("查询订阅订单失败", zap.Error(err))
+		event.MarkAsFailed("查询订阅订单失败")
+		return
+	}
+
+	if h.skipSupersededSubscription(event, &order, notification) {
+		return
+	}
+
+	// 账户保留期间 Google 持续重试扣款，暂停权益
+	if err := h.updateGoogleDunningState(notification.PurchaseToken, services.GoogleDunningState(notification.NotificationType)); err != nil {
+		h.logger.Error("更新订阅催缴状态失败", zap.Error(err))
+		event.MarkAsFailed("更新订阅催缴状态失败")
+		return
+	}
+	if err := h.db.Model(&order).Update("payment_status", models.PaymentStatusFailed).Error; err != nil {
+		h.logger.Error("更新订单状态失败", zap.Error(err))
+		event.MarkAsFailed("更新订单状态失败")
+		return
+	}
+
+	event.ProcessedData = models.JSON{
+		"order_id": order.ID,
+		"action":   "subscription_on_hold",
+		"status":   "ON_HOLD",
+	}
+
+	h.logger.Info("订阅账户保留处理完成",
+		zap.Uint("order_id", order.ID),
+		zap.String("subscription_id", notification.SubscriptionID))
+}
+
+func (h *GoogleWebhookHandler) handleSubscriptionRecovered(ctx context.Context, googleService *services.GooglePlayService, event *models.WebhookEvent, notification *models.SubscriptionNotification) {
+	// 二次验证：调用 Google API 确认订阅已恢复
+	subscription, err := googleService.VerifySubscription(ctx, notification.SubscriptionID, notification.PurchaseToken)
+	if err != nil {
+		h.logger.Error("二次验证订阅恢复失败", zap.Error(err), zap.String("subscription_id", notification.SubscriptionID))
+		event.MarkAsFailed("验证订阅失败")
+		return
+	}
+	if services.GetSubscriptionStatus(subscription, time.Now()) == models.SubscriptionStateExpired {
+		h.logger.Warn("订阅已过期，与恢复通知不符", zap.String("subscription_id", notification.SubscriptionID))
+		event.MarkAsFailed("订阅状态异常")
+		return
+	}
+
+	var order models.Order
+	err = h.db.Where("google_payments.purchase_token = ?", notification.PurchaseToken).
+		Joins("JOIN google_payments ON orders.id = google_payments.order_id").
+		First(&order).Error
+
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			h.logger.Warn("未找到对应的订阅订单", zap.String("purchase_token", notification.PurchaseToken))
+			event.MarkAsFailed("未找到对应的订阅订单")
+			return
+		}
+		h.logger.Error("查询订阅订单失败", zap.Error(err))
+		event.MarkAsFailed("查询订阅订单失败")
+		return
+	}
+
+	if h.skipSupersededSubscription(event, &order, notification) {
+		return
+	}
+
+	// 付款恢复：清除催缴状态并恢复权益
+	if err := h.updateGoogleDunningState(notification.PurchaseToken, models.DunningStateNone); err != nil {
+		h.logger.Error("清除订阅催缴状态失败", zap.Error(err))
+		event.MarkAsFailed("更新订阅催缴状态失败")
+		return
+	}
+	if err := h.db.Model(&order).Updates(map[string]interface{}{
+		"status":         models.OrderStatusPaid,
+		"payment_status": models.PaymentStatusCompleted,
+	}).Error; err != nil {
+		h.logger.Error("更新订单状态失败", zap.Error(err))
+		event.MarkAsFailed("更新订单状态失败")
+		return
+	}
+
+	event.ProcessedData = models.JSON{
+		"order_id": order.ID,
+		"action":   "subscription_recovered",
+		"status":   "ACTIVE",
+	}
+
+	h.logger.Info("订阅恢复处理完成",
+		zap.Uint("order_id", order.ID),
+		zap.String("subscription_id", notification.SubscriptionID))
+}
+
 // ==================== 辅助函数 ====================
 
+// skipSupersededSubscription 旧令牌已被升降级/重新订阅替代时，其后续状态通知不再影响订单
+func (h *GoogleWebhookHandler) skipSupersededSubscription(event *models.WebhookEvent, order *models.Order, notification *models.SubscriptionNotification) bool {
+	if order.Status != models.OrderStatusSuperseded {
+		return false
+	}
+	event.ProcessedData = models.JSON{
+		"order_id": order.ID,
+		"action":   "superseded_ignored",
+	}
+	h.logger.Info("订阅已被替代，忽略旧令牌通知",
+		zap.Uint("order_id", order.ID),
+		zap.Int("notification_type", notification.NotificationType))
+	return true
+}
+
+// updateGoogleDunningState 更新 Google 订阅的催缴状态
+func (h *GoogleWebhookHandler) updateGoogleDunningState(purchaseToken string, state models.DunningState) error {
+	return h.db.Model(&models.GooglePayment{}).
+		Where("purchase_token = ?", purchaseToken).
+		Update("dunning_state", state).Error
+}
+
 func (h *GoogleWebhookHandler) determineWebhookType(data *GoogleWebhookData) models.WebhookType {
 	if data.TestNotification != nil {
 		return models.WebhookTypeTest
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"pay-gateway/internal/models"
+	"pay-gateway/internal/services"
+)
+
+// StoreReconciliationHandler 应用商店对账处理器（App Store Connect 报告 / Google Play 收入报告）
+type StoreReconciliationHandler struct {
+	service *services.StoreReconciliationService
+	logger  *zap.Logger
+}
+
+// NewStoreReconciliationHandler 创建应用商店对账处理器
+func NewStoreReconciliationHandler(service *services.StoreReconciliationService, logger *zap.Logger) *StoreReconciliationHandler {
+	return &StoreReconciliationHandler{
+		service: service,
+		logger:  logger,
+	}
+}
+
+// ImportStoreReportRequest 导入报告请求
+type ImportStoreReportRequest struct {
+	File string `json:"file"` // 报告目录下的文件名，为空时导入全部未成功对账的文件
+}
+
+// ImportAppleReports 导入 App Store Connect 报告并对账
+// @Summary 导入 App Store Connect 报告并对账
+// @Description 从 apple.report_dir 读取销售/财务报告（gzip TSV），与本地 Apple 支付记录比对；file 为空时导入全部未成功对账的文件
+// @Tags Apple对账
+// @Accept json
+// @Produce json
+// @Param request body ImportStoreReportRequest false "报告文件"
+// @Success 200 {object} Response{data=[]models.StoreReconciliationReport}
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /api/v1/apple/reconciliation/import [post]
+func (h *StoreReconciliationHandler) ImportAppleReports(c *gin.Context) {
+	h.importReports(c, models.StoreApple)
+}
+
+// ListAppleReports 列出 App Store Connect 对账报告
+// @Summary 列出 App Store Connect 对账报告
+// @Tags Apple对账
+// @Produce json
+// @Param limit query int false "返回条数，默认20"
+// @Success 200 {object} Response{data=[]models.StoreReconciliationReport}
+// @Router /api/v1/apple/reconciliation/reports [get]
+func (h *StoreReconciliationHandler) ListAppleReports(c *gin.Context) {
+	h.listReports(c, models.StoreApple)
+}
+
+// GetAppleReport 获取 App Store Connect 对账报告详情
+// @Summary 获取 App Store Connect 对账报告详情
+// @Description 获取对账报告及差异明细
+// @Tags Apple对账
+// @Produce json
+// @Param id path int true "报告ID"
+// @Success 200 {object} Response{data=object}
+// @Failure 404 {object} ErrorResponse
+// @Router /api/v1/apple/reconciliation/reports/{id} [get]
+func (h *StoreReconciliationHandler) GetAppleReport(c *gin.Context) {
+	h.getReport(c, models.StoreApple)
+}
+
+// ImportGoogleReports 导入 Google Play 收入报告并对账
+// @Summary 导入 Google Play 收入报告并对账
+// @Description 从 google.earnings_report_dir 读取收入报告（CSV/ZIP），与本地 Google 支付记录比对；file 为空时导入全部未成功对账的文件
+// @Tags Google Play对账
+// @Accept json
+// @Produce json
+// @Param request body ImportStoreReportRequest false "报告文件"
+// @Success 200 {object} Response{data=[]models.StoreReconciliationReport}
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Router /api/v1/google/reconciliation/import [post]
+func (h *StoreReconciliationHandler) ImportGoogleReports(c *gin.Context) {
+	h.importReports(c, models.StoreGoogle)
+}
+
+// ListGoogleReports 列出 Google Play 对账报告
+// @Summary 列出 Google Play 对账报告
+// @Tags Google Play对账
+// @Produce json
+// @Param limit query int false "返回条数，默认20"
+// @Success 200 {object} Response{data=[]models.StoreReconciliationReport}
+// @Router /api/v1/google/reconciliation/reports [get]
+func (h *StoreReconciliationHandler) ListGoogleReports(c *gin.Context) {
+	h.listReports(c, models.StoreGoogle)
+}
+
+// GetGoogleReport 获取 Google Play 对账报告详情
+// @Summary 获取 Google Play 对账报告详情
+// @Description 获取对账报告及差异明细
+// @Tags Google Play对账
+// @Produce json
+// @Param id path int true "报告ID"
+// @Success 200 {object} Response{data=object}
+// @Failure 404 {object} ErrorResponse
+// @Router /api/v1/google/reconciliation/reports/{id} [get]
+func (h *StoreReconciliationHandler) GetGoogleReport(c *gin.Context) {
+	h.getReport(c, models.StoreGoogle)
+}
+
+// importReports 导入指定文件或全部待导入文件；部分文件失败时仍返回已生成的报告（失败报告 status=failed）
+func (h *StoreReconciliationHandler) importReports(c *gin.Context, store string) {
+	var req ImportStoreReportRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			ErrorJSON(c, 400, "请求参数错误", err)
+			return
+		}
+	}
+
+	var reports []*models.StoreReconciliationReport
+	var err error
+	if req.File != "" {
+		var report *models.StoreReconciliationReport
+		report, err = h.service.ImportReport(c.Request.Context(), store, req.File)
+		if report != nil {
+			reports = append(reports, report)
+		}
+	} else {
+		reports, err = h.service.ImportPendingReports(c.Request.Context(), store)
+	}
+
+	if errors.Is(err, services.ErrStoreReportDirNotConfigured) {
+		ErrorJSON(c, 400, "未配置报告目录", err)
+		return
+	}
+	if errors.Is(err, services.ErrReconciliationInProgress) && len(reports) == 0 {
+		ErrorJSON(c, 409, "报告正在导入", err)
+		return
+	}
+	if err != nil {
+		h.logger.Error("导入对账报告失败", zap.Error(err), zap.String("store", store), zap.String("file", req.File))
+		if len(reports) == 0 {
+			ErrorJSON(c, 500, "导入对账报告失败", err)
+			return
+		}
+	}
+	SuccessJSON(c, reports)
+}
+
+func (h *StoreReconciliationHandler) listReports(c *gin.Context, store string) {
+	limit := 20
+	if l := c.Query("limit"); l != "" {
+		if n, err := parseInt(l); err == nil && n > 0 {
+			limit = n
+		}
+	}
+	reports, err := h.service.ListReports(c.Request.Context(), store, limit)
+	if err != nil {
+		h.logger.Error("列出对账报告失败", zap.Error(err), zap.String("store", store))
+		ErrorJSON(c, 500, "列出对账报告失败", err)
+		return
+	}
+	SuccessJSON(c, reports)
+}
+
+func (h *StoreReconciliationHandler) getReport(c *gin.Context, store string) {
+	var idParam struct {
+		ID uint `uri:"id" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&idParam); err != nil {
+		ErrorJSON(c, 400, "无效的报告ID", err)
+		return
+	}
+	report, details, err := h.service.GetReport(c.Request.Context(), store, idParam.ID)
+	if err != nil {
+		ErrorJSON(c, 404, "对账报告不存在", err)
+		return
+	}
+	SuccessJSON(c, gin.H{
+		"report":  report,
+		"details": details,
+	})
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -9,20 +10,46 @@ import (
 	"pay-gateway/internal/services"
 )
 
-// WechatHandler 微信支付处理器
+// WechatHandler 微信支付处理器，按请求租户选择对应的微信商户号
 type WechatHandler struct {
-	wechatService *services.WechatService
-	logger        *zap.Logger
+	wechatServices         *services.TenantRegistry[*services.WechatService]
+	reconciliationServices *services.TenantRegistry[*services.WechatReconciliationService]
+	logger                 *zap.Logger
 }
 
 // NewWechatHandler 创建微信支付处理器
-func NewWechatHandler(wechatService *services.WechatService, logger *zap.Logger) *WechatHandler {
+func NewWechatHandler(wechatServices *services.TenantRegistry[*services.WechatService], reconciliationServices *services.TenantRegistry[*services.WechatReconciliationService], logger *zap.Logger) *WechatHandler {
 	return &WechatHandler{
-		wechatService: wechatService,
-		logger:        logger,
+		wechatServices:         wechatServices,
+		reconciliationServices: reconciliationServices,
+		logger:                 logger,
 	}
 }
 
+// tenantWechatService 获取请求租户的微信支付服务，租户不存在或未开通微信支付时返回 400
+func (h *WechatHandler) tenantWechatService(c *gin.Context) (*services.WechatService, bool) {
+	tenantID := requestTenantID(c)
+	wechatService, err := h.wechatServices.Get(tenantID)
+	if err != nil {
+		h.logger.Warn("租户未开通微信支付", zap.String("tenant_id", tenantID))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "租户不存在或未开通微信支付: " + tenantID})
+		return nil, false
+	}
+	return wechatService, true
+}
+
+// tenantReconciliationService 获取请求租户的微信支付对账服务，租户不存在或未开通微信支付时返回 400
+func (h *WechatHandler) tenantReconciliationService(c *gin.Context) (*services.WechatReconciliationService, bool) {
+	tenantID := requestTenantID(c)
+	reconciliationService, err := h.reconciliationServices.Get(tenantID)
+	if err != nil {
+		h.logger.Warn("租户未开通微信支付对账", zap.String("tenant_id", tenantID))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "租户不存在或未开通微信支付: " + tenantID})
+		return nil, false
+	}
+	return reconciliationService, true
+}
+
 // CreateOrder 创建微信支付订单
 // @Summary 创建微信支付订单
 // @Description 创建微信支付订单，支持JSAPI、NATIVE、APP、MWEB等支付方式
@@ -30,10 +57,16 @@ func NewWechatHandler(wechatService *services.WechatService, logger *zap.Logger)
 // @Accept json
 // @Produce json
 // @Param request body services.CreateWechatOrderRequest true "订单信息"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} services.CreateWechatOrderResponse
 // @Failure 400 {object} ErrorResponse
 // @Router /api/v1/wechat/orders [post]
 func (h *WechatHandler) CreateOrder(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
 	var req services.CreateWechatOrderRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		h.logger.Error("参数验证失败", zap.Error(err))
@@ -41,7 +74,7 @@ func (h *WechatHandler) CreateOrder(c *gin.Context) {
 		return
 	}
 
-	resp, err := h.wechatService.CreateOrder(c.Request.Context(), &req)
+	resp, err := wechatService.CreateOrder(c.Request.Context(), &req)
 	if err != nil {
 		h.logger.Error("创建微信订单失败", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建订单失败: " + err.Error()})
@@ -62,10 +95,16 @@ func (h *WechatHandler) CreateOrder(c *gin.Context) {
 // @Produce json
 // @Param order_no path string true "订单号"
 // @Param request body JSAPIPaymentRequest true "支付信息"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} services.JSAPIPaymentResponse
 // @Failure 400 {object} ErrorResponse
 // @Router /api/v1/wechat/payments/jsapi/{order_no} [post]
 func (h *WechatHandler) CreateJSAPIPayment(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
 	orderNo := c.Param("order_no")
 	if orderNo == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "订单号不能为空"})
@@ -81,7 +120,7 @@ func (h *WechatHandler) CreateJSAPIPayment(c *gin.Context) {
 		return
 	}
 
-	resp, err := h.wechatService.CreateJSAPIPayment(c.Request.Context(), orderNo, req.OpenID)
+	resp, err := wechatService.CreateJSAPIPayment(c.Request.Context(), orderNo, req.OpenID)
 	if err != nil {
 		h.logger.Error("创建JSAPI支付失败", zap.Error(err), zap.String("order_no", orderNo))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建支付失败: " + err.Error()})
@@ -94,6 +133,87 @@ func (h *WechatHandler) CreateJSAPIPayment(c *gin.Context) {
 	})
 }
 
+// CreateMiniProgramPayment 创建小程序支付
+// @Summary 创建小程序支付
+// @Description 使用配置的小程序应用ID（app_ids.miniprogram）创建JSAPI支付，返回 wx.requestPayment 所需参数
+// @Tags 微信支付
+// @Accept json
+// @Produce json
+// @Param order_no path string true "订单号"
+// @Param request body JSAPIPaymentRequest true "支付信息（小程序 openid）"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} services.JSAPIPaymentResponse
+// @Failure 400 {object} ErrorResponse
+// @Router /api/v1/wechat/payments/miniprogram/{order_no} [post]
+func (h *WechatHandler) CreateMiniProgramPayment(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
+	orderNo := c.Param("order_no")
+	if orderNo == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "订单号不能为空"})
+		return
+	}
+
+	var req JSAPIPaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.logger.Error("参数验证失败", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数验证失败: " + err.Error()})
+		return
+	}
+
+	resp, err := wechatService.CreateMiniProgramPayment(c.Request.Context(), orderNo, req.OpenID)
+	if err != nil {
+		h.logger.Error("创建小程序支付失败", zap.Error(err), zap.String("order_no", orderNo))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建支付失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    resp,
+	})
+}
+
+// CreateCombineOrder 创建合单支付
+// @Summary 创建微信合单支付
+// @Description 一次支付覆盖多个子单，每个子单生成独立订单，支持JSAPI、NATIVE、APP、MWEB
+// @Tags 微信支付
+// @Accept json
+// @Produce json
+// @Param request body services.CreateWechatCombineOrderRequest true "合单信息"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} services.CreateWechatCombineOrderResponse
+// @Failure 400 {object} ErrorResponse
+// @Router /api/v1/wechat/combine-orders [post]
+func (h *WechatHandler) CreateCombineOrder(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
+	var req services.CreateWechatCombineOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.logger.Error("参数验证失败", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数验证失败: " + err.Error()})
+		return
+	}
+
+	resp, err := wechatService.CreateCombineOrder(c.Request.Context(), &req)
+	if err != nil {
+		h.logger.Error("创建合单支付失败", zap.Error(err), zap.Uint("user_id", req.UserID))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建合单支付失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    resp,
+	})
+}
+
 // CreateNativePayment 创建Native支付
 // @Summary 创建Native支付（扫码支付）
 // @Description 创建Native支付，返回二维码链接
@@ -101,17 +221,23 @@ func (h *WechatHandler) CreateJSAPIPayment(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param order_no path string true "订单号"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} services.NativePaymentResponse
 // @Failure 400 {object} ErrorResponse
 // @Router /api/v1/wechat/payments/native/{order_no} [post]
 func (h *WechatHandler) CreateNativePayment(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
 	orderNo := c.Param("order_no")
 	if orderNo == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "订单号不能为空"})
 		return
 	}
 
-	resp, err := h.wechatService.CreateNativePayment(c.Request.Context(), orderNo)
+	resp, err := wechatService.CreateNativePayment(c.Request.Context(), orderNo)
 	if err != nil {
 		h.logger.Error("创建Native支付失败", zap.Error(err), zap.String("order_no", orderNo))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建支付失败: " + err.Error()})
@@ -131,17 +257,23 @@ func (h *WechatHandler) CreateNativePayment(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param order_no path string true "订单号"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} services.APPPaymentResponse
 // @Failure 400 {object} ErrorResponse
 // @Router /api/v1/wechat/payments/app/{order_no} [post]
 func (h *WechatHandler) CreateAPPPayment(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
 	orderNo := c.Param("order_no")
 	if orderNo == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "订单号不能为空"})
 		return
 	}
 
-	resp, err := h.wechatService.CreateAPPPayment(c.Request.Context(), orderNo)
+	resp, err := wechatService.CreateAPPPayment(c.Request.Context(), orderNo)
 	if err != nil {
 		h.logger.Error("创建APP支付失败", zap.Error(err), zap.String("order_no", orderNo))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建支付失败: " + err.Error()})
@@ -162,10 +294,16 @@ func (h *WechatHandler) CreateAPPPayment(c *gin.Context) {
 // @Produce json
 // @Param order_no path string true "订单号"
 // @Param request body H5PaymentRequest true "H5支付场景信息"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} services.H5PaymentResponse
 // @Failure 400 {object} ErrorResponse
 // @Router /api/v1/wechat/payments/h5/{order_no} [post]
 func (h *WechatHandler) CreateH5Payment(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
 	orderNo := c.Param("order_no")
 	if orderNo == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "订单号不能为空"})
@@ -180,7 +318,7 @@ func (h *WechatHandler) CreateH5Payment(c *gin.Context) {
 		req.SceneInfo = nil
 	}
 
-	resp, err := h.wechatService.CreateH5Payment(c.Request.Context(), orderNo, req.SceneInfo)
+	resp, err := wechatService.CreateH5Payment(c.Request.Context(), orderNo, req.SceneInfo)
 	if err != nil {
 		h.logger.Error("创建H5支付失败", zap.Error(err), zap.String("order_no", orderNo))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建支付失败: " + err.Error()})
@@ -200,17 +338,23 @@ func (h *WechatHandler) CreateH5Payment(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param order_no path string true "订单号"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} services.QueryWechatOrderResponse
 // @Failure 400 {object} ErrorResponse
 // @Router /api/v1/wechat/orders/{order_no} [get]
 func (h *WechatHandler) QueryOrder(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
 	orderNo := c.Param("order_no")
 	if orderNo == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "订单号不能为空"})
 		return
 	}
 
-	resp, err := h.wechatService.QueryOrder(c.Request.Context(), orderNo)
+	resp, err := wechatService.QueryOrder(c.Request.Context(), orderNo)
 	if err != nil {
 		h.logger.Error("查询订单失败", zap.Error(err), zap.String("order_no", orderNo))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询订单失败: " + err.Error()})
@@ -230,10 +374,16 @@ func (h *WechatHandler) QueryOrder(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param request body services.WechatRefundRequest true "退款信息"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} services.WechatRefundResponse
 // @Failure 400 {object} ErrorResponse
 // @Router /api/v1/wechat/refunds [post]
 func (h *WechatHandler) Refund(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
 	var req services.WechatRefundRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		h.logger.Error("参数验证失败", zap.Error(err))
@@ -241,7 +391,7 @@ func (h *WechatHandler) Refund(c *gin.Context) {
 		return
 	}
 
-	resp, err := h.wechatService.Refund(c.Request.Context(), &req)
+	resp, err := wechatService.Refund(c.Request.Context(), &req)
 	if err != nil {
 		h.logger.Error("退款失败", zap.Error(err), zap.String("order_no", req.OrderNo))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "退款失败: " + err.Error()})
@@ -261,17 +411,23 @@ func (h *WechatHandler) Refund(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param order_no path string true "订单号"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
 // @Success 200 {object} SuccessResponse
 // @Failure 400 {object} ErrorResponse
 // @Router /api/v1/wechat/orders/{order_no}/close [post]
 func (h *WechatHandler) CloseOrder(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
 	orderNo := c.Param("order_no")
 	if orderNo == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "订单号不能为空"})
 		return
 	}
 
-	err := h.wechatService.CloseOrder(c.Request.Context(), orderNo)
+	err := wechatService.CloseOrder(c.Request.Context(), orderNo)
 	if err != nil {
 		h.logger.Error("关闭订单失败", zap.Error(err), zap.String("order_no", orderNo))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "关闭订单失败: " + err.Error()})
@@ -284,6 +440,284 @@ func (h *WechatHandler) CloseOrder(c *gin.Context) {
 	})
 }
 
+// CreatePapayContract 发起委托代扣签约
+// @Summary 发起微信委托代扣签约
+// @Description 预签约并返回拉起签约页所需参数，签约结果通过签约通知回调
+// @Tags 微信支付
+// @Accept json
+// @Produce json
+// @Param request body services.CreateWechatPapayContractRequest true "签约信息"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} services.CreateWechatPapayContractResponse
+// @Failure 400 {object} ErrorResponse
+// @Router /api/v1/wechat/papay/contracts [post]
+func (h *WechatHandler) CreatePapayContract(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
+	var req services.CreateWechatPapayContractRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.logger.Error("参数验证失败", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数验证失败: " + err.Error()})
+		return
+	}
+
+	resp, err := wechatService.CreatePapayContract(c.Request.Context(), &req)
+	if err != nil {
+		h.logger.Error("发起委托代扣签约失败", zap.Error(err), zap.Uint("user_id", req.UserID))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "发起签约失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    resp,
+	})
+}
+
+// QueryPapayContract 查询委托代扣签约状态
+// @Summary 查询微信委托代扣签约状态
+// @Description 查询委托代扣协议状态，并以微信侧结果同步本地记录
+// @Tags 微信支付
+// @Accept json
+// @Produce json
+// @Param out_contract_code path string true "商户签约协议号"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} services.QueryWechatPapayContractResponse
+// @Failure 400 {object} ErrorResponse
+// @Router /api/v1/wechat/papay/contracts/{out_contract_code} [get]
+func (h *WechatHandler) QueryPapayContract(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
+	outContractCode := c.Param("out_contract_code")
+	if outContractCode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "签约协议号不能为空"})
+		return
+	}
+
+	resp, err := wechatService.QueryPapayContract(c.Request.Context(), outContractCode)
+	if err != nil {
+		h.logger.Error("查询委托代扣签约失败", zap.Error(err), zap.String("out_contract_code", outContractCode))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询签约失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    resp,
+	})
+}
+
+// TerminatePapayContract 解约委托代扣协议
+// @Summary 解约微信委托代扣协议
+// @Description 商户主动解约委托代扣协议
+// @Tags 微信支付
+// @Accept json
+// @Produce json
+// @Param out_contract_code path string true "商户签约协议号"
+// @Param request body services.TerminateWechatPapayContractRequest true "解约信息"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} SuccessResponse
+// @Failure 400 {object} ErrorResponse
+// @Router /api/v1/wechat/papay/contracts/{out_contract_code}/terminate [post]
+func (h *WechatHandler) TerminatePapayContract(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
+	outContractCode := c.Param("out_contract_code")
+	if outContractCode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "签约协议号不能为空"})
+		return
+	}
+
+	var req services.TerminateWechatPapayContractRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.logger.Error("参数验证失败", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数验证失败: " + err.Error()})
+		return
+	}
+	req.OutContractCode = outContractCode
+
+	if err := wechatService.TerminatePapayContract(c.Request.Context(), &req); err != nil {
+		h.logger.Error("解约委托代扣协议失败", zap.Error(err), zap.String("out_contract_code", outContractCode))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "解约失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "解约成功",
+	})
+}
+
+// ExecutePapayDeduct 委托代扣扣款
+// @Summary 微信委托代扣扣款
+// @Description 基于已签约协议申请扣款，扣款结果以支付通知为准
+// @Tags 微信支付
+// @Accept json
+// @Produce json
+// @Param request body services.ExecuteWechatPapayDeductRequest true "扣款信息"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} services.ExecuteWechatPapayDeductResponse
+// @Failure 400 {object} ErrorResponse
+// @Router /api/v1/wechat/papay/deductions [post]
+func (h *WechatHandler) ExecutePapayDeduct(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
+	var req services.ExecuteWechatPapayDeductRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.logger.Error("参数验证失败", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数验证失败: " + err.Error()})
+		return
+	}
+
+	resp, err := wechatService.ExecutePapayDeduct(c.Request.Context(), &req)
+	if err != nil {
+		h.logger.Error("委托代扣扣款失败", zap.Error(err), zap.String("contract_id", req.ContractID))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "扣款失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    resp,
+	})
+}
+
+// ==================== 对账 API ====================
+
+// RunReconciliation 执行微信支付对账
+// @Summary 执行微信支付对账
+// @Description 申请并下载指定日期的交易账单或资金账单，校验摘要后与本地支付、退款记录比对
+// @Tags 微信支付对账
+// @Produce json
+// @Param bill_date query string true "对账日期 yyyy-MM-dd"
+// @Param bill_type query string false "账单类型 tradebill-交易账单 fundflowbill-资金账单，默认 tradebill"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} models.WechatReconciliationReport
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/wechat/reconciliation/run [post]
+func (h *WechatHandler) RunReconciliation(c *gin.Context) {
+	reconciliationService, ok := h.tenantReconciliationService(c)
+	if !ok {
+		return
+	}
+
+	billDate := c.Query("bill_date")
+	if billDate == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少 bill_date 参数（格式：yyyy-MM-dd）"})
+		return
+	}
+	billType := c.DefaultQuery("bill_type", services.WechatBillTypeTrade)
+	if billType != services.WechatBillTypeTrade && billType != services.WechatBillTypeFundFlow {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bill_type 仅支持 tradebill 或 fundflowbill"})
+		return
+	}
+
+	report, err := reconciliationService.RunReconciliation(c.Request.Context(), billDate, billType)
+	if errors.Is(err, services.ErrReconciliationInProgress) {
+		c.JSON(http.StatusConflict, gin.H{"error": "该账单正在对账，请稍后重试"})
+		return
+	}
+	if err != nil {
+		h.logger.Error("执行微信支付对账失败", zap.Error(err), zap.String("bill_date", billDate), zap.String("bill_type", billType))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "执行对账失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    report,
+	})
+}
+
+// GetReconciliationReport 获取微信支付对账报告详情
+// @Summary 获取微信支付对账报告详情
+// @Description 获取对账报告及差异明细
+// @Tags 微信支付对账
+// @Produce json
+// @Param id path int true "报告ID"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} SuccessResponse
+// @Failure 404 {object} ErrorResponse
+// @Router /api/v1/wechat/reconciliation/reports/{id} [get]
+func (h *WechatHandler) GetReconciliationReport(c *gin.Context) {
+	reconciliationService, ok := h.tenantReconciliationService(c)
+	if !ok {
+		return
+	}
+
+	var idParam struct {
+		ID uint `uri:"id" binding:"required"`
+	}
+	if err := c.ShouldBindUri(&idParam); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的报告ID"})
+		return
+	}
+
+	report, details, err := reconciliationService.GetReconciliationReport(c.Request.Context(), idParam.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "对账报告不存在"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"report":  report,
+			"details": details,
+		},
+	})
+}
+
+// ListReconciliationReports 列出微信支付对账报告
+// @Summary 列出微信支付对账报告
+// @Description 按日期或最近记录列出对账报告
+// @Tags 微信支付对账
+// @Produce json
+// @Param bill_date query string false "对账日期 yyyy-MM-dd"
+// @Param limit query int false "返回条数，默认20"
+// @Param X-Tenant-ID header string false "租户ID，默认 default"
+// @Success 200 {object} []models.WechatReconciliationReport
+// @Router /api/v1/wechat/reconciliation/reports [get]
+func (h *WechatHandler) ListReconciliationReports(c *gin.Context) {
+	reconciliationService, ok := h.tenantReconciliationService(c)
+	if !ok {
+		return
+	}
+
+	limit := 20
+	if l := c.Query("limit"); l != "" {
+		if n, err := parseInt(l); err == nil && n > 0 {
+			limit = n
+		}
+	}
+
+	reports, err := reconciliationService.ListReconciliationReports(c.Request.Context(), c.Query("bill_date"), limit)
+	if err != nil {
+		h.logger.Error("列出微信支付对账报告失败", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "列出对账报告失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    reports,
+	})
+}
+
 // 请求结构体定义
 
 type JSAPIPaymentRequest struct {
@@ -293,4 +727,3 @@ type JSAPIPaymentRequest struct {
 type H5PaymentRequest struct {
 	SceneInfo map[string]interface{} `json:"scene_info"`
 }
-
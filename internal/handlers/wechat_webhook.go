@@ -11,22 +11,38 @@ import (
 )
 
 // WechatWebhookHandler 微信支付Webhook处理器
+// 多租户回调地址 /webhook/wechat/:tenant/... 按租户选择验签公钥与 APIv3 密钥，未带租户的旧地址归属默认租户
 type WechatWebhookHandler struct {
-	wechatService *services.WechatService
-	logger        *zap.Logger
+	wechatServices *services.TenantRegistry[*services.WechatService]
+	logger         *zap.Logger
 }
 
 // NewWechatWebhookHandler 创建微信支付Webhook处理器
 func NewWechatWebhookHandler(
-	wechatService *services.WechatService,
+	wechatServices *services.TenantRegistry[*services.WechatService],
 	logger *zap.Logger,
 ) *WechatWebhookHandler {
 	return &WechatWebhookHandler{
-		wechatService: wechatService,
-		logger:        logger,
+		wechatServices: wechatServices,
+		logger:         logger,
 	}
 }
 
+// tenantWechatService 获取回调地址对应租户的微信支付服务，租户未开通时返回 FAIL
+func (h *WechatWebhookHandler) tenantWechatService(c *gin.Context) (*services.WechatService, bool) {
+	tenantID := requestTenantID(c)
+	wechatService, err := h.wechatServices.Get(tenantID)
+	if err != nil {
+		h.logger.Error("微信回调租户未开通微信支付", zap.String("tenant_id", tenantID), zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    "FAIL",
+			"message": "租户不存在",
+		})
+		return nil, false
+	}
+	return wechatService, true
+}
+
 // HandleWechatNotify 处理微信支付异步通知
 // @Summary 处理微信支付异步通知
 // @Description 接收微信支付异步通知，更新订单状态
@@ -35,8 +51,15 @@ func NewWechatWebhookHandler(
 // @Produce json
 // @Success 200 {object} map[string]string
 // @Failure 400 {object} map[string]string
+// @Param tenant path string false "租户ID（多租户回调地址）"
 // @Router /webhook/wechat/notify [post]
+// @Router /webhook/wechat/{tenant}/notify [post]
 func (h *WechatWebhookHandler) HandleWechatNotify(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
 	// 必须读取原始 body，验签和解密都需要
 	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
@@ -49,15 +72,10 @@ func (h *WechatWebhookHandler) HandleWechatNotify(c *gin.Context) {
 	}
 
 	// 构建请求头 map（用于验签）
-	headers := map[string]string{
-		"Wechatpay-Timestamp": c.GetHeader("Wechatpay-Timestamp"),
-		"Wechatpay-Nonce":     c.GetHeader("Wechatpay-Nonce"),
-		"Wechatpay-Signature": c.GetHeader("Wechatpay-Signature"),
-		"Wechatpay-Serial":    c.GetHeader("Wechatpay-Serial"),
-	}
+	headers := wechatNotifyHeaders(c)
 
 	// 验签并解密
-	notifyData, err := h.wechatService.VerifyAndDecryptNotify(headers, body)
+	notifyData, err := wechatService.VerifyAndDecryptNotify(headers, body)
 	if err != nil {
 		h.logger.Error("微信通知验签或解密失败", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -72,7 +90,7 @@ func (h *WechatWebhookHandler) HandleWechatNotify(c *gin.Context) {
 		zap.Any("trade_state", notifyData["trade_state"]))
 
 	// 处理通知
-	err = h.wechatService.HandleNotify(c.Request.Context(), notifyData)
+	err = wechatService.HandleNotify(c.Request.Context(), notifyData)
 	if err != nil {
 		h.logger.Error("处理微信通知失败", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -91,6 +109,119 @@ func (h *WechatWebhookHandler) HandleWechatNotify(c *gin.Context) {
 	})
 }
 
+// HandleWechatPapayNotify 处理微信委托代扣签约/解约通知
+// @Summary 处理微信委托代扣签约/解约通知
+// @Description 接收微信委托代扣签约、解约通知，更新签约记录
+// @Tags 微信支付Webhook
+// @Accept json
+// @Produce json
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} map[string]string
+// @Param tenant path string false "租户ID（多租户回调地址）"
+// @Router /webhook/wechat/papay [post]
+// @Router /webhook/wechat/{tenant}/papay [post]
+func (h *WechatWebhookHandler) HandleWechatPapayNotify(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		h.logger.Error("读取微信签约通知请求体失败", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    "FAIL",
+			"message": "读取请求失败",
+		})
+		return
+	}
+
+	headers := wechatNotifyHeaders(c)
+
+	notifyData, err := wechatService.VerifyAndDecryptNotify(headers, body)
+	if err != nil {
+		h.logger.Error("微信签约通知验签或解密失败", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    "FAIL",
+			"message": "验签或解密失败",
+		})
+		return
+	}
+
+	h.logger.Info("收到微信委托代扣签约通知",
+		zap.Any("out_contract_code", notifyData["out_contract_code"]),
+		zap.Any("contract_state", notifyData["contract_state"]))
+
+	if err := wechatService.HandlePapayContractNotify(c.Request.Context(), notifyData); err != nil {
+		h.logger.Error("处理微信签约通知失败", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    "FAIL",
+			"message": "处理失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    "SUCCESS",
+		"message": "成功",
+	})
+}
+
+// HandleWechatCombineNotify 处理微信合单支付通知
+// @Summary 处理微信合单支付通知
+// @Description 接收微信合单支付通知，逐个更新子单订单状态
+// @Tags 微信支付Webhook
+// @Accept json
+// @Produce json
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} map[string]string
+// @Param tenant path string false "租户ID（多租户回调地址）"
+// @Router /webhook/wechat/combine-notify [post]
+// @Router /webhook/wechat/{tenant}/combine-notify [post]
+func (h *WechatWebhookHandler) HandleWechatCombineNotify(c *gin.Context) {
+	wechatService, ok := h.tenantWechatService(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		h.logger.Error("读取微信合单通知请求体失败", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    "FAIL",
+			"message": "读取请求失败",
+		})
+		return
+	}
+
+	notifyData, err := wechatService.VerifyAndDecryptNotify(wechatNotifyHeaders(c), body)
+	if err != nil {
+		h.logger.Error("微信合单通知验签或解密失败", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    "FAIL",
+			"message": "验签或解密失败",
+		})
+		return
+	}
+
+	h.logger.Info("收到微信合单支付通知",
+		zap.Any("combine_out_trade_no", notifyData["combine_out_trade_no"]))
+
+	if err := wechatService.HandleCombineNotify(c.Request.Context(), notifyData); err != nil {
+		h.logger.Error("处理微信合单通知失败", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    "FAIL",
+			"message": "处理失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    "SUCCESS",
+		"message": "成功",
+	})
+}
+
 // HandleWechatRefundNotify 处理微信退款异步通知
 // @Summary 处理微信退款异步通知
 // @Description 接收微信退款异步通知，更新退款状态
@@ -99,7 +230,9 @@ func (h *WechatWebhookHandler) HandleWechatNotify(c *gin.Context) {
 // @Produce json
 // @Success 200 {object} map[string]string
 // @Failure 400 {object} map[string]string
+// @Param tenant path string false "租户ID（多租户回调地址）"
 // @Router /webhook/wechat/refund [post]
+// @Router /webhook/wechat/{tenant}/refund [post]
 func (h *WechatWebhookHandler) HandleWechatRefundNotify(c *gin.Context) {
 	// 读取请求体
 	var notifyData map[string]interface{}
@@ -128,3 +261,12 @@ func (h *WechatWebhookHandler) HandleWechatRefundNotify(c *gin.Context) {
 	})
 }
 
+// wechatNotifyHeaders 提取微信回调验签所需请求头
+func wechatNotifyHeaders(c *gin.Context) map[string]string {
+	return map[string]string{
+		"Wechatpay-Timestamp": c.GetHeader("Wechatpay-Timestamp"),
+		"Wechatpay-Nonce":     c.GetHeader("Wechatpay-Nonce"),
+		"Wechatpay-Signature": c.GetHeader("Wechatpay-Signature"),
+		"Wechatpay-Serial":    c.GetHeader("Wechatpay-Serial"),
+	}
+}
@@ -44,10 +44,11 @@ const (
 type WebhookStatus string
 
 const (
-	WebhookStatusPending   WebhookStatus = "PENDING"
-	WebhookStatusProcessed WebhookStatus = "PROCESSED"
-	WebhookStatusFailed    WebhookStatus = "FAILED"
-	WebhookStatusSkipped   WebhookStatus = "SKIPPED"
+	WebhookStatusPending    WebhookStatus = "PENDING"
+	WebhookStatusProcessing WebhookStatus = "PROCESSING" // 已被工作协程领取
+	WebhookStatusProcessed  WebhookStatus = "PROCESSED"
+	WebhookStatusFailed     WebhookStatus = "FAILED"
+	WebhookStatusSkipped    WebhookStatus = "SKIPPED"
 )
 
 // WebhookEvent Webhook事件模型
@@ -68,9 +69,9 @@ type WebhookEvent struct {
 	RawPayload                 JSON                        `gorm:"type:jsonb" json:"raw_payload,omitempty"`    // 原始数据
 	ProcessedData              JSON                        `gorm:"type:jsonb" json:"processed_data,omitempty"` // 处理后的数据
 	Processed                  bool                        `gorm:"index;default:false" json:"processed"`
-	OneTimeProductNotification *OneTimeProductNotification `gorm:"embedded" json:"one_time_product_notification,omitempty"`
-	SubscriptionNotification   *SubscriptionNotification   `gorm:"embedded" json:"subscription_notification,omitempty"`
-	TestNotification           *TestNotification           `gorm:"embedded" json:"test_notification,omitempty"`
+	OneTimeProductNotification *OneTimeProductNotification `gorm:"embedded;embeddedPrefix:one_time_" json:"one_time_product_notification,omitempty"`
+	SubscriptionNotification   *SubscriptionNotification   `gorm:"embedded;embeddedPrefix:subscription_" json:"subscription_notification,omitempty"`
+	TestNotification           *TestNotification           `gorm:"embedded;embeddedPrefix:test_" json:"test_notification,omitempty"`
 	CreatedAt                  time.Time                   `json:"created_at"`
 	UpdatedAt                  time.Time                   `json:"updated_at"`
 }
@@ -155,6 +156,21 @@ func (w *WebhookEvent) CalculateNextRetry(strategy WebhookRetryStrategy) time.Ti
 	return time.Now().Add(delay)
 }
 
+// AfterFind 从数据库加载后按事件类型保留对应的通知
+// GORM 加载嵌入指针结构体时总会分配实例，需清除与类型不符的通知，保证 IsXxxEvent 判断正确
+func (w *WebhookEvent) AfterFind(tx *gorm.DB) error {
+	if w.Type != WebhookTypeOneTimeProduct {
+		w.OneTimeProductNotification = nil
+	}
+	if w.Type != WebhookTypeSubscription {
+		w.SubscriptionNotification = nil
+	}
+	if w.Type != WebhookTypeTest {
+		w.TestNotification = nil
+	}
+	return nil
+}
+
 // MarkAsProcessed 标记为已处理
 func (w *WebhookEvent) MarkAsProcessed() {
 	w.Status = WebhookStatusProcessed
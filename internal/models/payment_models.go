@@ -32,12 +32,13 @@ const (
 type OrderStatus string
 
 const (
-	OrderStatusCreated   OrderStatus = "CREATED"
-	OrderStatusPaid      OrderStatus = "PAID"
-	OrderStatusDelivered OrderStatus = "DELIVERED"
-	OrderStatusCancelled OrderStatus = "CANCELLED"
-	OrderStatusRefunded  OrderStatus = "REFUNDED"
-	OrderStatusExpired   OrderStatus = "EXPIRED" // 订阅过期
+	OrderStatusCreated    OrderStatus = "CREATED"
+	OrderStatusPaid       OrderStatus = "PAID"
+	OrderStatusDelivered  OrderStatus = "DELIVERED"
+	OrderStatusCancelled  OrderStatus = "CANCELLED"
+	OrderStatusRefunded   OrderStatus = "REFUNDED"
+	OrderStatusExpired    OrderStatus = "EXPIRED"    // 订阅过期
+	OrderStatusSuperseded OrderStatus = "SUPERSEDED" // 订阅已被升降级/重新订阅替代，权益转移到新订单
 )
 
 // OrderType 订单类型
@@ -58,27 +59,48 @@ const (
 	PaymentMethodWeChat     PaymentMethod = "WECHAT"
 )
 
+// DunningState 续费扣款失败后的催缴状态
+// 支付宝代扣按催缴策略流转；Apple 账单重试、Google 账户保留映射到同一组状态
+type DunningState string
+
+const (
+	DunningStateNone        DunningState = ""             // 正常扣款
+	DunningStateGracePeriod DunningState = "GRACE_PERIOD" // 宽限期：重试中，保留权益
+	DunningStateRetrying    DunningState = "RETRYING"     // 重试中：宽限期已过，暂停权益（Apple 账单重试 / Google 账户保留）
+	DunningStateSuspended   DunningState = "SUSPENDED"    // 重试耗尽：订阅终止
+)
+
+// Apple 交易所有权类型（inAppOwnershipType）
+const (
+	AppleOwnershipPurchased    = "PURCHASED"     // 用户本人购买
+	AppleOwnershipFamilyShared = "FAMILY_SHARED" // 家庭共享：家庭成员通过组织者的购买获得权益，不产生收入
+)
+
 // Order 订单主表
 type Order struct {
 	ID               uint           `gorm:"primarykey" json:"id"`
-	OrderNo          string         `gorm:"uniqueIndex;not null;size:32" json:"order_no"` // 系统订单号
-	UserID           uint           `gorm:"not null;index" json:"user_id"`                // 用户ID
-	ProductID        string         `gorm:"not null;index;size:100" json:"product_id"`    // 商品ID
-	Type             OrderType      `gorm:"not null;index" json:"type"`                   // 订单类型
-	Title            string         `gorm:"not null;size:200" json:"title"`               // 商品标题
-	Description      string         `gorm:"size:500" json:"description"`                  // 商品描述
-	Quantity         int            `gorm:"not null;default:1" json:"quantity"`           // 数量
-	Currency         string         `gorm:"not null;size:3" json:"currency"`              // 货币代码
-	TotalAmount      int64          `gorm:"not null" json:"total_amount"`                 // 总金额（微单位）
-	Status           OrderStatus    `gorm:"not null;index" json:"status"`                 // 订单状态
-	PaymentMethod    PaymentMethod  `gorm:"not null;index" json:"payment_method"`         // 支付方式
-	PaymentStatus    PaymentStatus  `gorm:"not null;index" json:"payment_status"`         // 支付状态
-	PaidAt           *time.Time     `json:"paid_at,omitempty"`                            // 支付时间
-	ExpiredAt        *time.Time     `json:"expired_at,omitempty"`                         // 过期时间
-	RefundAt         *time.Time     `json:"refund_at,omitempty"`                          // 退款时间
-	RefundReason     string         `gorm:"size:500" json:"refund_reason,omitempty"`      // 退款原因
-	RefundAmount     int64          `json:"refund_amount,omitempty"`                      // 退款金额
-	DeveloperPayload string         `gorm:"size:500" json:"developer_payload,omitempty"`  // 开发者透传数据
+	OrderNo          string         `gorm:"uniqueIndex;not null;size:32" json:"order_no"`              // 系统订单号
+	TenantID         string         `gorm:"size:64;not null;default:'default';index" json:"tenant_id"` // 租户ID
+	UserID           uint           `gorm:"not null;index" json:"user_id"`                             // 用户ID
+	ProductID        string         `gorm:"not null;index;size:100" json:"product_id"`                 // 商品ID
+	Type             OrderType      `gorm:"not null;index" json:"type"`                                // 订单类型
+	Title            string         `gorm:"not null;size:200" json:"title"`                            // 商品标题
+	Description      string         `gorm:"size:500" json:"description"`                               // 商品描述
+	Quantity         int            `gorm:"not null;default:1" json:"quantity"`                        // 数量
+	Currency         string         `gorm:"not null;size:3" json:"currency"`                           // 货币代码
+	TotalAmount      int64          `gorm:"not null" json:"total_amount"`                              // 总金额（微单位）
+	Status           OrderStatus    `gorm:"not null;index" json:"status"`                              // 订单状态
+	PaymentMethod    PaymentMethod  `gorm:"not null;index" json:"payment_method"`                      // 支付方式
+	PaymentStatus    PaymentStatus  `gorm:"not null;index" json:"payment_status"`                      // 支付状态
+	AppID            string         `gorm:"size:255;index" json:"app_id,omitempty"`                    // 应用标识（Google Play 包名 / Apple Bundle ID）
+	PaidAt           *time.Time     `json:"paid_at,omitempty"`                                         // 支付时间
+	ExpiredAt        *time.Time     `json:"expired_at,omitempty"`                                      // 过期时间
+	RefundAt         *time.Time     `json:"refund_at,omitempty"`                                       // 退款时间
+	RefundReason     string         `gorm:"size:500" json:"refund_reason,omitempty"`                   // 退款原因
+	RefundAmount     int64          `json:"refund_amount,omitempty"`                                   // 退款金额
+	DeveloperPayload string         `gorm:"size:500" json:"developer_payload,omitempty"`               // 开发者透传数据
+	AppAccountToken  string         `gorm:"size:36;index" json:"app_account_token,omitempty"`          // Apple 应用账户令牌（UUID），客户端购买时传给 StoreKit
+	IsTest           bool           `gorm:"not null;default:false;index" json:"is_test"`               // 测试订单（Apple 沙盒交易 / Google 测试购买），不计入收入报表
 	CreatedAt        time.Time      `json:"created_at"`
 	UpdatedAt        time.Time      `json:"updated_at"`
 	DeletedAt        gorm.DeletedAt `gorm:"index" json:"-"`
@@ -112,6 +134,50 @@ type GooglePayment struct {
 	PromoCode               *string    `gorm:"size:50" json:"promo_code,omitempty"`                 // 促销代码
 	CreatedAt               time.Time  `json:"created_at"`
 	UpdatedAt               time.Time  `json:"updated_at"`
+
+	// 催缴、作废与升降级
+	DunningState        DunningState `gorm:"size:20;index" json:"dunning_state,omitempty"`          // 催缴状态（宽限期/账户保留）
+	VoidedAt            *time.Time   `json:"voided_at,omitempty"`                                   // 作废时间（退款/拒付）
+	LinkedPurchaseToken string       `gorm:"size:255;index" json:"linked_purchase_token,omitempty"` // 被本次购买替代的旧购买令牌（升降级/重新订阅）
+	SupersededByToken   string       `gorm:"size:255;index" json:"superseded_by_token,omitempty"`   // 替代本次购买的新购买令牌
+	SupersededAt        *time.Time   `json:"superseded_at,omitempty"`                               // 被替代时间
+}
+
+// GooglePlay 作废购买处理结果
+const (
+	GoogleVoidedActionRefunded        = "REFUNDED"         // 退款，订单标记为已退款
+	GoogleVoidedActionRevoked         = "REVOKED"          // 欺诈/拒付，订单标记为已退款并撤销权益
+	GoogleVoidedActionPartialRefunded = "PARTIAL_REFUNDED" // 部分数量退款，按数量累计订单退款金额，全部数量退款后订单标记为已退款
+	GoogleVoidedActionRenewal         = "RENEWAL_VOIDED"   // 订阅续订订单作废，仅记录，不影响原订单
+	GoogleVoidedActionUnmatched       = "UNMATCHED"        // 未匹配到本地支付记录
+)
+
+// GoogleVoidedPurchase Google Play 作废购买记录（Voided Purchases API）
+// 同一购买令牌、Google 订单号下每次作废（作废时间）只处理一次，同一订单的多次部分数量作废分别记录
+type GoogleVoidedPurchase struct {
+	ID                 uint       `gorm:"primarykey" json:"id"`
+	PurchaseToken      string     `gorm:"not null;size:255;uniqueIndex:idx_google_voided_event" json:"purchase_token"`  // Google购买令牌
+	OrderIDGoogle      string     `gorm:"size:100;uniqueIndex:idx_google_voided_event" json:"order_id_google"`          // Google订单号（订阅续订为 GPA.xxx..N）
+	OrderID            *uint      `gorm:"index" json:"order_id,omitempty"`                                              // 匹配到的系统订单ID
+	PurchaseTimeMillis int64      `json:"purchase_time_millis"`                                                         // 购买时间（毫秒）
+	VoidedTimeMillis   int64      `gorm:"not null;index;uniqueIndex:idx_google_voided_event" json:"voided_time_millis"` // 作废时间（毫秒）
+	VoidedSource       int        `json:"voided_source"`                                                                // 发起方 0-用户 1-开发者 2-Google
+	VoidedReason       int        `json:"voided_reason"`                                                                // 作废原因 0-其他 1-反悔 2-未收到 3-有缺陷 4-误购 5-欺诈 6-友好欺诈 7-拒付 8-未确认
+	VoidedQuantity     int        `json:"voided_quantity,omitempty"`                                                    // 部分退款数量
+	Action             string     `gorm:"size:20;index" json:"action"`                                                  // 处理结果 REFUNDED/REVOKED/PARTIAL_REFUNDED/RENEWAL_VOIDED/UNMATCHED
+	ProcessedAt        *time.Time `json:"processed_at,omitempty"`                                                       // 处理时间
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+}
+
+// GoogleVoidedSyncCheckpoint 作废购买轮询检查点，按应用包名记录已处理的最大作废时间，下次从该时间回溯拉取
+type GoogleVoidedSyncCheckpoint struct {
+	ID                   uint      `gorm:"primarykey" json:"id"`
+	PackageName          string    `gorm:"not null;uniqueIndex;size:255" json:"package_name"` // Android应用包名
+	LastVoidedTimeMillis int64     `json:"last_voided_time_millis"`                           // 已处理的最大作废时间（毫秒），为 0 时从 API 最大回溯范围开始拉取
+	LastEndTime          time.Time `gorm:"not null" json:"last_end_time"`                     // 最近一次成功拉取的截止时间
+	CreatedAt            time.Time `json:"created_at"`
+	UpdatedAt            time.Time `json:"updated_at"`
 }
 
 // PaymentTransaction 支付交易记录
@@ -223,36 +289,63 @@ type AlipayRefund struct {
 }
 
 // AlipayReconciliationReport 支付宝对账任务表
+// 同一租户、账单日、账单类型每次运行生成一个新版本，成功的新版本取代之前的版本
 type AlipayReconciliationReport struct {
-	ID             uint       `gorm:"primarykey" json:"id"`
-	BillDate       string     `gorm:"not null;index;size:10" json:"bill_date"` // 对账日期 yyyy-MM-dd
-	BillType       string     `gorm:"not null;size:20" json:"bill_type"`       // trade-交易账单
-	Status         string     `gorm:"not null;size:20;index" json:"status"`    // pending/processing/completed/failed
-	DownloadURL    string     `gorm:"size:512" json:"download_url,omitempty"`  // 对账文件下载地址
-	TotalCount     int        `json:"total_count"`                             // 支付宝账单总笔数
-	MatchCount     int        `json:"match_count"`                             // 匹配笔数
-	DiffCount      int        `json:"diff_count"`                              // 差异笔数
-	LocalOnlyCount int        `json:"local_only_count"`                        // 仅本地有笔数
-	ErrorMessage   string     `gorm:"size:500" json:"error_message,omitempty"` // 失败原因
-	StartedAt      *time.Time `json:"started_at,omitempty"`
-	CompletedAt    *time.Time `json:"completed_at,omitempty"`
-	CreatedAt      time.Time  `json:"created_at"`
-	UpdatedAt      time.Time  `json:"updated_at"`
+	ID               uint       `gorm:"primarykey" json:"id"`
+	TenantID         string     `gorm:"size:64;not null;default:'default';index;uniqueIndex:idx_alipay_recon_report_version" json:"tenant_id"` // 租户ID
+	BillDate         string     `gorm:"not null;index;size:10;uniqueIndex:idx_alipay_recon_report_version" json:"bill_date"`                   // 对账日期 yyyy-MM-dd
+	BillType         string     `gorm:"not null;size:20;uniqueIndex:idx_alipay_recon_report_version" json:"bill_type"`                         // trade-交易账单 signcustomer-账务明细
+	Version          int        `gorm:"not null;default:1;uniqueIndex:idx_alipay_recon_report_version" json:"version"`                         // 运行版本，从 1 递增
+	Superseded       bool       `gorm:"not null;default:false;index" json:"superseded"`                                                        // 已被后续成功运行取代
+	PreviousReportID *uint      `json:"previous_report_id,omitempty"`                                                                          // 本次取代的上一版本报告
+	AddedDiffCount   int        `json:"added_diff_count"`                                                                                      // 相比上一版本新增的差异
+	RemovedDiffCount int        `json:"removed_diff_count"`                                                                                    // 相比上一版本消失的差异
+	Status           string     `gorm:"not null;size:20;index" json:"status"`                                                                  // pending/processing/completed/failed
+	DownloadURL      string     `gorm:"size:512" json:"download_url,omitempty"`                                                                // 对账文件下载地址
+	TotalCount       int        `json:"total_count"`                                                                                           // 支付宝账单总笔数
+	MatchCount       int        `json:"match_count"`                                                                                           // 匹配笔数
+	DiffCount        int        `json:"diff_count"`                                                                                            // 差异笔数
+	LocalOnlyCount   int        `json:"local_only_count"`                                                                                      // 仅本地有笔数
+	AutoFixedCount   int        `json:"auto_fixed_count"`                                                                                      // 自动修复笔数
+	ErrorMessage     string     `gorm:"size:500" json:"error_message,omitempty"`                                                               // 失败原因
+	StartedAt        *time.Time `json:"started_at,omitempty"`
+	CompletedAt      *time.Time `json:"completed_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
 }
 
+// 对账差异处理状态
+const (
+	ReconciliationDiffOpen      = "open"       // 待处理
+	ReconciliationDiffAutoFixed = "auto_fixed" // 已自动修复
+	ReconciliationDiffResolved  = "resolved"   // 已人工处理
+	ReconciliationDiffIgnored   = "ignored"    // 已忽略
+)
+
 // AlipayReconciliationDetail 支付宝对账明细（差异记录）
 type AlipayReconciliationDetail struct {
-	ID              uint      `gorm:"primarykey" json:"id"`
-	ReportID        uint      `gorm:"not null;index" json:"report_id"`
-	OutTradeNo      string    `gorm:"not null;index;size:64" json:"out_trade_no"` // 商户订单号
-	AlipayTradeNo   string    `gorm:"size:64" json:"alipay_trade_no,omitempty"`   // 支付宝交易号
-	DiffType        string    `gorm:"not null;size:32;index" json:"diff_type"`    // alipay_only/local_only/amount_mismatch/status_mismatch
-	AlipayAmount    string    `gorm:"size:20" json:"alipay_amount,omitempty"`     // 支付宝金额（元）
-	LocalAmount     int64     `json:"local_amount,omitempty"`                     // 本地金额（分）
-	AlipayStatus    string    `gorm:"size:32" json:"alipay_status,omitempty"`     // 支付宝业务类型/状态
-	LocalStatus     string    `gorm:"size:32" json:"local_status,omitempty"`      // 本地支付状态
-	AlipayTradeType string    `gorm:"size:32" json:"alipay_trade_type,omitempty"` // 业务类型：交易、退款等
-	CreatedAt       time.Time `json:"created_at"`
+	ID              uint       `gorm:"primarykey" json:"id"`
+	ReportID        uint       `gorm:"not null;index" json:"report_id"`
+	OutTradeNo      string     `gorm:"not null;index;size:64" json:"out_trade_no"` // 商户订单号
+	AlipayTradeNo   string     `gorm:"size:64" json:"alipay_trade_no,omitempty"`   // 支付宝交易号
+	RecordType      string     `gorm:"size:16;index" json:"record_type,omitempty"` // payment-支付 refund-退款 deduct-周期扣款
+	OutRequestNo    string     `gorm:"size:64" json:"out_request_no,omitempty"`    // 退款请求号
+	DiffType        string     `gorm:"not null;size:32;index" json:"diff_type"`    // alipay_only/local_only/amount_mismatch/status_mismatch
+	AlipayAmount    string     `gorm:"size:20" json:"alipay_amount,omitempty"`     // 支付宝金额（元）
+	LocalAmount     int64      `json:"local_amount,omitempty"`                     // 本地金额（分）
+	AlipayStatus    string     `gorm:"size:32" json:"alipay_status,omitempty"`     // 支付宝业务类型/状态
+	LocalStatus     string     `gorm:"size:32" json:"local_status,omitempty"`      // 本地支付/退款状态
+	AlipayTradeType string     `gorm:"size:32" json:"alipay_trade_type,omitempty"` // 业务类型：交易、退款等
+	BillTime        *time.Time `json:"bill_time,omitempty"`                        // 账单完成/发生时间
+
+	ResolutionStatus string     `gorm:"not null;size:16;default:'open';index" json:"resolution_status"` // 处理状态：open/auto_fixed/resolved/ignored
+	Assignee         string     `gorm:"size:100;index" json:"assignee,omitempty"`                       // 指派的财务处理人
+	Note             string     `gorm:"size:500" json:"note,omitempty"`                                 // 处理备注
+	ResolvedBy       string     `gorm:"size:100" json:"resolved_by,omitempty"`                          // 处理人，自动修复为 system
+	ResolvedAt       *time.Time `json:"resolved_at,omitempty"`                                          // 处理时间
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 // JSON 自定义JSON类型
@@ -305,6 +398,9 @@ type ApplePayment struct {
 	Status                    string     `gorm:"size:50;index" json:"status"`                            // 状态
 	CreatedAt                 time.Time  `json:"created_at"`
 	UpdatedAt                 time.Time  `json:"updated_at"`
+
+	// 催缴
+	DunningState DunningState `gorm:"size:20;index" json:"dunning_state,omitempty"` // 催缴状态（宽限期/账单重试）
 }
 
 // AppleRefund Apple退款记录
@@ -326,31 +422,230 @@ type AppleRefund struct {
 	UpdatedAt             time.Time  `json:"updated_at"`
 }
 
+// AppleConsumptionRequest Apple CONSUMPTION_REQUEST 消耗信息上报记录
+// 每条通知对应一条记录，记录发送给 Apple 的消耗数据和 App Store Server API 的响应
+type AppleConsumptionRequest struct {
+	ID                       uint       `gorm:"primarykey" json:"id"`
+	NotificationUUID         string     `gorm:"not null;uniqueIndex;size:64" json:"notification_uuid"`  // 通知UUID
+	OrderID                  uint       `gorm:"index" json:"order_id"`                                  // 订单ID（未关联时为0）
+	ApplePaymentID           uint       `gorm:"index" json:"apple_payment_id"`                          // Apple支付记录ID（未关联时为0）
+	TransactionID            string     `gorm:"not null;index;size:255" json:"transaction_id"`          // 申请退款的交易ID
+	OriginalTransactionID    string     `gorm:"not null;index;size:255" json:"original_transaction_id"` // 原始交易ID
+	BundleID                 string     `gorm:"size:100" json:"bundle_id"`                              // Bundle ID
+	CustomerConsented        bool       `json:"customer_consented"`                                     // 用户是否同意提供消耗数据
+	ConsumptionStatus        int32      `json:"consumption_status"`                                     // 消耗状态
+	DeliveryStatus           int32      `json:"delivery_status"`                                        // 交付状态
+	AccountTenure            int32      `json:"account_tenure"`                                         // 账户年龄区间
+	PlayTime                 int32      `json:"play_time"`                                              // 使用时长区间
+	LifetimeDollarsPurchased int32      `json:"lifetime_dollars_purchased"`                             // 累计消费金额区间
+	LifetimeDollarsRefunded  int32      `json:"lifetime_dollars_refunded"`                              // 累计退款金额区间
+	UserStatus               int32      `json:"user_status"`                                            // 账户状态
+	RefundPreference         int32      `json:"refund_preference"`                                      // 退款偏好
+	RawRequest               JSON       `gorm:"type:jsonb" json:"raw_request,omitempty"`                // 发送的请求体
+	ResponseStatusCode       int        `json:"response_status_code"`                                   // Apple 响应状态码
+	Status                   string     `gorm:"size:20;index" json:"status"`                            // 状态：SENT/FAILED/SKIPPED
+	ErrorMessage             string     `gorm:"type:text" json:"error_message,omitempty"`               // 错误信息
+	SentAt                   *time.Time `json:"sent_at,omitempty"`                                      // 发送成功时间
+	CreatedAt                time.Time  `json:"created_at"`
+	UpdatedAt                time.Time  `json:"updated_at"`
+}
+
+// Apple 待关联交易状态
+const (
+	AppleOrphanStatusPending = "PENDING" // 待人工关联
+	AppleOrphanStatusLinked  = "LINKED"  // 已关联订单
+	AppleOrphanStatusIgnored = "IGNORED" // 已忽略
+)
+
+// AppleOrphanTransaction 无法通过 appAccountToken 关联到订单的 Apple 交易
+// 交易缺少令牌或令牌与订单不匹配时进入队列，由人工核对后关联订单
+type AppleOrphanTransaction struct {
+	ID                    uint       `gorm:"primarykey" json:"id"`
+	TransactionID         string     `gorm:"not null;uniqueIndex;size:255" json:"transaction_id"`    // Apple交易ID
+	OriginalTransactionID string     `gorm:"not null;index;size:255" json:"original_transaction_id"` // 原始交易ID
+	ProductIDApple        string     `gorm:"size:100" json:"product_id_apple"`                       // Apple商品ID
+	BundleID              string     `gorm:"size:100" json:"bundle_id"`                              // Bundle ID
+	AppAccountToken       string     `gorm:"size:100" json:"app_account_token,omitempty"`            // 交易携带的应用账户令牌
+	InAppOwnershipType    string     `gorm:"size:50" json:"in_app_ownership_type,omitempty"`         // 所有权类型
+	ProductType           string     `gorm:"size:50" json:"product_type,omitempty"`                  // 产品类型
+	Quantity              int        `json:"quantity"`                                               // 数量
+	PurchaseDate          *time.Time `json:"purchase_date,omitempty"`                                // 购买时间
+	OriginalPurchaseDate  *time.Time `json:"original_purchase_date,omitempty"`                       // 原始购买时间
+	ExpiresDate           *time.Time `json:"expires_date,omitempty"`                                 // 到期时间（订阅）
+	Environment           string     `gorm:"size:20" json:"environment,omitempty"`                   // 环境（Sandbox/Production）
+	SignedTransactionInfo string     `gorm:"type:text" json:"-"`                                     // 签名交易信息
+	Source                string     `gorm:"size:20" json:"source"`                                  // 来源：VERIFY/NOTIFICATION
+	NotificationType      string     `gorm:"size:50" json:"notification_type,omitempty"`             // 通知类型（来源为通知时）
+	ClaimedOrderID        uint       `gorm:"index" json:"claimed_order_id,omitempty"`                // 客户端声称的订单ID（来源为验证接口时）
+	Reason                string     `gorm:"size:200" json:"reason"`                                 // 进入队列的原因
+	Status                string     `gorm:"size:20;index" json:"status"`                            // 状态：PENDING/LINKED/IGNORED
+	LinkedOrderID         uint       `gorm:"index" json:"linked_order_id,omitempty"`                 // 人工关联的订单ID
+	Operator              string     `gorm:"size:100" json:"operator,omitempty"`                     // 处理人
+	Note                  string     `gorm:"size:500" json:"note,omitempty"`                         // 处理备注
+	ResolvedAt            *time.Time `json:"resolved_at,omitempty"`                                  // 处理时间
+	CreatedAt             time.Time  `json:"created_at"`
+	UpdatedAt             time.Time  `json:"updated_at"`
+}
+
+// 应用商店对账来源
+const (
+	StoreApple  = "apple"  // App Store Connect 销售/财务报告
+	StoreGoogle = "google" // Google Play 收入报告
+)
+
+// StoreReconciliationReport 应用商店对账任务表（每个导入的报告文件一条）
+type StoreReconciliationReport struct {
+	ID             uint       `gorm:"primarykey" json:"id"`
+	Store          string     `gorm:"not null;size:16;index" json:"store"`         // apple/google
+	ReportType     string     `gorm:"not null;size:20" json:"report_type"`         // sales-销售报告 finance-财务报告 earnings-收入报告
+	SourceFile     string     `gorm:"not null;size:255;index" json:"source_file"`  // 报告文件名
+	MatchMode      string     `gorm:"size:16" json:"match_mode"`                   // transaction-按交易/订单号 product-按商品汇总
+	PeriodStart    string     `gorm:"size:10;index" json:"period_start,omitempty"` // 报告起始日期 yyyy-MM-dd（太平洋时间）
+	PeriodEnd      string     `gorm:"size:10" json:"period_end,omitempty"`         // 报告结束日期 yyyy-MM-dd（太平洋时间）
+	Status         string     `gorm:"not null;size:20;index" json:"status"`        // processing/completed/failed
+	TotalCount     int        `json:"total_count"`                                 // 报告参与比对的记录数
+	MatchCount     int        `json:"match_count"`                                 // 匹配笔数
+	DiffCount      int        `json:"diff_count"`                                  // 差异笔数
+	LocalOnlyCount int        `json:"local_only_count"`                            // 仅本地有笔数
+	ErrorMessage   string     `gorm:"size:500" json:"error_message,omitempty"`     // 失败原因
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// StoreReconciliationDetail 应用商店对账明细（差异记录）
+type StoreReconciliationDetail struct {
+	ID             uint       `gorm:"primarykey" json:"id"`
+	ReportID       uint       `gorm:"not null;index" json:"report_id"`
+	TransactionID  string     `gorm:"size:255;index" json:"transaction_id,omitempty"` // Apple 交易ID / Google 订单号（按商品汇总时为空）
+	ProductID      string     `gorm:"size:100;index" json:"product_id,omitempty"`     // 商品ID（Apple SKU / Google Sku Id）
+	RecordType     string     `gorm:"size:16" json:"record_type,omitempty"`           // payment-购买 refund-退款
+	DiffType       string     `gorm:"not null;size:32;index" json:"diff_type"`        // store_only/local_only/amount_mismatch/quantity_mismatch/status_mismatch
+	StoreAmount    string     `gorm:"size:20" json:"store_amount,omitempty"`          // 报告金额（报告币种，元）
+	StoreCurrency  string     `gorm:"size:3" json:"store_currency,omitempty"`         // 报告币种
+	StoreQuantity  int        `json:"store_quantity,omitempty"`                       // 报告数量
+	LocalAmount    int64      `json:"local_amount,omitempty"`                         // 本地金额（微单位）
+	LocalCurrency  string     `gorm:"size:3" json:"local_currency,omitempty"`         // 本地币种
+	LocalQuantity  int        `json:"local_quantity,omitempty"`                       // 本地数量
+	LocalStatus    string     `gorm:"size:32" json:"local_status,omitempty"`          // 本地订单状态
+	StoreTradeType string     `gorm:"size:64" json:"store_trade_type,omitempty"`      // 报告交易类型：Charge、Charge refund、IAY 等
+	BillTime       *time.Time `json:"bill_time,omitempty"`                            // 报告交易时间
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
 // WechatPayment 微信支付详情
 type WechatPayment struct {
-	ID              uint       `gorm:"primarykey" json:"id"`
-	OrderID         uint       `gorm:"not null;uniqueIndex" json:"order_id"`             // 订单ID
-	OutTradeNo      string     `gorm:"not null;uniqueIndex;size:32" json:"out_trade_no"` // 商户订单号
-	TransactionID   string     `gorm:"size:32;index" json:"transaction_id,omitempty"`    // 微信支付订单号
-	TradeType       string     `gorm:"size:16" json:"trade_type"`                        // 交易类型 JSAPI、NATIVE、APP、MWEB
-	TradeState      string     `gorm:"size:32;index" json:"trade_state,omitempty"`       // 交易状态
-	TradeStateDesc  string     `gorm:"size:256" json:"trade_state_desc,omitempty"`       // 交易状态描述
-	BankType        string     `gorm:"size:32" json:"bank_type,omitempty"`               // 银行类型
-	Attach          string     `gorm:"size:128" json:"attach,omitempty"`                 // 附加数据
-	SuccessTime     *time.Time `json:"success_time,omitempty"`                           // 支付完成时间
-	Payer           JSON       `gorm:"type:jsonb" json:"payer,omitempty"`                // 支付者信息
-	Amount          JSON       `gorm:"type:jsonb" json:"amount,omitempty"`               // 订单金额
-	SceneInfo       JSON       `gorm:"type:jsonb" json:"scene_info,omitempty"`           // 场景信息
-	PromotionDetail JSON       `gorm:"type:jsonb" json:"promotion_detail,omitempty"`     // 优惠功能
-	PrepayID        string     `gorm:"size:64" json:"prepay_id,omitempty"`               // 预支付交易会话标识
-	CodeURL         string     `gorm:"size:256" json:"code_url,omitempty"`               // 二维码链接（NATIVE）
-	H5URL           string     `gorm:"size:512" json:"h5_url,omitempty"`                 // H5支付链接（MWEB）
-	NotifyTime      *time.Time `json:"notify_time,omitempty"`                            // 通知时间
-	AppID           string     `gorm:"size:32;index" json:"app_id"`                      // 应用ID
-	MchID           string     `gorm:"size:32;index" json:"mch_id"`                      // 商户号
-	RawNotifyData   JSON       `gorm:"type:jsonb" json:"raw_notify_data,omitempty"`      // 原始通知数据
-	CreatedAt       time.Time  `json:"created_at"`
-	UpdatedAt       time.Time  `json:"updated_at"`
+	ID                uint       `gorm:"primarykey" json:"id"`
+	OrderID           uint       `gorm:"not null;uniqueIndex" json:"order_id"`                // 订单ID
+	OutTradeNo        string     `gorm:"not null;uniqueIndex;size:32" json:"out_trade_no"`    // 商户订单号
+	TransactionID     string     `gorm:"size:32;index" json:"transaction_id,omitempty"`       // 微信支付订单号
+	TradeType         string     `gorm:"size:16" json:"trade_type"`                           // 交易类型 JSAPI、NATIVE、APP、MWEB
+	TradeState        string     `gorm:"size:32;index" json:"trade_state,omitempty"`          // 交易状态
+	TradeStateDesc    string     `gorm:"size:256" json:"trade_state_desc,omitempty"`          // 交易状态描述
+	BankType          string     `gorm:"size:32" json:"bank_type,omitempty"`                  // 银行类型
+	Attach            string     `gorm:"size:128" json:"attach,omitempty"`                    // 附加数据
+	SuccessTime       *time.Time `json:"success_time,omitempty"`                              // 支付完成时间
+	Payer             JSON       `gorm:"type:jsonb" json:"payer,omitempty"`                   // 支付者信息
+	Amount            JSON       `gorm:"type:jsonb" json:"amount,omitempty"`                  // 订单金额
+	SceneInfo         JSON       `gorm:"type:jsonb" json:"scene_info,omitempty"`              // 场景信息
+	PromotionDetail   JSON       `gorm:"type:jsonb" json:"promotion_detail,omitempty"`        // 优惠功能
+	PrepayID          string     `gorm:"size:64" json:"prepay_id,omitempty"`                  // 预支付交易会话标识
+	CodeURL           string     `gorm:"size:256" json:"code_url,omitempty"`                  // 二维码链接（NATIVE）
+	H5URL             string     `gorm:"size:512" json:"h5_url,omitempty"`                    // H5支付链接（MWEB）
+	NotifyTime        *time.Time `json:"notify_time,omitempty"`                               // 通知时间
+	AppID             string     `gorm:"size:32;index" json:"app_id"`                         // 应用ID
+	MchID             string     `gorm:"size:32;index" json:"mch_id"`                         // 商户号
+	RawNotifyData     JSON       `gorm:"type:jsonb" json:"raw_notify_data,omitempty"`         // 原始通知数据
+	ContractID        string     `gorm:"size:64;index" json:"contract_id,omitempty"`          // 委托代扣协议号（代扣扣款时有值）
+	CombineOutTradeNo string     `gorm:"size:64;index" json:"combine_out_trade_no,omitempty"` // 合单商户订单号（合单子单时有值）
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// WechatReconciliationReport 微信支付对账任务表
+type WechatReconciliationReport struct {
+	ID             uint       `gorm:"primarykey" json:"id"`
+	TenantID       string     `gorm:"size:64;not null;default:'default';index" json:"tenant_id"` // 租户ID
+	BillDate       string     `gorm:"not null;index;size:10" json:"bill_date"`                   // 对账日期 yyyy-MM-dd
+	BillType       string     `gorm:"not null;size:20" json:"bill_type"`                         // tradebill-交易账单 fundflowbill-资金账单
+	Status         string     `gorm:"not null;size:20;index" json:"status"`                      // processing/completed/failed
+	DownloadURL    string     `gorm:"size:512" json:"download_url,omitempty"`                    // 账单下载地址
+	HashType       string     `gorm:"size:16" json:"hash_type,omitempty"`                        // 账单摘要算法
+	HashValue      string     `gorm:"size:128" json:"hash_value,omitempty"`                      // 账单摘要值
+	TotalCount     int        `json:"total_count"`                                               // 微信账单总笔数
+	MatchCount     int        `json:"match_count"`                                               // 匹配笔数
+	DiffCount      int        `json:"diff_count"`                                                // 差异笔数
+	LocalOnlyCount int        `json:"local_only_count"`                                          // 仅本地有笔数
+	ErrorMessage   string     `gorm:"size:500" json:"error_message,omitempty"`                   // 失败原因
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// WechatReconciliationDetail 微信支付对账明细（差异记录）
+type WechatReconciliationDetail struct {
+	ID            uint       `gorm:"primarykey" json:"id"`
+	ReportID      uint       `gorm:"not null;index" json:"report_id"`
+	OutTradeNo    string     `gorm:"not null;index;size:64" json:"out_trade_no"` // 商户订单号
+	TransactionID string     `gorm:"size:64" json:"transaction_id,omitempty"`    // 微信支付订单号/业务单号
+	RecordType    string     `gorm:"size:16;index" json:"record_type,omitempty"` // payment-支付 refund-退款
+	OutRefundNo   string     `gorm:"size:64" json:"out_refund_no,omitempty"`     // 商户退款单号
+	DiffType      string     `gorm:"not null;size:32;index" json:"diff_type"`    // wechat_only/local_only/amount_mismatch
+	WechatAmount  string     `gorm:"size:20" json:"wechat_amount,omitempty"`     // 微信金额（元）
+	LocalAmount   int64      `json:"local_amount,omitempty"`                     // 本地金额（分）
+	WechatStatus  string     `gorm:"size:32" json:"wechat_status,omitempty"`     // 微信交易状态/业务类型
+	LocalStatus   string     `gorm:"size:32" json:"local_status,omitempty"`      // 本地交易/退款状态
+	BillTime      *time.Time `json:"bill_time,omitempty"`                        // 账单交易/记账时间
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// WechatCombineOrder 微信合单支付主单（一次支付覆盖多个子单，子单为普通订单 + WechatPayment）
+type WechatCombineOrder struct {
+	ID                uint       `gorm:"primarykey" json:"id"`
+	TenantID          string     `gorm:"size:64;not null;default:'default';index" json:"tenant_id"` // 租户ID
+	UserID            uint       `gorm:"not null;index" json:"user_id"`                             // 用户ID
+	CombineOutTradeNo string     `gorm:"not null;uniqueIndex;size:64" json:"combine_out_trade_no"`  // 合单商户订单号
+	CombineAppID      string     `gorm:"size:32;index" json:"combine_appid"`                        // 合单发起方应用ID
+	CombineMchID      string     `gorm:"size:32;index" json:"combine_mchid"`                        // 合单发起方商户号
+	TradeType         string     `gorm:"size:16" json:"trade_type"`                                 // 交易类型 JSAPI、NATIVE、APP、MWEB
+	SubOrderCount     int        `json:"sub_order_count"`                                           // 子单数量
+	TotalAmount       int64      `gorm:"not null" json:"total_amount"`                              // 子单金额合计（分）
+	TradeState        string     `gorm:"size:32;index" json:"trade_state"`                          // NOTPAY、SUCCESS、PARTIAL（部分子单成功）、CLOSED
+	PrepayID          string     `gorm:"size:64" json:"prepay_id,omitempty"`                        // 预支付交易会话标识
+	CodeURL           string     `gorm:"size:256" json:"code_url,omitempty"`                        // 二维码链接（NATIVE）
+	H5URL             string     `gorm:"size:512" json:"h5_url,omitempty"`                          // H5支付链接（MWEB）
+	Payer             JSON       `gorm:"type:jsonb" json:"payer,omitempty"`                         // 支付者信息
+	SuccessTime       *time.Time `json:"success_time,omitempty"`                                    // 支付完成时间
+	NotifyTime        *time.Time `json:"notify_time,omitempty"`                                     // 通知时间
+	RawNotifyData     JSON       `gorm:"type:jsonb" json:"raw_notify_data,omitempty"`               // 原始通知数据
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// WechatPapayContract 微信委托代扣签约记录（与 AlipayWithholdAgreement 对应）
+type WechatPapayContract struct {
+	ID                      uint       `gorm:"primarykey" json:"id"`
+	TenantID                string     `gorm:"size:64;not null;default:'default';index" json:"tenant_id"` // 租户ID
+	UserID                  uint       `gorm:"not null;index" json:"user_id"`                             // 用户ID
+	PlanID                  string     `gorm:"not null;size:32;index" json:"plan_id"`                     // 委托代扣模板ID
+	OutContractCode         string     `gorm:"not null;uniqueIndex;size:64" json:"out_contract_code"`     // 商户签约协议号
+	ContractID              string     `gorm:"size:64;index" json:"contract_id,omitempty"`                // 微信委托代扣协议ID
+	ContractDisplayAccount  string     `gorm:"size:64" json:"contract_display_account,omitempty"`         // 签约用户展示名称
+	SignType                string     `gorm:"size:16" json:"sign_type"`                                  // 签约方式 APP、JSAPI、H5、MINIPROGRAM
+	OpenID                  string     `gorm:"size:128;index" json:"openid,omitempty"`                    // 签约用户 openid
+	Status                  string     `gorm:"not null;size:32;index" json:"status"`                      // TEMP-待签约 ADDED-已签约 TERMINATED-已解约
+	SignedTime              *time.Time `json:"signed_time,omitempty"`                                     // 签约时间
+	ExpiredTime             *time.Time `json:"expired_time,omitempty"`                                    // 协议到期时间
+	TerminatedTime          *time.Time `json:"terminated_time,omitempty"`                                 // 解约时间
+	TerminationMode         string     `gorm:"size:32" json:"termination_mode,omitempty"`                 // 解约方式 USER、MCH_API、PLATFORM 等
+	ContractTerminateRemark string     `gorm:"size:256" json:"contract_terminate_remark,omitempty"`       // 解约备注
+	AppID                   string     `gorm:"size:32;index" json:"app_id"`                               // 应用ID
+	MchID                   string     `gorm:"size:32;index" json:"mch_id"`                               // 商户号
+	RawNotifyData           JSON       `gorm:"type:jsonb" json:"raw_notify_data,omitempty"`               // 最近一次签约/解约通知
+	CreatedAt               time.Time  `json:"created_at"`
+	UpdatedAt               time.Time  `json:"updated_at"`
 }
 
 // WechatRefund 微信退款记录
@@ -381,32 +676,33 @@ type WechatRefund struct {
 // AlipayDeductRecord 支付宝周期扣款记录（每次扣款一条，用于幂等去重）
 type AlipayDeductRecord struct {
 	ID             uint       `gorm:"primarykey" json:"id"`
-	SubscriptionID uint       `gorm:"not null;index" json:"subscription_id"`            // 订阅ID
-	OrderID        uint       `gorm:"not null;index" json:"order_id"`                   // 关联订单ID
-	AgreementNo    string     `gorm:"not null;index;size:64" json:"agreement_no"`       // 协议号
-	OutTradeNo     string     `gorm:"not null;uniqueIndex;size:64" json:"out_trade_no"` // 商户扣款单号（幂等键）
-	TradeNo        string     `gorm:"not null;uniqueIndex;size:64" json:"trade_no"`     // 支付宝交易号（幂等键）
-	Amount         string     `gorm:"not null;size:20" json:"amount"`                   // 扣款金额（元）
-	Status         string     `gorm:"not null;size:32;index" json:"status"`             // SUCCESS/FAIL
-	DeductTime     *time.Time `json:"deduct_time,omitempty"`                            // 扣款时间
+	SubscriptionID uint       `gorm:"not null;index" json:"subscription_id"`                                                        // 订阅ID
+	OrderID        uint       `gorm:"not null;index" json:"order_id"`                                                               // 关联订单ID
+	AgreementNo    string     `gorm:"not null;index;size:64" json:"agreement_no"`                                                   // 协议号
+	OutTradeNo     string     `gorm:"not null;uniqueIndex;size:64" json:"out_trade_no"`                                             // 商户扣款单号（幂等键）
+	TradeNo        string     `gorm:"not null;size:64;uniqueIndex:idx_alipay_deduct_trade_no,where:trade_no <> ''" json:"trade_no"` // 支付宝交易号（幂等键，失败记录为空）
+	Amount         string     `gorm:"not null;size:20" json:"amount"`                                                               // 扣款金额（元）
+	Status         string     `gorm:"not null;size:32;index" json:"status"`                                                         // SUCCESS/FAIL
+	DeductTime     *time.Time `json:"deduct_time,omitempty"`                                                                        // 扣款时间
 	CreatedAt      time.Time  `json:"created_at"`
 }
 
 // AlipayWithholdAgreement 支付宝免密签约记录（商户代扣，单次扣款无需用户确认）
 type AlipayWithholdAgreement struct {
 	ID                  uint       `gorm:"primarykey" json:"id"`
-	UserID              uint       `gorm:"not null;index" json:"user_id"`                      // 用户ID
-	AgreementNo         string     `gorm:"uniqueIndex;size:64" json:"agreement_no"`            // 支付宝协议号
-	OutRequestNo        string     `gorm:"not null;uniqueIndex;size:64" json:"out_request_no"` // 商户签约号
-	ExternalAgreementNo string     `gorm:"size:32" json:"external_agreement_no,omitempty"`     // 代扣协议中标示用户的唯一签约号
-	Status              string     `gorm:"not null;size:32;index" json:"status"`               // NORMAL-正常 STOP-已解约
-	SignTime            *time.Time `json:"sign_time,omitempty"`                                // 签约时间
-	ValidTime           *time.Time `json:"valid_time,omitempty"`                               // 协议生效时间
-	InvalidTime         *time.Time `json:"invalid_time,omitempty"`                             // 协议失效时间
-	CancelTime          *time.Time `json:"cancel_time,omitempty"`                              // 解约时间
-	AppID               string     `gorm:"size:32;index" json:"app_id"`                        // 支付宝应用ID
-	PersonalProductCode string     `gorm:"size:64" json:"personal_product_code,omitempty"`     // 个人签约产品码 GENERAL_WITHHOLDING_P
-	SignScene           string     `gorm:"size:64" json:"sign_scene,omitempty"`                // 签约场景
+	TenantID            string     `gorm:"size:64;not null;default:'default';index" json:"tenant_id"` // 租户ID
+	UserID              uint       `gorm:"not null;index" json:"user_id"`                             // 用户ID
+	AgreementNo         string     `gorm:"uniqueIndex;size:64" json:"agreement_no"`                   // 支付宝协议号
+	OutRequestNo        string     `gorm:"not null;uniqueIndex;size:64" json:"out_request_no"`        // 商户签约号
+	ExternalAgreementNo string     `gorm:"size:32" json:"external_agreement_no,omitempty"`            // 代扣协议中标示用户的唯一签约号
+	Status              string     `gorm:"not null;size:32;index" json:"status"`                      // NORMAL-正常 STOP-已解约
+	SignTime            *time.Time `json:"sign_time,omitempty"`                                       // 签约时间
+	ValidTime           *time.Time `json:"valid_time,omitempty"`                                      // 协议生效时间
+	InvalidTime         *time.Time `json:"invalid_time,omitempty"`                                    // 协议失效时间
+	CancelTime          *time.Time `json:"cancel_time,omitempty"`                                     // 解约时间
+	AppID               string     `gorm:"size:32;index" json:"app_id"`                               // 支付宝应用ID
+	PersonalProductCode string     `gorm:"size:64" json:"personal_product_code,omitempty"`            // 个人签约产品码 GENERAL_WITHHOLDING_P
+	SignScene           string     `gorm:"size:64" json:"sign_scene,omitempty"`                       // 签约场景
 	CreatedAt           time.Time  `json:"created_at"`
 	UpdatedAt           time.Time  `json:"updated_at"`
 }
@@ -414,33 +710,40 @@ type AlipayWithholdAgreement struct {
 // AlipaySubscription 支付宝订阅（周期扣款）详情
 type AlipaySubscription struct {
 	ID                  uint       `gorm:"primarykey" json:"id"`
-	OrderID             uint       `gorm:"not null;index" json:"order_id"`                     // 订单ID
-	AgreementNo         string     `gorm:"not null;uniqueIndex;size:64" json:"agreement_no"`   // 支付宝系统中用以唯一标识用户签约记录的编号
-	OutRequestNo        string     `gorm:"not null;uniqueIndex;size:64" json:"out_request_no"` // 商户签约号
-	ExternalAgreementNo string     `gorm:"size:32" json:"external_agreement_no,omitempty"`     // 代扣协议中标示用户的唯一签约号
-	PeriodType          string     `gorm:"size:10" json:"period_type"`                         // 周期类型 DAY-日 MONTH-月
-	Period              int        `json:"period"`                                             // 周期数
-	ExecutionTime       *time.Time `json:"execution_time,omitempty"`                           // 首次执行时间
-	SingleAmount        string     `gorm:"size:20" json:"single_amount"`                       // 单次扣款金额
-	TotalAmount         string     `gorm:"size:20" json:"total_amount,omitempty"`              // 总金额限制
-	TotalPayments       int        `json:"total_payments,omitempty"`                           // 总扣款次数
-	CurrentPeriod       int        `gorm:"default:0" json:"current_period"`                    // 当前执行期数
-	Status              string     `gorm:"size:32;index" json:"status"`                        // 协议状态 NORMAL-正常 STOP-暂停
-	SignTime            *time.Time `json:"sign_time,omitempty"`                                // 签约时间
-	ValidTime           *time.Time `json:"valid_time,omitempty"`                               // 协议生效时间
-	InvalidTime         *time.Time `json:"invalid_time,omitempty"`                             // 协议失效时间
-	LastDeductTime      *time.Time `json:"last_deduct_time,omitempty"`                         // 最近一次扣款时间
-	NextDeductTime      *time.Time `json:"next_deduct_time,omitempty"`                         // 下次扣款时间
-	LastDeductAmount    string     `gorm:"size:20" json:"last_deduct_amount,omitempty"`        // 最近一次扣款金额
-	LastDeductStatus    string     `gorm:"size:32" json:"last_deduct_status,omitempty"`        // 最近一次扣款状态
-	DeductSuccessCount  int        `gorm:"default:0" json:"deduct_success_count"`              // 成功扣款次数
-	DeductFailCount     int        `gorm:"default:0" json:"deduct_fail_count"`                 // 失败扣款次数
-	AppID               string     `gorm:"size:32;index" json:"app_id"`                        // 支付宝应用ID
-	PersonalProductCode string     `gorm:"size:64" json:"personal_product_code,omitempty"`     // 个人签约产品码
-	SignScene           string     `gorm:"size:64" json:"sign_scene,omitempty"`                // 签约场景
-	RawAgreementData    JSON       `gorm:"type:jsonb" json:"raw_agreement_data,omitempty"`     // 原始签约数据
-	CancelTime          *time.Time `json:"cancel_time,omitempty"`                              // 取消时间
-	CancelReason        string     `gorm:"size:256" json:"cancel_reason,omitempty"`            // 取消原因
+	TenantID            string     `gorm:"size:64;not null;default:'default';index" json:"tenant_id"` // 租户ID
+	OrderID             uint       `gorm:"not null;index" json:"order_id"`                            // 订单ID
+	AgreementNo         string     `gorm:"not null;uniqueIndex;size:64" json:"agreement_no"`          // 支付宝系统中用以唯一标识用户签约记录的编号
+	OutRequestNo        string     `gorm:"not null;uniqueIndex;size:64" json:"out_request_no"`        // 商户签约号
+	ExternalAgreementNo string     `gorm:"size:32" json:"external_agreement_no,omitempty"`            // 代扣协议中标示用户的唯一签约号
+	PeriodType          string     `gorm:"size:10" json:"period_type"`                                // 周期类型 DAY-日 MONTH-月
+	Period              int        `json:"period"`                                                    // 周期数
+	ExecutionTime       *time.Time `json:"execution_time,omitempty"`                                  // 首次执行时间
+	SingleAmount        string     `gorm:"size:20" json:"single_amount"`                              // 单次扣款金额
+	TotalAmount         string     `gorm:"size:20" json:"total_amount,omitempty"`                     // 总金额限制
+	TotalPayments       int        `json:"total_payments,omitempty"`                                  // 总扣款次数
+	CurrentPeriod       int        `gorm:"default:0" json:"current_period"`                           // 当前执行期数
+	Status              string     `gorm:"size:32;index" json:"status"`                               // 协议状态 NORMAL-正常 STOP-暂停
+	SignTime            *time.Time `json:"sign_time,omitempty"`                                       // 签约时间
+	ValidTime           *time.Time `json:"valid_time,omitempty"`                                      // 协议生效时间
+	InvalidTime         *time.Time `json:"invalid_time,omitempty"`                                    // 协议失效时间
+	LastDeductTime      *time.Time `json:"last_deduct_time,omitempty"`                                // 最近一次扣款时间
+	NextDeductTime      *time.Time `json:"next_deduct_time,omitempty"`                                // 下次扣款时间
+	LastDeductAmount    string     `gorm:"size:20" json:"last_deduct_amount,omitempty"`               // 最近一次扣款金额
+	LastDeductStatus    string     `gorm:"size:32" json:"last_deduct_status,omitempty"`               // 最近一次扣款状态
+	DeductSuccessCount  int        `gorm:"default:0" json:"deduct_success_count"`                     // 成功扣款次数
+	DeductFailCount     int        `gorm:"default:0" json:"deduct_fail_count"`                        // 失败扣款次数
+	AppID               string     `gorm:"size:32;index" json:"app_id"`                               // 支付宝应用ID
+	PersonalProductCode string     `gorm:"size:64" json:"personal_product_code,omitempty"`            // 个人签约产品码
+	SignScene           string     `gorm:"size:64" json:"sign_scene,omitempty"`                       // 签约场景
+	RawAgreementData    JSON       `gorm:"type:jsonb" json:"raw_agreement_data,omitempty"`            // 原始签约数据
+	CancelTime          *time.Time `json:"cancel_time,omitempty"`                                     // 取消时间
+	CancelReason        string     `gorm:"size:256" json:"cancel_reason,omitempty"`                   // 取消原因
 	CreatedAt           time.Time  `json:"created_at"`
 	UpdatedAt           time.Time  `json:"updated_at"`
+
+	// 催缴
+	DunningState      DunningState `gorm:"size:20;index" json:"dunning_state,omitempty"` // 催缴状态
+	DunningRetryCount int          `gorm:"default:0" json:"dunning_retry_count"`         // 本期已安排的重试次数
+	DunningStartedAt  *time.Time   `json:"dunning_started_at,omitempty"`                 // 本期首次扣款失败时间
+	GraceExpiresAt    *time.Time   `json:"grace_expires_at,omitempty"`                   // 宽限期到期时间（期间保留权益）
 }
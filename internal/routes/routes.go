@@ -18,10 +18,13 @@ func SetupRoutes(
 	router *gin.Engine,
 	paymentService services.PaymentService,
 	googleService *services.GooglePlayService,
-	alipayService *services.AlipayService,
-	alipayReconciliationService *services.AlipayReconciliationService,
+	alipayServices *services.TenantRegistry[*services.AlipayService],
+	alipayReconciliationServices *services.TenantRegistry[*services.AlipayReconciliationService],
 	appleService *services.AppleService,
-	wechatService *services.WechatService,
+	wechatServices *services.TenantRegistry[*services.WechatService],
+	wechatReconciliationServices *services.TenantRegistry[*services.WechatReconciliationService],
+	storeReconciliationService *services.StoreReconciliationService,
+	googleWebhookHandler *handlers.GoogleWebhookHandler,
 	db *gorm.DB,
 	cfg *config.Config,
 	logger *zap.Logger,
@@ -33,22 +36,24 @@ func SetupRoutes(
 
 	// Google Play处理器
 	googleHandler := handlers.NewGoogleHandler(googleService, paymentService, logger)
-	googleWebhookHandler := handlers.NewGoogleWebhookHandler(db, googleService, paymentService, &cfg.Google, logger)
 
-	// 支付宝处理器
-	alipayHandler := handlers.NewAlipayHandler(alipayService, alipayReconciliationService, paymentService, logger)
-	alipayWebhookHandler := handlers.NewAlipayWebhookHandler(alipayService, logger)
+	// 支付宝处理器（按租户选择支付宝应用）
+	alipayHandler := handlers.NewAlipayHandler(alipayServices, alipayReconciliationServices, paymentService, logger)
+	alipayWebhookHandler := handlers.NewAlipayWebhookHandler(alipayServices, logger)
 
 	// Apple处理器
 	appleHandler := handlers.NewAppleHandler(appleService, paymentService, nil, logger)
 	appleWebhookHandler := handlers.NewAppleWebhookHandler(db, appleService, paymentService, nil, logger)
 
-	// 微信支付处理器
+	// 应用商店对账处理器（App Store Connect / Google Play 报告导入）
+	storeReconciliationHandler := handlers.NewStoreReconciliationHandler(storeReconciliationService, logger)
+
+	// 微信支付处理器（按租户选择微信商户号，无任何租户开通时不注册路由）
 	var wechatHandler *handlers.WechatHandler
 	var wechatWebhookHandler *handlers.WechatWebhookHandler
-	if wechatService != nil {
-		wechatHandler = handlers.NewWechatHandler(wechatService, logger)
-		wechatWebhookHandler = handlers.NewWechatWebhookHandler(wechatService, logger)
+	if wechatServices.Len() > 0 {
+		wechatHandler = handlers.NewWechatHandler(wechatServices, wechatReconciliationServices, logger)
+		wechatWebhookHandler = handlers.NewWechatWebhookHandler(wechatServices, logger)
 	}
 
 	// ==================== API路由 ====================
@@ -58,11 +63,11 @@ func SetupRoutes(
 		// ---------- 通用订单路由 ----------
 		orders := v1.Group("/orders")
 		{
-			orders.POST("", commonHandler.CreateOrder)                       // 创建订单
+			orders.POST("", commonHandler.CreateOrder)                        // 创建订单
 			orders.POST("/cancel-expired", commonHandler.CancelExpiredOrders) // 取消过期订单（供定时任务调用，需在 /:id 前）
-			orders.GET("/:id", commonHandler.GetOrder)                       // 获取订单详情
-			orders.GET("/no/:order_no", commonHandler.GetOrderByOrderNo)     // 根据订单号获取订单
-			orders.POST("/:id/cancel", commonHandler.CancelOrder)            // 取消订单
+			orders.GET("/:id", commonHandler.GetOrder)                        // 获取订单详情
+			orders.GET("/no/:order_no", commonHandler.GetOrderByOrderNo)      // 根据订单号获取订单
+			orders.POST("/:id/cancel", commonHandler.CancelOrder)             // 取消订单
 		}
 
 		// ---------- 用户相关路由 ----------
@@ -92,6 +97,11 @@ func SetupRoutes(
 			// 订阅查询
 			google.GET("/subscriptions/status", googleHandler.GetSubscriptionStatus)        // 获取订阅状态
 			google.GET("/users/:user_id/subscriptions", googleHandler.GetUserSubscriptions) // 获取用户订阅
+
+			// 对账
+			google.POST("/reconciliation/import", storeReconciliationHandler.ImportGoogleReports) // 导入收入报告并对账
+			google.GET("/reconciliation/reports", storeReconciliationHandler.ListGoogleReports)   // 列出对账报告
+			google.GET("/reconciliation/reports/:id", storeReconciliationHandler.GetGoogleReport) // 获取对账报告详情
 		}
 
 		// ---------- 支付宝路由 ----------
@@ -111,12 +121,21 @@ func SetupRoutes(
 			// 免密支付（商户代扣）
 			alipay.POST("/withhold/agreements", alipayHandler.CreateWithholdAgreement)     // 创建免密签约
 			alipay.GET("/withhold/agreements/query", alipayHandler.QueryWithholdAgreement) // 查询免密签约
-			alipay.POST("/withhold/execute", alipayHandler.ExecuteWithhold)               // 执行单次代扣
+			alipay.POST("/withhold/execute", alipayHandler.ExecuteWithhold)                // 执行单次代扣
 
 			// 对账
-			alipay.POST("/reconciliation/run", alipayHandler.RunReconciliation)           // 执行对账
-			alipay.GET("/reconciliation/reports", alipayHandler.ListReconciliationReports) // 列出对账报告
-			alipay.GET("/reconciliation/reports/:id", alipayHandler.GetReconciliationReport) // 获取对账报告详情
+			alipay.POST("/reconciliation/run", alipayHandler.RunReconciliation)                             // 执行对账
+			alipay.GET("/reconciliation/reports", alipayHandler.ListReconciliationReports)                  // 列出对账报告
+			alipay.GET("/reconciliation/reports/:id", alipayHandler.GetReconciliationReport)                // 获取对账报告详情
+			alipay.GET("/reconciliation/reports/:id/changes", alipayHandler.GetReconciliationReportChanges) // 对比上一版本
+			alipay.GET("/reconciliation/reports/:id/export", alipayHandler.ExportReconciliationReport)      // 导出对账报告
+			alipay.GET("/reconciliation/export", alipayHandler.ExportReconciliationRange)                   // 按日期区间导出
+
+			// 对账差异处理
+			alipay.GET("/reconciliation/discrepancies", alipayHandler.ListReconciliationDiscrepancies)               // 查询对账差异
+			alipay.POST("/reconciliation/discrepancies/:id/assign", alipayHandler.AssignReconciliationDiscrepancy)   // 指派差异
+			alipay.POST("/reconciliation/discrepancies/:id/resolve", alipayHandler.ResolveReconciliationDiscrepancy) // 人工处理差异
+			alipay.POST("/reconciliation/discrepancies/:id/ignore", alipayHandler.IgnoreReconciliationDiscrepancy)   // 忽略差异
 		}
 
 		// ---------- Apple路由 ----------
@@ -136,6 +155,20 @@ func SetupRoutes(
 
 			// 订阅查询
 			apple.GET("/subscriptions/:original_transaction_id/status", appleHandler.GetSubscriptionStatus) // 获取订阅状态
+
+			// 促销优惠
+			apple.GET("/offers/eligibility", appleHandler.GetOfferEligibility) // 查询促销优惠资格
+			apple.POST("/offers/signature", appleHandler.CreateOfferSignature) // 生成促销优惠签名
+
+			// 待关联交易（缺少 appAccountToken）
+			apple.GET("/orphan-transactions", appleHandler.ListOrphanTransactions)              // 查询待关联交易
+			apple.POST("/orphan-transactions/:id/link", appleHandler.LinkOrphanTransaction)     // 关联订单
+			apple.POST("/orphan-transactions/:id/ignore", appleHandler.IgnoreOrphanTransaction) // 忽略
+
+			// 对账
+			apple.POST("/reconciliation/import", storeReconciliationHandler.ImportAppleReports) // 导入销售/财务报告并对账
+			apple.GET("/reconciliation/reports", storeReconciliationHandler.ListAppleReports)   // 列出对账报告
+			apple.GET("/reconciliation/reports/:id", storeReconciliationHandler.GetAppleReport) // 获取对账报告详情
 		}
 
 		// ---------- 微信支付路由 ----------
@@ -148,13 +181,28 @@ func SetupRoutes(
 				wechat.POST("/orders/:order_no/close", wechatHandler.CloseOrder) // 关闭订单
 
 				// 支付
-				wechat.POST("/payments/jsapi/:order_no", wechatHandler.CreateJSAPIPayment)   // 创建JSAPI支付
-				wechat.POST("/payments/native/:order_no", wechatHandler.CreateNativePayment) // 创建Native支付
-				wechat.POST("/payments/app/:order_no", wechatHandler.CreateAPPPayment)       // 创建APP支付
-				wechat.POST("/payments/h5/:order_no", wechatHandler.CreateH5Payment)         // 创建H5支付
+				wechat.POST("/payments/jsapi/:order_no", wechatHandler.CreateJSAPIPayment)             // 创建JSAPI支付
+				wechat.POST("/payments/native/:order_no", wechatHandler.CreateNativePayment)           // 创建Native支付
+				wechat.POST("/payments/app/:order_no", wechatHandler.CreateAPPPayment)                 // 创建APP支付
+				wechat.POST("/payments/h5/:order_no", wechatHandler.CreateH5Payment)                   // 创建H5支付
+				wechat.POST("/payments/miniprogram/:order_no", wechatHandler.CreateMiniProgramPayment) // 创建小程序支付
+
+				// 合单支付
+				wechat.POST("/combine-orders", wechatHandler.CreateCombineOrder) // 创建合单支付
 
 				// 退款
 				wechat.POST("/refunds", wechatHandler.Refund) // 退款
+
+				// 委托代扣
+				wechat.POST("/papay/contracts", wechatHandler.CreatePapayContract)                                 // 发起签约
+				wechat.GET("/papay/contracts/:out_contract_code", wechatHandler.QueryPapayContract)                // 查询签约
+				wechat.POST("/papay/contracts/:out_contract_code/terminate", wechatHandler.TerminatePapayContract) // 解约
+				wechat.POST("/papay/deductions", wechatHandler.ExecutePapayDeduct)                                 // 申请扣款
+
+				// 对账
+				wechat.POST("/reconciliation/run", wechatHandler.RunReconciliation)              // 执行对账
+				wechat.GET("/reconciliation/reports", wechatHandler.ListReconciliationReports)   // 列出对账报告
+				wechat.GET("/reconciliation/reports/:id", wechatHandler.GetReconciliationReport) // 获取对账报告详情
 			}
 		}
 	}
@@ -166,19 +214,33 @@ func SetupRoutes(
 		// Google Play Webhook
 		webhooks.POST("/google", googleWebhookHandler.HandleGooglePlayWebhook)
 
-		// 支付宝 Webhook
+		// 支付宝 Webhook（不带租户的地址归属默认租户）
 		webhooks.POST("/alipay/notify", alipayWebhookHandler.HandleAlipayNotify)                   // 支付通知
 		webhooks.POST("/alipay/subscription", alipayWebhookHandler.HandleAlipaySubscriptionNotify) // 周期扣款签约通知
 		webhooks.POST("/alipay/deduct", alipayWebhookHandler.HandleAlipayDeductNotify)             // 周期扣款扣款通知
 		webhooks.POST("/alipay/withhold", alipayWebhookHandler.HandleAlipayWithholdNotify)         // 免密签约通知
 
+		// 支付宝多租户 Webhook（按租户选择验签密钥）
+		webhooks.POST("/alipay/:tenant/notify", alipayWebhookHandler.HandleAlipayNotify)                   // 支付通知
+		webhooks.POST("/alipay/:tenant/subscription", alipayWebhookHandler.HandleAlipaySubscriptionNotify) // 周期扣款签约通知
+		webhooks.POST("/alipay/:tenant/deduct", alipayWebhookHandler.HandleAlipayDeductNotify)             // 周期扣款扣款通知
+		webhooks.POST("/alipay/:tenant/withhold", alipayWebhookHandler.HandleAlipayWithholdNotify)         // 免密签约通知
+
 		// Apple Webhook
 		webhooks.POST("/apple", appleWebhookHandler.HandleAppleWebhook)
 
-		// 微信支付 Webhook
+		// 微信支付 Webhook（不带租户的地址归属默认租户）
 		if wechatWebhookHandler != nil {
-			webhooks.POST("/wechat/notify", wechatWebhookHandler.HandleWechatNotify)       // 支付通知
-			webhooks.POST("/wechat/refund", wechatWebhookHandler.HandleWechatRefundNotify) // 退款通知
+			webhooks.POST("/wechat/notify", wechatWebhookHandler.HandleWechatNotify)                // 支付通知
+			webhooks.POST("/wechat/refund", wechatWebhookHandler.HandleWechatRefundNotify)          // 退款通知
+			webhooks.POST("/wechat/papay", wechatWebhookHandler.HandleWechatPapayNotify)            // 委托代扣签约/解约通知
+			webhooks.POST("/wechat/combine-notify", wechatWebhookHandler.HandleWechatCombineNotify) // 合单支付通知
+
+			// 微信支付多租户 Webhook（按租户选择验签公钥与 APIv3 密钥）
+			webhooks.POST("/wechat/:tenant/notify", wechatWebhookHandler.HandleWechatNotify)                // 支付通知
+			webhooks.POST("/wechat/:tenant/refund", wechatWebhookHandler.HandleWechatRefundNotify)          // 退款通知
+			webhooks.POST("/wechat/:tenant/papay", wechatWebhookHandler.HandleWechatPapayNotify)            // 委托代扣签约/解约通知
+			webhooks.POST("/wechat/:tenant/combine-notify", wechatWebhookHandler.HandleWechatCombineNotify) // 合单支付通知
 		}
 	}
 
@@ -0,0 +1,317 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	alipay "github.com/smartwalle/alipay/v3"
+
+	"pay-gateway/internal/models"
+)
+
+const (
+	lockKeyPrefixDeductScheduler  = "alipay:deduct:scheduler:lock:"
+	deductSchedulerLockExpiration = 10 * time.Minute
+	deductSchedulerBatchSize      = 100
+	deductOutTradeNoPrefix        = "DED"
+)
+
+// ==================== 周期扣款调度 ====================
+
+// RunDueDeductions 服务端周期扣款调度：查找已到期的周期扣款协议，按期发起代扣
+// 每期使用固定的 out_trade_no，重复执行时由支付宝与扣款记录双重去重
+// 仅调度周期扣款签约（AlipaySubscription）；商户代扣协议（AlipayWithholdAgreement）没有周期与金额约定，
+// 由业务按需调用 ExecuteWithhold 扣款，不参与调度
+func (s *AlipayService) RunDueDeductions(ctx context.Context) (deductedCount int, err error) {
+	// 多副本部署时保证同一时刻每个租户只有一个实例在调度
+	if s.redis != nil {
+		lockKey := lockKeyPrefixDeductScheduler + s.tenantID
+		lockToken := uuid.NewString()
+		ok, lockErr := s.redis.SetNX(ctx, lockKey, lockToken, deductSchedulerLockExpiration)
+		if lockErr != nil {
+			return 0, fmt.Errorf("获取分布式锁失败: %w", lockErr)
+		}
+		if !ok {
+			return 0, nil
+		}
+		defer func() { _, _ = s.redis.DelIfValue(context.Background(), lockKey, lockToken) }()
+	}
+
+	// 宽限期到期的催缴订阅暂停权益
+	if err := s.expireDunningGrace(ctx); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var subscriptions []models.AlipaySubscription
+	err = s.db.WithContext(ctx).Scopes(tenantScope(s.tenantID)).
+		Where("status = ? AND agreement_no <> ''", "NORMAL").
+		Where("COALESCE(dunning_state, '') <> ?", models.DunningStateSuspended).
+		Where("(next_deduct_time <= ? OR (next_deduct_time IS NULL AND current_period = 0 AND execution_time <= ?))", now, now).
+		Order("next_deduct_time ASC").
+		Limit(deductSchedulerBatchSize).
+		Find(&subscriptions).Error
+	if err != nil {
+		return 0, fmt.Errorf("查询到期周期扣款失败: %w", err)
+	}
+
+	for i := range subscriptions {
+		ok, dErr := s.executePeriodDeduct(ctx, &subscriptions[i])
+		if dErr != nil || !ok {
+			continue
+		}
+		deductedCount++
+	}
+	return deductedCount, nil
+}
+
+// executePeriodDeduct 对单个周期扣款协议发起本期扣款，返回本期是否扣款成功
+func (s *AlipayService) executePeriodDeduct(ctx context.Context, subscription *models.AlipaySubscription) (bool, error) {
+	// 已达总期数或总金额限制，停止调度
+	reached, err := s.deductLimitReached(ctx, subscription)
+	if err != nil {
+		return false, err
+	}
+	if reached {
+		if err := s.db.WithContext(ctx).Model(subscription).Update("next_deduct_time", nil).Error; err != nil {
+			return false, fmt.Errorf("更新周期扣款状态失败: %v", err)
+		}
+		return false, nil
+	}
+
+	period := subscription.CurrentPeriod + 1
+	outTradeNo := deductOutTradeNo(subscription.ID, period, subscription.DunningRetryCount)
+
+	// 与扣款通知共用 out_trade_no 维度的锁，避免调度与通知并发记账
+	lockKey := lockKeyPrefixDeduct + outTradeNo
+	if s.redis != nil {
+		ok, lockErr := s.redis.SetNX(ctx, lockKey, "1", lockKeyExpiration)
+		if lockErr != nil {
+			return false, fmt.Errorf("获取分布式锁失败: %w", lockErr)
+		}
+		if !ok {
+			return false, errors.New("扣款正在处理中，请稍后重试")
+		}
+		defer func() { _ = s.redis.Del(context.Background(), lockKey) }()
+	}
+
+	// 本期已由扣款通知记账
+	var existingRecord models.AlipayDeductRecord
+	if err := s.db.WithContext(ctx).Where("out_trade_no = ?", outTradeNo).First(&existingRecord).Error; err == nil {
+		return false, nil
+	}
+
+	var order models.Order
+	if err := s.db.WithContext(ctx).First(&order, subscription.OrderID).Error; err != nil {
+		return false, fmt.Errorf("订单不存在: %v", err)
+	}
+
+	// 调用支付宝代扣接口 alipay.trade.pay
+	payParam := alipay.TradePay{}
+	payParam.OutTradeNo = outTradeNo
+	payParam.Subject = fmt.Sprintf("%s 第%d期", order.Title, period)
+	payParam.TotalAmount = subscription.SingleAmount
+	payParam.ProductCode = "AGREEMENT_PAYMENT"
+	payParam.NotifyURL = s.config.NotifyURL
+	payParam.AgreementParams = &alipay.AgreementParams{AgreementNo: subscription.AgreementNo}
+
+	result, err := s.client.TradePay(ctx, payParam)
+	if err != nil {
+		// 网络异常时结果未知，不记失败，下次调度以相同 out_trade_no 重试
+		return false, fmt.Errorf("代扣请求失败: %v", err)
+	}
+
+	tradeNo := result.TradeNo
+	if result.Code != alipay.CodeSuccess {
+		if result.Code == alipay.CodeBusinessFailed && !deductResultUnknown(result.SubCode) {
+			return false, s.recordDeductFailure(ctx, subscription, outTradeNo, result.SubCode, result.SubMsg)
+		}
+		// 支付处理中、服务不可用或本期此前已扣款成功（如上次调度在记账前中断），以交易查询结果为准
+		tradeNo, err = s.queryDeductTrade(ctx, outTradeNo)
+		if err != nil {
+			return false, err
+		}
+		if tradeNo == "" {
+			return false, s.recordDeductFailure(ctx, subscription, outTradeNo, string(result.Code), "交易已关闭")
+		}
+	}
+
+	if err := s.recordDeductResult(ctx, subscription, outTradeNo, tradeNo, subscription.SingleAmount, "SUCCESS"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// deductResultUnknown 业务失败中结果仍不确定的子错误码，需查询交易后再判断
+func deductResultUnknown(subCode string) bool {
+	switch subCode {
+	case "ACQ.TRADE_HAS_SUCCESS", "ACQ.SYSTEM_ERROR", "ACQ.PAYMENT_REQUEST_HAS_RISK":
+		return true
+	}
+	return false
+}
+
+// queryDeductTrade 查询本期扣款交易
+// 返回：扣款成功时返回支付宝交易号；交易已关闭时返回空交易号；交易不存在、处理中或查询失败时返回错误，
+// 本期保持待扣款，下次调度以相同 out_trade_no 重试，不会重复扣款
+func (s *AlipayService) queryDeductTrade(ctx context.Context, outTradeNo string) (string, error) {
+	q := alipay.TradeQuery{}
+	q.OutTradeNo = outTradeNo
+	result, err := s.client.TradeQuery(ctx, q)
+	if err != nil {
+		return "", fmt.Errorf("查询支付宝订单失败: %v", err)
+	}
+	if result.Code != alipay.CodeSuccess {
+		return "", fmt.Errorf("代扣结果未知，等待下次调度: %s - %s", result.SubCode, result.SubMsg)
+	}
+	switch result.TradeStatus {
+	case alipay.TradeStatusSuccess, alipay.TradeStatusFinished:
+		return result.TradeNo, nil
+	case alipay.TradeStatusClosed:
+		return "", nil
+	default:
+		return "", fmt.Errorf("代扣处理中，等待支付宝通知: %s", result.TradeStatus)
+	}
+}
+
+// recordDeductFailure 记录调度发起的扣款失败，并按催缴策略安排重试
+// 失败记录按 out_trade_no 写入扣款记录（无支付宝交易号），同一单号随后到达的 FAIL 通知不会重复推进催缴
+func (s *AlipayService) recordDeductFailure(ctx context.Context, subscription *models.AlipaySubscription, outTradeNo, subCode, subMsg string) error {
+	if err := s.recordDeductResult(ctx, subscription, outTradeNo, "", subscription.SingleAmount, "FAIL"); err != nil {
+		return err
+	}
+	return fmt.Errorf("代扣失败: %s - %s", subCode, subMsg)
+}
+
+// ==================== 扣款失败催缴 ====================
+
+// applyDunningFailure 按催缴策略处理本期的一次扣款失败：安排下次重试，重试耗尽时标记挂起
+func (s *AlipayService) applyDunningFailure(subscription *models.AlipaySubscription, now time.Time) {
+	if subscription.DunningStartedAt == nil {
+		graceExpiresAt := now.Add(s.dunning.GracePeriod)
+		subscription.DunningStartedAt = &now
+		subscription.GraceExpiresAt = &graceExpiresAt
+		subscription.DunningRetryCount = 0
+	}
+
+	next := s.dunning.NextRetryAt(*subscription.DunningStartedAt, subscription.DunningRetryCount)
+	if next == nil {
+		subscription.DunningState = models.DunningStateSuspended
+		subscription.NextDeductTime = nil
+		return
+	}
+	subscription.DunningRetryCount++
+	subscription.NextDeductTime = next
+	subscription.DunningState = s.dunning.StateAt(subscription.GraceExpiresAt, now)
+}
+
+// resetDunning 扣款成功后清除催缴状态
+func resetDunning(subscription *models.AlipaySubscription) {
+	subscription.DunningState = models.DunningStateNone
+	subscription.DunningRetryCount = 0
+	subscription.DunningStartedAt = nil
+	subscription.GraceExpiresAt = nil
+}
+
+// syncDunningEntitlement 根据催缴状态变化同步订单权益
+// RETRYING 暂停权益（支付状态置为失败）；SUSPENDED 订单过期并按配置解约；恢复扣款后重新开通
+func (s *AlipayService) syncDunningEntitlement(ctx context.Context, subscription *models.AlipaySubscription, prevState models.DunningState) error {
+	if subscription.DunningState == prevState {
+		return nil
+	}
+
+	orderQuery := s.db.WithContext(ctx).Model(&models.Order{}).Where("id = ?", subscription.OrderID)
+	switch subscription.DunningState {
+	case models.DunningStateRetrying:
+		if err := orderQuery.Update("payment_status", models.PaymentStatusFailed).Error; err != nil {
+			return fmt.Errorf("更新订单状态失败: %v", err)
+		}
+	case models.DunningStateSuspended:
+		if err := orderQuery.Updates(map[string]interface{}{
+			"status":         models.OrderStatusExpired,
+			"payment_status": models.PaymentStatusFailed,
+		}).Error; err != nil {
+			return fmt.Errorf("更新订单状态失败: %v", err)
+		}
+		if s.dunning.UnsignOnSuspend {
+			return s.CancelSubscription(ctx, &CancelAlipaySubscriptionRequest{
+				OutRequestNo: subscription.OutRequestNo,
+				AgreementNo:  subscription.AgreementNo,
+				CancelReason: "连续扣款失败，自动解约",
+			})
+		}
+	case models.DunningStateNone:
+		if prevState == models.DunningStateRetrying {
+			if err := orderQuery.Updates(map[string]interface{}{
+				"status":         models.OrderStatusPaid,
+				"payment_status": models.PaymentStatusCompleted,
+			}).Error; err != nil {
+				return fmt.Errorf("更新订单状态失败: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// expireDunningGrace 宽限期到期仍未扣款成功的订阅进入 RETRYING，暂停权益
+func (s *AlipayService) expireDunningGrace(ctx context.Context) error {
+	var subscriptions []models.AlipaySubscription
+	if err := s.db.WithContext(ctx).Scopes(tenantScope(s.tenantID)).
+		Where("dunning_state = ? AND grace_expires_at <= ?", models.DunningStateGracePeriod, time.Now()).
+		Find(&subscriptions).Error; err != nil {
+		return fmt.Errorf("查询宽限期订阅失败: %w", err)
+	}
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		subscription.DunningState = models.DunningStateRetrying
+		if err := s.db.WithContext(ctx).Model(subscription).Update("dunning_state", subscription.DunningState).Error; err != nil {
+			return fmt.Errorf("更新周期扣款状态失败: %v", err)
+		}
+		if err := s.syncDunningEntitlement(ctx, subscription, models.DunningStateGracePeriod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deductLimitReached 判断周期扣款是否已达总期数（TotalPayments）或总金额（TotalAmount）限制
+func (s *AlipayService) deductLimitReached(ctx context.Context, subscription *models.AlipaySubscription) (bool, error) {
+	if subscription.TotalPayments > 0 && subscription.CurrentPeriod >= subscription.TotalPayments {
+		return true, nil
+	}
+
+	totalLimit, err := parseAmountFromYuan(subscription.TotalAmount)
+	if err != nil || totalLimit <= 0 {
+		return false, nil
+	}
+	singleAmount, err := parseAmountFromYuan(subscription.SingleAmount)
+	if err != nil {
+		return false, fmt.Errorf("单次扣款金额格式错误: %v", err)
+	}
+
+	var records []models.AlipayDeductRecord
+	if err := s.db.WithContext(ctx).
+		Where("subscription_id = ? AND status = ?", subscription.ID, "SUCCESS").
+		Find(&records).Error; err != nil {
+		return false, fmt.Errorf("查询扣款记录失败: %w", err)
+	}
+	var deducted int64
+	for _, r := range records {
+		if amount, err := parseAmountFromYuan(r.Amount); err == nil {
+			deducted += amount
+		}
+	}
+
+	return deducted+singleAmount > totalLimit, nil
+}
+
+// deductOutTradeNo 生成周期扣款商户单号，同一协议同一期同一次重试固定不变以保证幂等
+func deductOutTradeNo(subscriptionID uint, period, retry int) string {
+	if retry == 0 {
+		return fmt.Sprintf("%s%dP%d", deductOutTradeNoPrefix, subscriptionID, period)
+	}
+	return fmt.Sprintf("%s%dP%dR%d", deductOutTradeNoPrefix, subscriptionID, period, retry)
+}
@@ -0,0 +1,310 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/transform"
+	"gorm.io/gorm"
+
+	"pay-gateway/internal/models"
+)
+
+// 对账导出格式
+const (
+	ReconciliationExportCSV  = "csv"
+	ReconciliationExportXLSX = "xlsx"
+)
+
+// 对账导出 CSV 编码：utf8 带 BOM（Excel 可直接识别），gbk 与支付宝账单编码一致
+const (
+	ReconciliationExportUTF8 = "utf8"
+	ReconciliationExportGBK  = "gbk"
+)
+
+const (
+	reconciliationExportBatch   = 500
+	reconciliationExportMaxDays = 92 // 区间导出最多覆盖的天数
+	reconciliationTimeLayout    = "2006-01-02 15:04:05"
+)
+
+var reconciliationSummaryHeader = []string{
+	"报告ID", "对账日期", "账单类型", "版本", "状态", "支付宝账单笔数", "匹配笔数", "差异笔数",
+	"仅本地有笔数", "自动修复笔数", "新增差异", "消失差异", "完成时间", "失败原因",
+}
+
+var reconciliationDetailHeader = []string{
+	"报告ID", "对账日期", "账单类型", "记录类型", "差异类型", "商户订单号", "支付宝交易号", "退款请求号",
+	"支付宝金额（元）", "本地金额（元）", "支付宝业务类型", "本地状态", "账单时间",
+	"处理状态", "指派人", "处理人", "处理时间", "备注",
+}
+
+// GetReportForExport 查询本租户的对账报告（不加载差异明细，明细在导出时分批读取）
+func (s *AlipayReconciliationService) GetReportForExport(ctx context.Context, reportID uint) (*models.AlipayReconciliationReport, error) {
+	var report models.AlipayReconciliationReport
+	if err := s.db.WithContext(ctx).Scopes(tenantScope(s.tenantID)).First(&report, reportID).Error; err != nil {
+		return nil, fmt.Errorf("对账报告不存在: %v", err)
+	}
+	return &report, nil
+}
+
+// ListReportsForExport 查询区间内各账单的当前版本报告，按对账日期、账单类型排序
+// 参数：
+//   - ctx: 上下文
+//   - startDate: 起始对账日期 yyyy-MM-dd（含）
+//   - endDate: 结束对账日期 yyyy-MM-dd（含）
+//   - billType: 账单类型，为空时不限
+//
+// 返回：对账报告或错误
+func (s *AlipayReconciliationService) ListReportsForExport(ctx context.Context, startDate, endDate, billType string) ([]models.AlipayReconciliationReport, error) {
+	start, _, err := billDateRange(startDate)
+	if err != nil {
+		return nil, err
+	}
+	end, _, err := billDateRange(endDate)
+	if err != nil {
+		return nil, err
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("结束日期不能早于起始日期")
+	}
+	if end.Sub(start) >= reconciliationExportMaxDays*24*time.Hour {
+		return nil, fmt.Errorf("导出区间不能超过 %d 天", reconciliationExportMaxDays)
+	}
+
+	query := s.db.WithContext(ctx).Scopes(tenantScope(s.tenantID)).
+		Where("bill_date >= ? AND bill_date <= ? AND superseded = ?", startDate, endDate, false).
+		Order("bill_date ASC, bill_type ASC, version ASC")
+	if billType != "" {
+		query = query.Where("bill_type = ?", billType)
+	}
+	var reports []models.AlipayReconciliationReport
+	if err := query.Find(&reports).Error; err != nil {
+		return nil, fmt.Errorf("查询对账报告失败: %v", err)
+	}
+	return reports, nil
+}
+
+// ExportReconciliation 导出对账报告汇总与全部差异明细，明细分批查询后逐行写出
+// 参数：
+//   - ctx: 上下文
+//   - w: 输出
+//   - reports: 要导出的报告（须属于本租户）
+//   - format: csv/xlsx
+//   - charset: CSV 编码 utf8/gbk，xlsx 忽略
+//
+// 返回：错误
+func (s *AlipayReconciliationService) ExportReconciliation(ctx context.Context, w io.Writer, reports []models.AlipayReconciliationReport, format, charset string) error {
+	switch format {
+	case ReconciliationExportCSV:
+		return s.exportCSV(ctx, w, reports, charset)
+	case ReconciliationExportXLSX:
+		return s.exportXLSX(ctx, w, reports)
+	default:
+		return fmt.Errorf("不支持的导出格式: %s", format)
+	}
+}
+
+// exportCSV 先写汇总表，空一行后写差异明细表
+func (s *AlipayReconciliationService) exportCSV(ctx context.Context, w io.Writer, reports []models.AlipayReconciliationReport, charset string) error {
+	var encoder *transform.Writer
+	switch charset {
+	case "", ReconciliationExportUTF8:
+		if _, err := w.Write([]byte("\xef\xbb\xbf")); err != nil {
+			return err
+		}
+	case ReconciliationExportGBK:
+		// GBK 无法表示的字符（如备注中的表情）替换为问号，避免整个导出失败
+		encoder = transform.NewWriter(w, encoding.ReplaceUnsupported(simplifiedchinese.GBK.NewEncoder()))
+		w = encoder
+	default:
+		return fmt.Errorf("不支持的编码: %s", charset)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(reconciliationSummaryHeader); err != nil {
+		return err
+	}
+	for i := range reports {
+		if err := cw.Write(reconciliationSummaryRow(&reports[i])); err != nil {
+			return err
+		}
+	}
+	if err := cw.Write(nil); err != nil {
+		return err
+	}
+	if err := cw.Write(reconciliationDetailHeader); err != nil {
+		return err
+	}
+
+	err := s.eachExportDetail(ctx, reports, func(report *models.AlipayReconciliationReport, d *models.AlipayReconciliationDetail) error {
+		return cw.Write(reconciliationDetailRow(report, d))
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	if encoder != nil {
+		return encoder.Close()
+	}
+	return nil
+}
+
+// exportXLSX 汇总与差异明细分两个工作表，金额写为数值
+func (s *AlipayReconciliationService) exportXLSX(ctx context.Context, w io.Writer, reports []models.AlipayReconciliationReport) error {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	const summarySheet, detailSheet = "汇总", "差异明细"
+	if err := f.SetSheetName("Sheet1", summarySheet); err != nil {
+		return err
+	}
+	if _, err := f.NewSheet(detailSheet); err != nil {
+		return err
+	}
+
+	summary, err := f.NewStreamWriter(summarySheet)
+	if err != nil {
+		return err
+	}
+	if err := summary.SetRow("A1", stringCells(reconciliationSummaryHeader)); err != nil {
+		return err
+	}
+	for i := range reports {
+		r := &reports[i]
+		cell, _ := excelize.CoordinatesToCellName(1, i+2)
+		row := []interface{}{
+			r.ID, r.BillDate, r.BillType, r.Version, r.Status, r.TotalCount, r.MatchCount, r.DiffCount,
+			r.LocalOnlyCount, r.AutoFixedCount, r.AddedDiffCount, r.RemovedDiffCount,
+			formatBillTime(r.CompletedAt), r.ErrorMessage,
+		}
+		if err := summary.SetRow(cell, row); err != nil {
+			return err
+		}
+	}
+	if err := summary.Flush(); err != nil {
+		return err
+	}
+
+	details, err := f.NewStreamWriter(detailSheet)
+	if err != nil {
+		return err
+	}
+	if err := details.SetRow("A1", stringCells(reconciliationDetailHeader)); err != nil {
+		return err
+	}
+	rowNum := 2
+	err = s.eachExportDetail(ctx, reports, func(report *models.AlipayReconciliationReport, d *models.AlipayReconciliationDetail) error {
+		row := stringCells(reconciliationDetailRow(report, d))
+		// 金额列写为数值，便于表格求和
+		if v, err := strconv.ParseFloat(row[8].(string), 64); err == nil {
+			row[8] = v
+		}
+		if v, err := strconv.ParseFloat(row[9].(string), 64); err == nil {
+			row[9] = v
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, rowNum)
+		rowNum++
+		return details.SetRow(cell, row)
+	})
+	if err != nil {
+		return err
+	}
+	if err := details.Flush(); err != nil {
+		return err
+	}
+	return f.Write(w)
+}
+
+// eachExportDetail 按报告顺序分批读取差异明细
+func (s *AlipayReconciliationService) eachExportDetail(ctx context.Context, reports []models.AlipayReconciliationReport, fn func(*models.AlipayReconciliationReport, *models.AlipayReconciliationDetail) error) error {
+	for i := range reports {
+		report := &reports[i]
+		var batch []models.AlipayReconciliationDetail
+		result := s.db.WithContext(ctx).Where("report_id = ?", report.ID).Order("id ASC").
+			FindInBatches(&batch, reconciliationExportBatch, func(_ *gorm.DB, _ int) error {
+				for j := range batch {
+					if err := fn(report, &batch[j]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		if result.Error != nil {
+			return fmt.Errorf("导出差异明细失败: %w", result.Error)
+		}
+	}
+	return nil
+}
+
+func reconciliationSummaryRow(r *models.AlipayReconciliationReport) []string {
+	return []string{
+		strconv.FormatUint(uint64(r.ID), 10), r.BillDate, r.BillType, strconv.Itoa(r.Version), r.Status,
+		strconv.Itoa(r.TotalCount), strconv.Itoa(r.MatchCount), strconv.Itoa(r.DiffCount),
+		strconv.Itoa(r.LocalOnlyCount), strconv.Itoa(r.AutoFixedCount),
+		strconv.Itoa(r.AddedDiffCount), strconv.Itoa(r.RemovedDiffCount),
+		formatBillTime(r.CompletedAt), r.ErrorMessage,
+	}
+}
+
+func reconciliationDetailRow(r *models.AlipayReconciliationReport, d *models.AlipayReconciliationDetail) []string {
+	localAmount := ""
+	if d.DiffType != "alipay_only" {
+		localAmount = formatYuan(d.LocalAmount)
+	}
+	return []string{
+		strconv.FormatUint(uint64(r.ID), 10), r.BillDate, r.BillType, d.RecordType, d.DiffType,
+		d.OutTradeNo, d.AlipayTradeNo, d.OutRequestNo,
+		normalizeYuan(d.AlipayAmount), localAmount, firstNonEmpty(d.AlipayTradeType, d.AlipayStatus), d.LocalStatus,
+		formatBillTime(d.BillTime), d.ResolutionStatus, d.Assignee, d.ResolvedBy, formatBillTime(d.ResolvedAt), d.Note,
+	}
+}
+
+// formatYuan 分转元，保留两位小数
+func formatYuan(fen int64) string {
+	sign := ""
+	if fen < 0 {
+		sign, fen = "-", -fen
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, fen/100, fen%100)
+}
+
+// normalizeYuan 账单金额统一为两位小数，无法解析时原样返回
+func normalizeYuan(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ""
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return s
+	}
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+// formatBillTime 按北京时间格式化，与账单时间一致
+func formatBillTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.In(billLocation).Format(reconciliationTimeLayout)
+}
+
+func stringCells(values []string) []interface{} {
+	cells := make([]interface{}, len(values))
+	for i, v := range values {
+		cells[i] = v
+	}
+	return cells
+}
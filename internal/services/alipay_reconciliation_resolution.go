@@ -0,0 +1,301 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	alipay "github.com/smartwalle/alipay/v3"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"pay-gateway/internal/models"
+)
+
+// 自动修复的处理人
+const reconciliationSystemOperator = "system"
+
+var (
+	// ErrReconciliationDiffClosed 差异已处理（自动修复、人工处理或忽略），不能再次处理
+	ErrReconciliationDiffClosed = errors.New("差异已处理")
+	// ErrReconciliationDiffNotFound 差异不存在或不属于当前租户
+	ErrReconciliationDiffNotFound = errors.New("差异不存在")
+)
+
+// SetAlipayService 设置同租户的支付宝服务，用于自动修复仅支付宝有的支付差异
+// 未设置时差异全部保持待处理
+func (s *AlipayReconciliationService) SetAlipayService(alipayService *AlipayService) {
+	s.alipayService = alipayService
+}
+
+// autoFixDetails 自动修复差异：仅支付宝有的支付记录，若本地订单仍待支付且金额一致，向支付宝查询确认后置为已支付
+// 修复成功的差异标记为 auto_fixed，失败或不满足条件的保持 open 等待人工处理
+// 返回：自动修复笔数
+func (s *AlipayReconciliationService) autoFixDetails(ctx context.Context, details []models.AlipayReconciliationDetail, records []BillRecord) int {
+	if s.alipayService == nil {
+		return 0
+	}
+
+	billPayments := make(map[string]BillRecord, len(records))
+	for _, rec := range records {
+		if rec.Kind == billRecordPayment {
+			billPayments[rec.OutTradeNo] = rec
+		}
+	}
+
+	fixed := 0
+	for i := range details {
+		d := &details[i]
+		if d.DiffType != "alipay_only" || d.RecordType != billRecordPayment {
+			continue
+		}
+
+		var order models.Order
+		if err := s.db.WithContext(ctx).Scopes(tenantScope(s.tenantID)).
+			Where("order_no = ? AND payment_method = ?", d.OutTradeNo, models.PaymentMethodAlipay).
+			First(&order).Error; err != nil {
+			continue
+		}
+		// 已取消、已过期等订单可能已另行处理，交由人工判断
+		if order.Status != models.OrderStatusCreated {
+			continue
+		}
+		rec, ok := billPayments[d.OutTradeNo]
+		if !ok || billAmountFen(rec) != order.TotalAmount {
+			continue
+		}
+
+		p := alipay.TradeQuery{}
+		p.OutTradeNo = d.OutTradeNo
+		result, err := s.alipayService.client.TradeQuery(ctx, p)
+		if err != nil {
+			s.logger.Warn("对账自动修复查询订单失败", zap.String("out_trade_no", d.OutTradeNo), zap.Error(err))
+			continue
+		}
+		if !result.Code.IsSuccess() ||
+			(result.TradeStatus != alipay.TradeStatusSuccess && result.TradeStatus != alipay.TradeStatusFinished) {
+			continue
+		}
+
+		if err := s.markOrderPaidFromBill(ctx, &order, rec, result); err != nil {
+			s.logger.Warn("对账自动修复更新订单失败", zap.String("out_trade_no", d.OutTradeNo), zap.Error(err))
+			continue
+		}
+
+		now := time.Now()
+		d.ResolutionStatus = models.ReconciliationDiffAutoFixed
+		d.ResolvedBy = reconciliationSystemOperator
+		d.ResolvedAt = &now
+		d.LocalStatus = string(models.PaymentStatusCompleted)
+		d.Note = fmt.Sprintf("支付宝查询确认已支付（%s %s），本地订单已置为已支付", result.TradeNo, result.TradeStatus)
+		fixed++
+
+		s.logger.Info("对账差异已自动修复",
+			zap.String("out_trade_no", d.OutTradeNo),
+			zap.String("trade_no", result.TradeNo))
+	}
+	return fixed
+}
+
+// markOrderPaidFromBill 按账单记录将待支付订单置为已支付，并写入支付宝支付记录与交易记录
+// 订单更新带 status = CREATED 条件，并发的支付通知已处理时不重复修复
+// 参数：
+//   - ctx: 上下文
+//   - order: 本地订单
+//   - rec: 支付宝账单中的支付记录，支付时间取账单完成时间
+//   - result: 支付宝交易查询结果
+//
+// 返回：错误信息
+func (s *AlipayReconciliationService) markOrderPaidFromBill(ctx context.Context, order *models.Order, rec BillRecord, result *alipay.TradeQueryRsp) error {
+	paidAt := time.Now()
+	if rec.BillTime != nil {
+		paidAt = *rec.BillTime
+	}
+	tradeNo := result.TradeNo
+	if tradeNo == "" {
+		tradeNo = rec.AlipayTradeNo
+	}
+
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&models.Order{}).
+			Where("id = ? AND status = ?", order.ID, models.OrderStatusCreated).
+			Updates(map[string]interface{}{
+				"status":         models.OrderStatusPaid,
+				"payment_status": models.PaymentStatusCompleted,
+				"paid_at":        paidAt,
+			})
+		if res.Error != nil {
+			return fmt.Errorf("更新订单状态失败: %w", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return errors.New("订单状态已变更")
+		}
+
+		var payment models.AlipayPayment
+		err := tx.Where("order_id = ?", order.ID).First(&payment).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			payment = models.AlipayPayment{
+				OrderID:     order.ID,
+				OutTradeNo:  order.OrderNo,
+				TotalAmount: formatAmount(order.TotalAmount),
+				Subject:     order.Title,
+				Body:        order.Description,
+				AppID:       s.alipayService.config.AppID,
+			}
+		} else if err != nil {
+			return fmt.Errorf("查询支付宝支付记录失败: %w", err)
+		}
+		payment.TradeNo = tradeNo
+		payment.TradeStatus = string(result.TradeStatus)
+		payment.BuyerUserID = result.BuyerUserId
+		payment.BuyerLogonID = result.BuyerLogonId
+		payment.ReceiptAmount = rec.ReceivedAmount
+		payment.TimeEnd = &paidAt
+		payment.SendPayDate = &paidAt
+		if err := tx.Save(&payment).Error; err != nil {
+			return fmt.Errorf("保存支付宝支付记录失败: %w", err)
+		}
+
+		if err := tx.Model(&models.PaymentTransaction{}).
+			Where("order_id = ? AND transaction_id = ?", order.ID, order.OrderNo).
+			Updates(map[string]interface{}{
+				"status":       models.PaymentStatusCompleted,
+				"processed_at": paidAt,
+			}).Error; err != nil {
+			return fmt.Errorf("更新交易记录失败: %w", err)
+		}
+		return nil
+	})
+}
+
+// AlipayReconciliationDiscrepancy 对账差异及所属报告的账单信息
+type AlipayReconciliationDiscrepancy struct {
+	models.AlipayReconciliationDetail
+	BillDate string `json:"bill_date"` // 对账日期
+	BillType string `json:"bill_type"` // 账单类型
+}
+
+// ReconciliationDiscrepancyFilter 差异查询条件，字段为空表示不限
+type ReconciliationDiscrepancyFilter struct {
+	Status    string // 处理状态
+	DiffType  string // 差异类型
+	Assignee  string // 指派的处理人
+	StartDate string // 对账日期起 yyyy-MM-dd（含）
+	EndDate   string // 对账日期止 yyyy-MM-dd（含）
+}
+
+// ListDiscrepancies 跨对账日期查询本租户的差异，仅包含各账单当前版本的报告
+// 参数：
+//   - ctx: 上下文
+//   - filter: 查询条件
+//   - page: 页码
+//   - pageSize: 每页数量
+//
+// 返回：差异列表、总数或错误
+func (s *AlipayReconciliationService) ListDiscrepancies(ctx context.Context, filter ReconciliationDiscrepancyFilter, page, pageSize int) ([]AlipayReconciliationDiscrepancy, int64, error) {
+	query := s.db.WithContext(ctx).Model(&models.AlipayReconciliationDetail{}).
+		Joins("JOIN alipay_reconciliation_reports ON alipay_reconciliation_reports.id = alipay_reconciliation_details.report_id").
+		Where("alipay_reconciliation_reports.tenant_id = ? AND alipay_reconciliation_reports.superseded = ?", s.tenantID, false)
+	if filter.Status != "" {
+		query = query.Where("alipay_reconciliation_details.resolution_status = ?", filter.Status)
+	}
+	if filter.DiffType != "" {
+		query = query.Where("alipay_reconciliation_details.diff_type = ?", filter.DiffType)
+	}
+	if filter.Assignee != "" {
+		query = query.Where("alipay_reconciliation_details.assignee = ?", filter.Assignee)
+	}
+	if filter.StartDate != "" {
+		query = query.Where("alipay_reconciliation_reports.bill_date >= ?", filter.StartDate)
+	}
+	if filter.EndDate != "" {
+		query = query.Where("alipay_reconciliation_reports.bill_date <= ?", filter.EndDate)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var discrepancies []AlipayReconciliationDiscrepancy
+	if err := query.
+		Select("alipay_reconciliation_details.*, alipay_reconciliation_reports.bill_date, alipay_reconciliation_reports.bill_type").
+		Order("alipay_reconciliation_reports.bill_date DESC, alipay_reconciliation_details.id ASC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Scan(&discrepancies).Error; err != nil {
+		return nil, 0, err
+	}
+	return discrepancies, total, nil
+}
+
+// AssignDiscrepancy 将待处理差异指派给财务人员
+// 参数：
+//   - ctx: 上下文
+//   - id: 差异ID
+//   - assignee: 处理人
+//   - note: 备注，为空时保留原备注
+//
+// 返回：更新后的差异或错误
+func (s *AlipayReconciliationService) AssignDiscrepancy(ctx context.Context, id uint, assignee, note string) (*models.AlipayReconciliationDetail, error) {
+	detail, err := s.openDiscrepancy(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	detail.Assignee = assignee
+	if note != "" {
+		detail.Note = note
+	}
+	if err := s.db.WithContext(ctx).Save(detail).Error; err != nil {
+		return nil, err
+	}
+	return detail, nil
+}
+
+// CloseDiscrepancy 人工处理或忽略差异
+// 参数：
+//   - ctx: 上下文
+//   - id: 差异ID
+//   - status: resolved 或 ignored
+//   - operator: 处理人
+//   - note: 处理备注
+//
+// 返回：更新后的差异或错误
+func (s *AlipayReconciliationService) CloseDiscrepancy(ctx context.Context, id uint, status, operator, note string) (*models.AlipayReconciliationDetail, error) {
+	if status != models.ReconciliationDiffResolved && status != models.ReconciliationDiffIgnored {
+		return nil, fmt.Errorf("不支持的处理状态: %s", status)
+	}
+	detail, err := s.openDiscrepancy(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	detail.ResolutionStatus = status
+	detail.ResolvedBy = operator
+	detail.ResolvedAt = &now
+	if note != "" {
+		detail.Note = note
+	}
+	if err := s.db.WithContext(ctx).Save(detail).Error; err != nil {
+		return nil, err
+	}
+	return detail, nil
+}
+
+// openDiscrepancy 查询本租户当前版本报告中待处理的差异，已被取代版本的差异不可再处理
+func (s *AlipayReconciliationService) openDiscrepancy(ctx context.Context, id uint) (*models.AlipayReconciliationDetail, error) {
+	var detail models.AlipayReconciliationDetail
+	err := s.db.WithContext(ctx).Select("alipay_reconciliation_details.*").
+		Joins("JOIN alipay_reconciliation_reports ON alipay_reconciliation_reports.id = alipay_reconciliation_details.report_id").
+		Where("alipay_reconciliation_reports.tenant_id = ? AND alipay_reconciliation_reports.superseded = ?", s.tenantID, false).
+		First(&detail, "alipay_reconciliation_details.id = ?", id).Error
+	if err != nil {
+		return nil, ErrReconciliationDiffNotFound
+	}
+	if detail.ResolutionStatus != models.ReconciliationDiffOpen {
+		return nil, ErrReconciliationDiffClosed
+	}
+	return &detail, nil
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,22 +13,28 @@ import (
 	"time"
 	"unicode/utf8"
 
+	"github.com/google/uuid"
 	alipay "github.com/smartwalle/alipay/v3"
 	"go.uber.org/zap"
 	"golang.org/x/text/encoding/simplifiedchinese"
 	"golang.org/x/text/transform"
 	"gorm.io/gorm"
 
+	"pay-gateway/internal/cache"
 	"pay-gateway/internal/config"
 	"pay-gateway/internal/models"
 )
 
 // AlipayReconciliationService 支付宝对账服务
 type AlipayReconciliationService struct {
-	client *alipay.Client
-	db     *gorm.DB
-	config *config.AlipayConfig
-	logger *zap.Logger
+	client   *alipay.Client
+	db       *gorm.DB
+	config   *config.AlipayConfig
+	logger   *zap.Logger
+	tenantID string // 所属租户，对账报告与本地订单按租户隔离
+
+	alipayService *AlipayService // 同租户支付宝服务，用于自动修复差异（可选）
+	redis         *cache.Redis   // 分布式锁，多副本部署时避免同一账单并发对账（可选）
 }
 
 // NewAlipayReconciliationService 创建对账服务
@@ -48,38 +55,100 @@ func NewAlipayReconciliationService(db *gorm.DB, cfg *config.AlipayConfig, logge
 		}
 	}
 	return &AlipayReconciliationService{
-		client: client,
-		db:     db,
-		config: cfg,
-		logger: logger,
+		client:   client,
+		db:       db,
+		config:   cfg,
+		logger:   logger,
+		tenantID: config.DefaultTenantID,
 	}, nil
 }
 
+// 支付宝账单类型
+const (
+	AlipayBillTypeTrade        = "trade"        // 交易账单（业务明细）
+	AlipayBillTypeSignCustomer = "signcustomer" // 账务明细（资金流水）
+)
+
+// AlipayReconciliationBillTypes 每日对账需要核对的账单类型
+var AlipayReconciliationBillTypes = []string{AlipayBillTypeTrade, AlipayBillTypeSignCustomer}
+
+// 对账记录类型
+const (
+	billRecordPayment = "payment" // 支付
+	billRecordRefund  = "refund"  // 退款
+	billRecordDeduct  = "deduct"  // 周期扣款
+)
+
+// billLocation 支付宝、微信支付账单的日期与时间均为北京时间
+var billLocation = time.FixedZone("CST", 8*3600)
+
 // BillRecord 对账文件中的单笔记录
 type BillRecord struct {
-	OutTradeNo    string // 商户订单号
-	AlipayTradeNo string // 支付宝交易号
-	TradeType     string // 业务类型：交易、退款等
-	Amount        string // 订单金额（元）
-	ReceivedAmount string // 商家实收（元）
+	Kind           string     // 记录类型：payment-支付 refund-退款
+	OutTradeNo     string     // 商户订单号
+	AlipayTradeNo  string     // 支付宝交易号（账务明细为业务流水号）
+	OutRequestNo   string     // 退款批次号/请求号
+	TradeType      string     // 业务类型：交易、退款、在线支付、交易退款等
+	Amount         string     // 订单金额（元），账务明细为收入或支出金额
+	ReceivedAmount string     // 商家实收（元）
+	BillTime       *time.Time // 完成时间（交易账单）或发生时间（账务明细）
+}
+
+// localBillEntry 参与对账的本地记录（订单、周期扣款或退款）
+type localBillEntry struct {
+	Kind         string
+	OutTradeNo   string
+	OutRequestNo string
+	AmountFen    int64
+	Status       string
+	matched      bool
 }
 
 // RunReconciliation 执行对账
-func (s *AlipayReconciliationService) RunReconciliation(ctx context.Context, billDate string) (*models.AlipayReconciliationReport, error) {
-	// 创建对账任务
-	report := &models.AlipayReconciliationReport{
-		BillDate: billDate,
-		BillType: "trade",
-		Status:   "processing",
-		StartedAt: func() *time.Time { t := time.Now(); return &t }(),
+// 每次运行生成一个新版本的报告；成功后在同一事务内写入差异明细并取代之前的版本，
+// 上一版本仍存在的差异沿用其处理状态，失败的运行不影响当前版本
+// 参数：
+//   - ctx: 上下文
+//   - billDate: 对账日期 yyyy-MM-dd（北京时间）
+//   - billType: 账单类型 trade/signcustomer，为空时使用交易账单
+//
+// 返回：对账报告或错误；同一账单正在其他实例对账时返回 ErrReconciliationInProgress
+func (s *AlipayReconciliationService) RunReconciliation(ctx context.Context, billDate, billType string) (*models.AlipayReconciliationReport, error) {
+	if billType == "" {
+		billType = AlipayBillTypeTrade
+	}
+	if billType != AlipayBillTypeTrade && billType != AlipayBillTypeSignCustomer {
+		return nil, fmt.Errorf("不支持的账单类型: %s", billType)
+	}
+	dayStart, dayEnd, err := billDateRange(billDate)
+	if err != nil {
+		return nil, err
+	}
+
+	// 多副本部署时保证同一账单同一时刻只有一个实例在对账
+	if s.redis != nil {
+		lockKey := fmt.Sprintf("%s%s:%s:%s", lockKeyPrefixReconciliation, s.tenantID, billDate, billType)
+		lockToken := uuid.NewString()
+		ok, lockErr := s.redis.SetNX(ctx, lockKey, lockToken, reconciliationLockExpiration)
+		if lockErr != nil {
+			return nil, fmt.Errorf("获取分布式锁失败: %w", lockErr)
+		}
+		if !ok {
+			return nil, ErrReconciliationInProgress
+		}
+		// 只释放自己持有的锁，避免对账超过锁过期时间后误删其他实例的锁
+		defer func() { _, _ = s.redis.DelIfValue(context.Background(), lockKey, lockToken) }()
 	}
-	if err := s.db.Create(report).Error; err != nil {
-		return nil, fmt.Errorf("创建对账任务失败: %v", err)
+
+	// 创建对账任务（新版本）
+	report, err := s.createReport(ctx, billDate, billType)
+	if err != nil {
+		return nil, err
 	}
 
 	// 1. 获取对账文件下载地址
 	req := alipay.BillDownloadURLQuery{
-		BillType: "trade",
+		BillType: billType,
 		BillDate: billDate,
 	}
 	result, err := s.client.BillDownloadURLQuery(ctx, req)
@@ -109,44 +178,90 @@ func (s *AlipayReconciliationService) RunReconciliation(ctx context.Context, bil
 	}
 
 	report.TotalCount = len(records)
-	s.db.Save(report)
+	if err := s.db.Save(report).Error; err != nil {
+		s.failReport(report, fmt.Sprintf("更新对账任务失败: %v", err))
+		return report, fmt.Errorf("更新对账任务失败: %v", err)
+	}
 
-	// 4. 逐笔比对
-	matchCount, diffCount, localOnlyCount, details := s.compareWithLocal(records, billDate)
+	// 4. 逐笔比对：支付与扣款按付款时间、退款按退款时间落在账单日内的本地记录参与比对
+	matchCount, diffCount, localOnlyCount, details, err := s.compareWithLocal(ctx, records, dayStart, dayEnd)
+	if err != nil {
+		s.failReport(report, fmt.Sprintf("比对本地记录失败: %v", err))
+		return report, err
+	}
+
+	// 5. 自动修复可确认的差异，其余差异待人工处理
+	autoFixedCount := s.autoFixDetails(ctx, details, records)
 
 	report.MatchCount = matchCount
 	report.DiffCount = diffCount
 	report.LocalOnlyCount = localOnlyCount
-	report.Status = "completed"
-	now := time.Now()
-	report.CompletedAt = &now
+	report.AutoFixedCount = autoFixedCount
 
-	// 保存差异明细
-	for _, d := range details {
-		d.ReportID = report.ID
-		s.db.Create(&d)
-	}
-
-	if err := s.db.Save(report).Error; err != nil {
+	// 6. 写入差异明细并取代上一版本
+	if err := s.completeReport(ctx, report, details); err != nil {
+		s.failReport(report, fmt.Sprintf("保存对账结果失败: %v", err))
 		return report, fmt.Errorf("保存对账结果失败: %v", err)
 	}
 
 	s.logger.Info("对账完成",
 		zap.String("bill_date", billDate),
+		zap.String("bill_type", billType),
+		zap.Int("version", report.Version),
 		zap.Int("total", report.TotalCount),
 		zap.Int("match", matchCount),
 		zap.Int("diff", diffCount),
-		zap.Int("local_only", localOnlyCount))
+		zap.Int("local_only", localOnlyCount),
+		zap.Int("auto_fixed", autoFixedCount),
+		zap.Int("added", report.AddedDiffCount),
+		zap.Int("removed", report.RemovedDiffCount))
 
 	return report, nil
 }
 
+// RunDailyReconciliation 依次核对交易账单与账务明细，单个账单失败不影响其余账单，其他实例正在对账的账单跳过
+// 返回：已生成的对账报告，以及各账单失败原因的合并错误
+func (s *AlipayReconciliationService) RunDailyReconciliation(ctx context.Context, billDate string) ([]*models.AlipayReconciliationReport, error) {
+	var reports []*models.AlipayReconciliationReport
+	var errs []error
+	for _, billType := range AlipayReconciliationBillTypes {
+		report, err := s.RunReconciliation(ctx, billDate, billType)
+		if report != nil {
+			reports = append(reports, report)
+		}
+		// 多副本定时任务同时触发时，由持有锁的实例完成对账
+		if errors.Is(err, ErrReconciliationInProgress) {
+			s.logger.Info("其他实例正在对账，跳过", zap.String("bill_date", billDate), zap.String("bill_type", billType))
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", billType, err))
+		}
+	}
+	return reports, errors.Join(errs...)
+}
+
+// billDateRange 返回账单日（北京时间）的起止时间，区间左闭右开
+func billDateRange(billDate string) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation("2006-01-02", billDate, billLocation)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("对账日期格式错误，应为 yyyy-MM-dd: %v", err)
+	}
+	return start, start.AddDate(0, 0, 1), nil
+}
+
+// failReport 将对账任务标记为失败，保存失败时记录日志（调用方已在返回原始错误）
 func (s *AlipayReconciliationService) failReport(report *models.AlipayReconciliationReport, msg string) {
 	report.Status = "failed"
 	report.ErrorMessage = msg
 	now := time.Now()
 	report.CompletedAt = &now
-	s.db.Save(report)
+	if err := s.db.Save(report).Error; err != nil {
+		s.logger.Error("保存对账失败状态失败",
+			zap.Uint("report_id", report.ID),
+			zap.String("reason", msg),
+			zap.Error(err))
+	}
 }
 
 func (s *AlipayReconciliationService) downloadFile(ctx context.Context, url string) ([]byte, error) {
@@ -174,28 +289,52 @@ func (s *AlipayReconciliationService) parseBillFile(body []byte, url string) ([]
 	return s.parseCSVBill(body)
 }
 
+// parseZipBill 解析 ZIP 账单中的全部明细 CSV（账单较大时支付宝会拆分为多个明细文件），跳过汇总文件
 func (s *AlipayReconciliationService) parseZipBill(body []byte) ([]BillRecord, error) {
 	reader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
 	if err != nil {
 		return nil, fmt.Errorf("解压ZIP失败: %w", err)
 	}
+	var records []BillRecord
+	found := false
 	for _, f := range reader.File {
-		if strings.HasSuffix(f.Name, ".csv") && !strings.Contains(f.Name, "汇总") {
-			rc, err := f.Open()
-			if err != nil {
-				return nil, err
-			}
-			data, err := io.ReadAll(rc)
-			rc.Close()
-			if err != nil {
-				return nil, err
-			}
-			return s.parseCSVBill(data)
+		name := zipEntryName(f)
+		if !strings.HasSuffix(name, ".csv") || strings.Contains(name, "汇总") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		fileRecords, err := s.parseCSVBill(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		records = append(records, fileRecords...)
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("ZIP中未找到业务明细CSV")
+	}
+	return records, nil
+}
+
+// zipEntryName 返回 ZIP 条目文件名，未标记 UTF-8 的文件名按 GBK 解码
+func zipEntryName(f *zip.File) string {
+	if f.NonUTF8 || !utf8.ValidString(f.Name) {
+		if decoded, err := gbkToUTF8([]byte(f.Name)); err == nil {
+			return string(decoded)
 		}
 	}
-	return nil, fmt.Errorf("ZIP中未找到业务明细CSV")
+	return f.Name
 }
 
+// parseCSVBill 解析交易账单（业务明细）或账务明细 CSV，只保留支付与退款记录
 func (s *AlipayReconciliationService) parseCSVBill(body []byte) ([]BillRecord, error) {
 	// 支付宝对账文件可能为 GBK 或 UTF-8，非 UTF-8 时尝试 GBK 解码
 	utf8Body := body
@@ -215,6 +354,7 @@ func (s *AlipayReconciliationService) parseCSVBill(body []byte) ([]BillRecord, e
 
 	// 查找表头行，确定列索引
 	var outTradeNoIdx, tradeNoIdx, tradeTypeIdx, amountIdx, receivedIdx int = -1, -1, -1, -1, -1
+	var requestNoIdx, finishedIdx, incomeIdx, expenseIdx int = -1, -1, -1, -1
 	var startRow int
 	for i, row := range rows {
 		if len(row) < 3 {
@@ -222,16 +362,25 @@ func (s *AlipayReconciliationService) parseCSVBill(body []byte) ([]BillRecord, e
 		}
 		for j, col := range row {
 			col = strings.TrimSpace(col)
-			if col == "商户订单号" {
+			switch {
+			case col == "商户订单号":
 				outTradeNoIdx = j
-			} else if col == "支付宝交易号" {
+			case col == "支付宝交易号" || col == "业务流水号":
 				tradeNoIdx = j
-			} else if col == "业务类型" {
+			case col == "业务类型":
 				tradeTypeIdx = j
-			} else if col == "订单金额（元）" {
+			case col == "订单金额（元）":
 				amountIdx = j
-			} else if col == "商家实收（元）" {
+			case col == "商家实收（元）":
 				receivedIdx = j
+			case strings.HasPrefix(col, "退款批次号"):
+				requestNoIdx = j
+			case col == "完成时间" || col == "发生时间":
+				finishedIdx = j
+			case strings.HasPrefix(col, "收入金额"):
+				incomeIdx = j
+			case strings.HasPrefix(col, "支出金额"):
+				expenseIdx = j
 			}
 		}
 		if outTradeNoIdx >= 0 {
@@ -243,11 +392,22 @@ func (s *AlipayReconciliationService) parseCSVBill(body []byte) ([]BillRecord, e
 	if outTradeNoIdx < 0 {
 		return nil, fmt.Errorf("未找到对账文件表头，请检查文件格式")
 	}
-	if amountIdx < 0 {
-		amountIdx = outTradeNoIdx + 11
+	// 账务明细没有订单金额列，按收入/支出金额核对
+	fundFlow := incomeIdx >= 0 || expenseIdx >= 0
+	if !fundFlow {
+		if amountIdx < 0 {
+			amountIdx = outTradeNoIdx + 11
+		}
+		if receivedIdx < 0 {
+			receivedIdx = amountIdx + 1
+		}
 	}
-	if receivedIdx < 0 {
-		receivedIdx = amountIdx + 1
+
+	cell := func(row []string, idx int) string {
+		if idx >= 0 && len(row) > idx {
+			return strings.TrimSpace(row[idx])
+		}
+		return ""
 	}
 
 	var records []BillRecord
@@ -260,88 +420,164 @@ func (s *AlipayReconciliationService) parseCSVBill(body []byte) ([]BillRecord, e
 		if outTradeNo == "" || strings.HasPrefix(outTradeNo, "#") {
 			continue
 		}
-		rec := BillRecord{OutTradeNo: outTradeNo}
-		if tradeNoIdx >= 0 && len(row) > tradeNoIdx {
-			rec.AlipayTradeNo = strings.TrimSpace(row[tradeNoIdx])
+		rec := BillRecord{
+			OutTradeNo:    outTradeNo,
+			AlipayTradeNo: cell(row, tradeNoIdx),
+			OutRequestNo:  cell(row, requestNoIdx),
+			TradeType:     cell(row, tradeTypeIdx),
 		}
-		if tradeTypeIdx >= 0 && len(row) > tradeTypeIdx {
-			rec.TradeType = strings.TrimSpace(row[tradeTypeIdx])
+		if fundFlow {
+			rec.Amount = cell(row, incomeIdx)
+			if amountFen, _ := parseBillAmount(rec.Amount); amountFen == 0 {
+				rec.Amount = cell(row, expenseIdx)
+			}
+		} else {
+			rec.Amount = cell(row, amountIdx)
+			rec.ReceivedAmount = cell(row, receivedIdx)
 		}
-		if amountIdx >= 0 && len(row) > amountIdx {
-			rec.Amount = strings.TrimSpace(row[amountIdx])
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", cell(row, finishedIdx), billLocation); err == nil {
+			rec.BillTime = &t
 		}
-		if receivedIdx >= 0 && len(row) > receivedIdx {
-			rec.ReceivedAmount = strings.TrimSpace(row[receivedIdx])
+		// 收费、提现、转账等与订单无关的资金流水不参与对账
+		rec.Kind = classifyBillRecord(rec.TradeType)
+		if rec.Kind == "" {
+			continue
 		}
 		records = append(records, rec)
 	}
 	return records, nil
 }
 
-func (s *AlipayReconciliationService) compareWithLocal(records []BillRecord, billDate string) (matchCount, diffCount, localOnlyCount int, details []models.AlipayReconciliationDetail) {
-	alipayOrderMap := make(map[string]BillRecord)
-	for _, r := range records {
-		if r.OutTradeNo != "" {
-			alipayOrderMap[r.OutTradeNo] = r
+// classifyBillRecord 按业务类型区分支付与退款记录，其余类型返回空
+func classifyBillRecord(tradeType string) string {
+	switch {
+	case strings.Contains(tradeType, "退款"):
+		return billRecordRefund
+	case strings.Contains(tradeType, "交易"), strings.Contains(tradeType, "支付"), strings.Contains(tradeType, "付款"):
+		return billRecordPayment
+	}
+	return ""
+}
+
+// parseBillAmount 解析账单金额（元）为分，退款和支出金额带负号，返回绝对值
+func parseBillAmount(s string) (int64, error) {
+	s = strings.TrimLeft(strings.TrimSpace(s), "+-")
+	return parseAmountFromYuan(s)
+}
+
+// billAmountFen 返回账单记录的核对金额（分），交易账单优先使用商家实收
+func billAmountFen(rec BillRecord) int64 {
+	if rec.ReceivedAmount != "" {
+		if fen, err := parseBillAmount(rec.ReceivedAmount); err == nil {
+			return fen
 		}
 	}
+	fen, _ := parseBillAmount(rec.Amount)
+	return fen
+}
 
-	var localOrders []struct {
-		OrderNo       string
-		TotalAmount   int64
-		PaymentStatus string
+// compareWithLocal 将账单记录与本地记录逐笔比对
+// 支付记录匹配本地订单（按 paid_at）或周期扣款记录（按 deduct_time），退款记录匹配本地退款（按 gmt_refund_pay）
+// 付款或退款时间跨越账单日边界的记录按单号补查，匹配后不计入差异
+func (s *AlipayReconciliationService) compareWithLocal(ctx context.Context, records []BillRecord, dayStart, dayEnd time.Time) (matchCount, diffCount, localOnlyCount int, details []models.AlipayReconciliationDetail, err error) {
+	payments, err := s.loadLocalPayments(ctx,
+		"paid_at >= ? AND paid_at < ?",
+		"alipay_deduct_records.deduct_time >= ? AND alipay_deduct_records.deduct_time < ?",
+		dayStart, dayEnd)
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+	refunds, err := s.loadLocalRefunds(ctx, "alipay_refunds.gmt_refund_pay >= ? AND alipay_refunds.gmt_refund_pay < ?", dayStart, dayEnd)
+	if err != nil {
+		return 0, 0, 0, nil, err
 	}
-	s.db.Model(&models.Order{}).
-		Where("payment_method = ? AND DATE(created_at) = ?", models.PaymentMethodAlipay, billDate).
-		Select("order_no, total_amount, payment_status").
-		Find(&localOrders)
 
-	localOrderMap := make(map[string]struct {
-		TotalAmount   int64
-		PaymentStatus string
-	})
-	for _, o := range localOrders {
-		localOrderMap[o.OrderNo] = struct {
-			TotalAmount   int64
-			PaymentStatus string
-		}{o.TotalAmount, string(o.PaymentStatus)}
+	paymentMap := make(map[string]*localBillEntry, len(payments))
+	for _, p := range payments {
+		paymentMap[p.OutTradeNo] = p
 	}
 
-	matchedLocal := make(map[string]bool)
+	// 补查账单日外的本地记录
+	var missingTradeNos, refundTradeNos []string
+	for _, rec := range records {
+		switch rec.Kind {
+		case billRecordPayment:
+			if paymentMap[rec.OutTradeNo] == nil {
+				missingTradeNos = append(missingTradeNos, rec.OutTradeNo)
+			}
+		case billRecordRefund:
+			refundTradeNos = append(refundTradeNos, rec.OutTradeNo)
+		}
+	}
+	if len(missingTradeNos) > 0 {
+		extra, err := s.loadLocalPayments(ctx, "order_no IN ?", "alipay_deduct_records.out_trade_no IN ?", missingTradeNos)
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		for _, p := range extra {
+			// 账单日外的记录只用于匹配，不参与仅本地有的统计
+			p.matched = true
+			if paymentMap[p.OutTradeNo] == nil {
+				paymentMap[p.OutTradeNo] = p
+			}
+		}
+	}
+	refundCandidates := refunds
+	if len(refundTradeNos) > 0 {
+		extra, err := s.loadLocalRefunds(ctx,
+			"alipay_refunds.out_trade_no IN ? AND (alipay_refunds.gmt_refund_pay IS NULL OR alipay_refunds.gmt_refund_pay < ? OR alipay_refunds.gmt_refund_pay >= ?)",
+			refundTradeNos, dayStart, dayEnd)
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		for _, r := range extra {
+			r.matched = true
+		}
+		refundCandidates = append(append([]*localBillEntry{}, refunds...), extra...)
+	}
+	usedRefunds := make(map[*localBillEntry]bool)
 
 	for _, rec := range records {
-		if rec.OutTradeNo == "" {
-			continue
+		billFen := billAmountFen(rec)
+
+		var local *localBillEntry
+		if rec.Kind == billRecordRefund {
+			local = matchLocalRefund(refundCandidates, usedRefunds, rec, billFen)
+		} else {
+			local = paymentMap[rec.OutTradeNo]
 		}
-		local, ok := localOrderMap[rec.OutTradeNo]
-		if !ok {
+
+		if local == nil {
 			details = append(details, models.AlipayReconciliationDetail{
 				OutTradeNo:      rec.OutTradeNo,
 				AlipayTradeNo:   rec.AlipayTradeNo,
+				RecordType:      rec.Kind,
+				OutRequestNo:    rec.OutRequestNo,
 				DiffType:        "alipay_only",
 				AlipayAmount:    rec.Amount,
 				AlipayTradeType: rec.TradeType,
+				BillTime:        rec.BillTime,
 			})
 			diffCount++
 			continue
 		}
-		matchedLocal[rec.OutTradeNo] = true
-
-		localAmountFen := local.TotalAmount
-		alipayAmountFen, _ := parseAmountFromYuan(rec.Amount)
-		if rec.ReceivedAmount != "" {
-			alipayAmountFen, _ = parseAmountFromYuan(rec.ReceivedAmount)
+		local.matched = true
+		if rec.Kind == billRecordRefund {
+			usedRefunds[local] = true
 		}
 
-		if alipayAmountFen != localAmountFen {
+		if billFen != local.AmountFen {
 			details = append(details, models.AlipayReconciliationDetail{
 				OutTradeNo:    rec.OutTradeNo,
 				AlipayTradeNo: rec.AlipayTradeNo,
+				RecordType:    local.Kind,
+				OutRequestNo:  local.OutRequestNo,
 				DiffType:      "amount_mismatch",
 				AlipayAmount:  rec.Amount,
-				LocalAmount:   localAmountFen,
+				LocalAmount:   local.AmountFen,
 				AlipayStatus:  rec.TradeType,
-				LocalStatus:   local.PaymentStatus,
+				LocalStatus:   local.Status,
+				BillTime:      rec.BillTime,
 			})
 			diffCount++
 		} else {
@@ -349,20 +585,122 @@ func (s *AlipayReconciliationService) compareWithLocal(records []BillRecord, bil
 		}
 	}
 
-	for orderNo := range localOrderMap {
-		if !matchedLocal[orderNo] {
-			local := localOrderMap[orderNo]
-			details = append(details, models.AlipayReconciliationDetail{
-				OutTradeNo:   orderNo,
-				DiffType:     "local_only",
-				LocalAmount:  local.TotalAmount,
-				LocalStatus:  local.PaymentStatus,
-			})
-			localOnlyCount++
+	for _, local := range append(payments, refunds...) {
+		if local.matched {
+			continue
+		}
+		details = append(details, models.AlipayReconciliationDetail{
+			OutTradeNo:   local.OutTradeNo,
+			RecordType:   local.Kind,
+			OutRequestNo: local.OutRequestNo,
+			DiffType:     "local_only",
+			LocalAmount:  local.AmountFen,
+			LocalStatus:  local.Status,
+		})
+		localOnlyCount++
+	}
+
+	return matchCount, diffCount, localOnlyCount, details, nil
+}
+
+// matchLocalRefund 为账单退款记录查找本地退款：优先按退款请求号，其次按商户订单号与金额，最后按商户订单号
+func matchLocalRefund(candidates []*localBillEntry, used map[*localBillEntry]bool, rec BillRecord, billFen int64) *localBillEntry {
+	if rec.OutRequestNo != "" {
+		for _, r := range candidates {
+			if !used[r] && r.OutRequestNo == rec.OutRequestNo {
+				return r
+			}
 		}
 	}
+	var fallback *localBillEntry
+	for _, r := range candidates {
+		if used[r] || r.OutTradeNo != rec.OutTradeNo {
+			continue
+		}
+		if r.AmountFen == billFen {
+			return r
+		}
+		if fallback == nil {
+			fallback = r
+		}
+	}
+	return fallback
+}
+
+// loadLocalPayments 查询本租户的支付宝订单与成功的周期扣款记录
+// 参数：
+//   - ctx: 上下文
+//   - orderWhere: 订单查询条件
+//   - deductWhere: 扣款记录查询条件，与订单条件使用相同参数
+//   - args: 查询参数
+//
+// 返回：本地支付记录
+func (s *AlipayReconciliationService) loadLocalPayments(ctx context.Context, orderWhere, deductWhere string, args ...interface{}) ([]*localBillEntry, error) {
+	var orders []struct {
+		OrderNo       string
+		TotalAmount   int64
+		PaymentStatus string
+	}
+	if err := s.db.WithContext(ctx).Model(&models.Order{}).Scopes(tenantScope(s.tenantID)).
+		Where("payment_method = ? AND paid_at IS NOT NULL", models.PaymentMethodAlipay).
+		Where(orderWhere, args...).
+		Select("order_no, total_amount, payment_status").
+		Find(&orders).Error; err != nil {
+		return nil, fmt.Errorf("查询本地订单失败: %w", err)
+	}
+
+	var deducts []models.AlipayDeductRecord
+	if err := s.db.WithContext(ctx).Model(&models.AlipayDeductRecord{}).
+		Joins("JOIN alipay_subscriptions ON alipay_subscriptions.id = alipay_deduct_records.subscription_id").
+		Where("alipay_subscriptions.tenant_id = ? AND alipay_deduct_records.status = ?", s.tenantID, "SUCCESS").
+		Where(deductWhere, args...).
+		Find(&deducts).Error; err != nil {
+		return nil, fmt.Errorf("查询周期扣款记录失败: %w", err)
+	}
+
+	entries := make([]*localBillEntry, 0, len(orders)+len(deducts))
+	for _, o := range orders {
+		entries = append(entries, &localBillEntry{
+			Kind:       billRecordPayment,
+			OutTradeNo: o.OrderNo,
+			AmountFen:  o.TotalAmount,
+			Status:     o.PaymentStatus,
+		})
+	}
+	for _, d := range deducts {
+		amountFen, _ := parseAmountFromYuan(d.Amount)
+		entries = append(entries, &localBillEntry{
+			Kind:       billRecordDeduct,
+			OutTradeNo: d.OutTradeNo,
+			AmountFen:  amountFen,
+			Status:     d.Status,
+		})
+	}
+	return entries, nil
+}
 
-	return matchCount, diffCount, localOnlyCount, details
+// loadLocalRefunds 查询本租户已成功的支付宝退款记录
+func (s *AlipayReconciliationService) loadLocalRefunds(ctx context.Context, where string, args ...interface{}) ([]*localBillEntry, error) {
+	var refunds []models.AlipayRefund
+	if err := s.db.WithContext(ctx).Model(&models.AlipayRefund{}).
+		Joins("JOIN orders ON orders.id = alipay_refunds.order_id").
+		Where("orders.tenant_id = ? AND alipay_refunds.refund_status = ?", s.tenantID, "REFUND_SUCCESS").
+		Where(where, args...).
+		Find(&refunds).Error; err != nil {
+		return nil, fmt.Errorf("查询本地退款记录失败: %w", err)
+	}
+
+	entries := make([]*localBillEntry, 0, len(refunds))
+	for _, r := range refunds {
+		entries = append(entries, &localBillEntry{
+			Kind:         billRecordRefund,
+			OutTradeNo:   r.OutTradeNo,
+			OutRequestNo: r.OutRequestNo,
+			AmountFen:    parseRefundAmount(r.RefundAmount),
+			Status:       r.RefundStatus,
+		})
+	}
+	return entries, nil
 }
 
 // gbkToUTF8 将 GBK 编码转为 UTF-8，失败时返回原字节
@@ -374,24 +712,30 @@ func gbkToUTF8(b []byte) ([]byte, error) {
 // GetReconciliationReport 查询对账报告
 func (s *AlipayReconciliationService) GetReconciliationReport(ctx context.Context, reportID uint) (*models.AlipayReconciliationReport, []models.AlipayReconciliationDetail, error) {
 	var report models.AlipayReconciliationReport
-	if err := s.db.First(&report, reportID).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).First(&report, reportID).Error; err != nil {
 		return nil, nil, fmt.Errorf("对账报告不存在: %v", err)
 	}
 	var details []models.AlipayReconciliationDetail
-	s.db.Where("report_id = ?", reportID).Find(&details)
+	if err := s.db.Where("report_id = ?", reportID).Find(&details).Error; err != nil {
+		return nil, nil, fmt.Errorf("查询差异明细失败: %v", err)
+	}
 	return &report, details, nil
 }
 
 // ListReconciliationReports 列出对账报告
-func (s *AlipayReconciliationService) ListReconciliationReports(ctx context.Context, billDate string, limit int) ([]models.AlipayReconciliationReport, error) {
+// allVersions 为 false 时不返回已被取代的版本
+func (s *AlipayReconciliationService) ListReconciliationReports(ctx context.Context, billDate string, allVersions bool, limit int) ([]models.AlipayReconciliationReport, error) {
 	if limit <= 0 {
 		limit = 20
 	}
 	var reports []models.AlipayReconciliationReport
-	query := s.db.Order("created_at DESC").Limit(limit)
+	query := s.db.Scopes(tenantScope(s.tenantID)).Order("created_at DESC").Limit(limit)
 	if billDate != "" {
 		query = query.Where("bill_date = ?", billDate)
 	}
+	if !allVersions {
+		query = query.Where("superseded = ?", false)
+	}
 	if err := query.Find(&reports).Error; err != nil {
 		return nil, err
 	}
@@ -0,0 +1,200 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"pay-gateway/internal/cache"
+	"pay-gateway/internal/models"
+)
+
+const (
+	lockKeyPrefixReconciliation  = "alipay:reconciliation:lock:"
+	reconciliationLockExpiration = 10 * time.Minute
+	reconciliationDetailBatch    = 200
+)
+
+// ErrReconciliationInProgress 同一账单正在对账（其他实例或并发请求持有锁）
+var ErrReconciliationInProgress = errors.New("该账单正在对账，请稍后重试")
+
+// SetRedis 设置 Redis，用于多副本部署时的对账分布式锁
+// 未设置时仅依赖报告版本唯一索引防止重复写入
+func (s *AlipayReconciliationService) SetRedis(redis *cache.Redis) {
+	s.redis = redis
+}
+
+// createReport 创建新版本的对账任务，版本号在同一租户、账单日、账单类型内递增
+// 并发创建同一版本时由唯一索引拒绝
+func (s *AlipayReconciliationService) createReport(ctx context.Context, billDate, billType string) (*models.AlipayReconciliationReport, error) {
+	var latest int
+	if err := s.db.WithContext(ctx).Model(&models.AlipayReconciliationReport{}).Scopes(tenantScope(s.tenantID)).
+		Where("bill_date = ? AND bill_type = ?", billDate, billType).
+		Select("COALESCE(MAX(version), 0)").
+		Scan(&latest).Error; err != nil {
+		return nil, fmt.Errorf("查询对账版本失败: %v", err)
+	}
+
+	report := &models.AlipayReconciliationReport{
+		TenantID:  s.tenantID,
+		BillDate:  billDate,
+		BillType:  billType,
+		Version:   latest + 1,
+		Status:    "processing",
+		StartedAt: func() *time.Time { t := time.Now(); return &t }(),
+	}
+	if err := s.db.WithContext(ctx).Create(report).Error; err != nil {
+		return nil, fmt.Errorf("创建对账任务失败: %v", err)
+	}
+	return report, nil
+}
+
+// completeReport 在同一事务内写入差异明细、沿用上一版本的处理状态、取代上一版本并完成本次报告
+// 任一步骤失败整体回滚，上一版本保持为当前版本
+func (s *AlipayReconciliationService) completeReport(ctx context.Context, report *models.AlipayReconciliationReport, details []models.AlipayReconciliationDetail) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		sameBill := func(db *gorm.DB) *gorm.DB {
+			return db.Scopes(tenantScope(s.tenantID)).
+				Where("bill_date = ? AND bill_type = ? AND status = ? AND superseded = ? AND id <> ?",
+					report.BillDate, report.BillType, "completed", false, report.ID)
+		}
+
+		var previous models.AlipayReconciliationReport
+		err := tx.Scopes(sameBill).Order("version DESC").First(&previous).Error
+		switch {
+		case err == nil:
+			var previousDetails []models.AlipayReconciliationDetail
+			if err := tx.Where("report_id = ?", previous.ID).Find(&previousDetails).Error; err != nil {
+				return fmt.Errorf("查询上一版本差异失败: %w", err)
+			}
+			report.PreviousReportID = &previous.ID
+			report.AddedDiffCount, report.RemovedDiffCount = carryOverResolutions(details, previousDetails)
+
+			if err := tx.Model(&models.AlipayReconciliationReport{}).Scopes(sameBill).
+				Update("superseded", true).Error; err != nil {
+				return fmt.Errorf("取代上一版本失败: %w", err)
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			report.AddedDiffCount = len(details)
+		default:
+			return fmt.Errorf("查询上一版本失败: %w", err)
+		}
+
+		for i := range details {
+			details[i].ReportID = report.ID
+		}
+		if len(details) > 0 {
+			if err := tx.CreateInBatches(details, reconciliationDetailBatch).Error; err != nil {
+				return fmt.Errorf("写入差异明细失败: %w", err)
+			}
+		}
+
+		report.Status = "completed"
+		now := time.Now()
+		report.CompletedAt = &now
+		return tx.Save(report).Error
+	})
+}
+
+// reconciliationDiffKey 差异的比对键：同一记录、同一差异类型视为同一差异
+func reconciliationDiffKey(d *models.AlipayReconciliationDetail) string {
+	return strings.Join([]string{d.RecordType, d.OutTradeNo, d.OutRequestNo, d.DiffType}, "|")
+}
+
+// carryOverResolutions 本次差异在上一版本中已存在时沿用其指派与处理状态（本次自动修复的除外）
+// 返回：新增差异数、上一版本中已消失的差异数
+func carryOverResolutions(current, previous []models.AlipayReconciliationDetail) (added, removed int) {
+	remaining := make(map[string][]*models.AlipayReconciliationDetail, len(previous))
+	for i := range previous {
+		key := reconciliationDiffKey(&previous[i])
+		remaining[key] = append(remaining[key], &previous[i])
+	}
+
+	matched := 0
+	for i := range current {
+		d := &current[i]
+		key := reconciliationDiffKey(d)
+		candidates := remaining[key]
+		if len(candidates) == 0 {
+			added++
+			continue
+		}
+		prev := candidates[0]
+		remaining[key] = candidates[1:]
+		matched++
+		if d.ResolutionStatus != "" && d.ResolutionStatus != models.ReconciliationDiffOpen {
+			continue
+		}
+		d.ResolutionStatus = prev.ResolutionStatus
+		d.Assignee = prev.Assignee
+		d.Note = prev.Note
+		d.ResolvedBy = prev.ResolvedBy
+		d.ResolvedAt = prev.ResolvedAt
+	}
+	return added, len(previous) - matched
+}
+
+// ReconciliationReportChanges 对账报告与上一版本的差异变化
+type ReconciliationReportChanges struct {
+	ReportID         uint                                `json:"report_id"`
+	Version          int                                 `json:"version"`
+	PreviousReportID *uint                               `json:"previous_report_id,omitempty"`
+	PreviousVersion  int                                 `json:"previous_version,omitempty"`
+	Added            []models.AlipayReconciliationDetail `json:"added"`     // 本版本新增的差异
+	Removed          []models.AlipayReconciliationDetail `json:"removed"`   // 上一版本有、本版本已消失的差异
+	Unchanged        int                                 `json:"unchanged"` // 两个版本都存在的差异数
+}
+
+// GetReportChanges 对比对账报告与其取代的上一版本，返回新增、消失的差异
+// 首个版本没有上一版本，全部差异视为新增
+func (s *AlipayReconciliationService) GetReportChanges(ctx context.Context, reportID uint) (*ReconciliationReportChanges, error) {
+	report, details, err := s.GetReconciliationReport(ctx, reportID)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &ReconciliationReportChanges{
+		ReportID:         report.ID,
+		Version:          report.Version,
+		PreviousReportID: report.PreviousReportID,
+		Added:            []models.AlipayReconciliationDetail{},
+		Removed:          []models.AlipayReconciliationDetail{},
+	}
+	if report.PreviousReportID == nil {
+		changes.Added = append(changes.Added, details...)
+		return changes, nil
+	}
+
+	previous, previousDetails, err := s.GetReconciliationReport(ctx, *report.PreviousReportID)
+	if err != nil {
+		return nil, err
+	}
+	changes.PreviousVersion = previous.Version
+
+	remaining := make(map[string][]models.AlipayReconciliationDetail, len(previousDetails))
+	for _, d := range previousDetails {
+		key := reconciliationDiffKey(&d)
+		remaining[key] = append(remaining[key], d)
+	}
+	for _, d := range details {
+		key := reconciliationDiffKey(&d)
+		if prev := remaining[key]; len(prev) > 0 {
+			remaining[key] = prev[1:]
+			changes.Unchanged++
+			continue
+		}
+		changes.Added = append(changes.Added, d)
+	}
+	for _, d := range previousDetails {
+		key := reconciliationDiffKey(&d)
+		if prev := remaining[key]; len(prev) > 0 && prev[0].ID == d.ID {
+			remaining[key] = prev[1:]
+			changes.Removed = append(changes.Removed, d)
+		}
+	}
+	return changes, nil
+}
@@ -33,7 +33,9 @@ type AlipayService struct {
 	db                       *gorm.DB
 	config                   *config.AlipayConfig
 	redis                    *cache.Redis // 可选，用于分布式锁
+	dunning                  *DunningPolicy
 	orderDelayCancelProducer OrderDelayCancelSender
+	tenantID                 string // 所属租户，订单与签约记录按租户隔离
 }
 
 // SetOrderDelayCancelProducer 注入订单延迟取消消息生产者
@@ -71,10 +73,12 @@ func NewAlipayService(db *gorm.DB, cfg *config.AlipayConfig, redis *cache.Redis)
 	}
 
 	return &AlipayService{
-		client: client,
-		db:     db,
-		config: cfg,
-		redis:  redis,
+		client:   client,
+		db:       db,
+		config:   cfg,
+		redis:    redis,
+		dunning:  NewDunningPolicy(cfg),
+		tenantID: config.DefaultTenantID,
 	}, nil
 }
 
@@ -83,7 +87,7 @@ func (s *AlipayService) CreateOrder(ctx context.Context, req *CreateAlipayOrderR
 	// 1. 防重复下单：检查是否存在同用户、同商品、未支付的待支付订单（且未过期）
 	if !req.AllowDuplicate {
 		var existingOrder models.Order
-		err := s.db.Where("user_id = ? AND product_id = ? AND payment_method = ? AND payment_status = ?",
+		err := s.db.Scopes(tenantScope(s.tenantID)).Where("user_id = ? AND product_id = ? AND payment_method = ? AND payment_status = ?",
 			req.UserID, req.ProductID, models.PaymentMethodAlipay, models.PaymentStatusPending).
 			Where("(expired_at IS NULL OR expired_at > ?)", time.Now()).
 			Order("created_at DESC").
@@ -109,6 +113,7 @@ func (s *AlipayService) CreateOrder(ctx context.Context, req *CreateAlipayOrderR
 	// 创建订单
 	order := &models.Order{
 		OrderNo:       orderNo,
+		TenantID:      s.tenantID,
 		UserID:        req.UserID,
 		ProductID:     req.ProductID,
 		Type:          models.OrderTypePurchase,
@@ -201,7 +206,7 @@ func (s *AlipayService) validateOrderForPayment(order *models.Order) error {
 func (s *AlipayService) CreateWapPayment(ctx context.Context, orderNo string) (string, error) {
 	// 查询订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", orderNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", orderNo).First(&order).Error; err != nil {
 		return "", fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -239,7 +244,7 @@ func (s *AlipayService) CreateWapPayment(ctx context.Context, orderNo string) (s
 func (s *AlipayService) CreatePagePayment(ctx context.Context, orderNo string) (string, error) {
 	// 查询订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", orderNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", orderNo).First(&order).Error; err != nil {
 		return "", fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -277,7 +282,7 @@ func (s *AlipayService) CreatePagePayment(ctx context.Context, orderNo string) (
 func (s *AlipayService) CreateAppPayment(ctx context.Context, orderNo string) (string, error) {
 	// 查询订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", orderNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", orderNo).First(&order).Error; err != nil {
 		return "", fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -344,7 +349,7 @@ func (s *AlipayService) HandleNotify(ctx context.Context, notifyData map[string]
 
 	// 查询订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", outTradeNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", outTradeNo).First(&order).Error; err != nil {
 		return fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -451,7 +456,7 @@ func (s *AlipayService) HandleNotify(ctx context.Context, notifyData map[string]
 func (s *AlipayService) QueryOrder(ctx context.Context, orderNo string) (*QueryAlipayOrderResponse, error) {
 	// 查询本地订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", orderNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", orderNo).First(&order).Error; err != nil {
 		return nil, fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -508,7 +513,7 @@ func (s *AlipayService) QueryOrder(ctx context.Context, orderNo string) (*QueryA
 func (s *AlipayService) SyncPendingOrders(ctx context.Context) (syncedCount int, err error) {
 	now := time.Now()
 	var orders []models.Order
-	err = s.db.WithContext(ctx).
+	err = s.db.WithContext(ctx).Scopes(tenantScope(s.tenantID)).
 		Where("payment_method = ? AND payment_status = ? AND status = ?",
 			models.PaymentMethodAlipay, models.PaymentStatusPending, models.OrderStatusCreated).
 		Where("(expired_at IS NULL OR expired_at > ?)", now).
@@ -531,7 +536,7 @@ func (s *AlipayService) SyncPendingOrders(ctx context.Context) (syncedCount int,
 func (s *AlipayService) Refund(ctx context.Context, req *RefundRequest) (*RefundResponse, error) {
 	// 查询订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", req.OrderNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", req.OrderNo).First(&order).Error; err != nil {
 		return nil, fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -696,6 +701,7 @@ func (s *AlipayService) CreateSubscription(ctx context.Context, req *CreateAlipa
 	// 创建订单记录
 	order := &models.Order{
 		OrderNo:       outRequestNo,
+		TenantID:      s.tenantID,
 		UserID:        req.UserID,
 		ProductID:     req.ProductID,
 		Type:          models.OrderTypeSubscription,
@@ -724,6 +730,7 @@ func (s *AlipayService) CreateSubscription(ctx context.Context, req *CreateAlipa
 
 	// 创建周期扣款记录
 	subscription := &models.AlipaySubscription{
+		TenantID:            s.tenantID,
 		OrderID:             order.ID,
 		OutRequestNo:        outRequestNo,
 		PeriodType:          req.PeriodType,
@@ -790,7 +797,7 @@ func (s *AlipayService) CreateSubscription(ctx context.Context, req *CreateAlipa
 // QuerySubscription 查询周期扣款状态
 func (s *AlipayService) QuerySubscription(ctx context.Context, outRequestNo string) (*QueryAlipaySubscriptionResponse, error) {
 	var subscription models.AlipaySubscription
-	if err := s.db.Where("out_request_no = ?", outRequestNo).First(&subscription).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("out_request_no = ?", outRequestNo).First(&subscription).Error; err != nil {
 		return nil, fmt.Errorf("周期扣款协议不存在: %v", err)
 	}
 
@@ -865,6 +872,7 @@ func (s *AlipayService) CreateWithholdAgreement(ctx context.Context, req *Create
 	}
 
 	agreement := &models.AlipayWithholdAgreement{
+		TenantID:            s.tenantID,
 		UserID:              req.UserID,
 		OutRequestNo:        outRequestNo,
 		Status:              "TEMP",
@@ -912,7 +920,7 @@ func (s *AlipayService) HandleWithholdNotify(ctx context.Context, notifyData map
 	status := notifyData["status"]
 
 	var agreement models.AlipayWithholdAgreement
-	if err := s.db.Where("out_request_no = ?", outRequestNo).First(&agreement).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("out_request_no = ?", outRequestNo).First(&agreement).Error; err != nil {
 		return fmt.Errorf("免密签约记录不存在: %v", err)
 	}
 
@@ -946,7 +954,7 @@ func (s *AlipayService) HandleWithholdNotify(ctx context.Context, notifyData map
 // ExecuteWithhold 执行单次代扣（免密支付）
 func (s *AlipayService) ExecuteWithhold(ctx context.Context, req *ExecuteWithholdRequest) (*ExecuteWithholdResponse, error) {
 	var agreement models.AlipayWithholdAgreement
-	if err := s.db.Where("agreement_no = ? AND user_id = ? AND status = ?", req.AgreementNo, req.UserID, "NORMAL").First(&agreement).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("agreement_no = ? AND user_id = ? AND status = ?", req.AgreementNo, req.UserID, "NORMAL").First(&agreement).Error; err != nil {
 		return nil, fmt.Errorf("免密协议不存在或已失效: %v", err)
 	}
 
@@ -954,6 +962,7 @@ func (s *AlipayService) ExecuteWithhold(ctx context.Context, req *ExecuteWithhol
 
 	order := &models.Order{
 		OrderNo:       orderNo,
+		TenantID:      s.tenantID,
 		UserID:        req.UserID,
 		ProductID:     req.ProductID,
 		Type:          models.OrderTypePurchase,
@@ -1063,7 +1072,7 @@ func (s *AlipayService) ExecuteWithhold(ctx context.Context, req *ExecuteWithhol
 // QueryWithholdAgreement 查询免密签约状态
 func (s *AlipayService) QueryWithholdAgreement(ctx context.Context, outRequestNo string) (*QueryWithholdAgreementResponse, error) {
 	var agreement models.AlipayWithholdAgreement
-	if err := s.db.Where("out_request_no = ?", outRequestNo).First(&agreement).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("out_request_no = ?", outRequestNo).First(&agreement).Error; err != nil {
 		return nil, fmt.Errorf("免密签约记录不存在: %v", err)
 	}
 
@@ -1110,13 +1119,15 @@ func (s *AlipayService) buildSubscriptionResponse(subscription *models.AlipaySub
 		NextDeductTime:      subscription.NextDeductTime,
 		DeductSuccessCount:  subscription.DeductSuccessCount,
 		DeductFailCount:     subscription.DeductFailCount,
+		DunningState:        subscription.DunningState,
+		GraceExpiresAt:      subscription.GraceExpiresAt,
 	}
 }
 
 // CancelSubscription 解约（取消周期扣款）
 func (s *AlipayService) CancelSubscription(ctx context.Context, req *CancelAlipaySubscriptionRequest) error {
 	var subscription models.AlipaySubscription
-	if err := s.db.Where("out_request_no = ? OR agreement_no = ?", req.OutRequestNo, req.AgreementNo).First(&subscription).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("out_request_no = ? OR agreement_no = ?", req.OutRequestNo, req.AgreementNo).First(&subscription).Error; err != nil {
 		return fmt.Errorf("周期扣款协议不存在: %v", err)
 	}
 
@@ -1177,7 +1188,7 @@ func (s *AlipayService) HandleSubscriptionNotify(ctx context.Context, notifyData
 
 	// 查询周期扣款记录
 	var subscription models.AlipaySubscription
-	if err := s.db.Where("out_request_no = ? OR agreement_no = ?", outRequestNo, agreementNo).First(&subscription).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("out_request_no = ? OR agreement_no = ?", outRequestNo, agreementNo).First(&subscription).Error; err != nil {
 		return fmt.Errorf("周期扣款协议不存在: %v", err)
 	}
 
@@ -1203,6 +1214,10 @@ func (s *AlipayService) HandleSubscriptionNotify(ctx context.Context, notifyData
 				subscription.InvalidTime = &t
 			}
 		}
+		// 签约成功后首期扣款时间即首次执行时间，由扣款调度任务发起
+		if subscription.NextDeductTime == nil && subscription.CurrentPeriod == 0 {
+			subscription.NextDeductTime = subscription.ExecutionTime
+		}
 	} else if status == "STOP" {
 		// 解约
 		subscription.CancelTime = &now
@@ -1248,45 +1263,53 @@ func (s *AlipayService) HandleDeductNotify(ctx context.Context, notifyData map[s
 	}
 
 	// 3. 幂等性：检查 trade_no 或 out_trade_no 是否已处理
+	// 失败通知不带 trade_no，仅按 out_trade_no 去重，避免空交易号匹配到其他失败记录
 	var existingRecord models.AlipayDeductRecord
-	if err := s.db.Where("trade_no = ? OR out_trade_no = ?", tradeNo, outTradeNo).First(&existingRecord).Error; err == nil {
+	dedupQuery := s.db.Where("out_trade_no = ?", outTradeNo)
+	if tradeNo != "" {
+		dedupQuery = s.db.Where("trade_no = ? OR out_trade_no = ?", tradeNo, outTradeNo)
+	}
+	if err := dedupQuery.First(&existingRecord).Error; err == nil {
 		return nil // 已处理过，直接返回成功
 	}
 
 	// 查询周期扣款记录
 	var subscription models.AlipaySubscription
-	if err := s.db.Where("agreement_no = ?", agreementNo).First(&subscription).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("agreement_no = ?", agreementNo).First(&subscription).Error; err != nil {
 		return fmt.Errorf("周期扣款协议不存在: %v", err)
 	}
 
+	return s.recordDeductResult(ctx, &subscription, outTradeNo, tradeNo, amount, status)
+}
+
+// recordDeductResult 记录一次周期扣款结果：更新扣款统计、推进下次扣款时间并写入扣款记录
+// 由扣款通知与服务端扣款调度共用，调用方需持有 out_trade_no 维度的分布式锁
+func (s *AlipayService) recordDeductResult(ctx context.Context, subscription *models.AlipaySubscription, outTradeNo, tradeNo, amount, status string) error {
 	// 更新扣款统计
 	now := time.Now()
 	subscription.LastDeductTime = &now
 	subscription.LastDeductAmount = amount
 	subscription.LastDeductStatus = status
 
+	prevDunningState := subscription.DunningState
 	if status == "SUCCESS" {
 		subscription.DeductSuccessCount++
 		subscription.CurrentPeriod++
+		resetDunning(subscription)
+		// 计算下次扣款时间
+		if next := nextDeductTime(subscription); next != nil {
+			subscription.NextDeductTime = next
+		}
 	} else {
 		subscription.DeductFailCount++
-	}
-
-	// 计算下次扣款时间
-	if subscription.ExecutionTime != nil {
-		var nextTime time.Time
-		if subscription.PeriodType == "MONTH" {
-			nextTime = subscription.ExecutionTime.AddDate(0, subscription.Period*subscription.CurrentPeriod, 0)
-		} else if subscription.PeriodType == "DAY" {
-			nextTime = subscription.ExecutionTime.AddDate(0, 0, subscription.Period*subscription.CurrentPeriod)
-		}
-		subscription.NextDeductTime = &nextTime
+		// 按催缴策略安排重试或挂起
+		s.applyDunningFailure(subscription, now)
 	}
 
 	// 开启事务
-	tx := s.db.Begin()
+	tx := s.db.WithContext(ctx).Begin()
 
-	if err := tx.Save(&subscription).Error; err != nil {
+	if err := tx.Save(subscription).Error; err != nil {
 		tx.Rollback()
 		return fmt.Errorf("更新周期扣款状态失败: %v", err)
 	}
@@ -1295,7 +1318,7 @@ func (s *AlipayService) HandleDeductNotify(ctx context.Context, notifyData map[s
 	deductRecord := &models.AlipayDeductRecord{
 		SubscriptionID: subscription.ID,
 		OrderID:        subscription.OrderID,
-		AgreementNo:    agreementNo,
+		AgreementNo:    subscription.AgreementNo,
 		OutTradeNo:     outTradeNo,
 		TradeNo:        tradeNo,
 		Amount:         amount,
@@ -1311,7 +1334,24 @@ func (s *AlipayService) HandleDeductNotify(ctx context.Context, notifyData map[s
 		return fmt.Errorf("提交事务失败: %v", err)
 	}
 
-	return nil
+	return s.syncDunningEntitlement(ctx, subscription, prevDunningState)
+}
+
+// nextDeductTime 按周期规则计算第 CurrentPeriod+1 期的扣款时间，未设置首次执行时间时返回 nil
+func nextDeductTime(subscription *models.AlipaySubscription) *time.Time {
+	if subscription.ExecutionTime == nil {
+		return nil
+	}
+	var nextTime time.Time
+	switch subscription.PeriodType {
+	case "MONTH":
+		nextTime = subscription.ExecutionTime.AddDate(0, subscription.Period*subscription.CurrentPeriod, 0)
+	case "DAY":
+		nextTime = subscription.ExecutionTime.AddDate(0, 0, subscription.Period*subscription.CurrentPeriod)
+	default:
+		return nil
+	}
+	return &nextTime
 }
 
 // ==================== 请求和响应结构体 ====================
@@ -1400,6 +1440,10 @@ type QueryAlipaySubscriptionResponse struct {
 	NextDeductTime      *time.Time `json:"next_deduct_time,omitempty"`
 	DeductSuccessCount  int        `json:"deduct_success_count"`
 	DeductFailCount     int        `json:"deduct_fail_count"`
+
+	// 催缴
+	DunningState   models.DunningState `json:"dunning_state,omitempty"`
+	GraceExpiresAt *time.Time          `json:"grace_expires_at,omitempty"`
 }
 
 type CancelAlipaySubscriptionRequest struct {
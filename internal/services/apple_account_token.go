@@ -0,0 +1,344 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"pay-gateway/internal/models"
+)
+
+// Apple 待关联交易来源
+const (
+	appleOrphanSourceVerify       = "VERIFY"
+	appleOrphanSourceNotification = "NOTIFICATION"
+)
+
+var (
+	// ErrAppleAppAccountTokenMismatch 交易的 appAccountToken 与订单不一致
+	ErrAppleAppAccountTokenMismatch = errors.New("app account token does not match the order")
+	// ErrAppleTransactionOrphaned 交易缺少 appAccountToken，已进入待关联队列
+	ErrAppleTransactionOrphaned = errors.New("transaction has no app account token, queued for manual linking")
+	// ErrAppleOrphanNotPending 待关联交易已处理
+	ErrAppleOrphanNotPending = errors.New("orphan transaction is not pending")
+	// ErrAppleTransactionAlreadyLinked 交易的支付记录已关联其他订单
+	ErrAppleTransactionAlreadyLinked = errors.New("transaction is already linked to another order")
+)
+
+// NewAppAccountToken 生成 Apple 应用账户令牌
+// 令牌随订单下发给客户端，购买时通过 Product.PurchaseOption.appAccountToken 传给 StoreKit
+func NewAppAccountToken() string {
+	return strings.ToLower(uuid.New().String())
+}
+
+// sameAppAccountToken 比较两个令牌，UUID 不区分大小写
+func sameAppAccountToken(a, b string) bool {
+	return a != "" && strings.EqualFold(a, b)
+}
+
+// checkOrderAppAccountToken 校验交易令牌与订单绑定的令牌一致
+// 家庭共享交易的令牌属于接收方，要求令牌所属用户与订单用户一致
+// 参数：
+//   - ctx: 上下文
+//   - order: 客户端提交的订单
+//   - response: 已验证的交易
+//
+// 返回：交易缺少令牌时返回 ErrAppleTransactionOrphaned，不一致时返回 ErrAppleAppAccountTokenMismatch
+func (s *AppleService) checkOrderAppAccountToken(ctx context.Context, order *models.Order, response *ApplePurchaseResponse) error {
+	if response.AppAccountToken == "" {
+		if err := s.queueOrphanTransaction(ctx, orphanFromPurchase(response, order.ID, "transaction has no app account token")); err != nil {
+			return err
+		}
+		return ErrAppleTransactionOrphaned
+	}
+
+	if isFamilyShared(response.InAppOwnershipType) {
+		owner, err := s.resolveAppAccountTokenOwner(ctx, response.AppAccountToken)
+		if err != nil {
+			return fmt.Errorf("failed to resolve app account token: %w", err)
+		}
+		if owner == nil || owner.UserID != order.UserID {
+			return ErrAppleAppAccountTokenMismatch
+		}
+		return nil
+	}
+
+	if !sameAppAccountToken(order.AppAccountToken, response.AppAccountToken) {
+		return ErrAppleAppAccountTokenMismatch
+	}
+	return nil
+}
+
+// findOrderByAppAccountToken 按 appAccountToken 查找当前应用的 Apple 订单
+// 返回：订单ID，未找到时返回 0
+func (s *AppleService) findOrderByAppAccountToken(ctx context.Context, token string) (uint, error) {
+	if token == "" {
+		return 0, nil
+	}
+
+	var order models.Order
+	err := s.db.WithContext(ctx).
+		Where("app_account_token = ? AND payment_method = ? AND app_id = ?",
+			strings.ToLower(token), models.PaymentMethodAppleStore, s.bundleID).
+		First(&order).Error
+	if err == gorm.ErrRecordNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return order.ID, nil
+}
+
+// orphanFromPurchase 由验证接口的交易构造待关联记录
+func orphanFromPurchase(response *ApplePurchaseResponse, claimedOrderID uint, reason string) *models.AppleOrphanTransaction {
+	return &models.AppleOrphanTransaction{
+		TransactionID:         response.TransactionID,
+		OriginalTransactionID: response.OriginalTransactionID,
+		ProductIDApple:        response.ProductID,
+		BundleID:              response.BundleID,
+		AppAccountToken:       response.AppAccountToken,
+		InAppOwnershipType:    response.InAppOwnershipType,
+		ProductType:           response.ProductType,
+		Quantity:              response.Quantity,
+		PurchaseDate:          &response.PurchaseDate,
+		OriginalPurchaseDate:  &response.OriginalPurchaseDate,
+		ExpiresDate:           response.ExpiresDate,
+		Environment:           response.Environment,
+		SignedTransactionInfo: response.SignedTransactionInfo,
+		Source:                appleOrphanSourceVerify,
+		ClaimedOrderID:        claimedOrderID,
+		Reason:                reason,
+	}
+}
+
+// orphanFromNotification 由通知中的交易构造待关联记录
+func orphanFromNotification(transactionInfo *AppleTransactionInfo, notification *AppleNotification, reason string) *models.AppleOrphanTransaction {
+	orphan := &models.AppleOrphanTransaction{
+		TransactionID:         transactionInfo.TransactionID,
+		OriginalTransactionID: transactionInfo.OriginalTransactionID,
+		ProductIDApple:        transactionInfo.ProductID,
+		BundleID:              transactionInfo.BundleID,
+		AppAccountToken:       transactionInfo.AppAccountToken,
+		InAppOwnershipType:    transactionInfo.InAppOwnershipType,
+		ProductType:           transactionInfo.Type,
+		Quantity:              int(transactionInfo.Quantity),
+		PurchaseDate:          &transactionInfo.PurchaseDate,
+		OriginalPurchaseDate:  &transactionInfo.OriginalPurchaseDate,
+		ExpiresDate:           transactionInfo.ExpiresDate,
+		Environment:           transactionInfo.Environment,
+		Source:                appleOrphanSourceNotification,
+		NotificationType:      notification.NotificationType,
+		Reason:                reason,
+	}
+	if notification.Data != nil {
+		orphan.SignedTransactionInfo = notification.Data.SignedTransactionInfo
+	}
+	return orphan
+}
+
+// queueOrphanTransaction 将交易加入待关联队列，同一交易重复提交时更新待处理记录
+func (s *AppleService) queueOrphanTransaction(ctx context.Context, orphan *models.AppleOrphanTransaction) error {
+	orphan.Status = models.AppleOrphanStatusPending
+
+	// 已处理的记录不会被重新打开
+	result := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "transaction_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"app_account_token", "expires_date", "source", "notification_type", "claimed_order_id", "reason", "updated_at",
+		}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Eq{Column: clause.Column{Table: "apple_orphan_transactions", Name: "status"}, Value: models.AppleOrphanStatusPending},
+		}},
+	}).Create(orphan)
+	if result.Error != nil {
+		return fmt.Errorf("failed to queue orphan Apple transaction: %w", result.Error)
+	}
+
+	s.logger.Warn("Apple transaction queued for manual linking",
+		zap.String("transaction_id", orphan.TransactionID),
+		zap.String("original_transaction_id", orphan.OriginalTransactionID),
+		zap.String("source", orphan.Source),
+		zap.String("reason", orphan.Reason),
+	)
+	return nil
+}
+
+// ListOrphanTransactions 查询待关联交易
+// 参数：
+//   - ctx: 上下文
+//   - status: 状态过滤，为空时返回全部
+//   - page: 页码
+//   - pageSize: 每页数量
+//
+// 返回：待关联交易列表、总数或错误
+func (s *AppleService) ListOrphanTransactions(ctx context.Context, status string, page, pageSize int) ([]*models.AppleOrphanTransaction, int64, error) {
+	query := s.db.WithContext(ctx).Model(&models.AppleOrphanTransaction{}).Where("bundle_id = ?", s.bundleID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var orphans []*models.AppleOrphanTransaction
+	if err := query.Order("created_at DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&orphans).Error; err != nil {
+		return nil, 0, err
+	}
+	return orphans, total, nil
+}
+
+// LinkOrphanTransaction 人工将待关联交易关联到订单
+// 已有支付记录（来自通知）时更新其订单，否则按待关联记录创建支付记录；同一交易链上未关联的后续交易一并关联
+// 参数：
+//   - ctx: 上下文
+//   - id: 待关联记录ID
+//   - orderID: 目标订单ID，须为当前应用的 Apple 订单
+//   - operator: 处理人
+//   - note: 处理备注
+//
+// 返回：更新后的待关联记录或错误
+func (s *AppleService) LinkOrphanTransaction(ctx context.Context, id, orderID uint, operator, note string) (*models.AppleOrphanTransaction, error) {
+	var orphan models.AppleOrphanTransaction
+	if err := s.db.WithContext(ctx).First(&orphan, id).Error; err != nil {
+		return nil, err
+	}
+	if orphan.Status != models.AppleOrphanStatusPending {
+		return nil, ErrAppleOrphanNotPending
+	}
+
+	var order models.Order
+	if err := s.db.WithContext(ctx).First(&order, orderID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load order: %w", err)
+	}
+	if order.PaymentMethod != models.PaymentMethodAppleStore {
+		return nil, fmt.Errorf("order %d is not an Apple order", orderID)
+	}
+	if err := bindOrderApp(s.db.WithContext(ctx), &order, orphan.BundleID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tx := s.db.WithContext(ctx).Begin()
+
+	var payment models.ApplePayment
+	err := tx.Where("transaction_id = ?", orphan.TransactionID).First(&payment).Error
+	if err == gorm.ErrRecordNotFound {
+		payment = models.ApplePayment{
+			OrderID:               order.ID,
+			TransactionID:         orphan.TransactionID,
+			OriginalTransactionID: orphan.OriginalTransactionID,
+			ProductIDApple:        orphan.ProductIDApple,
+			BundleID:              orphan.BundleID,
+			Quantity:              orphan.Quantity,
+			PurchaseDate:          orphan.PurchaseDate,
+			OriginalPurchaseDate:  orphan.OriginalPurchaseDate,
+			ExpiresDate:           orphan.ExpiresDate,
+			ProductType:           orphan.ProductType,
+			InAppOwnershipType:    orphan.InAppOwnershipType,
+			AppAccountToken:       orphan.AppAccountToken,
+			Environment:           orphan.Environment,
+			SignedTransactionInfo: orphan.SignedTransactionInfo,
+			Status:                "VERIFIED",
+		}
+		if err := tx.Create(&payment).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to create Apple payment: %w", err)
+		}
+	} else if err != nil {
+		tx.Rollback()
+		return nil, err
+	} else if payment.OrderID != 0 && payment.OrderID != order.ID {
+		// 支付记录已由验证接口或通知关联订单，不允许人工改绑
+		tx.Rollback()
+		return nil, fmt.Errorf("%w: order %d", ErrAppleTransactionAlreadyLinked, payment.OrderID)
+	} else {
+		if err := tx.Model(&models.ApplePayment{}).
+			Where("original_transaction_id = ? AND order_id = 0", orphan.OriginalTransactionID).
+			Update("order_id", order.ID).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if order.Status == models.OrderStatusCreated {
+		if err := tx.Model(&models.Order{}).Where("id = ?", order.ID).
+			Updates(map[string]interface{}{
+				"status":         models.OrderStatusPaid,
+				"payment_status": models.PaymentStatusCompleted,
+				"paid_at":        orphan.PurchaseDate,
+			}).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if isAppleTestEnvironment(orphan.Environment) {
+		if err := markTestOrder(tx, order.ID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	orphan.Status = models.AppleOrphanStatusLinked
+	orphan.LinkedOrderID = order.ID
+	orphan.Operator = operator
+	orphan.Note = note
+	orphan.ResolvedAt = &now
+	if err := tx.Save(&orphan).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("Apple orphan transaction linked",
+		zap.Uint("orphan_id", orphan.ID),
+		zap.Uint("order_id", order.ID),
+		zap.String("transaction_id", orphan.TransactionID),
+		zap.String("operator", operator),
+	)
+
+	return &orphan, nil
+}
+
+// IgnoreOrphanTransaction 忽略待关联交易（如测试交易或已通过其他方式补发权益）
+// 参数：
+//   - ctx: 上下文
+//   - id: 待关联记录ID
+//   - operator: 处理人
+//   - note: 处理备注
+//
+// 返回：更新后的待关联记录或错误
+func (s *AppleService) IgnoreOrphanTransaction(ctx context.Context, id uint, operator, note string) (*models.AppleOrphanTransaction, error) {
+	var orphan models.AppleOrphanTransaction
+	if err := s.db.WithContext(ctx).First(&orphan, id).Error; err != nil {
+		return nil, err
+	}
+	if orphan.Status != models.AppleOrphanStatusPending {
+		return nil, ErrAppleOrphanNotPending
+	}
+
+	now := time.Now()
+	orphan.Status = models.AppleOrphanStatusIgnored
+	orphan.Operator = operator
+	orphan.Note = note
+	orphan.ResolvedAt = &now
+	if err := s.db.WithContext(ctx).Save(&orphan).Error; err != nil {
+		return nil, err
+	}
+	return &orphan, nil
+}
@@ -0,0 +1,349 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/awa/go-iap/appstore/api"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"pay-gateway/internal/models"
+)
+
+// Apple 消耗信息上报记录状态
+const (
+	AppleConsumptionStatusSent    = "SENT"
+	AppleConsumptionStatusFailed  = "FAILED"
+	AppleConsumptionStatusSkipped = "SKIPPED"
+)
+
+// errAppleDeliveryStatusUnknown 无法确定交付状态，上报错误的交付状态会影响 Apple 的退款决定，此时不上报
+var errAppleDeliveryStatusUnknown = errors.New("delivery status unknown")
+
+// AppleConsumptionUsage 业务侧提供的使用数据，零值字段表示未知，由订单数据推断或以“未声明”上报
+type AppleConsumptionUsage struct {
+	ConsumptionStatus int32         // 消耗状态：1-未消耗，2-部分消耗，3-全部消耗
+	DeliveryStatus    *int32        // 交付状态，为空时订单已支付/已发货视为已交付，否则不上报
+	PlayTime          time.Duration // 用户在应用内的累计使用时长
+	UserStatus        int32         // 账户状态：1-正常，2-已暂停，3-已注销，4-受限
+}
+
+// AppleConsumptionUsageProvider 业务侧使用数据提供者
+// 网关只掌握订单和支付数据，使用时长、内容消耗等需由业务系统提供
+type AppleConsumptionUsageProvider interface {
+	ConsumptionUsage(ctx context.Context, order *models.Order, transaction *AppleTransactionInfo) (*AppleConsumptionUsage, error)
+}
+
+// SetConsumptionUsageProvider 设置业务侧使用数据提供者（可选），未设置时仅上报订单推断的数据
+func (s *AppleService) SetConsumptionUsageProvider(provider AppleConsumptionUsageProvider) {
+	s.consumptionUsageProvider = provider
+}
+
+// handleConsumptionRequest 处理消耗请求
+// 收集订单、交付和使用数据，通过 Send Consumption Information 接口回复 Apple，并记录请求与响应
+// 同一通知已成功上报时直接返回；上报失败返回错误，由 Apple 重试通知
+func (s *AppleService) handleConsumptionRequest(ctx context.Context, notification *AppleNotification, transactionInfo *AppleTransactionInfo) error {
+	s.logger.Info("Handling CONSUMPTION_REQUEST notification",
+		zap.String("transaction_id", transactionInfo.TransactionID),
+		zap.String("notification_uuid", notification.NotificationUUID),
+	)
+
+	var record models.AppleConsumptionRequest
+	err := s.db.WithContext(ctx).Where("notification_uuid = ?", notification.NotificationUUID).First(&record).Error
+	if err == nil && record.Status == AppleConsumptionStatusSent {
+		s.logger.Info("Consumption information already sent",
+			zap.String("notification_uuid", notification.NotificationUUID))
+		return nil
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	record.NotificationUUID = notification.NotificationUUID
+	record.TransactionID = transactionInfo.TransactionID
+	record.OriginalTransactionID = transactionInfo.OriginalTransactionID
+	record.BundleID = transactionInfo.BundleID
+
+	consumptionConfig := s.config.Apple.Consumption
+	if !consumptionConfig.Enabled || !consumptionConfig.CustomerConsented {
+		// 未开启或未取得用户同意时 Apple 不会采纳消耗数据，仅记录
+		record.Status = AppleConsumptionStatusSkipped
+		record.ErrorMessage = "consumption information disabled or customer consent not obtained"
+		return s.saveConsumptionRequest(ctx, &record)
+	}
+
+	body, err := s.buildConsumptionRequest(ctx, transactionInfo, &record)
+	if errors.Is(err, errAppleDeliveryStatusUnknown) {
+		s.logger.Warn("Skipping consumption information, delivery status unknown",
+			zap.Error(err),
+			zap.String("transaction_id", transactionInfo.TransactionID))
+		record.Status = AppleConsumptionStatusSkipped
+		record.ErrorMessage = err.Error()
+		return s.saveConsumptionRequest(ctx, &record)
+	}
+	if err != nil {
+		record.Status = AppleConsumptionStatusFailed
+		record.ErrorMessage = err.Error()
+		if saveErr := s.saveConsumptionRequest(ctx, &record); saveErr != nil {
+			s.logger.Error("failed to save Apple consumption request", zap.Error(saveErr))
+		}
+		return err
+	}
+
+	record.CustomerConsented = body.CustomerConsented
+	record.ConsumptionStatus = body.ConsumptionStatus
+	record.DeliveryStatus = body.DeliveryStatus
+	record.AccountTenure = body.AccountTenure
+	record.PlayTime = body.PlayTime
+	record.LifetimeDollarsPurchased = body.LifetimeDollarsPurchased
+	record.LifetimeDollarsRefunded = body.LifetimeDollarsRefunded
+	record.UserStatus = body.UserStatus
+	record.RefundPreference = body.RefundPreference
+	if raw, err := json.Marshal(body); err == nil {
+		var rawRequest models.JSON
+		if json.Unmarshal(raw, &rawRequest) == nil {
+			record.RawRequest = rawRequest
+		}
+	}
+
+	// 消耗信息须发送到通知所在环境
+	statusCode, sendErr := s.storeClientFor(notification.Data.Environment).SendConsumptionInfo(ctx, transactionInfo.TransactionID, *body)
+	record.ResponseStatusCode = statusCode
+	if sendErr == nil && statusCode != http.StatusAccepted {
+		sendErr = fmt.Errorf("unexpected status code %d", statusCode)
+	}
+	if sendErr != nil {
+		s.logger.Error("failed to send Apple consumption information",
+			zap.Error(sendErr),
+			zap.String("transaction_id", transactionInfo.TransactionID),
+			zap.Int("status_code", statusCode),
+		)
+		record.Status = AppleConsumptionStatusFailed
+		record.ErrorMessage = sendErr.Error()
+		if err := s.saveConsumptionRequest(ctx, &record); err != nil {
+			s.logger.Error("failed to save Apple consumption request", zap.Error(err))
+		}
+		return fmt.Errorf("failed to send Apple consumption information: %w", sendErr)
+	}
+
+	now := time.Now()
+	record.Status = AppleConsumptionStatusSent
+	record.ErrorMessage = ""
+	record.SentAt = &now
+
+	s.logger.Info("Apple consumption information sent",
+		zap.String("transaction_id", transactionInfo.TransactionID),
+		zap.Uint("order_id", record.OrderID),
+	)
+
+	return s.saveConsumptionRequest(ctx, &record)
+}
+
+// buildConsumptionRequest 根据订单、支付记录和业务侧使用数据构造 ConsumptionRequest
+// 本地无支付记录或订单、订单未交付且业务侧未提供交付状态时返回 errAppleDeliveryStatusUnknown
+func (s *AppleService) buildConsumptionRequest(ctx context.Context, transactionInfo *AppleTransactionInfo, record *models.AppleConsumptionRequest) (*api.ConsumptionRequestBody, error) {
+	consumptionConfig := s.config.Apple.Consumption
+	body := &api.ConsumptionRequestBody{
+		CustomerConsented:     consumptionConfig.CustomerConsented,
+		SampleContentProvided: consumptionConfig.SampleContentProvided,
+		RefundPreference:      consumptionConfig.RefundPreference,
+		Platform:              1, // 商品在 Apple 平台交付
+	}
+
+	var payment models.ApplePayment
+	err := s.db.WithContext(ctx).Where("transaction_id = ?", transactionInfo.TransactionID).First(&payment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = s.db.WithContext(ctx).Where("original_transaction_id = ?", transactionInfo.OriginalTransactionID).
+			Order("created_at DESC").First(&payment).Error
+	}
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: apple payment not found", errAppleDeliveryStatusUnknown)
+	}
+	record.ApplePaymentID = payment.ID
+	record.OrderID = payment.OrderID
+	body.AppAccountToken = payment.AppAccountToken
+
+	var order models.Order
+	if err := s.db.WithContext(ctx).First(&order, payment.OrderID).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: order %d not found", errAppleDeliveryStatusUnknown, payment.OrderID)
+	}
+
+	// 订单已交付时交付状态为 0；未交付的原因网关无法判断，需业务侧提供
+	delivered := appleOrderDelivered(&order)
+	body.ConsumptionStatus = appleConsumptionStatus(&order, transactionInfo, time.Now())
+
+	// 账户年龄以用户首个订单时间计算
+	var firstOrder models.Order
+	if err := s.db.WithContext(ctx).Where("user_id = ?", order.UserID).
+		Order("created_at ASC").First(&firstOrder).Error; err == nil {
+		body.AccountTenure = appleAccountTenure(time.Since(firstOrder.CreatedAt))
+	}
+
+	purchased, refunded, ok, err := s.lifetimeAppleDollars(ctx, order.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		body.LifetimeDollarsPurchased = appleDollarsRange(purchased)
+		body.LifetimeDollarsRefunded = appleDollarsRange(refunded)
+	}
+
+	if s.consumptionUsageProvider != nil {
+		usage, err := s.consumptionUsageProvider.ConsumptionUsage(ctx, &order, transactionInfo)
+		if err != nil {
+			s.logger.Warn("failed to get consumption usage from provider",
+				zap.Error(err),
+				zap.Uint("order_id", order.ID),
+			)
+		} else if usage != nil {
+			if usage.ConsumptionStatus > 0 {
+				body.ConsumptionStatus = usage.ConsumptionStatus
+			}
+			if usage.DeliveryStatus != nil {
+				body.DeliveryStatus = *usage.DeliveryStatus
+				delivered = true
+			}
+			body.PlayTime = applePlayTime(usage.PlayTime)
+			body.UserStatus = usage.UserStatus
+		}
+	}
+
+	if !delivered {
+		return nil, fmt.Errorf("%w: order %d status %s", errAppleDeliveryStatusUnknown, order.ID, order.Status)
+	}
+	return body, nil
+}
+
+// lifetimeAppleDollars 统计用户在 Apple 渠道的累计消费和退款金额（美元）
+// Apple 价格为千分之一货币单位；存在非美元交易时无法换算，返回 ok=false 按未声明上报
+// 家庭共享获得的交易由组织者付费，不计入接收方的消费；测试订单不计入
+func (s *AppleService) lifetimeAppleDollars(ctx context.Context, userID uint) (purchased, refunded float64, ok bool, err error) {
+	var nonUSD int64
+	if err := s.db.WithContext(ctx).Model(&models.ApplePayment{}).
+		Joins("JOIN orders ON orders.id = apple_payments.order_id").
+		Scopes(liveOrdersScope).
+		Where("orders.user_id = ? AND apple_payments.currency <> ? AND apple_payments.in_app_ownership_type <> ?", userID, "USD", models.AppleOwnershipFamilyShared).
+		Count(&nonUSD).Error; err != nil {
+		return 0, 0, false, err
+	}
+	if nonUSD > 0 {
+		return 0, 0, false, nil
+	}
+
+	var totals struct {
+		Purchased int64
+		Refunded  int64
+	}
+	if err := s.db.WithContext(ctx).Model(&models.ApplePayment{}).
+		Select("COALESCE(SUM(apple_payments.price), 0) AS purchased, "+
+			"COALESCE(SUM(CASE WHEN apple_payments.id IN (SELECT apple_payment_id FROM apple_refunds WHERE refund_status = ?) THEN apple_payments.price ELSE 0 END), 0) AS refunded", "REFUNDED").
+		Joins("JOIN orders ON orders.id = apple_payments.order_id").
+		Scopes(liveOrdersScope).
+		Where("orders.user_id = ? AND apple_payments.in_app_ownership_type <> ?", userID, models.AppleOwnershipFamilyShared).
+		Scan(&totals).Error; err != nil {
+		return 0, 0, false, err
+	}
+
+	return float64(totals.Purchased) / 1000, float64(totals.Refunded) / 1000, true, nil
+}
+
+// saveConsumptionRequest 保存上报记录，同一通知重试时更新已有记录
+func (s *AppleService) saveConsumptionRequest(ctx context.Context, record *models.AppleConsumptionRequest) error {
+	return s.db.WithContext(ctx).Save(record).Error
+}
+
+// appleOrderDelivered 按订单状态判断商品是否已正常交付（交付状态 0）
+func appleOrderDelivered(order *models.Order) bool {
+	switch order.Status {
+	case models.OrderStatusPaid, models.OrderStatusDelivered, models.OrderStatusExpired,
+		models.OrderStatusRefunded, models.OrderStatusSuperseded:
+		return true
+	}
+	return false
+}
+
+// appleConsumptionStatus 按订单推断消耗状态
+// 未交付为未消耗；订阅按当前时间是否已过期区分全部/部分消耗；其他商品无法判断，按未声明上报
+func appleConsumptionStatus(order *models.Order, transactionInfo *AppleTransactionInfo, now time.Time) int32 {
+	if !appleOrderDelivered(order) {
+		return 1
+	}
+	if order.Type == models.OrderTypeSubscription && transactionInfo.ExpiresDate != nil {
+		if now.After(*transactionInfo.ExpiresDate) {
+			return 3
+		}
+		return 2
+	}
+	return 0
+}
+
+// appleAccountTenure 账户年龄区间：1-0~3天，2-3~10天，3-10~30天，4-30~90天，5-90~180天，6-180~365天，7-365天以上
+func appleAccountTenure(age time.Duration) int32 {
+	days := age.Hours() / 24
+	switch {
+	case days < 3:
+		return 1
+	case days < 10:
+		return 2
+	case days < 30:
+		return 3
+	case days < 90:
+		return 4
+	case days < 180:
+		return 5
+	case days < 365:
+		return 6
+	}
+	return 7
+}
+
+// applePlayTime 使用时长区间：0-未声明，1-0~5分钟，2-5~60分钟，3-1~6小时，4-6~24小时，5-1~4天，6-4~16天，7-16天以上
+func applePlayTime(playTime time.Duration) int32 {
+	switch {
+	case playTime <= 0:
+		return 0
+	case playTime < 5*time.Minute:
+		return 1
+	case playTime < time.Hour:
+		return 2
+	case playTime < 6*time.Hour:
+		return 3
+	case playTime < 24*time.Hour:
+		return 4
+	case playTime < 4*24*time.Hour:
+		return 5
+	case playTime < 16*24*time.Hour:
+		return 6
+	}
+	return 7
+}
+
+// appleDollarsRange 金额区间：1-0美元，2-0.01~49.99，3-50~99.99，4-100~499.99，5-500~999.99，6-1000~1999.99，7-2000以上
+func appleDollarsRange(dollars float64) int32 {
+	switch {
+	case dollars <= 0:
+		return 1
+	case dollars < 50:
+		return 2
+	case dollars < 100:
+		return 3
+	case dollars < 500:
+		return 4
+	case dollars < 1000:
+		return 5
+	case dollars < 2000:
+		return 6
+	}
+	return 7
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"errors"
+
+	"github.com/awa/go-iap/appstore/api"
+)
+
+// Apple 交易环境（JWS environment 声明 / 收据 environment 字段）
+const (
+	appleEnvironmentProduction = "Production"
+	appleEnvironmentSandbox    = "Sandbox"
+)
+
+// acceptedEnvironments 返回当前部署接受的交易环境，按查询优先级排序
+// 沙盒部署只接受沙盒交易；生产部署默认同时接受沙盒交易（App 审核和 TestFlight 使用沙盒环境），开启 reject_sandbox 后只接受生产交易
+func (s *AppleService) acceptedEnvironments() []string {
+	if s.config.Apple.Sandbox {
+		return []string{appleEnvironmentSandbox}
+	}
+	if s.config.Apple.RejectSandbox {
+		return []string{appleEnvironmentProduction}
+	}
+	return []string{appleEnvironmentProduction, appleEnvironmentSandbox}
+}
+
+// isEnvironmentAccepted 判断交易环境是否被当前部署接受
+func (s *AppleService) isEnvironmentAccepted(environment string) bool {
+	for _, accepted := range s.acceptedEnvironments() {
+		if environment == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// storeClientFor 返回指定环境的 App Store Server API 客户端，未知环境使用生产环境
+func (s *AppleService) storeClientFor(environment string) *api.StoreClient {
+	if environment == appleEnvironmentSandbox {
+		return s.sandboxStoreClient
+	}
+	return s.storeClient
+}
+
+// withEnvironmentFallback 按环境优先级调用 App Store Server API
+// 交易不存在于当前环境时（如审核人员的沙盒交易发到生产环境查询）继续查询下一个环境
+// 参数：
+//   - call: 使用指定环境客户端的调用
+//
+// 返回：成功调用的环境，或最后一次调用的错误
+func (s *AppleService) withEnvironmentFallback(call func(client *api.StoreClient) error) (string, error) {
+	var err error
+	for _, environment := range s.acceptedEnvironments() {
+		err = call(s.storeClientFor(environment))
+		if err == nil {
+			return environment, nil
+		}
+		if !isAppleTransactionNotFound(err) {
+			return environment, err
+		}
+	}
+	return "", err
+}
+
+// isAppleTransactionNotFound 判断 App Store Server API 是否因交易不存在返回错误
+func isAppleTransactionNotFound(err error) bool {
+	return errors.Is(err, api.TransactionIdNotFoundError) ||
+		errors.Is(err, api.OriginalTransactionIdNotFoundError) ||
+		errors.Is(err, api.OriginalTransactionIdNotFoundRetryableError)
+}
+
+// isAppleTestEnvironment 判断交易是否来自测试环境（沙盒、Xcode 本地测试）
+func isAppleTestEnvironment(environment string) bool {
+	return environment != "" && environment != appleEnvironmentProduction
+}
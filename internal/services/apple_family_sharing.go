@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"pay-gateway/internal/config"
+	"pay-gateway/internal/models"
+)
+
+// isFamilyShared 判断交易是否为家庭共享获得
+func isFamilyShared(ownershipType string) bool {
+	return ownershipType == models.AppleOwnershipFamilyShared
+}
+
+// appAccountTokenOwner 应用账户令牌所属的用户
+type appAccountTokenOwner struct {
+	UserID   uint
+	TenantID string
+}
+
+// resolveAppAccountTokenOwner 通过应用账户令牌查找所属用户
+// 令牌在下单时与用户绑定（早期订单则来自用户本人验证过的交易），家庭成员使用自己的令牌接收共享
+// 参数：
+//   - ctx: 上下文
+//   - token: 应用账户令牌
+//
+// 返回：令牌所属用户，未找到时返回 nil
+func (s *AppleService) resolveAppAccountTokenOwner(ctx context.Context, token string) (*appAccountTokenOwner, error) {
+	if token == "" {
+		return nil, nil
+	}
+	// 下单时生成的令牌为小写，交易中的令牌大小写不保证一致，两处统一按小写比较
+	token = strings.ToLower(token)
+
+	var owners []appAccountTokenOwner
+	if err := s.db.WithContext(ctx).Model(&models.Order{}).
+		Select("user_id, tenant_id").
+		Where("app_account_token = ? AND app_id = ?", token, s.bundleID).
+		Limit(1).
+		Scan(&owners).Error; err != nil {
+		return nil, err
+	}
+	if len(owners) > 0 {
+		return &owners[0], nil
+	}
+
+	if err := s.db.WithContext(ctx).Model(&models.ApplePayment{}).
+		Select("orders.user_id, orders.tenant_id").
+		Joins("JOIN orders ON orders.id = apple_payments.order_id").
+		Where("LOWER(apple_payments.app_account_token) = ? AND apple_payments.bundle_id = ?", token, s.bundleID).
+		Order("apple_payments.created_at DESC").Limit(1).
+		Scan(&owners).Error; err != nil {
+		return nil, err
+	}
+	if len(owners) == 0 {
+		return nil, nil
+	}
+	return &owners[0], nil
+}
+
+// linkFamilySharedOrder 为家庭共享交易创建接收方的权益订单
+// 权益订单金额为0，不计入收入，生命周期跟随共享交易的续订、过期和撤销通知
+// 参数：
+//   - ctx: 上下文
+//   - transactionInfo: 家庭共享交易信息
+//
+// 返回：权益订单ID，无法通过 appAccountToken 确定接收方时返回 0
+func (s *AppleService) linkFamilySharedOrder(ctx context.Context, transactionInfo *AppleTransactionInfo) (uint, error) {
+	owner, err := s.resolveAppAccountTokenOwner(ctx, transactionInfo.AppAccountToken)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve app account token: %w", err)
+	}
+	if owner == nil {
+		s.logger.Warn("Family shared transaction has no known app account token, leaving unlinked",
+			zap.String("transaction_id", transactionInfo.TransactionID),
+			zap.String("app_account_token", transactionInfo.AppAccountToken),
+		)
+		return 0, nil
+	}
+
+	tenantID := owner.TenantID
+	if tenantID == "" {
+		tenantID = config.DefaultTenantID
+	}
+	orderType := models.OrderTypePurchase
+	if transactionInfo.ExpiresDate != nil {
+		orderType = models.OrderTypeSubscription
+	}
+	paidAt := transactionInfo.PurchaseDate
+	quantity := int(transactionInfo.Quantity)
+	if quantity <= 0 {
+		quantity = 1
+	}
+
+	order := &models.Order{
+		OrderNo:       generateAppleFamilyOrderNo(),
+		TenantID:      tenantID,
+		UserID:        owner.UserID,
+		ProductID:     transactionInfo.ProductID,
+		Type:          orderType,
+		Title:         transactionInfo.ProductID,
+		Description:   "Apple 家庭共享",
+		Quantity:      quantity,
+		Currency:      transactionInfo.Currency,
+		TotalAmount:   0,
+		Status:        models.OrderStatusPaid,
+		PaymentMethod: models.PaymentMethodAppleStore,
+		PaymentStatus: models.PaymentStatusCompleted,
+		AppID:         s.bundleID,
+		PaidAt:        &paidAt,
+		IsTest:        isAppleTestEnvironment(transactionInfo.Environment),
+	}
+	if err := s.db.WithContext(ctx).Create(order).Error; err != nil {
+		return 0, fmt.Errorf("failed to create family shared order: %w", err)
+	}
+
+	s.logger.Info("Family shared entitlement order created",
+		zap.Uint("order_id", order.ID),
+		zap.Uint("user_id", owner.UserID),
+		zap.String("transaction_id", transactionInfo.TransactionID),
+		zap.String("product_id", transactionInfo.ProductID),
+	)
+
+	return order.ID, nil
+}
+
+// generateAppleFamilyOrderNo 生成家庭共享权益订单号
+func generateAppleFamilyOrderNo() string {
+	return fmt.Sprintf("FS%s%s", time.Now().Format("20060102150405"), uuid.New().String()[:8])
+}
+
+// revokeApplePayments 撤销交易链上的全部支付记录及关联订单
+// 家庭共享的撤销只影响接收方自己的交易链，组织者的购买不受影响
+// 参数：
+//   - ctx: 上下文
+//   - transactionInfo: 被撤销的交易信息
+//
+// 返回：被撤销的支付记录数或错误
+func (s *AppleService) revokeApplePayments(ctx context.Context, transactionInfo *AppleTransactionInfo) (int, error) {
+	var payments []models.ApplePayment
+	if err := s.db.WithContext(ctx).
+		Where("transaction_id = ? OR original_transaction_id = ?", transactionInfo.TransactionID, transactionInfo.OriginalTransactionID).
+		Find(&payments).Error; err != nil {
+		return 0, err
+	}
+	if len(payments) == 0 {
+		return 0, nil
+	}
+
+	revocationReason := ""
+	if transactionInfo.RevocationReason > 0 {
+		revocationReason = fmt.Sprintf("%d", transactionInfo.RevocationReason)
+	}
+
+	tx := s.db.WithContext(ctx).Begin()
+	orderIDs := make([]uint, 0, len(payments))
+	for i := range payments {
+		payment := &payments[i]
+		payment.Status = "REVOKED"
+		payment.RevocationDate = transactionInfo.RevocationDate
+		payment.RevocationReason = revocationReason
+		if payment.InAppOwnershipType == "" {
+			payment.InAppOwnershipType = transactionInfo.InAppOwnershipType
+		}
+		if err := tx.Save(payment).Error; err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if payment.OrderID > 0 {
+			orderIDs = append(orderIDs, payment.OrderID)
+		}
+	}
+
+	// 已退款的订单保持退款状态
+	if len(orderIDs) > 0 {
+		if err := tx.Model(&models.Order{}).
+			Where("id IN ? AND status <> ?", orderIDs, models.OrderStatusRefunded).
+			Updates(map[string]interface{}{
+				"status":         models.OrderStatusCancelled,
+				"payment_status": models.PaymentStatusCancelled,
+			}).Error; err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+	return len(payments), nil
+}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// appleRootCAG3PEM Apple Root CA - G3，来源 https://www.apple.com/certificateauthority/AppleRootCA-G3.cer
+const appleRootCAG3PEM = `
+-----BEGIN CERTIFICATE-----
+MIICQzCCAcmgAwIBAgIILcX8iNLFS5UwCgYIKoZIzj0EAwMwZzEbMBkGA1UEAwwS
+QXBwbGUgUm9vdCBDQSAtIEczMSYwJAYDVQQLDB1BcHBsZSBDZXJ0aWZpY2F0aW9u
+IEF1dGhvcml0eTETMBEGA1UECgwKQXBwbGUgSW5jLjELMAkGA1UEBhMCVVMwHhcN
+MTQwNDMwMTgxOTA2WhcNMzkwNDMwMTgxOTA2WjBnMRswGQYDVQQDDBJBcHBsZSBS
+b290IENBIC0gRzMxJjAkBgNVBAsMHUFwcGxlIENlcnRpZmljYXRpb24gQXV0aG9y
+aXR5MRMwEQYDVQQKDApBcHBsZSBJbmMuMQswCQYDVQQGEwJVUzB2MBAGByqGSM49
+AgEGBSuBBAAiA2IABJjpLz1AcqTtkyJygRMc3RCV8cWjTnHcFBbZDuWmBSp3ZHtf
+TjjTuxxEtX/1H7YyYl3J6YRbTzBPEVoA/VhYDKX1DyxNB0cTddqXl5dvMVztK517
+IDvYuVTZXpmkOlEKMaNCMEAwHQYDVR0OBBYEFLuw3qFYM4iapIqZ3r6966/ayySr
+MA8GA1UdEwEB/wQFMAMBAf8wDgYDVR0PAQH/BAQDAgEGMAoGCCqGSM49BAMDA2gA
+MGUCMQCD6cHEFl4aXTQY2e3v9GwOAEZLuN+yRhHFD/3meoyhpmvOwgPUnPWTxnS4
+at+qIxUCMG1mihDK1A3UT82NQz60imOlM27jbdoXt2QfyFMm+YhidDkLF1vLUagM
+6BgD56KyKA==
+-----END CERTIFICATE-----
+`
+
+// Apple 签名证书扩展 OID：中间证书为 Apple WWDR CA，叶子证书为 App Store 收据签名证书
+const (
+	appleIntermediateCertOID = "1.2.840.113635.100.6.2.1"
+	appleLeafCertOID         = "1.2.840.113635.100.6.11.1"
+)
+
+// ErrAppleJWSInvalid Apple JWS 验证失败
+var ErrAppleJWSInvalid = errors.New("invalid Apple JWS")
+
+// AppleRootCertPool 返回内置的 Apple 根证书池（Apple Root CA - G3）
+func AppleRootCertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(appleRootCAG3PEM))
+	return pool
+}
+
+// AppleJWSVerifier Apple 签名数据（通知、交易、续订信息）的离线 JWS 验证器
+// 校验 x5c 证书链至固定的根证书、Apple 证书扩展 OID 和 ES256 签名，并强制 bundleId 与 environment 在允许范围内
+type AppleJWSVerifier struct {
+	roots        *x509.CertPool
+	bundleIDs    map[string]bool
+	environments map[string]bool
+}
+
+// NewAppleJWSVerifier 创建 Apple JWS 验证器
+// 参数：
+//   - roots: 信任的根证书池，生产环境使用 AppleRootCertPool，测试可传入本地生成的根证书
+//   - bundleIDs: 允许的 Bundle ID
+//   - environments: 允许的环境（Production/Sandbox），为空时不校验
+//
+// 返回：验证器实例
+func NewAppleJWSVerifier(roots *x509.CertPool, bundleIDs []string, environments ...string) *AppleJWSVerifier {
+	allowed := make(map[string]bool, len(bundleIDs))
+	for _, bundleID := range bundleIDs {
+		allowed[bundleID] = true
+	}
+	allowedEnvironments := make(map[string]bool, len(environments))
+	for _, environment := range environments {
+		allowedEnvironments[environment] = true
+	}
+	return &AppleJWSVerifier{
+		roots:        roots,
+		bundleIDs:    allowed,
+		environments: allowedEnvironments,
+	}
+}
+
+// appleJWSScope 载荷中用于校验的应用与环境字段
+// 交易与续订信息位于顶层，通知位于 data（或 summary）中
+type appleJWSScope struct {
+	BundleID    string `json:"bundleId"`
+	Environment string `json:"environment"`
+}
+
+// appleJWSEnvelope 验证所需的载荷字段
+type appleJWSEnvelope struct {
+	appleJWSScope
+	SignedDate int64          `json:"signedDate"`
+	Data       *appleJWSScope `json:"data"`
+	Summary    *appleJWSScope `json:"summary"`
+}
+
+// Verify 验证 JWS 并将载荷解析到 claims
+// 参数：
+//   - signed: JWS 紧凑序列化字符串
+//   - claims: 载荷解析目标
+//
+// 返回：验证失败时返回包装 ErrAppleJWSInvalid 的错误
+func (v *AppleJWSVerifier) Verify(signed string, claims jwt.Claims) error {
+	parts := strings.Split(signed, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: malformed token", ErrAppleJWSInvalid)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("%w: malformed payload: %v", ErrAppleJWSInvalid, err)
+	}
+	var envelope appleJWSEnvelope
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return fmt.Errorf("%w: malformed payload: %v", ErrAppleJWSInvalid, err)
+	}
+
+	// 证书有效期按签名时间校验，重放的历史通知在证书轮换后仍可验证
+	verifyTime := time.Now()
+	if envelope.SignedDate > 0 {
+		verifyTime = time.UnixMilli(envelope.SignedDate)
+	}
+
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}))
+	if _, err := parser.ParseWithClaims(signed, claims, func(token *jwt.Token) (interface{}, error) {
+		return v.verifyCertificateChain(token.Header["x5c"], verifyTime)
+	}); err != nil {
+		if errors.Is(err, ErrAppleJWSInvalid) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrAppleJWSInvalid, err)
+	}
+
+	scope := envelope.appleJWSScope
+	if envelope.Data != nil {
+		scope = *envelope.Data
+	} else if envelope.Summary != nil {
+		scope = *envelope.Summary
+	}
+
+	// 续订信息不含 bundleId，仅在载荷提供时校验
+	if scope.BundleID != "" && len(v.bundleIDs) > 0 && !v.bundleIDs[scope.BundleID] {
+		return fmt.Errorf("%w: unexpected bundle ID %s", ErrAppleJWSInvalid, scope.BundleID)
+	}
+	if len(v.environments) > 0 && !v.environments[scope.Environment] {
+		return fmt.Errorf("%w: unexpected environment %s", ErrAppleJWSInvalid, scope.Environment)
+	}
+
+	return nil
+}
+
+// verifyCertificateChain 校验 x5c 证书链并返回叶子证书公钥
+func (v *AppleJWSVerifier) verifyCertificateChain(x5c interface{}, verifyTime time.Time) (*ecdsa.PublicKey, error) {
+	encoded, ok := x5c.([]interface{})
+	if !ok || len(encoded) < 2 {
+		return nil, fmt.Errorf("%w: missing x5c certificate chain", ErrAppleJWSInvalid)
+	}
+
+	certs := make([]*x509.Certificate, 0, len(encoded))
+	for i, item := range encoded {
+		der, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid x5c[%d]", ErrAppleJWSInvalid, i)
+		}
+		raw, err := base64.StdEncoding.DecodeString(der)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid x5c[%d]: %v", ErrAppleJWSInvalid, i, err)
+		}
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid x5c[%d]: %v", ErrAppleJWSInvalid, i, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	leaf, intermediate := certs[0], certs[1]
+	if !hasCertificateExtension(leaf, appleLeafCertOID) {
+		return nil, fmt.Errorf("%w: leaf certificate missing OID %s", ErrAppleJWSInvalid, appleLeafCertOID)
+	}
+	if !hasCertificateExtension(intermediate, appleIntermediateCertOID) {
+		return nil, fmt.Errorf("%w: intermediate certificate missing OID %s", ErrAppleJWSInvalid, appleIntermediateCertOID)
+	}
+
+	// 只信任固定的根证书，x5c 中携带的根证书不参与信任判断
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intermediate)
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		CurrentTime:   verifyTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, fmt.Errorf("%w: certificate chain verification failed: %v", ErrAppleJWSInvalid, err)
+	}
+
+	publicKey, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: leaf certificate key is not ECDSA", ErrAppleJWSInvalid)
+	}
+	return publicKey, nil
+}
+
+// hasCertificateExtension 判断证书是否包含指定 OID 的扩展
+func hasCertificateExtension(cert *x509.Certificate, oid string) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.String() == oid {
+			return true
+		}
+	}
+	return false
+}
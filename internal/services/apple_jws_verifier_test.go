@@ -0,0 +1,249 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testAppleCA 本地生成的测试证书链：根证书 -> 中间证书 -> 叶子证书
+type testAppleCA struct {
+	roots        *x509.CertPool
+	intermediate *x509.Certificate
+	leaf         *x509.Certificate
+	leafKey      *ecdsa.PrivateKey
+}
+
+type testAppleCAOptions struct {
+	skipIntermediateOID bool
+	skipLeafOID         bool
+	leafNotBefore       time.Time
+	leafNotAfter        time.Time
+}
+
+func newTestAppleCA(t *testing.T, opts testAppleCAOptions) *testAppleCA {
+	t.Helper()
+
+	now := time.Now()
+	rootKey := newTestECKey(t)
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Apple Root CA"},
+		NotBefore:             now.Add(-10 * 365 * 24 * time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	root := createTestCert(t, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+
+	intermediateKey := newTestECKey(t)
+	intermediateTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Test Apple WWDR CA"},
+		NotBefore:             now.Add(-5 * 365 * 24 * time.Hour),
+		NotAfter:              now.Add(5 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	if !opts.skipIntermediateOID {
+		intermediateTemplate.ExtraExtensions = []pkix.Extension{testOIDExtension(t, appleIntermediateCertOID)}
+	}
+	intermediate := createTestCert(t, intermediateTemplate, root, &intermediateKey.PublicKey, rootKey)
+
+	leafKey := newTestECKey(t)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "Test Prod ECC Mac App Store and iTunes Store Receipt Signing"},
+		NotBefore:    now.Add(-365 * 24 * time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if !opts.leafNotBefore.IsZero() {
+		leafTemplate.NotBefore = opts.leafNotBefore
+	}
+	if !opts.leafNotAfter.IsZero() {
+		leafTemplate.NotAfter = opts.leafNotAfter
+	}
+	if !opts.skipLeafOID {
+		leafTemplate.ExtraExtensions = []pkix.Extension{testOIDExtension(t, appleLeafCertOID)}
+	}
+	leaf := createTestCert(t, leafTemplate, intermediate, &leafKey.PublicKey, intermediateKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return &testAppleCA{roots: roots, intermediate: intermediate, leaf: leaf, leafKey: leafKey}
+}
+
+// sign 以叶子证书私钥签名载荷，x5c 携带叶子证书和中间证书
+func (ca *testAppleCA) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["x5c"] = []string{
+		base64.StdEncoding.EncodeToString(ca.leaf.Raw),
+		base64.StdEncoding.EncodeToString(ca.intermediate.Raw),
+	}
+	signed, err := token.SignedString(ca.leafKey)
+	if err != nil {
+		t.Fatalf("sign JWS: %v", err)
+	}
+	return signed
+}
+
+func newTestECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+func createTestCert(t *testing.T, template, parent *x509.Certificate, pub *ecdsa.PublicKey, signer *ecdsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return cert
+}
+
+func testOIDExtension(t *testing.T, oid string) pkix.Extension {
+	t.Helper()
+
+	var id asn1.ObjectIdentifier
+	for _, part := range strings.Split(oid, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			t.Fatalf("parse OID %s: %v", oid, err)
+		}
+		id = append(id, n)
+	}
+	return pkix.Extension{Id: id, Value: asn1.NullBytes}
+}
+
+func testTransactionClaims(signedAt time.Time) jwt.MapClaims {
+	return jwt.MapClaims{
+		"transactionId": "2000000000000001",
+		"bundleId":      "com.example.app",
+		"environment":   "Sandbox",
+		"signedDate":    signedAt.UnixMilli(),
+	}
+}
+
+func TestAppleJWSVerifierVerify(t *testing.T) {
+	now := time.Now()
+	validCA := newTestAppleCA(t, testAppleCAOptions{})
+	otherCA := newTestAppleCA(t, testAppleCAOptions{})
+	expiredCA := newTestAppleCA(t, testAppleCAOptions{
+		leafNotBefore: now.Add(-48 * time.Hour),
+		leafNotAfter:  now.Add(-24 * time.Hour),
+	})
+
+	notification := jwt.MapClaims{
+		"notificationType": "DID_RENEW",
+		"signedDate":       now.UnixMilli(),
+		"data": map[string]interface{}{
+			"bundleId":    "com.example.app",
+			"environment": "Sandbox",
+		},
+	}
+	wrongBundle := testTransactionClaims(now)
+	wrongBundle["bundleId"] = "com.example.other"
+	wrongEnvironment := testTransactionClaims(now)
+	wrongEnvironment["environment"] = "Production"
+
+	tests := []struct {
+		name    string
+		ca      *testAppleCA
+		roots   *x509.CertPool
+		claims  jwt.MapClaims
+		wantErr bool
+	}{
+		{name: "valid chain", ca: validCA, roots: validCA.roots, claims: testTransactionClaims(now)},
+		{name: "valid notification", ca: validCA, roots: validCA.roots, claims: notification},
+		{name: "wrong root", ca: validCA, roots: otherCA.roots, claims: testTransactionClaims(now), wantErr: true},
+		{name: "production root", ca: validCA, roots: AppleRootCertPool(), claims: testTransactionClaims(now), wantErr: true},
+		{
+			name:    "missing leaf OID",
+			ca:      newTestAppleCA(t, testAppleCAOptions{skipLeafOID: true}),
+			claims:  testTransactionClaims(now),
+			wantErr: true,
+		},
+		{
+			name:    "missing intermediate OID",
+			ca:      newTestAppleCA(t, testAppleCAOptions{skipIntermediateOID: true}),
+			claims:  testTransactionClaims(now),
+			wantErr: true,
+		},
+		{name: "expired leaf signed after expiry", ca: expiredCA, roots: expiredCA.roots, claims: testTransactionClaims(now), wantErr: true},
+		{name: "expired leaf signed while valid", ca: expiredCA, roots: expiredCA.roots, claims: testTransactionClaims(now.Add(-36 * time.Hour))},
+		{name: "bundle mismatch", ca: validCA, roots: validCA.roots, claims: wrongBundle, wantErr: true},
+		{name: "environment mismatch", ca: validCA, roots: validCA.roots, claims: wrongEnvironment, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roots := tt.roots
+			if roots == nil {
+				roots = tt.ca.roots
+			}
+			verifier := NewAppleJWSVerifier(roots, []string{"com.example.app"}, "Sandbox")
+
+			claims := jwt.MapClaims{}
+			err := verifier.Verify(tt.ca.sign(t, tt.claims), claims)
+			if tt.wantErr {
+				if !errors.Is(err, ErrAppleJWSInvalid) {
+					t.Fatalf("Verify() error = %v, want ErrAppleJWSInvalid", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if claims["signedDate"] == nil {
+				t.Fatalf("Verify() did not decode claims: %v", claims)
+			}
+		})
+	}
+}
+
+func TestAppleJWSVerifierRejectsTamperedPayload(t *testing.T) {
+	ca := newTestAppleCA(t, testAppleCAOptions{})
+	verifier := NewAppleJWSVerifier(ca.roots, []string{"com.example.app"}, "Sandbox")
+
+	signed := ca.sign(t, testTransactionClaims(time.Now()))
+	other := ca.sign(t, jwt.MapClaims{
+		"transactionId": "2000000000000002",
+		"bundleId":      "com.example.app",
+		"environment":   "Sandbox",
+		"signedDate":    time.Now().UnixMilli(),
+	})
+
+	// 替换载荷但保留原签名
+	signedParts, otherParts := strings.Split(signed, "."), strings.Split(other, ".")
+	tampered := signedParts[0] + "." + otherParts[1] + "." + signedParts[2]
+	if err := verifier.Verify(tampered, jwt.MapClaims{}); !errors.Is(err, ErrAppleJWSInvalid) {
+		t.Fatalf("Verify() error = %v, want ErrAppleJWSInvalid", err)
+	}
+}
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"pay-gateway/internal/models"
+)
+
+// appleOfferSignatureSeparator 优惠签名各字段之间的分隔符（U+2063 INVISIBLE SEPARATOR）
+const appleOfferSignatureSeparator = "\u2063"
+
+// ErrAppleOfferNotEligible 用户不满足促销优惠资格
+var ErrAppleOfferNotEligible = errors.New("user is not eligible for the promotional offer")
+
+// appleSigningKey App Store Connect 的 In-App Purchase 密钥，同时用于 App Store Server API 和优惠签名
+type appleSigningKey struct {
+	keyID string
+	key   *ecdsa.PrivateKey
+}
+
+// AppleOfferSignatureRequest 促销优惠签名请求
+type AppleOfferSignatureRequest struct {
+	UserID          uint   // 用户ID，用于校验优惠资格
+	ProductID       string // 订阅商品ID
+	OfferID         string // App Store Connect 中配置的促销优惠ID
+	AppAccountToken string // 应用账户令牌（UUID），需与客户端购买时传入的一致，可为空
+}
+
+// AppleOfferSignature 促销优惠签名，客户端原样传给 StoreKit
+type AppleOfferSignature struct {
+	BundleID        string `json:"bundle_id"`
+	KeyID           string `json:"key_id"`
+	ProductID       string `json:"product_id"`
+	OfferID         string `json:"offer_id"`
+	AppAccountToken string `json:"app_account_token,omitempty"`
+	Nonce           string `json:"nonce"`
+	Timestamp       int64  `json:"timestamp"` // 毫秒时间戳，Apple 要求 24 小时内使用
+	Signature       string `json:"signature"` // Base64 编码的 DER 格式 ECDSA 签名
+}
+
+// AppleOfferEligibility 促销优惠资格
+// 促销优惠仅面向当前或曾经订阅过同一订阅组的用户
+type AppleOfferEligibility struct {
+	Eligible              bool       `json:"eligible"`
+	SubscriptionGroupID   string     `json:"subscription_group_id,omitempty"`
+	ActiveSubscription    bool       `json:"active_subscription"`               // 当前是否有有效订阅
+	LastExpiresDate       *time.Time `json:"last_expires_date,omitempty"`       // 最近一次订阅的到期时间
+	OriginalTransactionID string     `json:"original_transaction_id,omitempty"` // 最近一次订阅的原始交易ID
+}
+
+// CheckOfferEligibility 根据用户的 Apple 购买记录校验促销优惠资格
+// 商品所属订阅组已知时要求用户订阅过同一订阅组，否则要求用户在当前应用订阅过任一自动续期订阅
+// 参数：
+//   - ctx: 上下文
+//   - userID: 用户ID
+//   - productID: 订阅商品ID
+//
+// 返回：优惠资格或错误
+func (s *AppleService) CheckOfferEligibility(ctx context.Context, userID uint, productID string) (*AppleOfferEligibility, error) {
+	eligibility := &AppleOfferEligibility{}
+
+	// 订阅组来自已有的签名交易，同一商品的任一支付记录即可确定
+	var groupPayment models.ApplePayment
+	if err := s.db.WithContext(ctx).
+		Where("product_id_apple = ? AND bundle_id = ? AND subscription_group_id <> ''", productID, s.bundleID).
+		Order("created_at DESC").Limit(1).Find(&groupPayment).Error; err != nil {
+		return nil, err
+	}
+	eligibility.SubscriptionGroupID = groupPayment.SubscriptionGroupID
+
+	query := s.db.WithContext(ctx).Model(&models.ApplePayment{}).
+		Joins("JOIN orders ON orders.id = apple_payments.order_id").
+		Where("orders.user_id = ? AND apple_payments.bundle_id = ?", userID, s.bundleID)
+	if eligibility.SubscriptionGroupID != "" {
+		query = query.Where("apple_payments.subscription_group_id = ?", eligibility.SubscriptionGroupID)
+	} else {
+		query = query.Where("orders.type = ?", models.OrderTypeSubscription)
+	}
+
+	var payments []models.ApplePayment
+	if err := query.Order("apple_payments.expires_date DESC NULLS LAST").Find(&payments).Error; err != nil {
+		return nil, err
+	}
+	if len(payments) == 0 {
+		return eligibility, nil
+	}
+
+	eligibility.Eligible = true
+	eligibility.LastExpiresDate = payments[0].ExpiresDate
+	eligibility.OriginalTransactionID = payments[0].OriginalTransactionID
+
+	now := time.Now()
+	for _, payment := range payments {
+		if payment.Status == "REVOKED" || payment.Status == "EXPIRED" || payment.RevocationDate != nil {
+			continue
+		}
+		if payment.ExpiresDate != nil && payment.ExpiresDate.After(now) {
+			eligibility.ActiveSubscription = true
+			break
+		}
+	}
+
+	return eligibility, nil
+}
+
+// GeneratePromotionalOfferSignature 校验优惠资格并生成促销优惠签名
+// 签名内容为 bundleId、keyId、productId、offerId、appAccountToken、nonce、timestamp 以 U+2063 连接后的 SHA-256 摘要
+// 参数：
+//   - ctx: 上下文
+//   - req: 签名请求
+//
+// 返回：优惠签名或错误（不满足资格时返回 ErrAppleOfferNotEligible）
+func (s *AppleService) GeneratePromotionalOfferSignature(ctx context.Context, req *AppleOfferSignatureRequest) (*AppleOfferSignature, error) {
+	if s.signingKey == nil {
+		return nil, fmt.Errorf("Apple signing key not configured for bundle %s", s.bundleID)
+	}
+
+	appAccountToken := strings.ToLower(req.AppAccountToken)
+	if appAccountToken != "" {
+		if _, err := uuid.Parse(appAccountToken); err != nil {
+			return nil, fmt.Errorf("invalid app account token: %w", err)
+		}
+	}
+
+	eligibility, err := s.CheckOfferEligibility(ctx, req.UserID, req.ProductID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check offer eligibility: %w", err)
+	}
+	if !eligibility.Eligible {
+		s.logger.Info("User not eligible for Apple promotional offer",
+			zap.Uint("user_id", req.UserID),
+			zap.String("product_id", req.ProductID),
+			zap.String("offer_id", req.OfferID),
+		)
+		return nil, ErrAppleOfferNotEligible
+	}
+
+	signature := &AppleOfferSignature{
+		BundleID:        s.bundleID,
+		KeyID:           s.signingKey.keyID,
+		ProductID:       req.ProductID,
+		OfferID:         req.OfferID,
+		AppAccountToken: appAccountToken,
+		Nonce:           strings.ToLower(uuid.New().String()),
+		Timestamp:       time.Now().UnixMilli(),
+	}
+
+	payload := strings.Join([]string{
+		signature.BundleID,
+		signature.KeyID,
+		signature.ProductID,
+		signature.OfferID,
+		signature.AppAccountToken,
+		signature.Nonce,
+		strconv.FormatInt(signature.Timestamp, 10),
+	}, appleOfferSignatureSeparator)
+
+	digest := sha256.Sum256([]byte(payload))
+	sig, err := ecdsa.SignASN1(rand.Reader, s.signingKey.key, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign promotional offer: %w", err)
+	}
+	signature.Signature = base64.StdEncoding.EncodeToString(sig)
+
+	s.logger.Info("Apple promotional offer signature generated",
+		zap.Uint("user_id", req.UserID),
+		zap.String("product_id", req.ProductID),
+		zap.String("offer_id", req.OfferID),
+		zap.String("nonce", signature.Nonce),
+	)
+
+	return signature, nil
+}
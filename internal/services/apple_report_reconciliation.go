@@ -0,0 +1,393 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"pay-gateway/internal/models"
+)
+
+// appleReportRow App Store Connect 报告中的一行内购记录
+type appleReportRow struct {
+	TransactionID string
+	ProductID     string // SKU（销售报告）/ Vendor Identifier（财务报告），约定与 App Store 商品ID一致
+	ProductType   string // Product Type Identifier
+	Units         int    // 数量，退款为负数
+	Proceeds      string // 单位收益（开发者收益 / 分成）
+	Currency      string // 收益币种
+	BeginDate     time.Time
+	EndDate       time.Time
+}
+
+// isRefund 是否为退款行
+func (r appleReportRow) isRefund() bool {
+	return r.Units < 0
+}
+
+// appleReport 解析后的 App Store Connect 报告
+type appleReport struct {
+	reportType    string
+	byTransaction bool // 报告是否包含交易ID
+	rows          []appleReportRow
+	periodStart   time.Time
+	periodEnd     time.Time
+}
+
+// appleLocalPayment 本地 Apple 支付记录（比对用）
+type appleLocalPayment struct {
+	TransactionID  string
+	ProductIDApple string
+	Quantity       int
+	Status         string
+	Currency       string
+	TotalAmount    int64
+}
+
+// reconcileAppleReport 解析 App Store Connect 销售/财务报告并与本地 ApplePayment 比对
+// 报告含交易ID时逐笔比对，否则（汇总报告）按商品比对购买与退款数量
+func (s *StoreReconciliationService) reconcileAppleReport(ctx context.Context, report *models.StoreReconciliationReport, body []byte) (*storeComparison, error) {
+	parsed, err := parseAppleReport(body)
+	if err != nil {
+		return nil, err
+	}
+
+	report.ReportType = parsed.reportType
+	report.PeriodStart = parsed.periodStart.Format("2006-01-02")
+	report.PeriodEnd = parsed.periodEnd.Format("2006-01-02")
+	periodStart, periodEnd := storePeriodRange(parsed.periodStart, parsed.periodEnd)
+
+	if parsed.byTransaction {
+		report.MatchMode = storeMatchTransaction
+		return s.compareAppleTransactions(ctx, parsed.rows, periodStart, periodEnd)
+	}
+	report.MatchMode = storeMatchProduct
+	return s.compareAppleProducts(ctx, parsed.rows, periodStart, periodEnd)
+}
+
+// parseAppleReport 解析 App Store Connect 报告（TSV），仅保留内购行
+// 销售报告含 Developer Proceeds 列，财务报告含 Partner Share 列；Total_ 开头的汇总行结束解析
+func parseAppleReport(body []byte) (*appleReport, error) {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+
+	var idx map[string]int
+	parsed := &appleReport{reportType: StoreReportSales}
+	var colTxn, colProduct, colType, colUnits, colProceeds, colCurrency, colBegin, colEnd, colSalesOrReturn int
+
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		cells := strings.Split(line, "\t")
+		if strings.HasPrefix(strings.TrimSpace(cells[0]), "Total_") {
+			break
+		}
+
+		// 表头
+		if idx == nil {
+			idx = storeHeaderIndex(cells)
+			colProduct = storeColumn(idx, "sku", "vendor identifier")
+			colUnits = storeColumn(idx, "units", "quantity")
+			if colProduct < 0 || colUnits < 0 {
+				return nil, errors.New("报告缺少 SKU/Vendor Identifier 或 Units/Quantity 列")
+			}
+			if storeColumn(idx, "partner share") >= 0 {
+				parsed.reportType = StoreReportFinance
+			}
+			colTxn = storeColumn(idx, "transaction id", "original transaction id")
+			colType = storeColumn(idx, "product type identifier")
+			colProceeds = storeColumn(idx, "developer proceeds", "partner share")
+			colCurrency = storeColumn(idx, "currency of proceeds", "partner share currency")
+			colBegin = storeColumn(idx, "begin date", "start date")
+			colEnd = storeColumn(idx, "end date")
+			colSalesOrReturn = storeColumn(idx, "sales or return")
+			parsed.byTransaction = colTxn >= 0
+			continue
+		}
+
+		// 仅内购（IA1、IA9、IAY、IAC 等）参与比对，App 下载与更新跳过
+		productType := storeCell(cells, colType)
+		if colType >= 0 && !strings.HasPrefix(productType, "IA") {
+			continue
+		}
+
+		units, err := strconv.Atoi(strings.ReplaceAll(storeCell(cells, colUnits), ",", ""))
+		if err != nil || units == 0 {
+			continue
+		}
+		if storeCell(cells, colSalesOrReturn) == "R" && units > 0 {
+			units = -units
+		}
+
+		begin, err := parseAppleReportDate(storeCell(cells, colBegin))
+		if err != nil {
+			return nil, fmt.Errorf("解析报告日期失败: %v", err)
+		}
+		end := begin
+		if v := storeCell(cells, colEnd); v != "" {
+			if end, err = parseAppleReportDate(v); err != nil {
+				return nil, fmt.Errorf("解析报告日期失败: %v", err)
+			}
+		}
+
+		row := appleReportRow{
+			TransactionID: storeCell(cells, colTxn),
+			ProductID:     storeCell(cells, colProduct),
+			ProductType:   productType,
+			Units:         units,
+			Proceeds:      storeCell(cells, colProceeds),
+			Currency:      storeCell(cells, colCurrency),
+			BeginDate:     begin,
+			EndDate:       end,
+		}
+		if len(parsed.rows) == 0 || row.BeginDate.Before(parsed.periodStart) {
+			parsed.periodStart = row.BeginDate
+		}
+		if len(parsed.rows) == 0 || row.EndDate.After(parsed.periodEnd) {
+			parsed.periodEnd = row.EndDate
+		}
+		parsed.rows = append(parsed.rows, row)
+	}
+
+	if idx == nil {
+		return nil, errors.New("报告为空")
+	}
+	if len(parsed.rows) == 0 {
+		return nil, errors.New("报告中没有内购记录")
+	}
+	return parsed, nil
+}
+
+// parseAppleReportDate 解析报告日期，App Store Connect 使用 MM/DD/YYYY
+func parseAppleReportDate(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("01/02/2006", s, pacificLocation); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, pacificLocation)
+}
+
+// compareAppleTransactions 逐笔比对：购买行按交易ID匹配本地支付并核对数量，退款行核对本地订单是否已退款
+func (s *StoreReconciliationService) compareAppleTransactions(ctx context.Context, rows []appleReportRow, periodStart, periodEnd time.Time) (*storeComparison, error) {
+	local, err := s.loadAppleLocalPayments(ctx, "apple_payments.purchase_date >= ? AND apple_payments.purchase_date < ?", periodStart, periodEnd)
+	if err != nil {
+		return nil, err
+	}
+	byTxn := make(map[string]*appleLocalPayment, len(local))
+	for _, p := range local {
+		byTxn[p.TransactionID] = p
+	}
+
+	// 报告期外购买（跨期退款、时区边界）按交易ID补查，补查到的不计入仅本地有
+	var missing []string
+	for _, row := range rows {
+		if _, ok := byTxn[row.TransactionID]; !ok {
+			missing = append(missing, row.TransactionID)
+		}
+	}
+	if len(missing) > 0 {
+		extra, err := s.loadAppleLocalPayments(ctx, "apple_payments.transaction_id IN ?", missing)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range extra {
+			byTxn[p.TransactionID] = p
+		}
+	}
+
+	result := &storeComparison{totalCount: len(rows)}
+	matched := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		billTime := row.BeginDate
+		detail := models.StoreReconciliationDetail{
+			TransactionID:  row.TransactionID,
+			ProductID:      row.ProductID,
+			RecordType:     billRecordPayment,
+			StoreAmount:    row.Proceeds,
+			StoreCurrency:  row.Currency,
+			StoreQuantity:  row.Units,
+			StoreTradeType: row.ProductType,
+			BillTime:       &billTime,
+		}
+		if row.isRefund() {
+			detail.RecordType = billRecordRefund
+		}
+
+		p, ok := byTxn[row.TransactionID]
+		if !ok {
+			detail.DiffType = "store_only"
+			result.addDiff(detail)
+			continue
+		}
+		detail.LocalAmount = p.TotalAmount
+		detail.LocalCurrency = p.Currency
+		detail.LocalQuantity = p.Quantity
+		detail.LocalStatus = p.Status
+
+		if row.isRefund() {
+			if p.Status != string(models.OrderStatusRefunded) {
+				detail.DiffType = "status_mismatch"
+				result.addDiff(detail)
+			} else {
+				result.matchCount++
+			}
+			continue
+		}
+
+		matched[row.TransactionID] = true
+		if p.Quantity != row.Units {
+			detail.DiffType = "quantity_mismatch"
+			result.addDiff(detail)
+			continue
+		}
+		result.matchCount++
+	}
+
+	// 仅本地有：报告期内的本地购买未出现在报告中
+	for _, p := range local {
+		if matched[p.TransactionID] {
+			continue
+		}
+		result.addDiff(models.StoreReconciliationDetail{
+			TransactionID: p.TransactionID,
+			ProductID:     p.ProductIDApple,
+			RecordType:    billRecordPayment,
+			DiffType:      "local_only",
+			LocalAmount:   p.TotalAmount,
+			LocalCurrency: p.Currency,
+			LocalQuantity: p.Quantity,
+			LocalStatus:   p.Status,
+		})
+	}
+	return result, nil
+}
+
+// compareAppleProducts 按商品比对：汇总报告中各商品的购买与退款数量与本地同期记录数量核对
+func (s *StoreReconciliationService) compareAppleProducts(ctx context.Context, rows []appleReportRow, periodStart, periodEnd time.Time) (*storeComparison, error) {
+	storePurchases := make(map[string]int)
+	storeRefunds := make(map[string]int)
+	for _, row := range rows {
+		if row.isRefund() {
+			storeRefunds[row.ProductID] -= row.Units
+		} else {
+			storePurchases[row.ProductID] += row.Units
+		}
+	}
+
+	localPurchases, err := s.countAppleLocalPurchases(ctx, periodStart, periodEnd)
+	if err != nil {
+		return nil, err
+	}
+	localRefunds, err := s.countAppleLocalRefunds(ctx, periodStart, periodEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &storeComparison{totalCount: len(storePurchases) + len(storeRefunds)}
+	compareAppleProductCounts(result, billRecordPayment, storePurchases, localPurchases)
+	compareAppleProductCounts(result, billRecordRefund, storeRefunds, localRefunds)
+	return result, nil
+}
+
+// compareAppleProductCounts 比对单一记录类型下各商品的报告数量与本地数量
+func compareAppleProductCounts(result *storeComparison, recordType string, store, local map[string]int) {
+	products := make([]string, 0, len(store)+len(local))
+	for id := range store {
+		products = append(products, id)
+	}
+	for id := range local {
+		if _, ok := store[id]; !ok {
+			products = append(products, id)
+		}
+	}
+	sort.Strings(products)
+
+	for _, id := range products {
+		storeQty, localQty := store[id], local[id]
+		if storeQty == localQty {
+			result.matchCount++
+			continue
+		}
+		detail := models.StoreReconciliationDetail{
+			ProductID:     id,
+			RecordType:    recordType,
+			StoreQuantity: storeQty,
+			LocalQuantity: localQty,
+		}
+		switch {
+		case localQty == 0:
+			detail.DiffType = "store_only"
+		case storeQty == 0:
+			detail.DiffType = "local_only"
+		default:
+			detail.DiffType = "quantity_mismatch"
+		}
+		result.addDiff(detail)
+	}
+}
+
+// loadAppleLocalPayments 查询非测试订单的 Apple 支付记录，家庭共享交易不产生收入，不参与比对
+func (s *StoreReconciliationService) loadAppleLocalPayments(ctx context.Context, where string, args ...interface{}) ([]*appleLocalPayment, error) {
+	var payments []*appleLocalPayment
+	if err := s.db.WithContext(ctx).Model(&models.ApplePayment{}).
+		Joins("JOIN orders ON orders.id = apple_payments.order_id").
+		Scopes(liveOrdersScope).
+		Where("COALESCE(apple_payments.in_app_ownership_type, '') <> ?", models.AppleOwnershipFamilyShared).
+		Where(where, args...).
+		Select("apple_payments.transaction_id, apple_payments.product_id_apple, " +
+			"COALESCE(NULLIF(apple_payments.quantity, 0), 1) AS quantity, " +
+			"orders.status, orders.currency, orders.total_amount").
+		Scan(&payments).Error; err != nil {
+		return nil, fmt.Errorf("查询本地 Apple 支付记录失败: %w", err)
+	}
+	return payments, nil
+}
+
+// countAppleLocalPurchases 统计报告期内各商品的本地购买数量
+func (s *StoreReconciliationService) countAppleLocalPurchases(ctx context.Context, periodStart, periodEnd time.Time) (map[string]int, error) {
+	var rows []struct {
+		ProductID string
+		Quantity  int
+	}
+	if err := s.db.WithContext(ctx).Model(&models.ApplePayment{}).
+		Joins("JOIN orders ON orders.id = apple_payments.order_id").
+		Scopes(liveOrdersScope).
+		Where("COALESCE(apple_payments.in_app_ownership_type, '') <> ?", models.AppleOwnershipFamilyShared).
+		Where("apple_payments.purchase_date >= ? AND apple_payments.purchase_date < ?", periodStart, periodEnd).
+		Select("apple_payments.product_id_apple AS product_id, SUM(COALESCE(NULLIF(apple_payments.quantity, 0), 1)) AS quantity").
+		Group("apple_payments.product_id_apple").
+		Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("统计本地 Apple 购买失败: %w", err)
+	}
+	counts := make(map[string]int, len(rows))
+	for _, r := range rows {
+		counts[r.ProductID] = r.Quantity
+	}
+	return counts, nil
+}
+
+// countAppleLocalRefunds 统计报告期内各商品的本地退款笔数
+func (s *StoreReconciliationService) countAppleLocalRefunds(ctx context.Context, periodStart, periodEnd time.Time) (map[string]int, error) {
+	var rows []struct {
+		ProductID string
+		Quantity  int
+	}
+	if err := s.db.WithContext(ctx).Model(&models.AppleRefund{}).
+		Joins("JOIN apple_payments ON apple_payments.id = apple_refunds.apple_payment_id").
+		Joins("JOIN orders ON orders.id = apple_refunds.order_id").
+		Scopes(liveOrdersScope).
+		Where("apple_refunds.refund_date >= ? AND apple_refunds.refund_date < ?", periodStart, periodEnd).
+		Select("apple_payments.product_id_apple AS product_id, COUNT(*) AS quantity").
+		Group("apple_payments.product_id_apple").
+		Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("统计本地 Apple 退款失败: %w", err)
+	}
+	counts := make(map[string]int, len(rows))
+	for _, r := range rows {
+		counts[r.ProductID] = r.Quantity
+	}
+	return counts, nil
+}
@@ -2,15 +2,17 @@ package services
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"strconv"
 	"time"
 
 	"github.com/awa/go-iap/appstore"
 	"github.com/awa/go-iap/appstore/api"
-	"github.com/golang-jwt/jwt/v5"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 
@@ -20,13 +22,24 @@ import (
 
 // AppleService Apple服务核心结构体
 // 负责处理所有Apple Store相关的支付验证、订阅管理和Webhook处理
+// 配置多个应用时，每个 Bundle ID 对应独立的 App Store Server API 客户端，通过 ForBundle 获取绑定到指定应用的实例
 type AppleService struct {
-	config      *config.Config
-	logger      *zap.Logger
-	db          *gorm.DB
-	client      *appstore.Client
-	storeClient *api.StoreClient
-	bundleID    string
+	config       *config.Config
+	logger       *zap.Logger
+	db           *gorm.DB
+	client       *appstore.Client
+	storeClient  *api.StoreClient // 当前应用的生产环境客户端
+	bundleID     string
+	storeClients map[string]*api.StoreClient // Bundle ID -> App Store Server API客户端（含默认应用）
+	bundleIDs    []string                    // 已配置的 Bundle ID，默认应用在前
+	jwsVerifier  *AppleJWSVerifier           // Apple 签名数据离线验证器
+	signingKey   *appleSigningKey            // 当前应用的 In-App Purchase 密钥，用于生成优惠签名
+	signingKeys  map[string]*appleSigningKey // Bundle ID -> In-App Purchase 密钥
+
+	sandboxStoreClient  *api.StoreClient            // 当前应用的沙盒环境客户端
+	sandboxStoreClients map[string]*api.StoreClient // Bundle ID -> 沙盒环境客户端
+
+	consumptionUsageProvider AppleConsumptionUsageProvider // 业务侧使用数据，用于响应 CONSUMPTION_REQUEST（可选）
 }
 
 // ApplePurchaseResponse 购买验证响应结构体
@@ -46,8 +59,10 @@ type ApplePurchaseResponse struct {
 	SubscriptionGroupID   string     `json:"subscription_group_id,omitempty"`
 	ProductType           string     `json:"product_type"`
 	InAppOwnershipType    string     `json:"in_app_ownership_type"`
+	AppAccountToken       string     `json:"app_account_token,omitempty"`
 	Environment           string     `json:"environment"`
 	Status                string     `json:"status"`
+	SignedTransactionInfo string     `json:"-"` // 签名交易（JWS），收据验证时为空
 }
 
 // AppleSubscriptionResponse 订阅验证响应结构体
@@ -60,7 +75,7 @@ type AppleSubscriptionResponse struct {
 }
 
 // NewAppleService 创建Apple服务实例
-// 初始化Apple Store API连接
+// 初始化Apple Store API连接，顶层 bundle_id 为默认应用，apps 中的每个应用创建独立的 App Store Server API 客户端
 // 参数：
 //   - cfg: 应用配置
 //   - logger: 日志记录器
@@ -68,57 +83,144 @@ type AppleSubscriptionResponse struct {
 //
 // 返回：AppleService实例或错误
 func NewAppleService(cfg *config.Config, logger *zap.Logger, db *gorm.DB) (*AppleService, error) {
+	storeClients := make(map[string]*api.StoreClient)
+	sandboxStoreClients := make(map[string]*api.StoreClient)
+	signingKeys := make(map[string]*appleSigningKey)
+	var bundleIDs []string
+	for _, app := range cfg.Apple.AllApps() {
+		if app.BundleID == "" {
+			return nil, fmt.Errorf("Apple bundle ID is required")
+		}
+		if _, exists := storeClients[app.BundleID]; exists {
+			return nil, fmt.Errorf("duplicate Apple bundle ID: %s", app.BundleID)
+		}
+
+		privateKey, signingKey, err := loadApplePrivateKey(app)
+		if err != nil {
+			return nil, fmt.Errorf("bundle %s: %w", app.BundleID, err)
+		}
+		signingKeys[app.BundleID] = &appleSigningKey{keyID: app.KeyID, key: signingKey}
+
+		// 创建App Store Server API客户端，生产与沙盒环境各一个，按交易环境路由
+		storeClients[app.BundleID] = api.NewStoreClient(&api.StoreConfig{
+			KeyContent: []byte(privateKey),
+			KeyID:      app.KeyID,
+			BundleID:   app.BundleID,
+			Issuer:     app.IssuerID,
+		})
+		sandboxStoreClients[app.BundleID] = api.NewStoreClient(&api.StoreConfig{
+			KeyContent: []byte(privateKey),
+			KeyID:      app.KeyID,
+			BundleID:   app.BundleID,
+			Issuer:     app.IssuerID,
+			Sandbox:    true,
+		})
+		bundleIDs = append(bundleIDs, app.BundleID)
+	}
+	if len(bundleIDs) == 0 {
+		return nil, fmt.Errorf("no Apple app configured")
+	}
+
+	// 创建App Store客户端
+	client := appstore.New()
+
+	service := &AppleService{
+		config:       cfg,
+		logger:       logger,
+		db:           db,
+		client:       client,
+		storeClient:  storeClients[bundleIDs[0]],
+		bundleID:     bundleIDs[0],
+		storeClients: storeClients,
+		bundleIDs:    bundleIDs,
+		signingKey:   signingKeys[bundleIDs[0]],
+		signingKeys:  signingKeys,
+
+		sandboxStoreClient:  sandboxStoreClients[bundleIDs[0]],
+		sandboxStoreClients: sandboxStoreClients,
+	}
+	service.jwsVerifier = NewAppleJWSVerifier(AppleRootCertPool(), bundleIDs, service.acceptedEnvironments()...)
+
+	return service, nil
+}
+
+// SetJWSRootCertPool 替换签名数据验证信任的根证书池（默认 Apple Root CA - G3），用于测试或私有化验证环境
+func (s *AppleService) SetJWSRootCertPool(roots *x509.CertPool) {
+	s.jwsVerifier = NewAppleJWSVerifier(roots, s.bundleIDs, s.acceptedEnvironments()...)
+}
+
+// loadApplePrivateKey 读取并校验应用的 App Store Server API 私钥
+func loadApplePrivateKey(app config.AppleAppConfig) (string, *ecdsa.PrivateKey, error) {
 	// 获取私钥内容
-	privateKey := cfg.Apple.PrivateKey
-	if privateKey == "" && cfg.Apple.PrivateKeyPath != "" {
+	privateKey := app.PrivateKey
+	if privateKey == "" && app.PrivateKeyPath != "" {
 		// 从文件读取私钥
-		keyContent, err := ioutil.ReadFile(cfg.Apple.PrivateKeyPath)
+		keyContent, err := ioutil.ReadFile(app.PrivateKeyPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read Apple private key file: %w", err)
+			return "", nil, fmt.Errorf("failed to read Apple private key file: %w", err)
 		}
 		privateKey = string(keyContent)
 	}
 
 	if privateKey == "" {
-		return nil, fmt.Errorf("Apple private key is required")
+		return "", nil, fmt.Errorf("Apple private key is required")
 	}
 
 	// 验证私钥格式
 	block, _ := pem.Decode([]byte(privateKey))
 	if block == nil {
-		return nil, fmt.Errorf("invalid Apple private key format")
+		return "", nil, fmt.Errorf("invalid Apple private key format")
 	}
 
-	_, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse Apple private key: %w", err)
+		return "", nil, fmt.Errorf("failed to parse Apple private key: %w", err)
+	}
+	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return "", nil, fmt.Errorf("Apple private key is not an ECDSA key")
 	}
 
-	// 创建App Store客户端
-	client := appstore.New()
+	return privateKey, ecdsaKey, nil
+}
+
+// BundleID 返回当前绑定的 Bundle ID
+func (s *AppleService) BundleID() string {
+	return s.bundleID
+}
+
+// HasBundle 判断 Bundle ID 是否已配置
+func (s *AppleService) HasBundle(bundleID string) bool {
+	_, ok := s.storeClients[bundleID]
+	return ok
+}
 
-	// 创建App Store Server API客户端
-	storeConfig := &api.StoreConfig{
-		KeyContent: []byte(privateKey),
-		KeyID:      cfg.Apple.KeyID,
-		BundleID:   cfg.Apple.BundleID,
-		Issuer:     cfg.Apple.IssuerID,
-		Sandbox:    cfg.Apple.Sandbox,
-	}
-
-	storeClient := api.NewStoreClient(storeConfig)
-
-	return &AppleService{
-		config:      cfg,
-		logger:      logger,
-		db:          db,
-		client:      client,
-		storeClient: storeClient,
-		bundleID:    cfg.Apple.BundleID,
-	}, nil
+// ForBundle 返回绑定到指定 Bundle ID 的服务实例，Bundle ID 为空时返回默认应用
+// 参数：
+//   - bundleID: iOS应用Bundle ID
+//
+// 返回：AppleService实例或错误（Bundle ID 未配置）
+func (s *AppleService) ForBundle(bundleID string) (*AppleService, error) {
+	if bundleID == "" || bundleID == s.bundleID {
+		return s, nil
+	}
+	storeClient, ok := s.storeClients[bundleID]
+	if !ok {
+		return nil, fmt.Errorf("Apple app not configured: %s", bundleID)
+	}
+	scoped := *s
+	scoped.storeClient = storeClient
+	scoped.sandboxStoreClient = s.sandboxStoreClients[bundleID]
+	scoped.bundleID = bundleID
+	scoped.signingKey = s.signingKeys[bundleID]
+	return &scoped, nil
 }
 
-// VerifyPurchase 验证Apple购买
+// ErrAppleReceiptVerificationDisabled 未开启旧版收据验证
+var ErrAppleReceiptVerificationDisabled = errors.New("legacy Apple receipt verification is disabled")
+
+// VerifyPurchase 使用已废弃的 verifyReceipt 接口验证Apple收据
+// 仅作为旧版客户端的兼容方案，需开启 apple.legacy_receipt_verification；新客户端应提交 StoreKit 2 签名交易
 // 参数：
 //   - ctx: 上下文
 //   - receiptData: Base64编码的收据数据
@@ -126,6 +228,10 @@ func NewAppleService(cfg *config.Config, logger *zap.Logger, db *gorm.DB) (*Appl
 //
 // 返回：购买响应或错误
 func (s *AppleService) VerifyPurchase(ctx context.Context, receiptData string, orderID uint) (*ApplePurchaseResponse, error) {
+	if !s.config.Apple.LegacyReceiptVerification {
+		return nil, ErrAppleReceiptVerificationDisabled
+	}
+
 	// 验证收据
 	req := appstore.IAPRequest{
 		ReceiptData: receiptData,
@@ -150,77 +256,116 @@ func (s *AppleService) VerifyPurchase(ctx context.Context, receiptData string, o
 		return nil, fmt.Errorf("Apple receipt verification failed with status: %d", resp.Status)
 	}
 
+	// 防止使用其他应用的收据冒充
+	if resp.Receipt.BundleID != s.bundleID {
+		s.logger.Error("Apple receipt bundle ID mismatch",
+			zap.String("expected", s.bundleID),
+			zap.String("received", resp.Receipt.BundleID),
+			zap.Uint("order_id", orderID),
+		)
+		return nil, fmt.Errorf("receipt bundle ID %s does not match %s", resp.Receipt.BundleID, s.bundleID)
+	}
+
 	// 解析最新的交易信息
 	if len(resp.Receipt.InApp) == 0 {
 		return nil, fmt.Errorf("no in-app purchases found in receipt")
 	}
 
-	// 获取最新的交易
+	// 获取最新的交易，购买时间为毫秒时间戳字符串，需按数值比较
 	latestReceipt := resp.Receipt.InApp[0]
-	if len(resp.Receipt.InApp) > 1 {
-		// 如果有多个交易，找到最新的一个
-		for _, receipt := range resp.Receipt.InApp {
-			if receipt.PurchaseDateMS > latestReceipt.PurchaseDateMS {
-				latestReceipt = receipt
-			}
+	latestPurchaseDateMS := parseReceiptMillis(latestReceipt.PurchaseDateMS)
+	for _, receipt := range resp.Receipt.InApp[1:] {
+		if purchaseDateMS := parseReceiptMillis(receipt.PurchaseDateMS); purchaseDateMS > latestPurchaseDateMS {
+			latestReceipt = receipt
+			latestPurchaseDateMS = purchaseDateMS
 		}
 	}
 
-	// 解析时间戳
-	purchaseDateMS := int64(0)
-	fmt.Sscanf(latestReceipt.PurchaseDateMS, "%d", &purchaseDateMS)
-	purchaseDate := time.Unix(purchaseDateMS/1000, 0)
-
-	originalPurchaseDateMS := int64(0)
-	fmt.Sscanf(latestReceipt.OriginalPurchaseDateMS, "%d", &originalPurchaseDateMS)
-	originalPurchaseDate := time.Unix(originalPurchaseDateMS/1000, 0)
-
 	// 转换数量
 	quantity := 1
 	if latestReceipt.Quantity != "" {
 		fmt.Sscanf(latestReceipt.Quantity, "%d", &quantity)
 	}
 
+	// verifyReceipt 先请求生产环境，收到 21007（沙盒收据）时客户端自动改用沙盒环境重试，environment 标识实际环境
+	environment := string(resp.Environment)
+	if environment == "" {
+		environment = s.getEnvironment()
+	}
+	if !s.isEnvironmentAccepted(environment) {
+		s.logger.Warn("Apple receipt environment not accepted",
+			zap.String("environment", environment),
+			zap.Uint("order_id", orderID),
+		)
+		return nil, fmt.Errorf("Apple receipt environment %s is not accepted", environment)
+	}
+
 	response := &ApplePurchaseResponse{
 		TransactionID:         latestReceipt.TransactionID,
 		OriginalTransactionID: string(latestReceipt.OriginalTransactionID),
 		ProductID:             latestReceipt.ProductID,
 		BundleID:              resp.Receipt.BundleID,
-		PurchaseDate:          purchaseDate,
-		OriginalPurchaseDate:  originalPurchaseDate,
+		PurchaseDate:          time.Unix(latestPurchaseDateMS/1000, 0),
+		OriginalPurchaseDate:  time.Unix(parseReceiptMillis(latestReceipt.OriginalPurchaseDateMS)/1000, 0),
 		Quantity:              quantity,
 		IsTrialPeriod:         latestReceipt.IsTrialPeriod == "true",
 		IsInIntroOfferPeriod:  latestReceipt.IsInIntroOfferPeriod == "true",
 		WebOrderLineItemID:    latestReceipt.WebOrderLineItemID,
-		ProductType:           latestReceipt.ProductID, // 这里需要根据产品ID判断类型
 		InAppOwnershipType:    latestReceipt.InAppOwnershipType,
-		Environment:           s.getEnvironment(),
+		AppAccountToken:       latestReceipt.AppAccountToken,
+		Environment:           environment,
 		Status:                "VERIFIED",
 	}
 
-	// 设置到期时间（如果是订阅）
-	if latestReceipt.ExpiresDateMS != "" {
-		expiresDateMS := int64(0)
-		fmt.Sscanf(latestReceipt.ExpiresDateMS, "%d", &expiresDateMS)
-		if expiresDateMS > 0 {
-			expiresDate := time.Unix(expiresDateMS/1000, 0)
-			response.ExpiresDate = &expiresDate
-		}
+	// 设置到期时间（如果是订阅），收据不含商品类型，仅能通过到期时间识别自动续期订阅
+	if expiresDateMS := parseReceiptMillis(latestReceipt.ExpiresDateMS); expiresDateMS > 0 {
+		expiresDate := time.Unix(expiresDateMS/1000, 0)
+		response.ExpiresDate = &expiresDate
+		response.ProductType = string(api.AutoRenewable)
 	}
 
 	// 设置取消时间（如果有）
-	if latestReceipt.CancellationDateMS != "" {
-		cancellationDateMS := int64(0)
-		fmt.Sscanf(latestReceipt.CancellationDateMS, "%d", &cancellationDateMS)
-		if cancellationDateMS > 0 {
-			cancellationDate := time.Unix(cancellationDateMS/1000, 0)
-			response.CancellationDate = &cancellationDate
-		}
+	if cancellationDateMS := parseReceiptMillis(latestReceipt.CancellationDateMS); cancellationDateMS > 0 {
+		cancellationDate := time.Unix(cancellationDateMS/1000, 0)
+		response.CancellationDate = &cancellationDate
 	}
 
 	return response, nil
 }
 
+// parseReceiptMillis 解析收据中的毫秒时间戳字符串，无效时返回 0
+func parseReceiptMillis(value string) int64 {
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return millis
+}
+
+// VerifySignedTransaction 验证客户端提交的 StoreKit 2 签名交易（JWS）
+// 离线校验 x5c 证书链至 Apple 根证书及签名，无需请求 Apple 服务器
+// 参数：
+//   - ctx: 上下文
+//   - signedTransaction: StoreKit 2 Transaction.jwsRepresentation
+//
+// 返回：交易信息或错误
+func (s *AppleService) VerifySignedTransaction(ctx context.Context, signedTransaction string) (*ApplePurchaseResponse, error) {
+	transaction, err := s.verifySignedTransaction(signedTransaction)
+	if err != nil {
+		s.logger.Error("failed to verify signed transaction",
+			zap.Error(err),
+		)
+		return nil, fmt.Errorf("failed to verify signed transaction: %w", err)
+	}
+
+	result, err := s.verifiedPurchaseResponse(transaction)
+	if err != nil {
+		return nil, err
+	}
+	result.SignedTransactionInfo = signedTransaction
+	return result, nil
+}
+
 // VerifyTransaction 使用App Store Server API验证交易
 // 这是推荐的验证方式，比收据验证更准确
 // 参数：
@@ -229,8 +374,13 @@ func (s *AppleService) VerifyPurchase(ctx context.Context, receiptData string, o
 //
 // 返回：交易信息或错误
 func (s *AppleService) VerifyTransaction(ctx context.Context, transactionID string) (*ApplePurchaseResponse, error) {
-	// 获取交易信息
-	response, err := s.storeClient.GetTransactionInfo(ctx, transactionID)
+	// 获取交易信息，生产环境查不到时查询沙盒环境
+	var response *api.TransactionInfoResponse
+	_, err := s.withEnvironmentFallback(func(client *api.StoreClient) error {
+		var err error
+		response, err = client.GetTransactionInfo(ctx, transactionID)
+		return err
+	})
 	if err != nil {
 		s.logger.Error("failed to get Apple transaction info",
 			zap.Error(err),
@@ -240,7 +390,7 @@ func (s *AppleService) VerifyTransaction(ctx context.Context, transactionID stri
 	}
 
 	// 解析签名的交易信息
-	transaction, err := s.storeClient.ParseSignedTransaction(response.SignedTransactionInfo)
+	transaction, err := s.verifySignedTransaction(response.SignedTransactionInfo)
 	if err != nil {
 		s.logger.Error("failed to parse signed transaction",
 			zap.Error(err),
@@ -249,24 +399,61 @@ func (s *AppleService) VerifyTransaction(ctx context.Context, transactionID stri
 		return nil, fmt.Errorf("failed to parse signed transaction: %w", err)
 	}
 
-	purchaseDate := time.Unix(transaction.PurchaseDate/1000, 0)
-	originalPurchaseDate := time.Unix(transaction.OriginalPurchaseDate/1000, 0)
+	result, err := s.verifiedPurchaseResponse(transaction)
+	if err != nil {
+		return nil, err
+	}
+	result.SignedTransactionInfo = response.SignedTransactionInfo
+	return result, nil
+}
+
+// verifySignedTransaction 离线验证签名交易 JWS 并解析
+func (s *AppleService) verifySignedTransaction(signedTransaction string) (*api.JWSTransaction, error) {
+	transaction := &api.JWSTransaction{}
+	if err := s.jwsVerifier.Verify(signedTransaction, transaction); err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// verifiedPurchaseResponse 校验已验签交易所属应用并转换为购买响应
+func (s *AppleService) verifiedPurchaseResponse(transaction *api.JWSTransaction) (*ApplePurchaseResponse, error) {
+	// 防止使用其他应用的交易冒充
+	if transaction.BundleID != s.bundleID {
+		s.logger.Error("Apple transaction bundle ID mismatch",
+			zap.String("expected", s.bundleID),
+			zap.String("received", transaction.BundleID),
+			zap.String("transaction_id", transaction.TransactionID),
+		)
+		return nil, fmt.Errorf("transaction bundle ID %s does not match %s", transaction.BundleID, s.bundleID)
+	}
+
+	return s.convertJWSTransaction(transaction), nil
+}
+
+// convertJWSTransaction 将签名交易转换为购买响应
+func (s *AppleService) convertJWSTransaction(transaction *api.JWSTransaction) *ApplePurchaseResponse {
+	environment := string(transaction.Environment)
+	if environment == "" {
+		environment = s.getEnvironment()
+	}
 
 	result := &ApplePurchaseResponse{
 		TransactionID:         transaction.TransactionID,
 		OriginalTransactionID: transaction.OriginalTransactionId,
 		ProductID:             transaction.ProductID,
 		BundleID:              transaction.BundleID,
-		PurchaseDate:          purchaseDate,
-		OriginalPurchaseDate:  originalPurchaseDate,
+		PurchaseDate:          time.Unix(transaction.PurchaseDate/1000, 0),
+		OriginalPurchaseDate:  time.Unix(transaction.OriginalPurchaseDate/1000, 0),
 		Quantity:              int(transaction.Quantity),
-		IsTrialPeriod:         transaction.Type == "Auto-Renewable Subscription" && transaction.OfferType == 0,
-		IsInIntroOfferPeriod:  transaction.OfferType != 0,
+		IsTrialPeriod:         transaction.OfferType == 1 && transaction.OfferDiscountType == api.OfferDiscountTypeFreeTrial,
+		IsInIntroOfferPeriod:  transaction.OfferType == 1,
 		WebOrderLineItemID:    transaction.WebOrderLineItemId,
-		SubscriptionGroupID:   "", // 需要从其他地方获取
-		ProductType:           transaction.ProductID,
+		SubscriptionGroupID:   transaction.SubscriptionGroupIdentifier,
+		ProductType:           string(transaction.Type),
 		InAppOwnershipType:    transaction.InAppOwnershipType,
-		Environment:           s.getEnvironment(),
+		AppAccountToken:       transaction.AppAccountToken,
+		Environment:           environment,
 		Status:                "VERIFIED",
 	}
 
@@ -282,7 +469,7 @@ func (s *AppleService) VerifyTransaction(ctx context.Context, transactionID stri
 		result.CancellationDate = &cancellationDate
 	}
 
-	return result, nil
+	return result
 }
 
 // GetTransactionHistory 获取交易历史
@@ -292,7 +479,12 @@ func (s *AppleService) VerifyTransaction(ctx context.Context, transactionID stri
 //
 // 返回：交易历史列表或错误
 func (s *AppleService) GetTransactionHistory(ctx context.Context, originalTransactionID string) ([]*ApplePurchaseResponse, error) {
-	responses, err := s.storeClient.GetTransactionHistory(ctx, originalTransactionID, nil)
+	var responses []*api.HistoryResponse
+	_, err := s.withEnvironmentFallback(func(client *api.StoreClient) error {
+		var err error
+		responses, err = client.GetTransactionHistory(ctx, originalTransactionID, nil)
+		return err
+	})
 	if err != nil {
 		s.logger.Error("failed to get Apple transaction history",
 			zap.Error(err),
@@ -303,50 +495,16 @@ func (s *AppleService) GetTransactionHistory(ctx context.Context, originalTransa
 
 	var results []*ApplePurchaseResponse
 	for _, response := range responses {
-		transactions, err := s.storeClient.ParseSignedTransactions(response.SignedTransactions)
-		if err != nil {
-			s.logger.Error("failed to parse signed transactions",
-				zap.Error(err),
-				zap.String("original_transaction_id", originalTransactionID),
-			)
-			continue
-		}
-
-		for _, transaction := range transactions {
-			purchaseDate := time.Unix(transaction.PurchaseDate/1000, 0)
-			originalPurchaseDate := time.Unix(transaction.OriginalPurchaseDate/1000, 0)
-
-			result := &ApplePurchaseResponse{
-				TransactionID:         transaction.TransactionID,
-				OriginalTransactionID: transaction.OriginalTransactionId,
-				ProductID:             transaction.ProductID,
-				BundleID:              transaction.BundleID,
-				PurchaseDate:          purchaseDate,
-				OriginalPurchaseDate:  originalPurchaseDate,
-				Quantity:              int(transaction.Quantity),
-				IsTrialPeriod:         transaction.Type == "Auto-Renewable Subscription" && transaction.OfferType == 0,
-				IsInIntroOfferPeriod:  transaction.OfferType != 0,
-				WebOrderLineItemID:    transaction.WebOrderLineItemId,
-				SubscriptionGroupID:   "", // 需要从其他地方获取
-				ProductType:           transaction.ProductID,
-				InAppOwnershipType:    transaction.InAppOwnershipType,
-				Environment:           s.getEnvironment(),
-				Status:                "VERIFIED",
+		for _, signedTransaction := range response.SignedTransactions {
+			transaction, err := s.verifySignedTransaction(signedTransaction)
+			if err != nil {
+				s.logger.Error("failed to verify signed transaction",
+					zap.Error(err),
+					zap.String("original_transaction_id", originalTransactionID),
+				)
+				continue
 			}
-
-			// 设置到期时间（如果是订阅）
-			if transaction.ExpiresDate > 0 {
-				expiresDate := time.Unix(transaction.ExpiresDate/1000, 0)
-				result.ExpiresDate = &expiresDate
-			}
-
-			// 设置取消时间（如果有）
-			if transaction.RevocationDate > 0 {
-				cancellationDate := time.Unix(transaction.RevocationDate/1000, 0)
-				result.CancellationDate = &cancellationDate
-			}
-
-			results = append(results, result)
+			results = append(results, s.convertJWSTransaction(transaction))
 		}
 	}
 
@@ -385,6 +543,7 @@ type AppleTransactionInfo struct {
 	Quantity              int64      `json:"quantity"`
 	Type                  string     `json:"type"`
 	InAppOwnershipType    string     `json:"in_app_ownership_type"`
+	AppAccountToken       string     `json:"app_account_token,omitempty"`
 	Environment           string     `json:"environment"`
 	Price                 int64      `json:"price"`
 	Currency              string     `json:"currency"`
@@ -399,16 +558,21 @@ type AppleTransactionInfo struct {
 
 // AppleRenewalInfo 续订信息
 type AppleRenewalInfo struct {
-	OriginalTransactionID  string     `json:"original_transaction_id"`
-	AutoRenewProductID     string     `json:"auto_renew_product_id"`
-	AutoRenewStatus        int        `json:"auto_renew_status"`
-	ExpirationIntent       int        `json:"expiration_intent,omitempty"`
-	GracePeriodExpiresDate *time.Time `json:"grace_period_expires_date,omitempty"`
-	IsInBillingRetryPeriod bool       `json:"is_in_billing_retry_period"`
-	ProductID              string     `json:"product_id"`
-	RenewalDate            *time.Time `json:"renewal_date,omitempty"`
-	RenewalPrice           int64      `json:"renewal_price,omitempty"`
-	Currency               string     `json:"currency,omitempty"`
+	OriginalTransactionID       string     `json:"original_transaction_id"`
+	AutoRenewProductID          string     `json:"auto_renew_product_id"`
+	AutoRenewStatus             int        `json:"auto_renew_status"`
+	ExpirationIntent            int        `json:"expiration_intent,omitempty"`
+	GracePeriodExpiresDate      *time.Time `json:"grace_period_expires_date,omitempty"`
+	IsInBillingRetryPeriod      bool       `json:"is_in_billing_retry_period"`
+	ProductID                   string     `json:"product_id"`
+	RenewalDate                 *time.Time `json:"renewal_date,omitempty"`
+	RenewalPrice                int64      `json:"renewal_price,omitempty"`
+	Currency                    string     `json:"currency,omitempty"`
+	PriceIncreaseStatus         int        `json:"price_increase_status"`                    // 涨价同意状态：0-未同意（或无涨价），1-已同意
+	OfferType                   int        `json:"offer_type,omitempty"`                     // 下次续订使用的优惠类型：1-介绍性优惠，2-促销优惠，3-优惠码
+	OfferIdentifier             string     `json:"offer_identifier,omitempty"`               // 下次续订使用的优惠ID（促销优惠ID或优惠码名称）
+	RecentSubscriptionStartDate *time.Time `json:"recent_subscription_start_date,omitempty"` // 最近一次连续订阅的开始时间
+	Environment                 string     `json:"environment,omitempty"`
 }
 
 // ParseNotification 解析Apple通知
@@ -417,9 +581,9 @@ type AppleRenewalInfo struct {
 //
 // 返回：解析后的通知或错误
 func (s *AppleService) ParseNotification(signedPayload string) (*AppleNotification, error) {
-	// 使用 ParseNotificationV2WithClaim 解析通知
+	// 离线验证通知签名、证书链、应用与环境
 	payload := &appstore.SubscriptionNotificationV2DecodedPayload{}
-	err := s.client.ParseNotificationV2WithClaim(signedPayload, payload)
+	err := s.jwsVerifier.Verify(signedPayload, payload)
 	if err != nil {
 		s.logger.Error("failed to parse Apple notification",
 			zap.Error(err),
@@ -466,17 +630,11 @@ func (s *AppleService) ParseNotification(signedPayload string) (*AppleNotificati
 
 // parseSignedTransactionInfo 解析签名的交易信息
 func (s *AppleService) parseSignedTransactionInfo(signedInfo string) (*AppleTransactionInfo, error) {
-	payload := &appstore.JWSTransactionDecodedPayload{}
-
-	// 使用JWT解析（签名已在ParseNotificationV2WithClaim中验证）
-	token, _, err := jwt.NewParser().ParseUnverified(signedInfo, payload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse transaction JWT: %w", err)
-	}
+	claims := &appstore.JWSTransactionDecodedPayload{}
 
-	claims, ok := token.Claims.(*appstore.JWSTransactionDecodedPayload)
-	if !ok {
-		return nil, fmt.Errorf("invalid transaction claims")
+	// 嵌套的签名交易同样带有 x5c 证书链，独立验证
+	if err := s.jwsVerifier.Verify(signedInfo, claims); err != nil {
+		return nil, fmt.Errorf("failed to verify transaction JWS: %w", err)
 	}
 
 	info := &AppleTransactionInfo{
@@ -489,6 +647,7 @@ func (s *AppleService) parseSignedTransactionInfo(signedInfo string) (*AppleTran
 		Quantity:              claims.Quantity,
 		Type:                  string(claims.IAPtype),
 		InAppOwnershipType:    claims.InAppOwnershipType,
+		AppAccountToken:       claims.AppAccountToken,
 		Environment:           string(claims.Environment),
 		Price:                 claims.Price,
 		Currency:              claims.Currency,
@@ -515,17 +674,11 @@ func (s *AppleService) parseSignedTransactionInfo(signedInfo string) (*AppleTran
 
 // parseSignedRenewalInfo 解析签名的续订信息
 func (s *AppleService) parseSignedRenewalInfo(signedInfo string) (*AppleRenewalInfo, error) {
-	payload := &appstore.JWSRenewalInfoDecodedPayload{}
-
-	// 使用JWT解析
-	token, _, err := jwt.NewParser().ParseUnverified(signedInfo, payload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse renewal JWT: %w", err)
-	}
+	claims := &appstore.JWSRenewalInfoDecodedPayload{}
 
-	claims, ok := token.Claims.(*appstore.JWSRenewalInfoDecodedPayload)
-	if !ok {
-		return nil, fmt.Errorf("invalid renewal claims")
+	// 嵌套的签名续订信息同样带有 x5c 证书链，独立验证
+	if err := s.jwsVerifier.Verify(signedInfo, claims); err != nil {
+		return nil, fmt.Errorf("failed to verify renewal JWS: %w", err)
 	}
 
 	info := &AppleRenewalInfo{
@@ -537,6 +690,10 @@ func (s *AppleService) parseSignedRenewalInfo(signedInfo string) (*AppleRenewalI
 		ProductID:              claims.ProductId,
 		RenewalPrice:           claims.RenewalPrice,
 		Currency:               claims.Currency,
+		PriceIncreaseStatus:    int(claims.PriceIncreaseStatus),
+		OfferType:              int(claims.OfferType),
+		OfferIdentifier:        claims.OfferIdentifier,
+		Environment:            string(claims.Environment),
 	}
 
 	if claims.GracePeriodExpiresDate > 0 {
@@ -549,6 +706,11 @@ func (s *AppleService) parseSignedRenewalInfo(signedInfo string) (*AppleRenewalI
 		info.RenewalDate = &renewalDate
 	}
 
+	if claims.RecentSubscriptionStartDate > 0 {
+		recentStartDate := time.Unix(claims.RecentSubscriptionStartDate/1000, 0)
+		info.RecentSubscriptionStartDate = &recentStartDate
+	}
+
 	return info, nil
 }
 
@@ -624,7 +786,14 @@ func (s *AppleService) handleDidRenew(ctx context.Context, notification *AppleNo
 	)
 
 	// 更新支付记录
-	return s.upsertApplePayment(ctx, transactionInfo, notification)
+	if err := s.upsertApplePayment(ctx, transactionInfo, notification); err != nil {
+		return err
+	}
+
+	// 续订成功（含 BILLING_RECOVERY 账单重试恢复）后清除催缴状态
+	return s.db.WithContext(ctx).Model(&models.ApplePayment{}).
+		Where("original_transaction_id = ? AND dunning_state <> ?", transactionInfo.OriginalTransactionID, models.DunningStateNone).
+		Update("dunning_state", models.DunningStateNone).Error
 }
 
 // handleDidFailToRenew 处理续订失败通知
@@ -648,6 +817,7 @@ func (s *AppleService) handleDidFailToRenew(ctx context.Context, notification *A
 
 	// 更新状态
 	payment.Status = "RENEWAL_FAILED"
+	payment.DunningState = AppleDunningState(notification.NotificationType, notification.Subtype)
 	if notification.Subtype == "GRACE_PERIOD" {
 		payment.GracePeriodStatus = "IN_GRACE_PERIOD"
 	} else {
@@ -728,6 +898,9 @@ func (s *AppleService) handleExpired(ctx context.Context, notification *AppleNot
 	}
 
 	payment.Status = "EXPIRED"
+	if dunningState := AppleDunningState(notification.NotificationType, notification.Subtype); dunningState != models.DunningStateNone {
+		payment.DunningState = dunningState
+	}
 	if notification.Data.RenewalInfo != nil {
 		payment.ExpirationIntent = fmt.Sprintf("%d", notification.Data.RenewalInfo.ExpirationIntent)
 	}
@@ -758,6 +931,7 @@ func (s *AppleService) handleGracePeriodExpired(ctx context.Context, notificatio
 
 	payment.Status = "GRACE_PERIOD_EXPIRED"
 	payment.GracePeriodStatus = "EXPIRED"
+	payment.DunningState = AppleDunningState(notification.NotificationType, notification.Subtype)
 
 	// 更新订单状态为过期
 	if payment.OrderID > 0 {
@@ -857,44 +1031,29 @@ func (s *AppleService) handleRefundReversed(ctx context.Context, notification *A
 }
 
 // handleRevoke 处理撤销
+// Apple 在家庭组织者停止共享、退款或家庭成员离开家庭组时向接收方发送 REVOKE，仅撤销接收方自己的交易链
 func (s *AppleService) handleRevoke(ctx context.Context, notification *AppleNotification, transactionInfo *AppleTransactionInfo) error {
 	s.logger.Info("Handling REVOKE notification",
 		zap.String("transaction_id", transactionInfo.TransactionID),
+		zap.String("original_transaction_id", transactionInfo.OriginalTransactionID),
+		zap.String("in_app_ownership_type", transactionInfo.InAppOwnershipType),
 	)
 
-	var payment models.ApplePayment
-	if err := s.db.WithContext(ctx).Where("transaction_id = ?", transactionInfo.TransactionID).
-		First(&payment).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return nil
-		}
+	revoked, err := s.revokeApplePayments(ctx, transactionInfo)
+	if err != nil {
 		return err
 	}
-
-	payment.Status = "REVOKED"
-	payment.RevocationDate = transactionInfo.RevocationDate
-	if transactionInfo.RevocationReason > 0 {
-		payment.RevocationReason = fmt.Sprintf("%d", transactionInfo.RevocationReason)
-	}
-
-	// 更新订单状态（撤销通常因为家庭共享被移除等原因）
-	if payment.OrderID > 0 {
-		s.db.WithContext(ctx).Model(&models.Order{}).Where("id = ?", payment.OrderID).
-			Updates(map[string]interface{}{
-				"status":         models.OrderStatusCancelled,
-				"payment_status": models.PaymentStatusCancelled,
-			})
+	if revoked == 0 {
+		s.logger.Warn("Apple payment not found for REVOKE",
+			zap.String("transaction_id", transactionInfo.TransactionID))
+		return nil
 	}
 
-	return s.db.WithContext(ctx).Save(&payment).Error
-}
-
-// handleConsumptionRequest 处理消耗请求
-func (s *AppleService) handleConsumptionRequest(ctx context.Context, notification *AppleNotification, transactionInfo *AppleTransactionInfo) error {
-	s.logger.Info("Handling CONSUMPTION_REQUEST notification",
-		zap.String("transaction_id", transactionInfo.TransactionID),
+	s.logger.Info("Apple entitlement revoked",
+		zap.String("original_transaction_id", transactionInfo.OriginalTransactionID),
+		zap.Bool("family_shared", isFamilyShared(transactionInfo.InAppOwnershipType)),
+		zap.Int("payments", revoked),
 	)
-	// 消耗请求需要业务方响应，这里只记录日志
 	return nil
 }
 
@@ -915,19 +1074,48 @@ func (s *AppleService) upsertApplePayment(ctx context.Context, transactionInfo *
 
 	if err == gorm.ErrRecordNotFound {
 		// 尝试通过 original_transaction_id 查找已有的 ApplePayment 获取 OrderID
-		// 这是关键：首次购买时客户端会调用 verify-receipt/verify-transaction 并传入 order_id
 		// 后续的续订/退款等 webhook 可以通过 original_transaction_id 关联到同一个订单
+		// 新交易链通过 appAccountToken 关联到下单时生成令牌的订单，无法关联的进入待关联队列
 		var orderID uint
+		orphanReason := ""
 		var existingPayment models.ApplePayment
 		if err := s.db.WithContext(ctx).
 			Where("original_transaction_id = ?", transactionInfo.OriginalTransactionID).
 			Order("created_at ASC"). // 找到最早的那条记录（首次购买）
 			First(&existingPayment).Error; err == nil && existingPayment.OrderID > 0 {
-			orderID = existingPayment.OrderID
-			s.logger.Info("Found existing order for Apple transaction",
-				zap.Uint("order_id", orderID),
-				zap.String("original_transaction_id", transactionInfo.OriginalTransactionID),
-			)
+			if transactionInfo.AppAccountToken != "" && existingPayment.AppAccountToken != "" &&
+				!sameAppAccountToken(existingPayment.AppAccountToken, transactionInfo.AppAccountToken) {
+				orphanReason = "app account token differs from the original transaction"
+			} else {
+				orderID = existingPayment.OrderID
+				s.logger.Info("Found existing order for Apple transaction",
+					zap.Uint("order_id", orderID),
+					zap.String("original_transaction_id", transactionInfo.OriginalTransactionID),
+				)
+			}
+		} else if transactionInfo.AppAccountToken == "" {
+			orphanReason = "transaction has no app account token"
+		} else if isFamilyShared(transactionInfo.InAppOwnershipType) {
+			// 家庭共享交易没有接收方下单，通过 appAccountToken 找到接收方并创建权益订单
+			if orderID, err = s.linkFamilySharedOrder(ctx, transactionInfo); err != nil {
+				return err
+			}
+			if orderID == 0 {
+				orphanReason = "no user bound to app account token"
+			}
+		} else {
+			if orderID, err = s.findOrderByAppAccountToken(ctx, transactionInfo.AppAccountToken); err != nil {
+				return err
+			}
+			if orderID == 0 {
+				orphanReason = "no order bound to app account token"
+			}
+		}
+
+		if orphanReason != "" {
+			if err := s.queueOrphanTransaction(ctx, orphanFromNotification(transactionInfo, notification, orphanReason)); err != nil {
+				return err
+			}
 		}
 
 		// 创建新记录
@@ -943,6 +1131,7 @@ func (s *AppleService) upsertApplePayment(ctx context.Context, transactionInfo *
 			ExpiresDate:           transactionInfo.ExpiresDate,
 			ProductType:           transactionInfo.Type,
 			InAppOwnershipType:    transactionInfo.InAppOwnershipType,
+			AppAccountToken:       transactionInfo.AppAccountToken,
 			SubscriptionGroupID:   transactionInfo.SubscriptionGroupID,
 			WebOrderLineItemID:    transactionInfo.WebOrderLineItemID,
 			Price:                 transactionInfo.Price,
@@ -963,6 +1152,11 @@ func (s *AppleService) upsertApplePayment(ctx context.Context, transactionInfo *
 
 		// 如果找到了关联订单，更新订单状态
 		if orderID > 0 {
+			if isAppleTestEnvironment(transactionInfo.Environment) {
+				if err := markTestOrder(s.db.WithContext(ctx), orderID); err != nil {
+					return err
+				}
+			}
 			s.updateOrderStatusFromNotification(ctx, orderID, notification)
 		}
 
@@ -1008,8 +1202,8 @@ func (s *AppleService) updateOrderStatusFromNotification(ctx context.Context, or
 	needUpdate := false
 
 	switch notification.NotificationType {
-	case "SUBSCRIBED", "DID_RENEW":
-		// 订阅成功或续订成功
+	case "SUBSCRIBED", "DID_RENEW", "ONE_TIME_CHARGE":
+		// 订阅成功、续订成功或一次性购买成功
 		newStatus = models.OrderStatusPaid
 		newPaymentStatus = models.PaymentStatusCompleted
 		needUpdate = true
@@ -1062,6 +1256,7 @@ func (s *AppleService) updateOrderStatusFromNotification(ctx context.Context, or
 }
 
 // GetSubscriptionStatus 获取订阅状态
+// 通过 Get All Subscription Statuses 获取实时状态，Apple 接口不可用时返回本地记录
 func (s *AppleService) GetSubscriptionStatus(ctx context.Context, originalTransactionID string) (*AppleSubscriptionResponse, error) {
 	// 首先查询本地数据库
 	var payment models.ApplePayment
@@ -1073,7 +1268,7 @@ func (s *AppleService) GetSubscriptionStatus(ctx context.Context, originalTransa
 	}
 
 	// 尝试从Apple获取最新状态
-	transactions, err := s.GetTransactionHistory(ctx, originalTransactionID)
+	statuses, err := s.GetAllSubscriptionStatuses(ctx, originalTransactionID)
 	if err != nil {
 		// 如果获取失败但有本地记录，返回本地数据
 		if payment.ID > 0 {
@@ -1082,22 +1277,48 @@ func (s *AppleService) GetSubscriptionStatus(ctx context.Context, originalTransa
 		return nil, err
 	}
 
-	if len(transactions) == 0 {
+	latest := statuses.Find(originalTransactionID)
+	if latest == nil || latest.Transaction == nil {
 		if payment.ID > 0 {
 			return s.convertPaymentToSubscriptionResponse(&payment), nil
 		}
 		return nil, fmt.Errorf("no subscription found for original_transaction_id: %s", originalTransactionID)
 	}
 
-	// 返回最新的交易信息
-	latest := transactions[len(transactions)-1]
-	return &AppleSubscriptionResponse{
-		ApplePurchaseResponse: *latest,
-		AutoRenewStatus:       payment.AutoRenewStatus != nil && *payment.AutoRenewStatus,
-		AutoRenewProductID:    payment.AutoRenewProductID,
-		GracePeriodStatus:     payment.GracePeriodStatus,
-		ExpirationIntent:      payment.ExpirationIntent,
-	}, nil
+	transaction := latest.Transaction
+	response := &AppleSubscriptionResponse{
+		ApplePurchaseResponse: ApplePurchaseResponse{
+			TransactionID:         transaction.TransactionID,
+			OriginalTransactionID: transaction.OriginalTransactionID,
+			ProductID:             transaction.ProductID,
+			BundleID:              transaction.BundleID,
+			PurchaseDate:          transaction.PurchaseDate,
+			OriginalPurchaseDate:  transaction.OriginalPurchaseDate,
+			Quantity:              int(transaction.Quantity),
+			IsInIntroOfferPeriod:  transaction.OfferType == 1,
+			ExpiresDate:           transaction.ExpiresDate,
+			CancellationDate:      transaction.RevocationDate,
+			WebOrderLineItemID:    transaction.WebOrderLineItemID,
+			SubscriptionGroupID:   transaction.SubscriptionGroupID,
+			ProductType:           transaction.Type,
+			InAppOwnershipType:    transaction.InAppOwnershipType,
+			Environment:           transaction.Environment,
+			Status:                latest.StatusName,
+		},
+	}
+
+	if renewalInfo := latest.RenewalInfo; renewalInfo != nil {
+		response.AutoRenewStatus = renewalInfo.AutoRenewStatus == 1
+		response.AutoRenewProductID = renewalInfo.AutoRenewProductID
+		if renewalInfo.ExpirationIntent > 0 {
+			response.ExpirationIntent = fmt.Sprintf("%d", renewalInfo.ExpirationIntent)
+		}
+	}
+	if api.AutoRenewSubscriptionStatus(latest.Status) == api.SubscriptionGracePeriod {
+		response.GracePeriodStatus = "IN_GRACE_PERIOD"
+	}
+
+	return response, nil
 }
 
 // convertPaymentToSubscriptionResponse 将支付记录转换为订阅响应
@@ -1142,7 +1363,7 @@ func (s *AppleService) convertPaymentToSubscriptionResponse(payment *models.Appl
 	return response
 }
 
-// SaveApplePayment 保存Apple支付信息到数据库
+// SaveApplePayment 保存Apple支付信息到数据库，并校验订单所属应用
 // 参数：
 //   - ctx: 上下文
 //   - orderID: 订单ID
@@ -1150,6 +1371,49 @@ func (s *AppleService) convertPaymentToSubscriptionResponse(payment *models.Appl
 //
 // 返回：错误或nil
 func (s *AppleService) SaveApplePayment(ctx context.Context, orderID uint, response *ApplePurchaseResponse) error {
+	var order models.Order
+	if err := s.db.WithContext(ctx).First(&order, orderID).Error; err != nil {
+		return fmt.Errorf("failed to load order: %w", err)
+	}
+	if err := bindOrderApp(s.db.WithContext(ctx), &order, response.BundleID); err != nil {
+		s.logger.Error("Apple order app mismatch",
+			zap.Error(err),
+			zap.Uint("order_id", orderID),
+			zap.String("bundle_id", response.BundleID),
+		)
+		return err
+	}
+
+	// 交易须携带下单时生成的 appAccountToken，防止客户端伪造 order_id 关联他人订单
+	if err := s.checkOrderAppAccountToken(ctx, &order, response); err != nil {
+		s.logger.Warn("Apple transaction rejected for order",
+			zap.Error(err),
+			zap.Uint("order_id", orderID),
+			zap.String("transaction_id", response.TransactionID),
+		)
+		return err
+	}
+
+	if isAppleTestEnvironment(response.Environment) {
+		if err := markTestOrder(s.db.WithContext(ctx), orderID); err != nil {
+			return err
+		}
+	}
+
+	// 通知可能先于客户端验证到达并已按令牌关联订单
+	var existing models.ApplePayment
+	if err := s.db.WithContext(ctx).Where("transaction_id = ?", response.TransactionID).
+		First(&existing).Error; err == nil && existing.OrderID == orderID {
+		return nil
+	}
+
+	// 家庭共享交易由组织者付费，接收方订单不计收入
+	if isFamilyShared(response.InAppOwnershipType) && order.TotalAmount != 0 {
+		if err := s.db.WithContext(ctx).Model(&order).Update("total_amount", 0).Error; err != nil {
+			return fmt.Errorf("failed to clear family shared order amount: %w", err)
+		}
+	}
+
 	applePayment := &models.ApplePayment{
 		OrderID:               orderID,
 		TransactionID:         response.TransactionID,
@@ -1164,8 +1428,10 @@ func (s *AppleService) SaveApplePayment(ctx context.Context, orderID uint, respo
 		SubscriptionGroupID:   response.SubscriptionGroupID,
 		ProductType:           response.ProductType,
 		InAppOwnershipType:    response.InAppOwnershipType,
+		AppAccountToken:       response.AppAccountToken,
 		WebOrderLineItemID:    response.WebOrderLineItemID,
 		Environment:           response.Environment,
+		SignedTransactionInfo: response.SignedTransactionInfo,
 		Status:                response.Status,
 	}
 
@@ -1194,10 +1460,10 @@ func (s *AppleService) SaveApplePayment(ctx context.Context, orderID uint, respo
 	return nil
 }
 
-// getEnvironment 获取当前环境
+// getEnvironment 获取部署的默认环境，交易未携带环境时使用
 func (s *AppleService) getEnvironment() string {
 	if s.config.Apple.Sandbox {
-		return "Sandbox"
+		return appleEnvironmentSandbox
 	}
-	return "Production"
+	return appleEnvironmentProduction
 }
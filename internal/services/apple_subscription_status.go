@@ -0,0 +1,295 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/awa/go-iap/appstore/api"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"pay-gateway/internal/models"
+)
+
+// AppleSubscriptionStatusName 将 Get All Subscription Statuses 返回的状态码转换为可读名称
+// 1-有效，2-已过期，3-账单重试期，4-账单宽限期，5-已撤销
+func AppleSubscriptionStatusName(status int32) string {
+	switch api.AutoRenewSubscriptionStatus(status) {
+	case api.SubscriptionActive:
+		return "ACTIVE"
+	case api.SubscriptionExpired:
+		return "EXPIRED"
+	case api.SubscriptionRetryPeriod:
+		return "BILLING_RETRY"
+	case api.SubscriptionGracePeriod:
+		return "GRACE_PERIOD"
+	case api.SubscriptionRevoked:
+		return "REVOKED"
+	}
+	return "UNKNOWN"
+}
+
+// AppleSubscriptionStatuses Apple 实时订阅状态，包含用户在该应用下全部订阅组的最新交易
+type AppleSubscriptionStatuses struct {
+	Environment string                         `json:"environment"`
+	BundleID    string                         `json:"bundle_id"`
+	AppAppleID  int64                          `json:"app_apple_id"`
+	Groups      []AppleSubscriptionGroupStatus `json:"groups"`
+}
+
+// AppleSubscriptionGroupStatus 单个订阅组的状态
+type AppleSubscriptionGroupStatus struct {
+	SubscriptionGroupID string                             `json:"subscription_group_id"`
+	LastTransactions    []AppleSubscriptionLastTransaction `json:"last_transactions"`
+}
+
+// AppleSubscriptionLastTransaction 订阅组内某个订阅的最新交易及续订信息
+type AppleSubscriptionLastTransaction struct {
+	OriginalTransactionID string                `json:"original_transaction_id"`
+	Status                int32                 `json:"status"`      // Apple 订阅状态码
+	StatusName            string                `json:"status_name"` // 状态名称，见 AppleSubscriptionStatusName
+	Transaction           *AppleTransactionInfo `json:"transaction,omitempty"`
+	RenewalInfo           *AppleRenewalInfo     `json:"renewal_info,omitempty"`
+	SignedTransactionInfo string                `json:"-"`
+	SignedRenewalInfo     string                `json:"-"`
+}
+
+// GetAllSubscriptionStatuses 调用 App Store Server API 的 Get All Subscription Statuses 接口获取实时订阅状态
+// 返回用户在当前应用下每个订阅组的最新交易，并解码续订信息（自动续订商品、过期原因、宽限期、涨价同意状态、优惠等）
+// 参数：
+//   - ctx: 上下文
+//   - originalTransactionID: 任一属于该用户的原始交易ID
+//   - statuses: 可选，仅返回指定状态码的订阅，为空时返回全部
+//
+// 返回：订阅状态或错误
+func (s *AppleService) GetAllSubscriptionStatuses(ctx context.Context, originalTransactionID string, statuses ...int32) (*AppleSubscriptionStatuses, error) {
+	var query *url.Values
+	if len(statuses) > 0 {
+		query = &url.Values{}
+		for _, status := range statuses {
+			query.Add("status", strconv.Itoa(int(status)))
+		}
+	}
+
+	var response *api.StatusResponse
+	_, err := s.withEnvironmentFallback(func(client *api.StoreClient) error {
+		var err error
+		response, err = client.GetALLSubscriptionStatuses(ctx, originalTransactionID, query)
+		return err
+	})
+	if err != nil {
+		s.logger.Error("failed to get Apple subscription statuses",
+			zap.Error(err),
+			zap.String("original_transaction_id", originalTransactionID),
+		)
+		return nil, fmt.Errorf("failed to get Apple subscription statuses: %w", err)
+	}
+
+	result := &AppleSubscriptionStatuses{
+		Environment: string(response.Environment),
+		BundleID:    response.BundleId,
+		AppAppleID:  response.AppAppleId,
+		Groups:      make([]AppleSubscriptionGroupStatus, 0, len(response.Data)),
+	}
+
+	for _, group := range response.Data {
+		groupStatus := AppleSubscriptionGroupStatus{
+			SubscriptionGroupID: group.SubscriptionGroupIdentifier,
+			LastTransactions:    make([]AppleSubscriptionLastTransaction, 0, len(group.LastTransactions)),
+		}
+
+		for _, item := range group.LastTransactions {
+			lastTransaction := AppleSubscriptionLastTransaction{
+				OriginalTransactionID: item.OriginalTransactionId,
+				Status:                int32(item.Status),
+				StatusName:            AppleSubscriptionStatusName(int32(item.Status)),
+				SignedTransactionInfo: item.SignedTransactionInfo,
+				SignedRenewalInfo:     item.SignedRenewalInfo,
+			}
+
+			if item.SignedTransactionInfo != "" {
+				transactionInfo, err := s.parseSignedTransactionInfo(item.SignedTransactionInfo)
+				if err != nil {
+					s.logger.Warn("failed to parse signed transaction info",
+						zap.Error(err),
+						zap.String("original_transaction_id", item.OriginalTransactionId),
+					)
+				} else {
+					lastTransaction.Transaction = transactionInfo
+				}
+			}
+
+			if item.SignedRenewalInfo != "" {
+				renewalInfo, err := s.parseSignedRenewalInfo(item.SignedRenewalInfo)
+				if err != nil {
+					s.logger.Warn("failed to parse signed renewal info",
+						zap.Error(err),
+						zap.String("original_transaction_id", item.OriginalTransactionId),
+					)
+				} else {
+					lastTransaction.RenewalInfo = renewalInfo
+				}
+			}
+
+			groupStatus.LastTransactions = append(groupStatus.LastTransactions, lastTransaction)
+		}
+
+		result.Groups = append(result.Groups, groupStatus)
+	}
+
+	return result, nil
+}
+
+// Find 查找指定原始交易ID的最新交易，不存在时返回 nil
+func (r *AppleSubscriptionStatuses) Find(originalTransactionID string) *AppleSubscriptionLastTransaction {
+	for i := range r.Groups {
+		for j := range r.Groups[i].LastTransactions {
+			if r.Groups[i].LastTransactions[j].OriginalTransactionID == originalTransactionID {
+				return &r.Groups[i].LastTransactions[j]
+			}
+		}
+	}
+	return nil
+}
+
+// SyncSubscriptionStatuses 将实时订阅状态回写到本地 ApplePayment 及关联订单
+// 用于补偿丢失或延迟的 Server Notification，未在本地记录的订阅跳过
+// 参数：
+//   - ctx: 上下文
+//   - statuses: GetAllSubscriptionStatuses 的返回结果
+//
+// 返回：已同步的支付记录数量或错误
+func (s *AppleService) SyncSubscriptionStatuses(ctx context.Context, statuses *AppleSubscriptionStatuses) (int, error) {
+	synced := 0
+	for _, group := range statuses.Groups {
+		for i := range group.LastTransactions {
+			ok, err := s.syncSubscriptionStatus(ctx, &group.LastTransactions[i])
+			if err != nil {
+				return synced, err
+			}
+			if ok {
+				synced++
+			}
+		}
+	}
+	return synced, nil
+}
+
+// syncSubscriptionStatus 回写单个订阅的最新状态，本地无记录时返回 false
+func (s *AppleService) syncSubscriptionStatus(ctx context.Context, item *AppleSubscriptionLastTransaction) (bool, error) {
+	if item.Transaction == nil {
+		s.logger.Warn("Skip syncing Apple subscription without transaction info",
+			zap.String("original_transaction_id", item.OriginalTransactionID))
+		return false, nil
+	}
+
+	tx := s.db.WithContext(ctx).Begin()
+
+	// 优先匹配最新交易，续订交易尚未入库时退回到该订阅最新的一条记录
+	var payment models.ApplePayment
+	err := tx.Where("transaction_id = ?", item.Transaction.TransactionID).First(&payment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = tx.Where("original_transaction_id = ?", item.OriginalTransactionID).
+			Order("created_at DESC").First(&payment).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			s.logger.Info("Apple payment not found for subscription status sync",
+				zap.String("original_transaction_id", item.OriginalTransactionID))
+			return false, nil
+		}
+		return false, err
+	}
+
+	if payment.TransactionID == item.Transaction.TransactionID || payment.ExpiresDate == nil ||
+		(item.Transaction.ExpiresDate != nil && item.Transaction.ExpiresDate.After(*payment.ExpiresDate)) {
+		payment.ExpiresDate = item.Transaction.ExpiresDate
+	}
+	payment.SignedTransactionInfo = item.SignedTransactionInfo
+	payment.SignedRenewalInfo = item.SignedRenewalInfo
+	if item.Transaction.RevocationDate != nil {
+		payment.RevocationDate = item.Transaction.RevocationDate
+		payment.RevocationReason = fmt.Sprintf("%d", item.Transaction.RevocationReason)
+	}
+	if item.RenewalInfo != nil {
+		autoRenewStatus := item.RenewalInfo.AutoRenewStatus == 1
+		payment.AutoRenewStatus = &autoRenewStatus
+		payment.AutoRenewProductID = item.RenewalInfo.AutoRenewProductID
+		payment.GracePeriodExpirationDate = item.RenewalInfo.GracePeriodExpiresDate
+		if item.RenewalInfo.ExpirationIntent > 0 {
+			payment.ExpirationIntent = fmt.Sprintf("%d", item.RenewalInfo.ExpirationIntent)
+		}
+	}
+
+	// 按 Apple 状态码映射支付记录状态、催缴状态和订单状态，与对应的 Server Notification 处理保持一致
+	orderUpdates := map[string]interface{}{}
+	var fromStatuses []models.OrderStatus
+	switch api.AutoRenewSubscriptionStatus(item.Status) {
+	case api.SubscriptionActive:
+		payment.Status = "VERIFIED"
+		payment.DunningState = models.DunningStateNone
+		payment.GracePeriodStatus = ""
+		orderUpdates["status"] = models.OrderStatusPaid
+		orderUpdates["payment_status"] = models.PaymentStatusCompleted
+		fromStatuses = []models.OrderStatus{models.OrderStatusCreated, models.OrderStatusExpired}
+	case api.SubscriptionExpired:
+		payment.Status = "EXPIRED"
+		if item.RenewalInfo != nil && item.RenewalInfo.ExpirationIntent == 2 {
+			// 过期原因为账单错误，视为账单重试耗尽
+			payment.DunningState = models.DunningStateSuspended
+		}
+		orderUpdates["status"] = models.OrderStatusExpired
+		orderUpdates["payment_status"] = models.PaymentStatusExpired
+		fromStatuses = []models.OrderStatus{models.OrderStatusCreated, models.OrderStatusPaid, models.OrderStatusDelivered}
+	case api.SubscriptionRetryPeriod:
+		payment.Status = "RENEWAL_FAILED"
+		payment.DunningState = models.DunningStateRetrying
+		if payment.GracePeriodStatus == "IN_GRACE_PERIOD" {
+			payment.GracePeriodStatus = "EXPIRED"
+		}
+		orderUpdates["status"] = models.OrderStatusExpired
+		orderUpdates["payment_status"] = models.PaymentStatusFailed
+		fromStatuses = []models.OrderStatus{models.OrderStatusCreated, models.OrderStatusPaid, models.OrderStatusDelivered}
+	case api.SubscriptionGracePeriod:
+		// 宽限期内订单仍然有效，仅更新支付记录
+		payment.Status = "RENEWAL_FAILED"
+		payment.DunningState = models.DunningStateGracePeriod
+		payment.GracePeriodStatus = "IN_GRACE_PERIOD"
+	case api.SubscriptionRevoked:
+		payment.Status = "REVOKED"
+		orderUpdates["status"] = models.OrderStatusCancelled
+		orderUpdates["payment_status"] = models.PaymentStatusCancelled
+		fromStatuses = []models.OrderStatus{models.OrderStatusCreated, models.OrderStatusPaid, models.OrderStatusDelivered, models.OrderStatusExpired}
+	}
+
+	if err := tx.Save(&payment).Error; err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("failed to sync Apple payment: %w", err)
+	}
+
+	// 仅在订单处于可流转的状态时更新，避免覆盖已退款、已被替代等终态
+	if payment.OrderID > 0 && len(orderUpdates) > 0 {
+		if err := tx.Model(&models.Order{}).
+			Where("id = ? AND status IN ?", payment.OrderID, fromStatuses).
+			Updates(orderUpdates).Error; err != nil {
+			tx.Rollback()
+			return false, fmt.Errorf("failed to sync order status: %w", err)
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return false, err
+	}
+
+	s.logger.Info("Apple subscription status synced",
+		zap.Uint("order_id", payment.OrderID),
+		zap.String("original_transaction_id", item.OriginalTransactionID),
+		zap.String("status", item.StatusName),
+	)
+
+	return true, nil
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"time"
+
+	"pay-gateway/internal/config"
+	"pay-gateway/internal/models"
+)
+
+// 默认催缴策略：首次失败后第 1/3/7 天重试，宽限期 3 天
+var (
+	defaultDunningRetryDays = []int{1, 3, 7}
+	defaultDunningGraceDays = 3
+)
+
+// DunningPolicy 续费扣款失败催缴策略
+// 首次失败后按 RetryDays 重试；GracePeriod 内保留权益，之后暂停权益继续重试；重试耗尽后挂起订阅
+type DunningPolicy struct {
+	RetryDays       []int         // 重试时间点（距首次失败天数，升序）
+	GracePeriod     time.Duration // 宽限期，期间保留权益
+	UnsignOnSuspend bool          // 重试耗尽后是否自动解约
+}
+
+// NewDunningPolicy 根据支付宝配置创建催缴策略，未配置项使用默认值
+func NewDunningPolicy(cfg *config.AlipayConfig) *DunningPolicy {
+	retryDays := cfg.DunningRetryDays
+	if len(retryDays) == 0 {
+		retryDays = defaultDunningRetryDays
+	}
+	graceDays := cfg.DunningGraceDays
+	if graceDays <= 0 {
+		graceDays = defaultDunningGraceDays
+	}
+	return &DunningPolicy{
+		RetryDays:       retryDays,
+		GracePeriod:     time.Duration(graceDays) * 24 * time.Hour,
+		UnsignOnSuspend: cfg.DunningUnsignOnSuspend,
+	}
+}
+
+// NextRetryAt 计算第 retryCount+1 次重试时间，重试次数耗尽时返回 nil
+func (p *DunningPolicy) NextRetryAt(startedAt time.Time, retryCount int) *time.Time {
+	if retryCount >= len(p.RetryDays) {
+		return nil
+	}
+	next := startedAt.AddDate(0, 0, p.RetryDays[retryCount])
+	return &next
+}
+
+// StateAt 计算未挂起时的催缴状态：宽限期内为 GRACE_PERIOD，之后为 RETRYING
+func (p *DunningPolicy) StateAt(graceExpiresAt *time.Time, now time.Time) models.DunningState {
+	if graceExpiresAt != nil && now.Before(*graceExpiresAt) {
+		return models.DunningStateGracePeriod
+	}
+	return models.DunningStateRetrying
+}
+
+// AppleDunningState 将 Apple 续订失败通知映射为催缴状态
+// DID_FAIL_TO_RENEW(GRACE_PERIOD) 为宽限期；其余续订失败及 GRACE_PERIOD_EXPIRED 进入账单重试；EXPIRED(BILLING_RETRY) 为重试耗尽
+func AppleDunningState(notificationType, subtype string) models.DunningState {
+	switch notificationType {
+	case "DID_FAIL_TO_RENEW":
+		if subtype == "GRACE_PERIOD" {
+			return models.DunningStateGracePeriod
+		}
+		return models.DunningStateRetrying
+	case "GRACE_PERIOD_EXPIRED":
+		return models.DunningStateRetrying
+	case "EXPIRED":
+		if subtype == "BILLING_RETRY" {
+			return models.DunningStateSuspended
+		}
+	}
+	return models.DunningStateNone
+}
+
+// GoogleDunningState 将 Google 订阅通知类型映射为催缴状态
+// 宽限期对应 GRACE_PERIOD，账户保留（ON_HOLD）对应 RETRYING，恢复/续订后清除
+func GoogleDunningState(notificationType int) models.DunningState {
+	switch notificationType {
+	case models.SubscriptionNotificationTypeInGracePeriod:
+		return models.DunningStateGracePeriod
+	case models.SubscriptionNotificationTypeAccountHold:
+		return models.DunningStateRetrying
+	}
+	return models.DunningStateNone
+}
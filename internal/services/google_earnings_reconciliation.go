@@ -0,0 +1,259 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"pay-gateway/internal/models"
+)
+
+// Google Play 收入报告交易类型（仅以下两类参与比对，Google fee、Tax 等跳过）
+const (
+	googleEarningsCharge       = "Charge"
+	googleEarningsChargeRefund = "Charge refund"
+)
+
+// googleEarningsRow Google Play 收入报告中的一笔扣款或退款
+type googleEarningsRow struct {
+	OrderID         string // Description 列，即 Google 订单号（续订形如 GPA.xxxx..N）
+	ProductID       string // Sku Id
+	TransactionType string
+	Currency        string // Buyer Currency
+	Amount          string // Amount (Buyer Currency)
+	TransactionDate time.Time
+}
+
+// googleLocalPayment 本地 Google 支付记录（比对用）
+type googleLocalPayment struct {
+	OrderIDGoogle     string
+	ProductIDGoogle   string
+	PriceAmountMicros string
+	VoidedAt          *time.Time
+	Status            string
+	Currency          string
+}
+
+// googleBaseOrderID 去掉续订后缀 ..N，得到订阅的首期订单号
+func googleBaseOrderID(orderID string) string {
+	if i := strings.Index(orderID, ".."); i >= 0 {
+		return orderID[:i]
+	}
+	return orderID
+}
+
+// reconcileGoogleEarnings 解析 Google Play 收入报告并与本地 GooglePayment 逐笔比对
+// 扣款按订单号匹配并核对金额，续订扣款按首期订单号匹配；退款核对本地订单是否已退款或作废
+func (s *StoreReconciliationService) reconcileGoogleEarnings(ctx context.Context, report *models.StoreReconciliationReport, body []byte) (*storeComparison, error) {
+	rows, err := parseGoogleEarningsReport(body)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := rows[0].TransactionDate, rows[0].TransactionDate
+	for _, row := range rows {
+		if row.TransactionDate.Before(first) {
+			first = row.TransactionDate
+		}
+		if row.TransactionDate.After(last) {
+			last = row.TransactionDate
+		}
+	}
+	report.MatchMode = storeMatchTransaction
+	report.PeriodStart = first.Format("2006-01-02")
+	report.PeriodEnd = last.Format("2006-01-02")
+	periodStart, periodEnd := storePeriodRange(first, last)
+
+	local, err := s.loadGoogleLocalPayments(ctx, "orders.paid_at >= ? AND orders.paid_at < ?", periodStart, periodEnd)
+	if err != nil {
+		return nil, err
+	}
+	byOrder := make(map[string]*googleLocalPayment, len(local))
+	byBase := make(map[string]*googleLocalPayment, len(local))
+	for _, p := range local {
+		byOrder[p.OrderIDGoogle] = p
+		byBase[googleBaseOrderID(p.OrderIDGoogle)] = p
+	}
+
+	// 报告期外的本地支付（跨期退款、续订）按首期订单号补查，补查到的不计入仅本地有
+	var missing []string
+	for _, row := range rows {
+		if _, ok := byOrder[row.OrderID]; ok {
+			continue
+		}
+		if _, ok := byBase[googleBaseOrderID(row.OrderID)]; !ok {
+			missing = append(missing, googleBaseOrderID(row.OrderID))
+		}
+	}
+	if len(missing) > 0 {
+		extra, err := s.loadGoogleLocalPayments(ctx, "split_part(google_payments.order_id_google, '..', 1) IN ?", missing)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range extra {
+			if _, ok := byOrder[p.OrderIDGoogle]; !ok {
+				byOrder[p.OrderIDGoogle] = p
+			}
+			if _, ok := byBase[googleBaseOrderID(p.OrderIDGoogle)]; !ok {
+				byBase[googleBaseOrderID(p.OrderIDGoogle)] = p
+			}
+		}
+	}
+
+	result := &storeComparison{totalCount: len(rows)}
+	matched := make(map[*googleLocalPayment]bool, len(rows))
+	for _, row := range rows {
+		billTime := row.TransactionDate
+		detail := models.StoreReconciliationDetail{
+			TransactionID:  row.OrderID,
+			ProductID:      row.ProductID,
+			RecordType:     billRecordPayment,
+			StoreAmount:    row.Amount,
+			StoreCurrency:  row.Currency,
+			StoreTradeType: row.TransactionType,
+			BillTime:       &billTime,
+		}
+		if row.TransactionType == googleEarningsChargeRefund {
+			detail.RecordType = billRecordRefund
+		}
+
+		p, exact := byOrder[row.OrderID]
+		if !exact {
+			p = byBase[googleBaseOrderID(row.OrderID)]
+		}
+		if p == nil {
+			detail.DiffType = "store_only"
+			result.addDiff(detail)
+			continue
+		}
+		localMicros, _ := strconv.ParseInt(p.PriceAmountMicros, 10, 64)
+		detail.LocalAmount = localMicros
+		detail.LocalCurrency = p.Currency
+		detail.LocalStatus = p.Status
+
+		if row.TransactionType == googleEarningsChargeRefund {
+			if p.Status != string(models.OrderStatusRefunded) && p.VoidedAt == nil {
+				detail.DiffType = "status_mismatch"
+				result.addDiff(detail)
+			} else {
+				result.matchCount++
+			}
+			continue
+		}
+
+		matched[p] = true
+		// 续订扣款只匹配到首期订单，本地未保存每期价格，不核对金额
+		if exact && p.PriceAmountMicros != "" && strings.EqualFold(row.Currency, p.Currency) {
+			storeMicros, err := parseEarningsMicros(row.Amount)
+			if err != nil || storeMicros != localMicros {
+				detail.DiffType = "amount_mismatch"
+				result.addDiff(detail)
+				continue
+			}
+		}
+		result.matchCount++
+	}
+
+	// 仅本地有：报告期内支付的本地订单未出现在报告中
+	for _, p := range local {
+		if matched[p] {
+			continue
+		}
+		localMicros, _ := strconv.ParseInt(p.PriceAmountMicros, 10, 64)
+		result.addDiff(models.StoreReconciliationDetail{
+			TransactionID: p.OrderIDGoogle,
+			ProductID:     p.ProductIDGoogle,
+			RecordType:    billRecordPayment,
+			DiffType:      "local_only",
+			LocalAmount:   localMicros,
+			LocalCurrency: p.Currency,
+			LocalStatus:   p.Status,
+		})
+	}
+	return result, nil
+}
+
+// parseGoogleEarningsReport 解析 Google Play 收入报告 CSV，仅保留扣款与扣款退款行
+func parseGoogleEarningsReport(body []byte) ([]googleEarningsRow, error) {
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("读取报告表头失败: %v", err)
+	}
+	idx := storeHeaderIndex(header)
+	colOrder := storeColumn(idx, "description")
+	colType := storeColumn(idx, "transaction type")
+	colDate := storeColumn(idx, "transaction date")
+	colSku := storeColumn(idx, "sku id")
+	colCurrency := storeColumn(idx, "buyer currency")
+	colAmount := storeColumn(idx, "amount (buyer currency)")
+	if colOrder < 0 || colType < 0 || colDate < 0 || colAmount < 0 {
+		return nil, errors.New("报告缺少 Description、Transaction Type、Transaction Date 或 Amount (Buyer Currency) 列")
+	}
+
+	var rows []googleEarningsRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("读取报告失败: %v", err)
+		}
+		txnType := storeCell(record, colType)
+		if txnType != googleEarningsCharge && txnType != googleEarningsChargeRefund {
+			continue
+		}
+		date, err := time.ParseInLocation("Jan 2, 2006", storeCell(record, colDate), pacificLocation)
+		if err != nil {
+			return nil, fmt.Errorf("解析交易日期失败: %v", err)
+		}
+		rows = append(rows, googleEarningsRow{
+			OrderID:         storeCell(record, colOrder),
+			ProductID:       storeCell(record, colSku),
+			TransactionType: txnType,
+			Currency:        storeCell(record, colCurrency),
+			Amount:          storeCell(record, colAmount),
+			TransactionDate: date,
+		})
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("报告中没有扣款记录")
+	}
+	return rows, nil
+}
+
+// parseEarningsMicros 将报告金额（买家币种）转为微单位，与 priceAmountMicros 对齐
+func parseEarningsMicros(s string) (int64, error) {
+	f, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(s), ",", ""), 64)
+	if err != nil {
+		return 0, fmt.Errorf("解析金额失败: %w", err)
+	}
+	return int64(math.Round(f * 1e6)), nil
+}
+
+// loadGoogleLocalPayments 查询非测试订单的 Google 支付记录
+func (s *StoreReconciliationService) loadGoogleLocalPayments(ctx context.Context, where string, args ...interface{}) ([]*googleLocalPayment, error) {
+	var payments []*googleLocalPayment
+	if err := s.db.WithContext(ctx).Model(&models.GooglePayment{}).
+		Joins("JOIN orders ON orders.id = google_payments.order_id").
+		Scopes(liveOrdersScope).
+		Where(where, args...).
+		Select("google_payments.order_id_google, google_payments.product_id_google, " +
+			"google_payments.price_amount_micros, google_payments.voided_at, orders.status, orders.currency").
+		Scan(&payments).Error; err != nil {
+		return nil, fmt.Errorf("查询本地 Google 支付记录失败: %w", err)
+	}
+	return payments, nil
+}
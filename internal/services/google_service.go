@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/androidpublisher/v3"
 	"google.golang.org/api/option"
+	"gorm.io/gorm"
 
 	"pay-gateway/internal/config"
 	"pay-gateway/internal/models"
@@ -17,11 +19,15 @@ import (
 
 // GooglePlayService Google Play服务核心结构体
 // 负责处理所有Google Play相关的支付验证、订阅管理和Webhook处理
+// 配置多个应用时，每个包名对应独立的 API 客户端，通过 ForPackage 获取绑定到指定包名的实例
 type GooglePlayService struct {
-	config      *config.Config            // 应用配置
-	logger      *zap.Logger               // 日志记录器
-	service     *androidpublisher.Service // Google Play Android Publisher API服务
-	packageName string                    // Android应用包名
+	config      *config.Config                       // 应用配置
+	logger      *zap.Logger                          // 日志记录器
+	service     *androidpublisher.Service            // 当前包名的 Android Publisher API服务
+	packageName string                               // 当前绑定的Android应用包名
+	apps        map[string]*androidpublisher.Service // 包名 -> API服务（含默认应用）
+	packages    []string                             // 已配置的包名，默认应用在前
+	db          *gorm.DB                             // 数据库连接（订阅链路记录）
 }
 
 // PurchaseResponse 购买验证响应结构体
@@ -38,78 +44,201 @@ type PurchaseResponse struct {
 	ObfuscatedExternalAccountId string `json:"obfuscatedExternalAccountId,omitempty"`
 	ObfuscatedExternalProfileId string `json:"obfuscatedExternalProfileId,omitempty"`
 	RegionCode                  string `json:"regionCode,omitempty"`
+	TestPurchase                bool   `json:"testPurchase"` // 是否为测试购买（许可测试账号，purchaseType=0）
 }
 
-// SubscriptionResponse 订阅验证响应结构体
-// 包含订阅的详细状态、价格信息和自动续费设置
+// Google Play 订阅状态（purchases.subscriptionsv2 subscriptionState）
+const (
+	GoogleSubscriptionStatePending                 = "SUBSCRIPTION_STATE_PENDING"
+	GoogleSubscriptionStateActive                  = "SUBSCRIPTION_STATE_ACTIVE"
+	GoogleSubscriptionStatePaused                  = "SUBSCRIPTION_STATE_PAUSED"
+	GoogleSubscriptionStateInGracePeriod           = "SUBSCRIPTION_STATE_IN_GRACE_PERIOD"
+	GoogleSubscriptionStateOnHold                  = "SUBSCRIPTION_STATE_ON_HOLD"
+	GoogleSubscriptionStateCanceled                = "SUBSCRIPTION_STATE_CANCELED"
+	GoogleSubscriptionStateExpired                 = "SUBSCRIPTION_STATE_EXPIRED"
+	GoogleSubscriptionStatePendingPurchaseCanceled = "SUBSCRIPTION_STATE_PENDING_PURCHASE_CANCELED"
+)
+
+// Google Play 订阅确认状态
+const (
+	GoogleAcknowledgementStatePending      = "ACKNOWLEDGEMENT_STATE_PENDING"
+	GoogleAcknowledgementStateAcknowledged = "ACKNOWLEDGEMENT_STATE_ACKNOWLEDGED"
+)
+
+// SubscriptionResponse 订阅验证响应结构体（基于 purchases.subscriptionsv2）
+// 一个购买令牌可包含多个订阅项（LineItems），每项对应一个基础方案/优惠，支持自动续订与预付费方案
 type SubscriptionResponse struct {
-	Kind                  string `json:"kind"`
-	StartTimeMillis       string `json:"startTimeMillis"`
-	ExpiryTimeMillis      string `json:"expiryTimeMillis"`
-	AutoResumeTimeMillis  string `json:"autoResumeTimeMillis,omitempty"`
-	AutoRenewing          bool   `json:"autoRenewing"`
-	PriceCurrencyCode     string `json:"priceCurrencyCode"`
-	PriceAmountMicros     string `json:"priceAmountMicros"`
-	IntroductoryPriceInfo *struct {
-		IntroductoryPriceCurrencyCode string `json:"introductoryPriceCurrencyCode"`
-		IntroductoryPriceAmountMicros string `json:"introductoryPriceAmountMicros"`
-		IntroductoryPricePeriod       string `json:"introductoryPricePeriod"`
-		IntroductoryPriceCycles       int    `json:"introductoryPriceCycles"`
-	} `json:"introductoryPriceInfo,omitempty"`
-	CountryCode                 string `json:"countryCode"`
-	DeveloperPayload            string `json:"developerPayload,omitempty"`
-	PaymentState                int    `json:"paymentState"`
-	CancelReason                int    `json:"cancelReason,omitempty"`
-	UserCancellationTimeMillis  string `json:"userCancellationTimeMillis,omitempty"`
-	OrderId                     string `json:"orderId"`
-	AcknowledgementState        int    `json:"acknowledgementState"`
-	ObfuscatedExternalAccountId string `json:"obfuscatedExternalAccountId,omitempty"`
-	ObfuscatedExternalProfileId string `json:"obfuscatedExternalProfileId,omitempty"`
+	Kind                        string                    `json:"kind"`
+	SubscriptionState           string                    `json:"subscriptionState"`   // Google 原始订阅状态
+	Status                      models.SubscriptionState  `json:"status"`              // 映射后的订阅状态
+	StartTime                   string                    `json:"startTime,omitempty"` // RFC3339
+	RegionCode                  string                    `json:"regionCode,omitempty"`
+	LatestOrderId               string                    `json:"latestOrderId,omitempty"`
+	LinkedPurchaseToken         string                    `json:"linkedPurchaseToken,omitempty"` // 升降级/重新订阅前的购买令牌
+	AcknowledgementState        string                    `json:"acknowledgementState"`
+	CanceledReason              string                    `json:"canceledReason,omitempty"`       // USER/SYSTEM/DEVELOPER/REPLACEMENT
+	UserCancellationTime        string                    `json:"userCancellationTime,omitempty"` // 用户取消时间，RFC3339
+	AutoResumeTime              string                    `json:"autoResumeTime,omitempty"`       // 暂停订阅的自动恢复时间，RFC3339
+	TestPurchase                bool                      `json:"testPurchase"`
+	ObfuscatedExternalAccountId string                    `json:"obfuscatedExternalAccountId,omitempty"`
+	ObfuscatedExternalProfileId string                    `json:"obfuscatedExternalProfileId,omitempty"`
+	LineItems                   []SubscriptionLineItem    `json:"lineItems"`
+	Lineage                     []SubscriptionLineageItem `json:"lineage,omitempty"` // 订阅链路（仅状态查询接口返回）
+}
+
+// SubscriptionLineItem 订阅项
+type SubscriptionLineItem struct {
+	ProductId               string   `json:"productId"`
+	ExpiryTime              string   `json:"expiryTime"` // RFC3339
+	BasePlanId              string   `json:"basePlanId,omitempty"`
+	OfferId                 string   `json:"offerId,omitempty"`
+	OfferTags               []string `json:"offerTags,omitempty"`
+	AutoRenewing            bool     `json:"autoRenewing"`
+	Prepaid                 bool     `json:"prepaid"`                        // 预付费方案，不自动续订
+	AllowExtendAfterTime    string   `json:"allowExtendAfterTime,omitempty"` // 预付费方案可充值延期的起始时间
+	RecurringPriceCurrency  string   `json:"recurringPriceCurrency,omitempty"`
+	RecurringPriceMicros    int64    `json:"recurringPriceMicros,omitempty"`
+	LatestSuccessfulOrderId string   `json:"latestSuccessfulOrderId,omitempty"`
+}
+
+// IsAcknowledged 订阅是否已确认
+func (r *SubscriptionResponse) IsAcknowledged() bool {
+	return r.AcknowledgementState == GoogleAcknowledgementStateAcknowledged
+}
+
+// IsAutoRenewing 是否存在开启自动续订的订阅项
+func (r *SubscriptionResponse) IsAutoRenewing() bool {
+	for _, item := range r.LineItems {
+		if item.AutoRenewing {
+			return true
+		}
+	}
+	return false
+}
+
+// LatestExpiryTime 返回所有订阅项中最晚的到期时间，无有效到期时间时返回零值
+func (r *SubscriptionResponse) LatestExpiryTime() time.Time {
+	var latest time.Time
+	for _, item := range r.LineItems {
+		expiryTime, err := time.Parse(time.RFC3339, item.ExpiryTime)
+		if err != nil {
+			continue
+		}
+		if expiryTime.After(latest) {
+			latest = expiryTime
+		}
+	}
+	return latest
+}
+
+// LineItem 按商品ID查找订阅项
+func (r *SubscriptionResponse) LineItem(productID string) *SubscriptionLineItem {
+	for i := range r.LineItems {
+		if r.LineItems[i].ProductId == productID {
+			return &r.LineItems[i]
+		}
+	}
+	return nil
 }
 
 // NewGooglePlayService 创建Google Play服务实例
-// 初始化Google Play Android Publisher API连接
+// 初始化Google Play Android Publisher API连接，顶层 package_name 为默认应用，apps 中的每个应用使用各自的服务账号
 // 参数：
 //   - cfg: 应用配置
 //   - logger: 日志记录器
+//   - db: 数据库连接
 //
 // 返回：GooglePlayService实例或错误
-func NewGooglePlayService(cfg *config.Config, logger *zap.Logger) (*GooglePlayService, error) {
+func NewGooglePlayService(cfg *config.Config, logger *zap.Logger, db *gorm.DB) (*GooglePlayService, error) {
 	ctx := context.Background()
 
-	// Load service account
-	credentials, err := google.CredentialsFromJSON(
-		ctx,
-		[]byte(cfg.Google.ServiceAccountFile),
-		androidpublisher.AndroidpublisherScope,
-	)
-	if err != nil {
-		// Try to load from file path
-		return nil, fmt.Errorf("failed to load credentials: %w", err)
-	}
+	apps := make(map[string]*androidpublisher.Service)
+	var packages []string
+	for _, app := range cfg.Google.AllApps() {
+		if app.PackageName == "" {
+			return nil, fmt.Errorf("google app package name is required")
+		}
+		if _, exists := apps[app.PackageName]; exists {
+			return nil, fmt.Errorf("duplicate google app package name: %s", app.PackageName)
+		}
 
-	// Create service
-	service, err := androidpublisher.NewService(
-		ctx,
-		option.WithCredentials(credentials),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create androidpublisher service: %w", err)
+		service, err := newAndroidPublisherService(ctx, app.ServiceAccountFile)
+		if err != nil {
+			return nil, fmt.Errorf("package %s: %w", app.PackageName, err)
+		}
+		apps[app.PackageName] = service
+		packages = append(packages, app.PackageName)
+	}
+	if len(packages) == 0 {
+		return nil, fmt.Errorf("no google app configured")
 	}
 
 	return &GooglePlayService{
 		config:      cfg,
 		logger:      logger,
-		service:     service,
-		packageName: cfg.Google.PackageName,
+		service:     apps[packages[0]],
+		packageName: packages[0],
+		apps:        apps,
+		packages:    packages,
+		db:          db,
 	}, nil
 }
 
-// PackageName 返回配置的 Android 应用包名，用于 Webhook 包名校验
+// newAndroidPublisherService 使用服务账号创建 Android Publisher API服务
+// serviceAccount 可以是服务账号 JSON 文件路径，也可以直接是 JSON 内容
+func newAndroidPublisherService(ctx context.Context, serviceAccount string) (*androidpublisher.Service, error) {
+	credentialsJSON := []byte(serviceAccount)
+	if content, err := os.ReadFile(serviceAccount); err == nil {
+		credentialsJSON = content
+	}
+
+	credentials, err := google.CredentialsFromJSON(ctx, credentialsJSON, androidpublisher.AndroidpublisherScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load credentials: %w", err)
+	}
+
+	service, err := androidpublisher.NewService(ctx, option.WithCredentials(credentials))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create androidpublisher service: %w", err)
+	}
+	return service, nil
+}
+
+// PackageName 返回当前绑定的 Android 应用包名
 func (s *GooglePlayService) PackageName() string {
 	return s.packageName
 }
 
+// Packages 返回所有已配置的包名，默认应用在前
+func (s *GooglePlayService) Packages() []string {
+	return s.packages
+}
+
+// HasPackage 判断包名是否已配置
+func (s *GooglePlayService) HasPackage(packageName string) bool {
+	_, ok := s.apps[packageName]
+	return ok
+}
+
+// ForPackage 返回绑定到指定包名的服务实例，包名为空时返回默认应用
+// 参数：
+//   - packageName: Android应用包名
+//
+// 返回：GooglePlayService实例或错误（包名未配置）
+func (s *GooglePlayService) ForPackage(packageName string) (*GooglePlayService, error) {
+	if packageName == "" || packageName == s.packageName {
+		return s, nil
+	}
+	service, ok := s.apps[packageName]
+	if !ok {
+		return nil, fmt.Errorf("google app not configured: %s", packageName)
+	}
+	scoped := *s
+	scoped.service = service
+	scoped.packageName = packageName
+	return &scoped, nil
+}
+
 // VerifyPurchase 验证单次购买
 // 向Google Play服务器验证购买令牌的有效性
 // 参数：
@@ -140,6 +269,7 @@ func (s *GooglePlayService) VerifyPurchase(ctx context.Context, productID, purch
 		ObfuscatedExternalAccountId: purchase.ObfuscatedExternalAccountId,
 		ObfuscatedExternalProfileId: purchase.ObfuscatedExternalProfileId,
 		RegionCode:                  purchase.RegionCode,
+		TestPurchase:                purchase.PurchaseType != nil && *purchase.PurchaseType == 0,
 	}
 
 	s.logger.Info("purchase verified successfully",
@@ -151,15 +281,15 @@ func (s *GooglePlayService) VerifyPurchase(ctx context.Context, productID, purch
 }
 
 // VerifySubscription 验证订阅
-// 向Google Play服务器验证订阅购买令牌的有效性
+// 通过 purchases.subscriptionsv2.get 向Google Play服务器验证订阅购买令牌的有效性
 // 参数：
 //   - ctx: 上下文
-//   - subscriptionID: 订阅商品ID
+//   - subscriptionID: 订阅商品ID，非空时要求购买令牌包含该商品的订阅项
 //   - purchaseToken: 购买令牌
 //
 // 返回：订阅详情或错误
 func (s *GooglePlayService) VerifySubscription(ctx context.Context, subscriptionID, purchaseToken string) (*SubscriptionResponse, error) {
-	subscription, err := s.service.Purchases.Subscriptions.Get(s.packageName, subscriptionID, purchaseToken).Context(ctx).Do()
+	subscription, err := s.service.Purchases.Subscriptionsv2.Get(s.packageName, purchaseToken).Context(ctx).Do()
 	if err != nil {
 		s.logger.Error("failed to verify subscription",
 			zap.String("subscription_id", subscriptionID),
@@ -168,47 +298,95 @@ func (s *GooglePlayService) VerifySubscription(ctx context.Context, subscription
 		return nil, fmt.Errorf("failed to verify subscription: %w", err)
 	}
 
-	response := &SubscriptionResponse{
-		Kind:                        subscription.Kind,
-		StartTimeMillis:             fmt.Sprintf("%d", subscription.StartTimeMillis),
-		ExpiryTimeMillis:            fmt.Sprintf("%d", subscription.ExpiryTimeMillis),
-		AutoResumeTimeMillis:        fmt.Sprintf("%d", subscription.AutoResumeTimeMillis),
-		AutoRenewing:                subscription.AutoRenewing,
-		PriceCurrencyCode:           subscription.PriceCurrencyCode,
-		PriceAmountMicros:           fmt.Sprintf("%d", subscription.PriceAmountMicros),
-		CountryCode:                 subscription.CountryCode,
-		DeveloperPayload:            subscription.DeveloperPayload,
-		PaymentState:                int(getInt64Value(subscription.PaymentState)),
-		CancelReason:                int(subscription.CancelReason),
-		UserCancellationTimeMillis:  fmt.Sprintf("%d", subscription.UserCancellationTimeMillis),
-		OrderId:                     subscription.OrderId,
-		AcknowledgementState:        int(subscription.AcknowledgementState),
-		ObfuscatedExternalAccountId: subscription.ObfuscatedExternalAccountId,
-		ObfuscatedExternalProfileId: subscription.ObfuscatedExternalProfileId,
-	}
+	response := convertSubscriptionPurchaseV2(subscription)
 
-	if subscription.IntroductoryPriceInfo != nil {
-		response.IntroductoryPriceInfo = &struct {
-			IntroductoryPriceCurrencyCode string `json:"introductoryPriceCurrencyCode"`
-			IntroductoryPriceAmountMicros string `json:"introductoryPriceAmountMicros"`
-			IntroductoryPricePeriod       string `json:"introductoryPricePeriod"`
-			IntroductoryPriceCycles       int    `json:"introductoryPriceCycles"`
-		}{
-			IntroductoryPriceCurrencyCode: subscription.IntroductoryPriceInfo.IntroductoryPriceCurrencyCode,
-			IntroductoryPriceAmountMicros: fmt.Sprintf("%d", subscription.IntroductoryPriceInfo.IntroductoryPriceAmountMicros),
-			IntroductoryPricePeriod:       subscription.IntroductoryPriceInfo.IntroductoryPricePeriod,
-			IntroductoryPriceCycles:       int(subscription.IntroductoryPriceInfo.IntroductoryPriceCycles),
-		}
+	// 防止使用其他商品的购买令牌冒充
+	if subscriptionID != "" && response.LineItem(subscriptionID) == nil {
+		s.logger.Warn("subscription product mismatch",
+			zap.String("subscription_id", subscriptionID),
+			zap.String("purchase_token", purchaseToken))
+		return nil, fmt.Errorf("purchase token does not contain subscription %s", subscriptionID)
 	}
 
+	response.Status = GetSubscriptionStatus(response, time.Now())
+
 	s.logger.Info("subscription verified successfully",
-		zap.String("order_id", subscription.OrderId),
+		zap.String("order_id", response.LatestOrderId),
 		zap.String("subscription_id", subscriptionID),
-		zap.Bool("auto_renewing", subscription.AutoRenewing))
+		zap.String("subscription_state", response.SubscriptionState),
+		zap.Bool("auto_renewing", response.IsAutoRenewing()))
 
 	return response, nil
 }
 
+// convertSubscriptionPurchaseV2 将 subscriptionsv2 资源转换为订阅验证响应
+func convertSubscriptionPurchaseV2(subscription *androidpublisher.SubscriptionPurchaseV2) *SubscriptionResponse {
+	response := &SubscriptionResponse{
+		Kind:                 subscription.Kind,
+		SubscriptionState:    subscription.SubscriptionState,
+		StartTime:            subscription.StartTime,
+		RegionCode:           subscription.RegionCode,
+		LatestOrderId:        subscription.LatestOrderId,
+		LinkedPurchaseToken:  subscription.LinkedPurchaseToken,
+		AcknowledgementState: subscription.AcknowledgementState,
+		TestPurchase:         subscription.TestPurchase != nil,
+		LineItems:            make([]SubscriptionLineItem, 0, len(subscription.LineItems)),
+	}
+
+	if ids := subscription.ExternalAccountIdentifiers; ids != nil {
+		response.ObfuscatedExternalAccountId = ids.ObfuscatedExternalAccountId
+		response.ObfuscatedExternalProfileId = ids.ObfuscatedExternalProfileId
+	}
+
+	if canceled := subscription.CanceledStateContext; canceled != nil {
+		switch {
+		case canceled.UserInitiatedCancellation != nil:
+			response.CanceledReason = "USER"
+			response.UserCancellationTime = canceled.UserInitiatedCancellation.CancelTime
+		case canceled.SystemInitiatedCancellation != nil:
+			response.CanceledReason = "SYSTEM"
+		case canceled.DeveloperInitiatedCancellation != nil:
+			response.CanceledReason = "DEVELOPER"
+		case canceled.ReplacementCancellation != nil:
+			response.CanceledReason = "REPLACEMENT"
+		}
+	}
+
+	if subscription.PausedStateContext != nil {
+		response.AutoResumeTime = subscription.PausedStateContext.AutoResumeTime
+	}
+
+	for _, item := range subscription.LineItems {
+		if item == nil {
+			continue
+		}
+		lineItem := SubscriptionLineItem{
+			ProductId:               item.ProductId,
+			ExpiryTime:              item.ExpiryTime,
+			LatestSuccessfulOrderId: item.LatestSuccessfulOrderId,
+		}
+		if item.OfferDetails != nil {
+			lineItem.BasePlanId = item.OfferDetails.BasePlanId
+			lineItem.OfferId = item.OfferDetails.OfferId
+			lineItem.OfferTags = item.OfferDetails.OfferTags
+		}
+		if plan := item.AutoRenewingPlan; plan != nil {
+			lineItem.AutoRenewing = plan.AutoRenewEnabled
+			if plan.RecurringPrice != nil {
+				lineItem.RecurringPriceCurrency = plan.RecurringPrice.CurrencyCode
+				lineItem.RecurringPriceMicros = plan.RecurringPrice.Units*1000000 + plan.RecurringPrice.Nanos/1000
+			}
+		}
+		if item.PrepaidPlan != nil {
+			lineItem.Prepaid = true
+			lineItem.AllowExtendAfterTime = item.PrepaidPlan.AllowExtendAfterTime
+		}
+		response.LineItems = append(response.LineItems, lineItem)
+	}
+
+	return response
+}
+
 // AcknowledgePurchase 确认购买
 // 向Google Play确认已收到购买信息，防止重复发放商品
 // 参数：
@@ -295,6 +473,41 @@ func (s *GooglePlayService) ConsumePurchase(ctx context.Context, productID, purc
 	return nil
 }
 
+// ListVoidedPurchases 分页查询作废购买（退款、撤销、拒付）
+// 参数：
+//   - ctx: 上下文
+//   - startTime: 起始作废时间（Google 最多保留 30 天）
+//   - endTime: 截止作废时间
+//   - pageToken: 分页令牌，首页为空
+//
+// 返回：作废购买列表、下一页令牌（无更多数据时为空）或错误
+func (s *GooglePlayService) ListVoidedPurchases(ctx context.Context, startTime, endTime time.Time, pageToken string) ([]*androidpublisher.VoidedPurchase, string, error) {
+	call := s.service.Purchases.Voidedpurchases.List(s.packageName).
+		StartTime(startTime.UnixMilli()).
+		EndTime(endTime.UnixMilli()).
+		Type(1). // 同时返回一次性商品与订阅
+		MaxResults(1000).
+		Context(ctx)
+	if pageToken != "" {
+		call = call.Token(pageToken)
+	}
+
+	resp, err := call.Do()
+	if err != nil {
+		s.logger.Error("failed to list voided purchases",
+			zap.Time("start_time", startTime),
+			zap.Time("end_time", endTime),
+			zap.Error(err))
+		return nil, "", fmt.Errorf("failed to list voided purchases: %w", err)
+	}
+
+	nextPageToken := ""
+	if resp.TokenPagination != nil {
+		nextPageToken = resp.TokenPagination.NextPageToken
+	}
+	return resp.VoidedPurchases, nextPageToken, nil
+}
+
 // Helper function to get int64 value from pointer
 func getInt64Value(val *int64) int64 {
 	if val != nil {
@@ -306,52 +519,40 @@ func getInt64Value(val *int64) int64 {
 // Google Play RTDN 通过 Pub/Sub 推送，身份验证使用 Pub/Sub OIDC JWT（在 Handler 中 verifyPubSubJWT 实现）。
 // 需在 Pub/Sub 订阅中启用认证，并配置 webhook_url、verify_push_jwt=true。
 
-// Helper function to convert millis to time
-func millisToTime(millis string) (time.Time, error) {
-	if millis == "" {
-		return time.Time{}, nil
-	}
-
-	var millisInt int64
-	_, err := fmt.Sscanf(millis, "%d", &millisInt)
-	if err != nil {
-		return time.Time{}, err
-	}
-
-	return time.Unix(0, millisInt*int64(time.Millisecond)), nil
-}
-
 // GetSubscriptionStatus 确定订阅当前状态
-// 根据订阅信息和时间判断订阅状态（活跃、过期、取消等）
+// 以 subscriptionsv2 的 subscriptionState 为准映射订阅状态；对活跃/已取消状态再按最晚到期时间校正，
+// 避免使用缓存的响应时误判仍在有效期内
 // 参数：
 //   - subscription: 订阅信息
 //   - currentTime: 当前时间
 //
 // 返回：订阅状态枚举值
 func GetSubscriptionStatus(subscription *SubscriptionResponse, currentTime time.Time) models.SubscriptionState {
-	expiryTime, _ := millisToTime(subscription.ExpiryTimeMillis)
+	expiryTime := subscription.LatestExpiryTime()
+	expired := !expiryTime.IsZero() && !expiryTime.After(currentTime)
 
-	if !subscription.AutoRenewing && expiryTime.Before(currentTime) {
-		return models.SubscriptionStateExpired
-	}
-
-	if subscription.CancelReason != 0 {
-		if subscription.AutoRenewing {
-			return models.SubscriptionStateCancelled // Will expire at end of period
-		}
-		if expiryTime.Before(currentTime) {
+	switch subscription.SubscriptionState {
+	case GoogleSubscriptionStatePending:
+		return models.SubscriptionStatePending
+	case GoogleSubscriptionStateActive:
+		if expired {
 			return models.SubscriptionStateExpired
 		}
-	}
-
-	// Check payment state
-	switch subscription.PaymentState {
-	case 0: // Payment pending
-		return models.SubscriptionStatePending
-	case 1: // Payment received
-		return models.SubscriptionStateActive
-	case 2: // Free trial
 		return models.SubscriptionStateActive
+	case GoogleSubscriptionStatePaused:
+		return models.SubscriptionStatePaused
+	case GoogleSubscriptionStateInGracePeriod:
+		return models.SubscriptionStateInGracePeriod
+	case GoogleSubscriptionStateOnHold:
+		return models.SubscriptionStateOnHold
+	case GoogleSubscriptionStateCanceled:
+		// 已取消但未到期，到期前仍保留权益
+		if expired {
+			return models.SubscriptionStateExpired
+		}
+		return models.SubscriptionStateCancelled
+	case GoogleSubscriptionStateExpired, GoogleSubscriptionStatePendingPurchaseCanceled:
+		return models.SubscriptionStateExpired
 	default:
 		if expiryTime.After(currentTime) {
 			return models.SubscriptionStateActive
@@ -0,0 +1,359 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"pay-gateway/internal/models"
+)
+
+// 沿 linkedPurchaseToken 回溯订阅链路的最大深度，防止异常数据形成环
+const subscriptionLineageMaxDepth = 20
+
+// ErrGooglePurchaseTokenBound 购买令牌已绑定到其他用户或其他商品的订单
+var ErrGooglePurchaseTokenBound = errors.New("purchase token already bound to another order")
+
+// SubscriptionLineageItem 订阅链路节点，按时间从旧到新排列
+type SubscriptionLineageItem struct {
+	PurchaseToken     string     `json:"purchase_token"`
+	OrderID           uint       `json:"order_id,omitempty"` // 未在本系统记录的旧令牌为 0
+	ProductID         string     `json:"product_id,omitempty"`
+	SupersededByToken string     `json:"superseded_by_token,omitempty"`
+	SupersededAt      *time.Time `json:"superseded_at,omitempty"`
+	Current           bool       `json:"current"` // 是否为查询的购买令牌
+}
+
+// RecordSubscriptionPurchase 记录订阅购买令牌与订单的绑定，并处理升降级/重新订阅链路
+// 令牌已由 Webhook 自动建单绑定到同一用户同一商品的订单时视为幂等成功，返回已有绑定
+// 参数：
+//   - ctx: 上下文
+//   - orderID: 系统订单ID
+//   - purchaseToken: 购买令牌
+//   - subscription: subscriptionsv2 验证结果
+//
+// 返回：订阅支付记录或错误
+func (s *GooglePlayService) RecordSubscriptionPurchase(ctx context.Context, orderID uint, purchaseToken string, subscription *SubscriptionResponse) (*models.GooglePayment, error) {
+	tx := s.db.WithContext(ctx).Begin()
+
+	var payment models.GooglePayment
+	err := tx.Where("purchase_token = ?", purchaseToken).First(&payment).Error
+	switch {
+	case err == nil:
+		if payment.OrderID != orderID {
+			if err := checkSameSubscriptionOwner(tx, payment.OrderID, orderID); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			orderID = payment.OrderID
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		var order models.Order
+		if err := tx.First(&order, orderID).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to load order: %w", err)
+		}
+		if order.PaymentMethod != models.PaymentMethodGooglePlay || order.Type != models.OrderTypeSubscription {
+			tx.Rollback()
+			return nil, fmt.Errorf("order %d is not a google play subscription", orderID)
+		}
+		if err := bindOrderApp(tx, &order, s.packageName); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		payment = models.GooglePayment{OrderID: orderID, PurchaseToken: purchaseToken}
+	default:
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to query google payment: %w", err)
+	}
+
+	fillSubscriptionPayment(&payment, subscription)
+	if err := tx.Save(&payment).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to save google payment: %w", err)
+	}
+
+	if subscription.TestPurchase {
+		if err := markTestOrder(tx, orderID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := s.supersedeLinkedPurchase(tx, &payment); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to commit google payment: %w", err)
+	}
+	return &payment, nil
+}
+
+// checkSameSubscriptionOwner 校验令牌已绑定的订单与调用方订单属于同一用户的同一商品
+func checkSameSubscriptionOwner(tx *gorm.DB, boundOrderID, orderID uint) error {
+	var orders []models.Order
+	if err := tx.Where("id IN ?", []uint{boundOrderID, orderID}).Find(&orders).Error; err != nil {
+		return fmt.Errorf("failed to load orders: %w", err)
+	}
+	if len(orders) != 2 {
+		return fmt.Errorf("failed to load order %d", orderID)
+	}
+	if orders[0].UserID != orders[1].UserID || orders[0].ProductID != orders[1].ProductID {
+		return fmt.Errorf("%w: order %d", ErrGooglePurchaseTokenBound, boundOrderID)
+	}
+	return nil
+}
+
+// MarkTestOrder 将一次性购买的订单标记为测试订单，测试订单不计入收入报表
+// 参数：
+//   - ctx: 上下文
+//   - orderID: 系统订单ID
+//
+// 返回：错误或nil
+func (s *GooglePlayService) MarkTestOrder(ctx context.Context, orderID uint) error {
+	return markTestOrder(s.db.WithContext(ctx), orderID)
+}
+
+// ApplyLinkedPurchase 处理 Webhook 收到的带 linkedPurchaseToken 的新购买
+// 新令牌尚未绑定订单时（客户端未调用验证接口），按旧订单复制出新订单，保证权益转移到新令牌
+// 返回：新令牌的订阅支付记录；未找到旧令牌记录时返回 nil
+func (s *GooglePlayService) ApplyLinkedPurchase(ctx context.Context, purchaseToken string, subscription *SubscriptionResponse) (*models.GooglePayment, error) {
+	if subscription.LinkedPurchaseToken == "" {
+		return nil, nil
+	}
+
+	tx := s.db.WithContext(ctx).Begin()
+
+	var payment models.GooglePayment
+	err := tx.Where("purchase_token = ?", purchaseToken).First(&payment).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to query google payment: %w", err)
+	}
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		var oldPayment models.GooglePayment
+		if err := tx.Where("purchase_token = ?", subscription.LinkedPurchaseToken).First(&oldPayment).Error; err != nil {
+			tx.Rollback()
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to query linked google payment: %w", err)
+		}
+		var oldOrder models.Order
+		if err := tx.First(&oldOrder, oldPayment.OrderID).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to load linked order: %w", err)
+		}
+
+		order := newLinkedSubscriptionOrder(&oldOrder, subscription)
+		if err := tx.Create(order).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to create linked order: %w", err)
+		}
+		payment = models.GooglePayment{OrderID: order.ID, PurchaseToken: purchaseToken}
+	}
+
+	fillSubscriptionPayment(&payment, subscription)
+	if err := tx.Save(&payment).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to save google payment: %w", err)
+	}
+
+	if err := s.supersedeLinkedPurchase(tx, &payment); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to commit google payment: %w", err)
+	}
+	return &payment, nil
+}
+
+// supersedeLinkedPurchase 将旧令牌的支付记录与订单标记为已被替代，并把权益转移到新订单
+// 旧订单有权益（已支付/已发货）时新订单直接置为已支付；已退款/已替代的旧订单不再更新
+func (s *GooglePlayService) supersedeLinkedPurchase(tx *gorm.DB, payment *models.GooglePayment) error {
+	if payment.LinkedPurchaseToken == "" {
+		return nil
+	}
+
+	var oldPayment models.GooglePayment
+	err := tx.Where("purchase_token = ?", payment.LinkedPurchaseToken).First(&oldPayment).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to query linked google payment: %w", err)
+	}
+	if oldPayment.SupersededByToken == payment.PurchaseToken {
+		return nil
+	}
+
+	now := time.Now()
+	if err := tx.Model(&oldPayment).Updates(map[string]interface{}{
+		"superseded_by_token": payment.PurchaseToken,
+		"superseded_at":       now,
+		"dunning_state":       models.DunningStateNone,
+	}).Error; err != nil {
+		return fmt.Errorf("failed to supersede google payment: %w", err)
+	}
+
+	var oldOrder models.Order
+	if err := tx.First(&oldOrder, oldPayment.OrderID).Error; err != nil {
+		return fmt.Errorf("failed to load linked order: %w", err)
+	}
+	entitled := oldOrder.Status == models.OrderStatusPaid || oldOrder.Status == models.OrderStatusDelivered
+
+	if oldOrder.Status != models.OrderStatusRefunded && oldOrder.Status != models.OrderStatusSuperseded {
+		if err := tx.Model(&oldOrder).Update("status", models.OrderStatusSuperseded).Error; err != nil {
+			return fmt.Errorf("failed to supersede order: %w", err)
+		}
+	}
+
+	if entitled {
+		if err := tx.Model(&models.Order{}).
+			Where("id = ? AND status = ?", payment.OrderID, models.OrderStatusCreated).
+			Updates(map[string]interface{}{
+				"status":         models.OrderStatusPaid,
+				"payment_status": models.PaymentStatusCompleted,
+				"paid_at":        now,
+			}).Error; err != nil {
+			return fmt.Errorf("failed to transfer entitlement: %w", err)
+		}
+	}
+
+	s.logger.Info("subscription superseded by linked purchase",
+		zap.Uint("old_order_id", oldPayment.OrderID),
+		zap.Uint("new_order_id", payment.OrderID),
+		zap.String("linked_purchase_token", payment.LinkedPurchaseToken),
+		zap.String("purchase_token", payment.PurchaseToken))
+	return nil
+}
+
+// GetSubscriptionLineage 查询购买令牌所在的订阅链路，从最早的令牌到最新的令牌
+func (s *GooglePlayService) GetSubscriptionLineage(ctx context.Context, purchaseToken string, linkedPurchaseToken string) ([]SubscriptionLineageItem, error) {
+	db := s.db.WithContext(ctx)
+	visited := map[string]bool{}
+
+	loadNode := func(token string) (SubscriptionLineageItem, string, error) {
+		item := SubscriptionLineageItem{PurchaseToken: token, Current: token == purchaseToken}
+		var payment models.GooglePayment
+		err := db.Where("purchase_token = ?", token).First(&payment).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return item, "", nil
+			}
+			return item, "", fmt.Errorf("failed to query google payment: %w", err)
+		}
+		item.OrderID = payment.OrderID
+		item.ProductID = payment.ProductIDGoogle
+		item.SupersededByToken = payment.SupersededByToken
+		item.SupersededAt = payment.SupersededAt
+		return item, payment.LinkedPurchaseToken, nil
+	}
+
+	current, storedLinked, err := loadNode(purchaseToken)
+	if err != nil {
+		return nil, err
+	}
+	visited[purchaseToken] = true
+	if linkedPurchaseToken == "" {
+		linkedPurchaseToken = storedLinked
+	}
+
+	// 向前回溯旧令牌
+	var ancestors []SubscriptionLineageItem
+	for token := linkedPurchaseToken; token != "" && !visited[token] && len(ancestors) < subscriptionLineageMaxDepth; {
+		visited[token] = true
+		item, prev, err := loadNode(token)
+		if err != nil {
+			return nil, err
+		}
+		ancestors = append(ancestors, item)
+		token = prev
+	}
+
+	lineage := make([]SubscriptionLineageItem, 0, len(ancestors)+1)
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		lineage = append(lineage, ancestors[i])
+	}
+	lineage = append(lineage, current)
+
+	// 向后追踪替代它的新令牌
+	for token := current.SupersededByToken; token != "" && !visited[token] && len(lineage) < 2*subscriptionLineageMaxDepth; {
+		visited[token] = true
+		item, _, err := loadNode(token)
+		if err != nil {
+			return nil, err
+		}
+		lineage = append(lineage, item)
+		token = item.SupersededByToken
+	}
+
+	return lineage, nil
+}
+
+// fillSubscriptionPayment 用 subscriptionsv2 验证结果填充订阅支付记录
+func fillSubscriptionPayment(payment *models.GooglePayment, subscription *SubscriptionResponse) {
+	payment.OrderIDGoogle = subscription.LatestOrderId
+	if len(subscription.LineItems) > 0 {
+		payment.ProductIDGoogle = subscription.LineItems[0].ProductId
+		if price := subscription.LineItems[0].RecurringPriceMicros; price > 0 {
+			payment.PriceAmountMicros = strconv.FormatInt(price, 10)
+		}
+	}
+	if subscription.IsAcknowledged() {
+		payment.AcknowledgementState = 1
+	}
+	if startTime, err := time.Parse(time.RFC3339, subscription.StartTime); err == nil {
+		payment.PurchaseTimeMillis = strconv.FormatInt(startTime.UnixMilli(), 10)
+	}
+	if expiryTime := subscription.LatestExpiryTime(); !expiryTime.IsZero() {
+		payment.ExpiryTimeMillis = strconv.FormatInt(expiryTime.UnixMilli(), 10)
+	}
+	autoRenewing := subscription.IsAutoRenewing()
+	payment.AutoRenewing = &autoRenewing
+	payment.RegionCode = subscription.RegionCode
+	payment.ObfuscatedAccountID = subscription.ObfuscatedExternalAccountId
+	payment.ObfuscatedProfileID = subscription.ObfuscatedExternalProfileId
+	payment.LinkedPurchaseToken = subscription.LinkedPurchaseToken
+}
+
+// newLinkedSubscriptionOrder 按旧订阅订单为新购买令牌创建订单，商品与价格取新订阅项
+func newLinkedSubscriptionOrder(oldOrder *models.Order, subscription *SubscriptionResponse) *models.Order {
+	order := &models.Order{
+		OrderNo:          generateOrderNo(),
+		TenantID:         oldOrder.TenantID,
+		UserID:           oldOrder.UserID,
+		ProductID:        oldOrder.ProductID,
+		Type:             models.OrderTypeSubscription,
+		Title:            oldOrder.Title,
+		Description:      oldOrder.Description,
+		Quantity:         1,
+		Currency:         oldOrder.Currency,
+		TotalAmount:      oldOrder.TotalAmount,
+		Status:           models.OrderStatusCreated,
+		PaymentMethod:    models.PaymentMethodGooglePlay,
+		PaymentStatus:    models.PaymentStatusPending,
+		DeveloperPayload: oldOrder.DeveloperPayload,
+		AppID:            oldOrder.AppID,
+		IsTest:           oldOrder.IsTest || subscription.TestPurchase,
+	}
+	if len(subscription.LineItems) > 0 {
+		item := subscription.LineItems[0]
+		order.ProductID = item.ProductId
+		if item.RecurringPriceMicros > 0 && item.RecurringPriceCurrency != "" {
+			order.Currency = item.RecurringPriceCurrency
+			order.TotalAmount = item.RecurringPriceMicros
+		}
+	}
+	return order
+}
@@ -0,0 +1,352 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/api/androidpublisher/v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"pay-gateway/internal/cache"
+	"pay-gateway/internal/models"
+)
+
+const (
+	// Voided Purchases API 最多返回 30 天内的作废记录
+	voidedPurchasesMaxLookback = 30 * 24 * time.Hour
+	// 作废记录可能延迟出现在 API 中，每次从检查点向前回溯一段时间，重复记录由唯一索引去重
+	voidedPurchasesOverlap = time.Hour
+
+	lockKeyPrefixVoidedSync  = "google:voided:sync:lock:"
+	voidedSyncLockExpiration = 10 * time.Minute
+)
+
+// Google Play 作废原因
+var googleVoidedReasons = map[int]string{
+	0: "其他",
+	1: "用户反悔",
+	2: "未收到商品",
+	3: "商品有缺陷",
+	4: "误购",
+	5: "欺诈",
+	6: "友好欺诈",
+	7: "拒付",
+	8: "未确认购买",
+}
+
+// GoogleVoidedPurchaseService Google Play 作废购买轮询服务
+// RTDN 只覆盖部分退款场景，定期拉取 Voided Purchases API，确保 Play Console 退款与拒付不会遗漏
+type GoogleVoidedPurchaseService struct {
+	db            *gorm.DB
+	googleService *GooglePlayService
+	redis         *cache.Redis // 可选，多副本部署时保证同一应用只有一个实例在同步
+	logger        *zap.Logger
+}
+
+// NewGoogleVoidedPurchaseService 创建作废购买轮询服务
+func NewGoogleVoidedPurchaseService(db *gorm.DB, googleService *GooglePlayService, logger *zap.Logger) *GoogleVoidedPurchaseService {
+	return &GoogleVoidedPurchaseService{
+		db:            db,
+		googleService: googleService,
+		logger:        logger,
+	}
+}
+
+// SetRedis 设置 Redis，用于多副本部署时的同步分布式锁
+func (s *GoogleVoidedPurchaseService) SetRedis(redis *cache.Redis) {
+	s.redis = redis
+}
+
+// SyncVoidedPurchases 依次同步所有已配置应用的作废购买，单个应用失败不影响其他应用
+// 返回：本次新处理的作废记录数
+func (s *GoogleVoidedPurchaseService) SyncVoidedPurchases(ctx context.Context) (int, error) {
+	processed := 0
+	var errs []error
+	for _, packageName := range s.googleService.Packages() {
+		googleService, err := s.googleService.ForPackage(packageName)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		count, err := s.syncPackage(ctx, googleService)
+		processed += count
+		if err != nil {
+			errs = append(errs, fmt.Errorf("package %s: %w", packageName, err))
+		}
+	}
+	return processed, errors.Join(errs...)
+}
+
+// syncPackage 从上次检查点开始分页拉取单个应用的作废购买，匹配本地支付记录并撤销权益
+// 全部分页处理成功后才推进检查点，失败时下次从原检查点重试
+func (s *GoogleVoidedPurchaseService) syncPackage(ctx context.Context, googleService *GooglePlayService) (int, error) {
+	packageName := googleService.PackageName()
+	if s.redis != nil {
+		lockKey := lockKeyPrefixVoidedSync + packageName
+		lockToken := uuid.NewString()
+		ok, err := s.redis.SetNX(ctx, lockKey, lockToken, voidedSyncLockExpiration)
+		if err != nil {
+			return 0, fmt.Errorf("failed to acquire voided purchases sync lock: %w", err)
+		}
+		if !ok {
+			s.logger.Info("voided purchases sync in progress on another instance", zap.String("package_name", packageName))
+			return 0, nil
+		}
+		defer func() { _, _ = s.redis.DelIfValue(context.Background(), lockKey, lockToken) }()
+	}
+
+	endTime := time.Now()
+	checkpoint, err := s.loadCheckpoint(ctx, packageName)
+	if err != nil {
+		return 0, err
+	}
+	startTime := voidedSyncStartTime(checkpoint, endTime)
+
+	processed := 0
+	pageToken := ""
+	for {
+		voidedPurchases, nextPageToken, err := googleService.ListVoidedPurchases(ctx, startTime, endTime, pageToken)
+		if err != nil {
+			return processed, err
+		}
+		for _, voided := range voidedPurchases {
+			created, err := s.processVoidedPurchase(ctx, voided)
+			if err != nil {
+				return processed, err
+			}
+			if created {
+				processed++
+			}
+			if voided.VoidedTimeMillis > checkpoint.LastVoidedTimeMillis {
+				checkpoint.LastVoidedTimeMillis = voided.VoidedTimeMillis
+			}
+		}
+		if nextPageToken == "" {
+			break
+		}
+		pageToken = nextPageToken
+	}
+
+	checkpoint.LastEndTime = endTime
+	if err := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "package_name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_voided_time_millis", "last_end_time", "updated_at"}),
+	}).Create(checkpoint).Error; err != nil {
+		return processed, fmt.Errorf("failed to save voided purchases checkpoint: %w", err)
+	}
+
+	return processed, nil
+}
+
+// loadCheckpoint 加载应用的同步检查点，尚未同步过时返回空检查点
+func (s *GoogleVoidedPurchaseService) loadCheckpoint(ctx context.Context, packageName string) (*models.GoogleVoidedSyncCheckpoint, error) {
+	var checkpoint models.GoogleVoidedSyncCheckpoint
+	err := s.db.WithContext(ctx).Where("package_name = ?", packageName).First(&checkpoint).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &models.GoogleVoidedSyncCheckpoint{PackageName: packageName}, nil
+		}
+		return nil, fmt.Errorf("failed to load voided purchases checkpoint: %w", err)
+	}
+	return &checkpoint, nil
+}
+
+// voidedSyncStartTime 计算本次拉取起始时间：已处理的最大作废时间回溯重叠窗口，且不早于 API 最大回溯范围
+// 作废记录可能晚于其作废时间才出现在 API 中，以作废时间而非拉取时间作为检查点，避免漏掉延迟出现的记录
+func voidedSyncStartTime(checkpoint *models.GoogleVoidedSyncCheckpoint, endTime time.Time) time.Time {
+	earliest := endTime.Add(-voidedPurchasesMaxLookback).Add(time.Minute)
+	if checkpoint.LastVoidedTimeMillis == 0 {
+		return earliest
+	}
+	startTime := time.UnixMilli(checkpoint.LastVoidedTimeMillis).Add(-voidedPurchasesOverlap)
+	if startTime.Before(earliest) {
+		startTime = earliest
+	}
+	return startTime
+}
+
+// processVoidedPurchase 处理单条作废购买，已处理过的记录直接跳过
+// 按 Google 订单号匹配支付记录，未命中时按购买令牌匹配；订阅续订订单（GPA.xxx..N）作废只记录，不影响原订单，
+// 部分数量作废按数量累计退款金额
+// 返回：是否为新记录
+func (s *GoogleVoidedPurchaseService) processVoidedPurchase(ctx context.Context, voided *androidpublisher.VoidedPurchase) (bool, error) {
+	tx := s.db.WithContext(ctx).Begin()
+
+	var existing models.GoogleVoidedPurchase
+	err := tx.Where("purchase_token = ? AND order_id_google = ? AND voided_time_millis = ?",
+		voided.PurchaseToken, voided.OrderId, voided.VoidedTimeMillis).First(&existing).Error
+	if err == nil {
+		tx.Rollback()
+		return false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		tx.Rollback()
+		return false, fmt.Errorf("failed to query voided purchase: %w", err)
+	}
+
+	payment, err := findVoidedGooglePayment(tx, voided)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	now := time.Now()
+	record := models.GoogleVoidedPurchase{
+		PurchaseToken:      voided.PurchaseToken,
+		OrderIDGoogle:      voided.OrderId,
+		PurchaseTimeMillis: voided.PurchaseTimeMillis,
+		VoidedTimeMillis:   voided.VoidedTimeMillis,
+		VoidedSource:       int(voided.VoidedSource),
+		VoidedReason:       int(voided.VoidedReason),
+		VoidedQuantity:     int(voided.VoidedQuantity),
+		Action:             models.GoogleVoidedActionUnmatched,
+		ProcessedAt:        &now,
+	}
+
+	if payment != nil {
+		record.OrderID = &payment.OrderID
+		if isGoogleRenewalOrderID(voided.OrderId) {
+			// 续订订单作废只退该期费用，原订单不变；撤销权益由 SUBSCRIPTION_REVOKED 通知处理
+			record.Action = models.GoogleVoidedActionRenewal
+		} else {
+			record.Action, err = s.voidOrder(tx, payment, voided)
+			if err != nil {
+				tx.Rollback()
+				return false, err
+			}
+		}
+	}
+
+	// 多实例并发处理同一记录时由唯一索引去重
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	if result.Error != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("failed to save voided purchase: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+	if err := tx.Commit().Error; err != nil {
+		return false, fmt.Errorf("failed to commit voided purchase: %w", err)
+	}
+
+	if payment == nil {
+		s.logger.Warn("voided purchase not matched",
+			zap.String("purchase_token", voided.PurchaseToken),
+			zap.String("order_id_google", voided.OrderId))
+	} else {
+		s.logger.Info("voided purchase processed",
+			zap.Uint("order_id", payment.OrderID),
+			zap.String("order_id_google", voided.OrderId),
+			zap.String("action", record.Action),
+			zap.Int64("voided_reason", voided.VoidedReason),
+			zap.Int64("voided_quantity", voided.VoidedQuantity))
+	}
+	return true, nil
+}
+
+// voidOrder 作废原订单：全部数量作废时订单标记为已退款并撤销权益，部分数量作废时按数量累计退款金额
+// 返回：处理结果
+func (s *GoogleVoidedPurchaseService) voidOrder(tx *gorm.DB, payment *models.GooglePayment, voided *androidpublisher.VoidedPurchase) (string, error) {
+	var order models.Order
+	if err := tx.First(&order, payment.OrderID).Error; err != nil {
+		return "", fmt.Errorf("failed to load voided order: %w", err)
+	}
+
+	action := googleVoidedAction(int(voided.VoidedReason))
+	voidedAt := time.UnixMilli(voided.VoidedTimeMillis)
+	refundAmount := order.TotalAmount
+	if quantity := int64(order.Quantity); voided.VoidedQuantity > 0 && voided.VoidedQuantity < quantity {
+		refundAmount = order.RefundAmount + order.TotalAmount*voided.VoidedQuantity/quantity
+		if refundAmount < order.TotalAmount {
+			action = models.GoogleVoidedActionPartialRefunded
+		} else {
+			refundAmount = order.TotalAmount
+		}
+	}
+
+	if order.Status == models.OrderStatusRefunded {
+		// 已退款的订单不重复更新
+		return action, nil
+	}
+
+	updates := map[string]interface{}{
+		"refund_at":     voidedAt,
+		"refund_amount": refundAmount,
+		"refund_reason": "Google Play作废购买：" + googleVoidedReasonText(int(voided.VoidedReason)),
+	}
+	if action != models.GoogleVoidedActionPartialRefunded {
+		// 订单标记为已退款即撤销权益
+		updates["status"] = models.OrderStatusRefunded
+		updates["payment_status"] = models.PaymentStatusRefunded
+	}
+	if err := tx.Model(&order).Updates(updates).Error; err != nil {
+		return "", fmt.Errorf("failed to update voided order: %w", err)
+	}
+
+	if action != models.GoogleVoidedActionPartialRefunded {
+		if err := tx.Model(payment).Updates(map[string]interface{}{
+			"voided_at":     voidedAt,
+			"dunning_state": models.DunningStateNone,
+		}).Error; err != nil {
+			return "", fmt.Errorf("failed to update voided google payment: %w", err)
+		}
+	}
+	return action, nil
+}
+
+// findVoidedGooglePayment 查找作废购买对应的支付记录，未找到时返回 nil
+// 优先按 Google 订单号（续订订单取基础订单号）匹配，订单号缺失或未命中时按购买令牌匹配
+func findVoidedGooglePayment(tx *gorm.DB, voided *androidpublisher.VoidedPurchase) (*models.GooglePayment, error) {
+	var payment models.GooglePayment
+	if voided.OrderId != "" {
+		baseOrderID, _, _ := strings.Cut(voided.OrderId, "..")
+		err := tx.Where("order_id_google IN ? OR order_id_google LIKE ?", []string{voided.OrderId, baseOrderID}, baseOrderID+"..%").
+			Order("id ASC").First(&payment).Error
+		if err == nil {
+			return &payment, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("failed to query google payment: %w", err)
+		}
+	}
+
+	err := tx.Where("purchase_token = ?", voided.PurchaseToken).First(&payment).Error
+	if err == nil {
+		return &payment, nil
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("failed to query google payment: %w", err)
+}
+
+// isGoogleRenewalOrderID 订阅续订订单号为基础订单号加 ..N 后缀
+func isGoogleRenewalOrderID(orderID string) bool {
+	return strings.Contains(orderID, "..")
+}
+
+// googleVoidedAction 欺诈与拒付视为撤销，其余为退款
+func googleVoidedAction(reason int) string {
+	switch reason {
+	case 5, 6, 7:
+		return models.GoogleVoidedActionRevoked
+	default:
+		return models.GoogleVoidedActionRefunded
+	}
+}
+
+// googleVoidedReasonText 作废原因描述
+func googleVoidedReasonText(reason int) string {
+	if text, ok := googleVoidedReasons[reason]; ok {
+		return text
+	}
+	return fmt.Sprintf("未知原因(%d)", reason)
+}
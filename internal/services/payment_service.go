@@ -43,6 +43,8 @@ type CreateOrderRequest struct {
 	TotalAmount      int64                `json:"total_amount" binding:"required,min=0"`
 	PaymentMethod    models.PaymentMethod `json:"payment_method" binding:"required"`
 	DeveloperPayload string               `json:"developer_payload"`
+	AppID            string               `json:"app_id"` // 应用标识（Google Play 包名 / Apple Bundle ID）
+	AppAccountToken  string               `json:"-"`      // Apple 应用账户令牌，由服务端生成
 }
 
 // paymentServiceImpl 支付服务实现
@@ -79,7 +81,16 @@ func (s *paymentServiceImpl) SetOrderDelayCancelProducer(producer OrderDelayCanc
 }
 
 // CreateOrder 创建订单
+// 订单归属上下文中的租户（WithTenantID），未设置时归属默认租户
 func (s *paymentServiceImpl) CreateOrder(ctx context.Context, req *CreateOrderRequest) (*models.Order, error) {
+	tenantID := TenantIDFromContext(ctx)
+	if tenantID == "" {
+		tenantID = config.DefaultTenantID
+	}
+	if !s.config.HasTenant(tenantID) {
+		return nil, fmt.Errorf("%w: %s", ErrTenantNotFound, tenantID)
+	}
+
 	// 生成订单号
 	orderNo := s.generateOrderNo()
 
@@ -88,6 +99,7 @@ func (s *paymentServiceImpl) CreateOrder(ctx context.Context, req *CreateOrderRe
 
 	order := &models.Order{
 		OrderNo:          orderNo,
+		TenantID:         tenantID,
 		UserID:           req.UserID,
 		ProductID:        req.ProductID,
 		Type:             req.Type,
@@ -101,6 +113,8 @@ func (s *paymentServiceImpl) CreateOrder(ctx context.Context, req *CreateOrderRe
 		PaymentStatus:    models.PaymentStatusPending,
 		ExpiredAt:        &expiredAt,
 		DeveloperPayload: req.DeveloperPayload,
+		AppID:            req.AppID,
+		AppAccountToken:  req.AppAccountToken,
 	}
 
 	// 开始事务
@@ -145,6 +159,7 @@ func (s *paymentServiceImpl) CreateOrder(ctx context.Context, req *CreateOrderRe
 func (s *paymentServiceImpl) GetOrder(ctx context.Context, orderID uint) (*models.Order, error) {
 	var order models.Order
 	err := s.db.WithContext(ctx).
+		Scopes(tenantScope(TenantIDFromContext(ctx))).
 		First(&order, orderID).Error
 
 	if err != nil {
@@ -162,6 +177,7 @@ func (s *paymentServiceImpl) GetOrder(ctx context.Context, orderID uint) (*model
 func (s *paymentServiceImpl) GetOrderByOrderNo(ctx context.Context, orderNo string) (*models.Order, error) {
 	var order models.Order
 	err := s.db.WithContext(ctx).
+		Scopes(tenantScope(TenantIDFromContext(ctx))).
 		Where("order_no = ?", orderNo).
 		First(&order).Error
 
@@ -210,7 +226,7 @@ func (s *paymentServiceImpl) CancelOrder(ctx context.Context, orderID uint, reas
 
 	// 获取订单
 	var order models.Order
-	if err := tx.First(&order, orderID).Error; err != nil {
+	if err := tx.Scopes(tenantScope(TenantIDFromContext(ctx))).First(&order, orderID).Error; err != nil {
 		tx.Rollback()
 		if err == gorm.ErrRecordNotFound {
 			return fmt.Errorf("订单不存在: %d", orderID)
@@ -284,6 +300,7 @@ func (s *paymentServiceImpl) GetUserOrders(ctx context.Context, userID uint, pag
 	// 查询总数
 	err := s.db.WithContext(ctx).
 		Model(&models.Order{}).
+		Scopes(tenantScope(TenantIDFromContext(ctx))).
 		Where("user_id = ?", userID).
 		Count(&total).Error
 
@@ -293,6 +310,7 @@ func (s *paymentServiceImpl) GetUserOrders(ctx context.Context, userID uint, pag
 
 	// 查询订单列表
 	err = s.db.WithContext(ctx).
+		Scopes(tenantScope(TenantIDFromContext(ctx))).
 		Where("user_id = ?", userID).
 		Order("created_at DESC").
 		Offset(offset).
@@ -335,3 +353,35 @@ func (s *paymentServiceImpl) generateTransactionID() string {
 		time.Now().Format("20060102150405"),
 		uuid.New().String()[:8])
 }
+
+// bindOrderApp 校验订单所属应用，未记录应用的历史订单补记为当前应用
+// 防止使用其他应用的购买凭证完成本订单
+func bindOrderApp(tx *gorm.DB, order *models.Order, appID string) error {
+	if appID == "" || order.AppID == appID {
+		return nil
+	}
+	if order.AppID != "" {
+		return fmt.Errorf("订单 %d 属于应用 %s，与凭证所属应用 %s 不一致", order.ID, order.AppID, appID)
+	}
+	if err := tx.Model(order).Update("app_id", appID).Error; err != nil {
+		return fmt.Errorf("更新订单应用失败: %w", err)
+	}
+	return nil
+}
+
+// markTestOrder 将订单标记为测试订单（Apple 沙盒交易 / Google 测试购买）
+func markTestOrder(tx *gorm.DB, orderID uint) error {
+	if orderID == 0 {
+		return nil
+	}
+	if err := tx.Model(&models.Order{}).Where("id = ? AND is_test = ?", orderID, false).
+		Update("is_test", true).Error; err != nil {
+		return fmt.Errorf("标记测试订单失败: %w", err)
+	}
+	return nil
+}
+
+// liveOrdersScope 排除测试订单，收入统计与报表查询使用
+func liveOrdersScope(db *gorm.DB) *gorm.DB {
+	return db.Where("orders.is_test = ?", false)
+}
@@ -0,0 +1,400 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"pay-gateway/internal/cache"
+	"pay-gateway/internal/config"
+	"pay-gateway/internal/models"
+)
+
+// StoreReconciliationService 应用商店对账服务
+// 导入 App Store Connect 销售/财务报告与 Google Play 收入报告，与本地 ApplePayment、GooglePayment 比对，
+// 差异明细结构与支付宝、微信对账一致
+type StoreReconciliationService struct {
+	db     *gorm.DB
+	config *config.Config
+	redis  *cache.Redis // 分布式锁，多副本部署时避免同一报告并发导入（可选）
+	logger *zap.Logger
+}
+
+// NewStoreReconciliationService 创建应用商店对账服务
+func NewStoreReconciliationService(db *gorm.DB, cfg *config.Config, logger *zap.Logger) *StoreReconciliationService {
+	return &StoreReconciliationService{
+		db:     db,
+		config: cfg,
+		logger: logger,
+	}
+}
+
+// SetRedis 设置 Redis，用于多副本部署时的导入分布式锁
+func (s *StoreReconciliationService) SetRedis(redis *cache.Redis) {
+	s.redis = redis
+}
+
+// 报告类型
+const (
+	StoreReportSales    = "sales"    // App Store Connect 销售报告
+	StoreReportFinance  = "finance"  // App Store Connect 财务报告
+	StoreReportEarnings = "earnings" // Google Play 收入报告
+)
+
+// 比对方式
+const (
+	storeMatchTransaction = "transaction" // 逐笔按交易/订单号比对
+	storeMatchProduct     = "product"     // 报告无交易号，按商品汇总数量比对
+)
+
+// ErrStoreReportDirNotConfigured 未配置报告目录
+var ErrStoreReportDirNotConfigured = errors.New("未配置报告目录")
+
+// lockKeyPrefixStoreReconciliation 应用商店对账分布式锁前缀，按商店加批量导入锁、按报告文件加单文件锁
+const lockKeyPrefixStoreReconciliation = "store:reconciliation:lock:"
+
+// pacificLocation App Store Connect 与 Google Play 报告日期均为太平洋时间
+var pacificLocation = loadPacificLocation()
+
+func loadPacificLocation() *time.Location {
+	if loc, err := time.LoadLocation("America/Los_Angeles"); err == nil {
+		return loc
+	}
+	return time.FixedZone("PST", -8*3600)
+}
+
+// storeComparison 单个报告的比对结果
+type storeComparison struct {
+	totalCount     int
+	matchCount     int
+	diffCount      int
+	localOnlyCount int
+	details        []models.StoreReconciliationDetail
+}
+
+// addDiff 记录一条差异，仅本地有的记录单独计数
+func (c *storeComparison) addDiff(d models.StoreReconciliationDetail) {
+	if d.DiffType == "local_only" {
+		c.localOnlyCount++
+	} else {
+		c.diffCount++
+	}
+	c.details = append(c.details, d)
+}
+
+// reportDir 返回对应商店的报告目录
+func (s *StoreReconciliationService) reportDir(store string) (string, error) {
+	var dir string
+	switch store {
+	case models.StoreApple:
+		dir = s.config.Apple.ReportDir
+	case models.StoreGoogle:
+		dir = s.config.Google.EarningsReportDir
+	default:
+		return "", fmt.Errorf("不支持的商店: %s", store)
+	}
+	if dir == "" {
+		return "", ErrStoreReportDirNotConfigured
+	}
+	return dir, nil
+}
+
+// ImportReport 导入报告目录下的单个报告文件并执行对账
+// 参数：
+//   - ctx: 上下文
+//   - store: apple/google
+//   - fileName: 报告文件名（不含目录，禁止路径穿越）
+//
+// 返回：对账报告或错误；同一报告文件正在其他实例导入时返回 ErrReconciliationInProgress
+func (s *StoreReconciliationService) ImportReport(ctx context.Context, store, fileName string) (*models.StoreReconciliationReport, error) {
+	dir, err := s.reportDir(store)
+	if err != nil {
+		return nil, err
+	}
+	if fileName == "" || filepath.Base(fileName) != fileName || strings.HasPrefix(fileName, ".") {
+		return nil, fmt.Errorf("报告文件名无效: %s", fileName)
+	}
+
+	unlock, err := s.lock(ctx, store+":"+fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// 创建对账任务
+	reportType := StoreReportSales
+	if store == models.StoreGoogle {
+		reportType = StoreReportEarnings
+	}
+	report := &models.StoreReconciliationReport{
+		Store:      store,
+		ReportType: reportType,
+		SourceFile: fileName,
+		Status:     "processing",
+		StartedAt:  func() *time.Time { t := time.Now(); return &t }(),
+	}
+	if err := s.db.WithContext(ctx).Create(report).Error; err != nil {
+		return nil, fmt.Errorf("创建对账任务失败: %v", err)
+	}
+
+	// 1. 读取报告文件（gzip/zip 自动解压）
+	body, err := readStoreReportFile(filepath.Join(dir, fileName))
+	if err != nil {
+		s.failReport(report, fmt.Sprintf("读取报告文件失败: %v", err))
+		return report, err
+	}
+
+	// 2. 解析报告并与本地记录比对
+	var result *storeComparison
+	switch store {
+	case models.StoreApple:
+		result, err = s.reconcileAppleReport(ctx, report, body)
+	case models.StoreGoogle:
+		result, err = s.reconcileGoogleEarnings(ctx, report, body)
+	}
+	if err != nil {
+		s.failReport(report, fmt.Sprintf("对账失败: %v", err))
+		return report, err
+	}
+
+	report.TotalCount = result.totalCount
+	report.MatchCount = result.matchCount
+	report.DiffCount = result.diffCount
+	report.LocalOnlyCount = result.localOnlyCount
+	if err := s.completeReport(ctx, report, result.details); err != nil {
+		s.failReport(report, fmt.Sprintf("保存对账结果失败: %v", err))
+		return report, fmt.Errorf("保存对账结果失败: %v", err)
+	}
+
+	s.logger.Info("应用商店对账完成",
+		zap.String("store", store),
+		zap.String("file", fileName),
+		zap.String("report_type", report.ReportType),
+		zap.String("match_mode", report.MatchMode),
+		zap.Int("total", report.TotalCount),
+		zap.Int("match", report.MatchCount),
+		zap.Int("diff", report.DiffCount),
+		zap.Int("local_only", report.LocalOnlyCount))
+
+	return report, nil
+}
+
+// ImportPendingReports 导入报告目录下尚未成功对账的全部报告文件，单个文件失败不影响其余文件
+// 其他实例正在导入的文件跳过，由该实例完成
+// 返回：本次生成的对账报告，以及各文件失败原因的合并错误；同一商店正在批量导入时返回 ErrReconciliationInProgress
+func (s *StoreReconciliationService) ImportPendingReports(ctx context.Context, store string) ([]*models.StoreReconciliationReport, error) {
+	dir, err := s.reportDir(store)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := s.lock(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("读取报告目录失败: %v", err)
+	}
+
+	var imported []string
+	if err := s.db.WithContext(ctx).Model(&models.StoreReconciliationReport{}).
+		Where("store = ? AND status = ?", store, "completed").
+		Pluck("source_file", &imported).Error; err != nil {
+		return nil, fmt.Errorf("查询已导入报告失败: %v", err)
+	}
+	done := make(map[string]bool, len(imported))
+	for _, name := range imported {
+		done[name] = true
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || done[e.Name()] {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	var reports []*models.StoreReconciliationReport
+	var errs []error
+	for _, name := range names {
+		report, err := s.ImportReport(ctx, store, name)
+		if errors.Is(err, ErrReconciliationInProgress) {
+			continue
+		}
+		if report != nil {
+			reports = append(reports, report)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return reports, errors.Join(errs...)
+}
+
+// lock 获取分布式锁，未配置 Redis 时不加锁
+// 返回：释放锁的函数；锁被占用时返回 ErrReconciliationInProgress
+func (s *StoreReconciliationService) lock(ctx context.Context, name string) (func(), error) {
+	if s.redis == nil {
+		return func() {}, nil
+	}
+	lockKey := lockKeyPrefixStoreReconciliation + name
+	lockToken := uuid.NewString()
+	ok, err := s.redis.SetNX(ctx, lockKey, lockToken, reconciliationLockExpiration)
+	if err != nil {
+		return nil, fmt.Errorf("获取分布式锁失败: %w", err)
+	}
+	if !ok {
+		return nil, ErrReconciliationInProgress
+	}
+	return func() { _, _ = s.redis.DelIfValue(context.Background(), lockKey, lockToken) }, nil
+}
+
+// completeReport 在同一事务内写入差异明细并完成报告，任一步骤失败整体回滚
+func (s *StoreReconciliationService) completeReport(ctx context.Context, report *models.StoreReconciliationReport, details []models.StoreReconciliationDetail) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i := range details {
+			details[i].ReportID = report.ID
+		}
+		if len(details) > 0 {
+			if err := tx.CreateInBatches(details, reconciliationDetailBatch).Error; err != nil {
+				return fmt.Errorf("写入差异明细失败: %w", err)
+			}
+		}
+
+		report.Status = "completed"
+		now := time.Now()
+		report.CompletedAt = &now
+		return tx.Save(report).Error
+	})
+}
+
+// failReport 将对账任务标记为失败，保存失败时记录日志（调用方已返回原始错误）
+func (s *StoreReconciliationService) failReport(report *models.StoreReconciliationReport, msg string) {
+	report.Status = "failed"
+	report.ErrorMessage = msg
+	now := time.Now()
+	report.CompletedAt = &now
+	if err := s.db.Save(report).Error; err != nil {
+		s.logger.Error("保存对账失败状态失败",
+			zap.String("store", report.Store),
+			zap.Uint("report_id", report.ID),
+			zap.String("reason", msg),
+			zap.Error(err))
+	}
+}
+
+// readStoreReportFile 读取报告文件：gzip 解压（App Store Connect），zip 取第一个 CSV（Google Play），否则按原文返回
+func readStoreReportFile(path string) ([]byte, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(body, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("解压 gzip 失败: %v", err)
+		}
+		defer gz.Close()
+		return io.ReadAll(gz)
+	case bytes.HasPrefix(body, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			return nil, fmt.Errorf("解压 zip 失败: %v", err)
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() || !strings.EqualFold(filepath.Ext(f.Name), ".csv") {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			return data, err
+		}
+		return nil, errors.New("zip 中未找到 CSV 文件")
+	}
+	return body, nil
+}
+
+// storePeriodRange 返回报告期（太平洋时间）的起止时间，区间左闭右开
+func storePeriodRange(start, end time.Time) (time.Time, time.Time) {
+	from := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, pacificLocation)
+	to := time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, pacificLocation).AddDate(0, 0, 1)
+	return from, to
+}
+
+// storeHeaderIndex 表头列名（小写）到列序号的映射
+func storeHeaderIndex(header []string) map[string]int {
+	idx := make(map[string]int, len(header))
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		if _, ok := idx[h]; !ok {
+			idx[h] = i
+		}
+	}
+	return idx
+}
+
+// storeColumn 按候选列名依次查找列序号，找不到返回 -1
+func storeColumn(idx map[string]int, names ...string) int {
+	for _, n := range names {
+		if i, ok := idx[n]; ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// storeCell 安全取列值
+func storeCell(row []string, i int) string {
+	if i < 0 || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+// GetReport 查询对账报告及差异明细
+func (s *StoreReconciliationService) GetReport(ctx context.Context, store string, reportID uint) (*models.StoreReconciliationReport, []models.StoreReconciliationDetail, error) {
+	var report models.StoreReconciliationReport
+	if err := s.db.WithContext(ctx).Where("store = ?", store).First(&report, reportID).Error; err != nil {
+		return nil, nil, fmt.Errorf("对账报告不存在: %v", err)
+	}
+	var details []models.StoreReconciliationDetail
+	if err := s.db.WithContext(ctx).Where("report_id = ?", reportID).Find(&details).Error; err != nil {
+		return nil, nil, fmt.Errorf("查询差异明细失败: %v", err)
+	}
+	return &report, details, nil
+}
+
+// ListReports 列出对账报告
+func (s *StoreReconciliationService) ListReports(ctx context.Context, store string, limit int) ([]models.StoreReconciliationReport, error) {
+	if limit <= 0 {
+		limit = 20
+	}
+	var reports []models.StoreReconciliationReport
+	if err := s.db.Where("store = ?", store).Order("created_at DESC").Limit(limit).Find(&reports).Error; err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"pay-gateway/internal/cache"
+	"pay-gateway/internal/config"
+)
+
+// ErrTenantNotFound 租户不存在或未开通对应支付渠道
+var ErrTenantNotFound = errors.New("租户不存在或未开通该支付渠道")
+
+// tenantContextKey 上下文中租户ID的键
+type tenantContextKey struct{}
+
+// WithTenantID 将租户ID写入上下文，供 PaymentService 等跨渠道服务按租户限定查询
+func WithTenantID(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenantID)
+}
+
+// TenantIDFromContext 从上下文获取租户ID，未设置时返回空字符串（不限定租户）
+func TenantIDFromContext(ctx context.Context) string {
+	tenantID, _ := ctx.Value(tenantContextKey{}).(string)
+	return tenantID
+}
+
+// tenantScope 限定查询的租户，tenantID 为空时不限定
+func tenantScope(tenantID string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if tenantID == "" {
+			return db
+		}
+		return db.Where("tenant_id = ?", tenantID)
+	}
+}
+
+// TenantRegistry 按租户ID索引的支付服务集合
+type TenantRegistry[T any] struct {
+	services map[string]T
+	ids      []string
+}
+
+// NewTenantRegistry 创建租户服务注册表
+func NewTenantRegistry[T any]() *TenantRegistry[T] {
+	return &TenantRegistry[T]{services: make(map[string]T)}
+}
+
+// Register 注册租户服务，重复注册时覆盖
+func (r *TenantRegistry[T]) Register(tenantID string, svc T) {
+	if _, exists := r.services[tenantID]; !exists {
+		r.ids = append(r.ids, tenantID)
+	}
+	r.services[tenantID] = svc
+}
+
+// Get 获取租户服务，tenantID 为空时返回默认租户
+func (r *TenantRegistry[T]) Get(tenantID string) (T, error) {
+	if tenantID == "" {
+		tenantID = config.DefaultTenantID
+	}
+	svc, ok := r.services[tenantID]
+	if !ok {
+		var zero T
+		return zero, fmt.Errorf("%w: %s", ErrTenantNotFound, tenantID)
+	}
+	return svc, nil
+}
+
+// TenantIDs 返回已注册的租户ID，按注册顺序
+func (r *TenantRegistry[T]) TenantIDs() []string {
+	return r.ids
+}
+
+// Len 返回已注册的租户数量
+func (r *TenantRegistry[T]) Len() int {
+	return len(r.ids)
+}
+
+// Each 按注册顺序遍历租户服务
+func (r *TenantRegistry[T]) Each(fn func(tenantID string, svc T)) {
+	for _, id := range r.ids {
+		fn(id, r.services[id])
+	}
+}
+
+// NewAlipayServices 为全部租户创建支付宝服务，未配置支付宝的租户跳过
+// 默认租户或任一租户配置错误时返回错误
+func NewAlipayServices(db *gorm.DB, cfg *config.Config, redis *cache.Redis) (*TenantRegistry[*AlipayService], error) {
+	registry := NewTenantRegistry[*AlipayService]()
+	for _, tenant := range cfg.AllTenants() {
+		if tenant.Alipay == nil {
+			continue
+		}
+		svc, err := NewAlipayService(db, tenant.Alipay, redis)
+		if err != nil {
+			return nil, fmt.Errorf("租户 %s: %w", tenant.ID, err)
+		}
+		svc.tenantID = tenant.ID
+		registry.Register(tenant.ID, svc)
+	}
+	return registry, nil
+}
+
+// NewAlipayReconciliationServices 为全部租户创建支付宝对账服务，初始化失败的租户记录告警后跳过
+// 同租户的支付宝服务用于自动修复仅支付宝有的支付差异，Redis 用于多副本对账分布式锁
+func NewAlipayReconciliationServices(db *gorm.DB, cfg *config.Config, alipayServices *TenantRegistry[*AlipayService], redis *cache.Redis, logger *zap.Logger) *TenantRegistry[*AlipayReconciliationService] {
+	registry := NewTenantRegistry[*AlipayReconciliationService]()
+	for _, tenant := range cfg.AllTenants() {
+		if tenant.Alipay == nil {
+			continue
+		}
+		svc, err := NewAlipayReconciliationService(db, tenant.Alipay, logger)
+		if err != nil {
+			logger.Warn("初始化支付宝对账服务失败，该租户对账功能将不可用", zap.String("tenant_id", tenant.ID), zap.Error(err))
+			continue
+		}
+		svc.tenantID = tenant.ID
+		if alipayService, err := alipayServices.Get(tenant.ID); err == nil {
+			svc.SetAlipayService(alipayService)
+		}
+		if redis != nil {
+			svc.SetRedis(redis)
+		}
+		registry.Register(tenant.ID, svc)
+	}
+	return registry
+}
+
+// NewWechatServices 为全部租户创建微信支付服务，初始化失败的租户记录告警后跳过
+func NewWechatServices(db *gorm.DB, cfg *config.Config, logger *zap.Logger) *TenantRegistry[*WechatService] {
+	registry := NewTenantRegistry[*WechatService]()
+	for _, tenant := range cfg.AllTenants() {
+		if tenant.Wechat == nil {
+			continue
+		}
+		svc, err := NewWechatService(db, tenant.Wechat, logger)
+		if err != nil {
+			logger.Warn("初始化微信支付服务失败，该租户微信支付功能将不可用", zap.String("tenant_id", tenant.ID), zap.Error(err))
+			continue
+		}
+		svc.tenantID = tenant.ID
+		registry.Register(tenant.ID, svc)
+	}
+	return registry
+}
+
+// NewWechatReconciliationServices 为已开通微信支付的租户创建对账服务，复用租户微信支付服务的商户凭证
+// redis 可为 nil，此时不加分布式锁
+func NewWechatReconciliationServices(db *gorm.DB, wechatServices *TenantRegistry[*WechatService], redis *cache.Redis, logger *zap.Logger) *TenantRegistry[*WechatReconciliationService] {
+	registry := NewTenantRegistry[*WechatReconciliationService]()
+	wechatServices.Each(func(tenantID string, svc *WechatService) {
+		reconciliationService := NewWechatReconciliationService(svc, db, logger)
+		if redis != nil {
+			reconciliationService.SetRedis(redis)
+		}
+		registry.Register(tenantID, reconciliationService)
+	})
+	return registry
+}
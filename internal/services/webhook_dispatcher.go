@@ -0,0 +1,267 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"pay-gateway/internal/config"
+	"pay-gateway/internal/models"
+)
+
+const (
+	webhookDefaultWorkers      = 4
+	webhookDefaultQueueSize    = 100
+	webhookDefaultPollInterval = 30 * time.Second
+	// 领取后超过该时间仍未完成的事件视为实例崩溃遗留，允许重新领取
+	webhookProcessingTimeout = 10 * time.Minute
+	webhookPollBatchSize     = 100
+)
+
+// webhookRetryStrategy Webhook 处理失败后的重试退避策略
+var webhookRetryStrategy = models.WebhookRetryStrategy{
+	InitialDelay:  time.Minute,
+	MaxDelay:      time.Hour,
+	BackoffFactor: 2,
+	MaxRetries:    3,
+}
+
+// WebhookProcessor Webhook 事件处理函数，失败时调用 event.MarkAsFailed，状态落库由调度器负责
+type WebhookProcessor func(ctx context.Context, event *models.WebhookEvent)
+
+// WebhookDispatcher Webhook 事件调度器
+// 事件先落库再入队，由固定数量的工作协程处理；定期扫描数据库补偿队列溢出、失败重试和崩溃遗留的事件，
+// 启动时立即扫描一次以恢复上次退出前未处理完的事件
+type WebhookDispatcher struct {
+	db           *gorm.DB
+	logger       *zap.Logger
+	workers      int
+	pollInterval time.Duration
+	processor    WebhookProcessor
+
+	queue    chan uint
+	mu       sync.RWMutex
+	closed   bool
+	stopPoll chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewWebhookDispatcher 创建 Webhook 事件调度器
+func NewWebhookDispatcher(db *gorm.DB, cfg *config.GoogleConfig, logger *zap.Logger) *WebhookDispatcher {
+	workers := cfg.WebhookWorkers
+	if workers <= 0 {
+		workers = webhookDefaultWorkers
+	}
+	queueSize := cfg.WebhookQueueSize
+	if queueSize <= 0 {
+		queueSize = webhookDefaultQueueSize
+	}
+	pollInterval := cfg.WebhookPollInterval
+	if pollInterval <= 0 {
+		pollInterval = webhookDefaultPollInterval
+	}
+	return &WebhookDispatcher{
+		db:           db,
+		logger:       logger,
+		workers:      workers,
+		pollInterval: pollInterval,
+		queue:        make(chan uint, queueSize),
+		stopPoll:     make(chan struct{}),
+	}
+}
+
+// SetProcessor 设置事件处理函数，需在 Start 之前调用
+func (d *WebhookDispatcher) SetProcessor(processor WebhookProcessor) {
+	d.processor = processor
+}
+
+// Start 启动工作协程与数据库轮询
+func (d *WebhookDispatcher) Start() {
+	if d.processor == nil {
+		d.logger.Warn("未设置Webhook处理函数，调度器未启动")
+		return
+	}
+
+	for i := 0; i < d.workers; i++ {
+		d.wg.Add(1)
+		go d.runWorker()
+	}
+
+	d.wg.Add(1)
+	go d.runPoller()
+
+	d.logger.Info("Webhook调度器已启动",
+		zap.Int("workers", d.workers),
+		zap.Int("queue_size", cap(d.queue)),
+		zap.Duration("poll_interval", d.pollInterval))
+}
+
+// Enqueue 将已落库的事件加入处理队列，队列已满或已关闭时返回 false，事件由轮询补偿处理
+func (d *WebhookDispatcher) Enqueue(eventID uint) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return false
+	}
+	select {
+	case d.queue <- eventID:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown 停止接收新事件并等待队列中的事件处理完成
+// 超时后直接返回，未处理完的事件保留在数据库中，下次启动时恢复
+func (d *WebhookDispatcher) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	close(d.stopPoll)
+	close(d.queue)
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		d.logger.Info("Webhook调度器已停止")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("等待Webhook事件处理完成超时: %w", ctx.Err())
+	}
+}
+
+// runWorker 工作协程：队列关闭后处理完剩余事件再退出
+func (d *WebhookDispatcher) runWorker() {
+	defer d.wg.Done()
+	for eventID := range d.queue {
+		d.dispatch(eventID)
+	}
+}
+
+// runPoller 轮询协程：启动时立即扫描一次，之后按间隔扫描
+func (d *WebhookDispatcher) runPoller() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+	for {
+		if count := d.pollDueEvents(); count > 0 {
+			d.logger.Info("Webhook轮询补偿入队", zap.Int("count", count))
+		}
+		select {
+		case <-d.stopPoll:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollDueEvents 扫描待处理、到期重试及领取超时的事件并入队，返回入队数量
+func (d *WebhookDispatcher) pollDueEvents() int {
+	now := time.Now()
+	var eventIDs []uint
+	err := d.db.Model(&models.WebhookEvent{}).
+		Where("status = ?", models.WebhookStatusPending).
+		Or("status = ? AND retry_count < max_retries AND next_retry_at <= ?", models.WebhookStatusFailed, now).
+		Or("status = ? AND updated_at < ?", models.WebhookStatusProcessing, now.Add(-webhookProcessingTimeout)).
+		Order("id ASC").
+		Limit(webhookPollBatchSize).
+		Pluck("id", &eventIDs).Error
+	if err != nil {
+		d.logger.Error("扫描待处理Webhook事件失败", zap.Error(err))
+		return 0
+	}
+
+	count := 0
+	for _, eventID := range eventIDs {
+		if !d.Enqueue(eventID) {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+// claim 领取事件：状态条件更新保证同一事件在多实例间只被一个工作协程处理
+func (d *WebhookDispatcher) claim(eventID uint) (*models.WebhookEvent, bool, error) {
+	now := time.Now()
+	result := d.db.Model(&models.WebhookEvent{}).
+		Where("id = ?", eventID).
+		Where(d.db.Where("status = ?", models.WebhookStatusPending).
+			Or("status = ? AND retry_count < max_retries AND next_retry_at <= ?", models.WebhookStatusFailed, now).
+			Or("status = ? AND updated_at < ?", models.WebhookStatusProcessing, now.Add(-webhookProcessingTimeout))).
+		Updates(map[string]interface{}{
+			"status":     models.WebhookStatusProcessing,
+			"updated_at": now,
+		})
+	if result.Error != nil {
+		return nil, false, fmt.Errorf("领取Webhook事件失败: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, false, nil
+	}
+
+	var event models.WebhookEvent
+	if err := d.db.First(&event, eventID).Error; err != nil {
+		return nil, false, fmt.Errorf("加载Webhook事件失败: %w", err)
+	}
+	return &event, true, nil
+}
+
+// dispatch 领取并处理单个事件，处理失败时按退避策略安排重试
+func (d *WebhookDispatcher) dispatch(eventID uint) {
+	event, ok, err := d.claim(eventID)
+	if err != nil {
+		d.logger.Error("领取Webhook事件失败", zap.Uint("id", eventID), zap.Error(err))
+		return
+	}
+	if !ok {
+		return
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				d.logger.Error("处理Webhook事件时发生panic", zap.String("event_id", event.EventID), zap.Any("panic", r))
+				event.MarkAsFailed(fmt.Sprintf("Panic: %v", r))
+			}
+		}()
+		d.processor(context.Background(), event)
+	}()
+
+	if event.Status == models.WebhookStatusFailed {
+		strategy := webhookRetryStrategy
+		strategy.MaxRetries = event.MaxRetries
+		if event.ShouldRetry() {
+			nextRetryAt := event.CalculateNextRetry(strategy)
+			event.NextRetryAt = &nextRetryAt
+		} else {
+			event.NextRetryAt = nil
+		}
+	} else {
+		event.MarkAsProcessed()
+	}
+
+	if err := d.db.Save(event).Error; err != nil {
+		d.logger.Error("更新Webhook事件状态失败", zap.String("event_id", event.EventID), zap.Error(err))
+		return
+	}
+
+	d.logger.Info("Webhook事件处理完成",
+		zap.String("event_id", event.EventID),
+		zap.String("status", string(event.Status)),
+		zap.Int("retry_count", event.RetryCount))
+}
@@ -0,0 +1,383 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"pay-gateway/internal/models"
+)
+
+// ==================== 合单支付功能 ====================
+
+const (
+	combineOutTradeNoPrefix = "CWX"
+	combineMaxSubOrders     = 50
+)
+
+// combineTradeTypePaths 合单交易类型对应的下单接口路径
+var combineTradeTypePaths = map[string]string{
+	"JSAPI":  "jsapi",
+	"NATIVE": "native",
+	"APP":    "app",
+	"MWEB":   "h5",
+}
+
+// getCombineNotifyURL 获取合单支付通知URL
+func (s *WechatService) getCombineNotifyURL() string {
+	if s.config.CombineNotifyURL != "" {
+		return s.config.CombineNotifyURL
+	}
+	// 从 NotifyURL 派生：将 /notify 替换为 /combine-notify，若无则追加 /combine-notify
+	if strings.HasSuffix(s.config.NotifyURL, "/notify") {
+		return strings.TrimSuffix(s.config.NotifyURL, "/notify") + "/combine-notify"
+	}
+	return strings.TrimSuffix(s.config.NotifyURL, "/") + "/combine-notify"
+}
+
+// CreateCombineOrder 创建合单支付：每个子单生成一笔普通订单，一次支付完成全部子单
+func (s *WechatService) CreateCombineOrder(ctx context.Context, req *CreateWechatCombineOrderRequest) (*CreateWechatCombineOrderResponse, error) {
+	if len(req.SubOrders) < 2 || len(req.SubOrders) > combineMaxSubOrders {
+		return nil, fmt.Errorf("合单子单数量须在 2 到 %d 之间", combineMaxSubOrders)
+	}
+	tradePath, ok := combineTradeTypePaths[req.TradeType]
+	if !ok {
+		return nil, fmt.Errorf("不支持的交易类型: %s", req.TradeType)
+	}
+	if req.TradeType == "JSAPI" && req.OpenID == "" {
+		return nil, errors.New("JSAPI 合单支付需要 openid")
+	}
+	if req.TradeType == "MWEB" && req.PayerClientIP == "" {
+		return nil, errors.New("H5 合单支付需要 payer_client_ip")
+	}
+
+	appID, err := s.resolveAppID(req.AppType)
+	if err != nil {
+		return nil, err
+	}
+
+	combineOutTradeNo := fmt.Sprintf("%s%s%s", combineOutTradeNoPrefix, time.Now().Format("20060102150405"), uuid.New().String()[:8])
+	expiredAt := time.Now().Add(30 * time.Minute)
+
+	combineOrder := &models.WechatCombineOrder{
+		TenantID:          s.tenantID,
+		UserID:            req.UserID,
+		CombineOutTradeNo: combineOutTradeNo,
+		CombineAppID:      appID,
+		CombineMchID:      s.config.MchID,
+		TradeType:         req.TradeType,
+		SubOrderCount:     len(req.SubOrders),
+		TradeState:        "NOTPAY",
+	}
+
+	// 开启事务：主单与全部子单一起落库
+	tx := s.db.Begin()
+	orders := make([]*models.Order, 0, len(req.SubOrders))
+	subOrders := make([]wechatCombineSubOrder, 0, len(req.SubOrders))
+	for _, sub := range req.SubOrders {
+		orderNo := generateWechatOrderNo()
+
+		order := &models.Order{
+			OrderNo:       orderNo,
+			TenantID:      s.tenantID,
+			UserID:        req.UserID,
+			ProductID:     sub.ProductID,
+			Type:          models.OrderTypePurchase,
+			Title:         sub.Description,
+			Description:   sub.Detail,
+			Quantity:      1,
+			Currency:      "CNY",
+			TotalAmount:   sub.TotalAmount,
+			Status:        models.OrderStatusCreated,
+			PaymentMethod: models.PaymentMethodWeChat,
+			PaymentStatus: models.PaymentStatusPending,
+			ExpiredAt:     &expiredAt,
+		}
+		if err := tx.Create(order).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("创建订单失败: %v", err)
+		}
+
+		attach := sub.Attach
+		if attach == "" {
+			attach = combineOutTradeNo
+		}
+		wechatPayment := &models.WechatPayment{
+			OrderID:           order.ID,
+			OutTradeNo:        orderNo,
+			TradeType:         req.TradeType,
+			Attach:            attach,
+			AppID:             appID,
+			MchID:             s.config.MchID,
+			CombineOutTradeNo: combineOutTradeNo,
+			Amount:            models.JSON{"total": sub.TotalAmount, "currency": "CNY"},
+		}
+		if err := tx.Create(wechatPayment).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("创建微信支付记录失败: %v", err)
+		}
+
+		transaction := &models.PaymentTransaction{
+			OrderID:       order.ID,
+			TransactionID: orderNo,
+			Provider:      models.PaymentProviderWeChat,
+			Type:          "PAYMENT",
+			Amount:        sub.TotalAmount,
+			Currency:      "CNY",
+			Status:        models.PaymentStatusPending,
+			ProviderData:  models.JSON{},
+		}
+		if err := tx.Create(transaction).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("创建交易记录失败: %v", err)
+		}
+
+		orders = append(orders, order)
+		combineOrder.TotalAmount += sub.TotalAmount
+		subOrders = append(subOrders, wechatCombineSubOrder{
+			MchID:       s.config.MchID,
+			Attach:      attach,
+			Amount:      wechatCombineAmount{TotalAmount: sub.TotalAmount, Currency: "CNY"},
+			OutTradeNo:  orderNo,
+			Description: sub.Description,
+		})
+	}
+
+	if err := tx.Create(combineOrder).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("创建合单记录失败: %v", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("提交事务失败: %v", err)
+	}
+
+	// 调用微信合单下单接口
+	reqBody := wechatCombineReq{
+		CombineAppID:      appID,
+		CombineMchID:      s.config.MchID,
+		CombineOutTradeNo: combineOutTradeNo,
+		SubOrders:         subOrders,
+		TimeExpire:        expiredAt.Format(time.RFC3339),
+		NotifyURL:         s.getCombineNotifyURL(),
+	}
+	if req.OpenID != "" {
+		reqBody.CombinePayerInfo = &wechatPayer{OpenID: req.OpenID}
+	}
+	if req.PayerClientIP != "" {
+		reqBody.SceneInfo = &wechatCombineSceneInfo{PayerClientIP: req.PayerClientIP}
+		if req.TradeType == "MWEB" {
+			reqBody.SceneInfo.H5Info = &wechatH5Info{Type: "Wap", AppName: "PayGateway"}
+		}
+	}
+
+	respBody, _, err := s.wechatAPIRequest(ctx, "POST", "/v3/combine-transactions/"+tradePath, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("调用微信合单下单失败: %w", err)
+	}
+
+	var prepayResp wechatPrepayResp
+	if err := json.Unmarshal(respBody, &prepayResp); err != nil {
+		return nil, fmt.Errorf("解析微信响应失败: %w", err)
+	}
+
+	combineOrder.PrepayID = prepayResp.PrepayID
+	combineOrder.CodeURL = prepayResp.CodeURL
+	combineOrder.H5URL = prepayResp.H5URL
+	if req.OpenID != "" {
+		combineOrder.Payer = models.JSON{"openid": req.OpenID}
+	}
+	if err := s.db.Save(combineOrder).Error; err != nil {
+		s.logger.Error("更新合单记录失败", zap.Error(err))
+	}
+
+	resp := &CreateWechatCombineOrderResponse{
+		CombineOutTradeNo: combineOutTradeNo,
+		TradeType:         req.TradeType,
+		TotalAmount:       combineOrder.TotalAmount,
+		PrepayID:          prepayResp.PrepayID,
+		CodeURL:           prepayResp.CodeURL,
+		H5URL:             prepayResp.H5URL,
+	}
+	for _, order := range orders {
+		resp.SubOrderNos = append(resp.SubOrderNos, order.OrderNo)
+	}
+
+	// JSAPI/APP 需要返回调起支付参数
+	if req.TradeType == "JSAPI" || req.TradeType == "APP" {
+		if prepayResp.PrepayID == "" {
+			return nil, errors.New("微信未返回 prepay_id")
+		}
+		timestamp := fmt.Sprintf("%d", time.Now().Unix())
+		nonceStr := generateNonceStr()
+		packageStr := fmt.Sprintf("prepay_id=%s", prepayResp.PrepayID)
+		paySign, err := s.signPayParams(appID, timestamp, nonceStr, packageStr)
+		if err != nil {
+			return nil, fmt.Errorf("生成签名失败: %w", err)
+		}
+		resp.AppID = appID
+		resp.TimeStamp = timestamp
+		resp.NonceStr = nonceStr
+		resp.Package = packageStr
+		resp.SignType = "RSA"
+		resp.PaySign = paySign
+		if req.TradeType == "APP" {
+			resp.PartnerID = s.config.MchID
+		}
+	}
+
+	s.logger.Info("微信合单支付创建成功",
+		zap.String("combine_out_trade_no", combineOutTradeNo),
+		zap.String("trade_type", req.TradeType),
+		zap.Int("sub_order_count", len(orders)),
+		zap.Int64("total_amount", combineOrder.TotalAmount),
+	)
+
+	// 子单与普通订单一样参与超时取消
+	if s.orderDelayCancelProducer != nil {
+		for _, order := range orders {
+			if err := s.orderDelayCancelProducer.SendOrderTimeoutMessage(ctx, order.OrderNo, order.ID); err != nil {
+				s.logger.Warn("发送订单超时取消延迟消息失败，将由定时任务兜底",
+					zap.String("order_no", order.OrderNo),
+					zap.Error(err))
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+// HandleCombineNotify 处理合单支付通知（已验签解密的业务数据）
+// 每个子单按普通支付通知处理，再汇总更新合单状态
+func (s *WechatService) HandleCombineNotify(ctx context.Context, notifyData map[string]interface{}) error {
+	combineOutTradeNo, _ := notifyData["combine_out_trade_no"].(string)
+	if combineOutTradeNo == "" {
+		return errors.New("缺少合单商户订单号")
+	}
+
+	var combineOrder models.WechatCombineOrder
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("combine_out_trade_no = ?", combineOutTradeNo).First(&combineOrder).Error; err != nil {
+		return fmt.Errorf("合单记录不存在: %v", err)
+	}
+
+	subOrders, _ := notifyData["sub_orders"].([]interface{})
+	if len(subOrders) == 0 {
+		return errors.New("合单通知缺少子单信息")
+	}
+
+	successCount := 0
+	var lastSuccessTime *time.Time
+	for _, item := range subOrders {
+		subOrder, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if err := s.HandleNotify(ctx, subOrder); err != nil {
+			return fmt.Errorf("处理合单子单失败: %w", err)
+		}
+		if tradeState, _ := subOrder["trade_state"].(string); tradeState == "SUCCESS" {
+			successCount++
+			if t := parseWechatNotifyTime(subOrder, "success_time"); t != nil {
+				lastSuccessTime = t
+			}
+		}
+	}
+
+	switch {
+	case successCount == combineOrder.SubOrderCount:
+		combineOrder.TradeState = "SUCCESS"
+	case successCount > 0:
+		combineOrder.TradeState = "PARTIAL"
+	default:
+		combineOrder.TradeState = "CLOSED"
+	}
+	now := time.Now()
+	combineOrder.SuccessTime = lastSuccessTime
+	combineOrder.NotifyTime = &now
+	combineOrder.RawNotifyData = models.JSON(notifyData)
+	if payer, ok := notifyData["combine_payer_info"].(map[string]interface{}); ok {
+		combineOrder.Payer = models.JSON(payer)
+	}
+
+	if err := s.db.Save(&combineOrder).Error; err != nil {
+		return fmt.Errorf("更新合单记录失败: %v", err)
+	}
+
+	s.logger.Info("微信合单支付通知处理成功",
+		zap.String("combine_out_trade_no", combineOutTradeNo),
+		zap.String("trade_state", combineOrder.TradeState),
+		zap.Int("success_count", successCount),
+	)
+
+	return nil
+}
+
+// 合单支付 API 请求结构
+type wechatCombineReq struct {
+	CombineAppID      string                  `json:"combine_appid"`
+	CombineMchID      string                  `json:"combine_mchid"`
+	CombineOutTradeNo string                  `json:"combine_out_trade_no"`
+	SceneInfo         *wechatCombineSceneInfo `json:"scene_info,omitempty"`
+	SubOrders         []wechatCombineSubOrder `json:"sub_orders"`
+	CombinePayerInfo  *wechatPayer            `json:"combine_payer_info,omitempty"`
+	TimeExpire        string                  `json:"time_expire,omitempty"`
+	NotifyURL         string                  `json:"notify_url"`
+}
+type wechatCombineSceneInfo struct {
+	PayerClientIP string        `json:"payer_client_ip"`
+	H5Info        *wechatH5Info `json:"h5_info,omitempty"`
+}
+type wechatCombineSubOrder struct {
+	MchID       string              `json:"mchid"`
+	Attach      string              `json:"attach"`
+	Amount      wechatCombineAmount `json:"amount"`
+	OutTradeNo  string              `json:"out_trade_no"`
+	Description string              `json:"description"`
+}
+type wechatCombineAmount struct {
+	TotalAmount int64  `json:"total_amount"`
+	Currency    string `json:"currency"`
+}
+
+// CreateWechatCombineOrderRequest 创建合单支付请求
+type CreateWechatCombineOrderRequest struct {
+	UserID        uint                          `json:"user_id" binding:"required"`
+	TradeType     string                        `json:"trade_type" binding:"required,oneof=JSAPI NATIVE APP MWEB"`
+	AppType       string                        `json:"app_type"`        // 应用类型（对应 app_ids 的键），为空时使用默认 AppID
+	OpenID        string                        `json:"openid"`          // JSAPI 必填，须属于所选应用
+	PayerClientIP string                        `json:"payer_client_ip"` // MWEB 必填
+	SubOrders     []CreateWechatCombineSubOrder `json:"sub_orders" binding:"required,min=2,dive"`
+}
+
+// CreateWechatCombineSubOrder 合单子单
+type CreateWechatCombineSubOrder struct {
+	ProductID   string `json:"product_id" binding:"required"`
+	Description string `json:"description" binding:"required"`
+	Detail      string `json:"detail"`
+	Attach      string `json:"attach"` // 附加数据，为空时使用合单号
+	TotalAmount int64  `json:"total_amount" binding:"required,min=1"`
+}
+
+// CreateWechatCombineOrderResponse 创建合单支付响应
+type CreateWechatCombineOrderResponse struct {
+	CombineOutTradeNo string   `json:"combine_out_trade_no"`
+	SubOrderNos       []string `json:"sub_order_nos"`
+	TradeType         string   `json:"trade_type"`
+	TotalAmount       int64    `json:"total_amount"`
+	PrepayID          string   `json:"prepay_id,omitempty"`
+	CodeURL           string   `json:"code_url,omitempty"` // NATIVE
+	H5URL             string   `json:"h5_url,omitempty"`   // MWEB
+	AppID             string   `json:"app_id,omitempty"`   // JSAPI/APP 调起支付参数
+	PartnerID         string   `json:"partner_id,omitempty"`
+	TimeStamp         string   `json:"time_stamp,omitempty"`
+	NonceStr          string   `json:"nonce_str,omitempty"`
+	Package           string   `json:"package,omitempty"`
+	SignType          string   `json:"sign_type,omitempty"`
+	PaySign           string   `json:"pay_sign,omitempty"`
+}
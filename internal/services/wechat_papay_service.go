@@ -0,0 +1,527 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"pay-gateway/internal/models"
+)
+
+// ==================== 委托代扣（papay）功能 ====================
+
+const (
+	papayOutContractCodePrefix = "PAP"
+	papayTradeType             = "PAP"
+	papayTradeStateUnknown     = "UNKNOWN" // 扣款申请结果未知且查询失败
+
+	papayContractStatusTemp       = "TEMP"
+	papayContractStatusAdded      = "ADDED"
+	papayContractStatusTerminated = "TERMINATED"
+)
+
+// papaySignTypePaths 签约方式对应的预签约接口路径
+var papaySignTypePaths = map[string]string{
+	"APP":         "app",
+	"JSAPI":       "jsapi",
+	"H5":          "h5",
+	"MINIPROGRAM": "mini-program",
+}
+
+// getPapayNotifyURL 获取委托代扣签约/解约通知URL
+func (s *WechatService) getPapayNotifyURL() string {
+	if s.config.PapayNotifyURL != "" {
+		return s.config.PapayNotifyURL
+	}
+	// 从 NotifyURL 派生：将 /notify 替换为 /papay，若无则追加 /papay
+	if strings.HasSuffix(s.config.NotifyURL, "/notify") {
+		return strings.TrimSuffix(s.config.NotifyURL, "/notify") + "/papay"
+	}
+	return strings.TrimSuffix(s.config.NotifyURL, "/") + "/papay"
+}
+
+// CreatePapayContract 发起委托代扣签约，返回客户端拉起签约页所需参数
+func (s *WechatService) CreatePapayContract(ctx context.Context, req *CreateWechatPapayContractRequest) (*CreateWechatPapayContractResponse, error) {
+	planID := req.PlanID
+	if planID == "" {
+		planID = s.config.PapayPlanID
+	}
+	if planID == "" {
+		return nil, errors.New("未配置委托代扣模板ID")
+	}
+
+	signPath, ok := papaySignTypePaths[req.SignType]
+	if !ok {
+		return nil, fmt.Errorf("不支持的签约方式: %s", req.SignType)
+	}
+	if (req.SignType == "JSAPI" || req.SignType == "MINIPROGRAM") && req.OpenID == "" {
+		return nil, errors.New("JSAPI/小程序签约需要 openid")
+	}
+
+	outContractCode := fmt.Sprintf("%s%s%s", papayOutContractCodePrefix, time.Now().Format("20060102150405"), uuid.New().String()[:8])
+
+	contract := &models.WechatPapayContract{
+		TenantID:               s.tenantID,
+		UserID:                 req.UserID,
+		PlanID:                 planID,
+		OutContractCode:        outContractCode,
+		ContractDisplayAccount: req.ContractDisplayAccount,
+		SignType:               req.SignType,
+		OpenID:                 req.OpenID,
+		Status:                 papayContractStatusTemp,
+		AppID:                  s.config.AppID,
+		MchID:                  s.config.MchID,
+	}
+	if err := s.db.Create(contract).Error; err != nil {
+		return nil, fmt.Errorf("创建委托代扣签约记录失败: %v", err)
+	}
+
+	preSignReq := wechatPapayPreSignReq{
+		AppID:                  s.config.AppID,
+		MchID:                  s.config.MchID,
+		PlanID:                 planID,
+		OutContractCode:        outContractCode,
+		ContractDisplayAccount: req.ContractDisplayAccount,
+		NotifyURL:              s.getPapayNotifyURL(),
+		OpenID:                 req.OpenID,
+	}
+
+	respBody, _, err := s.wechatAPIRequest(ctx, "POST", "/v3/papay/sign/contracts/pre-entrust-sign/"+signPath, preSignReq)
+	if err != nil {
+		return nil, fmt.Errorf("微信预签约失败: %w", err)
+	}
+
+	var preSignResp wechatPapayPreSignResp
+	if err := json.Unmarshal(respBody, &preSignResp); err != nil {
+		return nil, fmt.Errorf("解析预签约响应失败: %w", err)
+	}
+
+	s.logger.Info("微信委托代扣预签约成功",
+		zap.Uint("user_id", req.UserID),
+		zap.String("out_contract_code", outContractCode),
+		zap.String("sign_type", req.SignType),
+	)
+
+	return &CreateWechatPapayContractResponse{
+		OutContractCode: outContractCode,
+		PlanID:          planID,
+		SignType:        req.SignType,
+		PreEntrustwebID: preSignResp.PreEntrustwebID,
+		RedirectURL:     preSignResp.RedirectURL,
+		Status:          papayContractStatusTemp,
+	}, nil
+}
+
+// HandlePapayContractNotify 处理委托代扣签约/解约通知（已验签解密的业务数据）
+func (s *WechatService) HandlePapayContractNotify(ctx context.Context, notifyData map[string]interface{}) error {
+	outContractCode, _ := notifyData["out_contract_code"].(string)
+	contractState, _ := notifyData["contract_state"].(string)
+	if outContractCode == "" {
+		return errors.New("缺少商户签约协议号")
+	}
+
+	var contract models.WechatPapayContract
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("out_contract_code = ?", outContractCode).First(&contract).Error; err != nil {
+		return fmt.Errorf("委托代扣签约记录不存在: %v", err)
+	}
+
+	if contractID, ok := notifyData["contract_id"].(string); ok && contractID != "" {
+		contract.ContractID = contractID
+	}
+	if openID, ok := notifyData["openid"].(string); ok && openID != "" {
+		contract.OpenID = openID
+	}
+
+	switch contractState {
+	case papayContractStatusAdded:
+		contract.Status = papayContractStatusAdded
+		contract.SignedTime = parseWechatNotifyTime(notifyData, "contract_signed_time")
+		contract.ExpiredTime = parseWechatNotifyTime(notifyData, "contract_expired_time")
+	case papayContractStatusTerminated:
+		contract.Status = papayContractStatusTerminated
+		contract.TerminatedTime = parseWechatNotifyTime(notifyData, "contract_terminated_time")
+		if contract.TerminatedTime == nil {
+			now := time.Now()
+			contract.TerminatedTime = &now
+		}
+		if mode, ok := notifyData["contract_termination_mode"].(string); ok {
+			contract.TerminationMode = mode
+		}
+	default:
+		return fmt.Errorf("未知的签约状态: %s", contractState)
+	}
+	contract.RawNotifyData = models.JSON(notifyData)
+
+	if err := s.db.Save(&contract).Error; err != nil {
+		return fmt.Errorf("更新委托代扣签约记录失败: %v", err)
+	}
+
+	s.logger.Info("微信委托代扣签约通知处理成功",
+		zap.String("out_contract_code", outContractCode),
+		zap.String("contract_id", contract.ContractID),
+		zap.String("contract_state", contractState),
+	)
+
+	return nil
+}
+
+// QueryPapayContract 查询委托代扣签约状态，以微信侧协议状态为准同步本地记录
+func (s *WechatService) QueryPapayContract(ctx context.Context, outContractCode string) (*QueryWechatPapayContractResponse, error) {
+	var contract models.WechatPapayContract
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("out_contract_code = ?", outContractCode).First(&contract).Error; err != nil {
+		return nil, fmt.Errorf("委托代扣签约记录不存在: %v", err)
+	}
+
+	urlPath := fmt.Sprintf("/v3/papay/sign/contracts/plan-id/%s/out-contract-code/%s?appid=%s",
+		url.PathEscape(contract.PlanID), url.PathEscape(contract.OutContractCode), url.QueryEscape(contract.AppID))
+	respBody, _, err := s.wechatAPIRequest(ctx, "GET", urlPath, nil)
+	if err != nil {
+		// 查询失败时返回本地记录
+		s.logger.Warn("查询微信委托代扣协议失败", zap.String("out_contract_code", outContractCode), zap.Error(err))
+	} else {
+		var queryResp wechatPapayContractResp
+		if err := json.Unmarshal(respBody, &queryResp); err == nil && queryResp.ContractState != "" {
+			contract.Status = queryResp.ContractState
+			if queryResp.ContractID != "" {
+				contract.ContractID = queryResp.ContractID
+			}
+			if t, err := time.Parse(time.RFC3339, queryResp.ContractSignedTime); err == nil {
+				contract.SignedTime = &t
+			}
+			if t, err := time.Parse(time.RFC3339, queryResp.ContractExpiredTime); err == nil {
+				contract.ExpiredTime = &t
+			}
+			if t, err := time.Parse(time.RFC3339, queryResp.ContractTerminatedTime); err == nil {
+				contract.TerminatedTime = &t
+			}
+			if err := s.db.Save(&contract).Error; err != nil {
+				return nil, fmt.Errorf("更新委托代扣签约记录失败: %v", err)
+			}
+		}
+	}
+
+	return buildPapayContractResponse(&contract), nil
+}
+
+// TerminatePapayContract 商户主动解约委托代扣协议
+func (s *WechatService) TerminatePapayContract(ctx context.Context, req *TerminateWechatPapayContractRequest) error {
+	var contract models.WechatPapayContract
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("out_contract_code = ?", req.OutContractCode).First(&contract).Error; err != nil {
+		return fmt.Errorf("委托代扣签约记录不存在: %v", err)
+	}
+	if contract.Status != papayContractStatusAdded {
+		return fmt.Errorf("协议状态不允许解约: %s", contract.Status)
+	}
+
+	urlPath := fmt.Sprintf("/v3/papay/sign/contracts/plan-id/%s/out-contract-code/%s/terminate",
+		url.PathEscape(contract.PlanID), url.PathEscape(contract.OutContractCode))
+	terminateReq := wechatPapayTerminateReq{
+		AppID:                     contract.AppID,
+		ContractTerminationRemark: req.Remark,
+	}
+	if _, _, err := s.wechatAPIRequest(ctx, "POST", urlPath, terminateReq); err != nil {
+		return fmt.Errorf("微信解约失败: %w", err)
+	}
+
+	now := time.Now()
+	contract.Status = papayContractStatusTerminated
+	contract.TerminatedTime = &now
+	contract.TerminationMode = "MCH_API"
+	contract.ContractTerminateRemark = req.Remark
+	if err := s.db.Save(&contract).Error; err != nil {
+		return fmt.Errorf("更新委托代扣签约记录失败: %v", err)
+	}
+
+	s.logger.Info("微信委托代扣解约成功",
+		zap.String("out_contract_code", contract.OutContractCode),
+		zap.String("contract_id", contract.ContractID),
+	)
+
+	return nil
+}
+
+// ExecutePapayDeduct 基于已签约协议申请扣款
+// 微信受理后异步扣款，结果通过支付通知（NotifyURL）回调，由 HandleNotify 按 out_trade_no 更新订单
+func (s *WechatService) ExecutePapayDeduct(ctx context.Context, req *ExecuteWechatPapayDeductRequest) (*ExecuteWechatPapayDeductResponse, error) {
+	var contract models.WechatPapayContract
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("contract_id = ? AND user_id = ? AND status = ?", req.ContractID, req.UserID, papayContractStatusAdded).First(&contract).Error; err != nil {
+		return nil, fmt.Errorf("委托代扣协议不存在或已失效: %v", err)
+	}
+
+	orderNo := generateWechatOrderNo()
+
+	order := &models.Order{
+		OrderNo:       orderNo,
+		TenantID:      s.tenantID,
+		UserID:        req.UserID,
+		ProductID:     req.ProductID,
+		Type:          models.OrderTypeSubscription,
+		Title:         req.Description,
+		Description:   req.Detail,
+		Quantity:      1,
+		Currency:      "CNY",
+		TotalAmount:   req.TotalAmount,
+		Status:        models.OrderStatusCreated,
+		PaymentMethod: models.PaymentMethodWeChat,
+		PaymentStatus: models.PaymentStatusPending,
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Create(order).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("创建订单失败: %v", err)
+	}
+
+	wechatPayment := &models.WechatPayment{
+		OrderID:    order.ID,
+		OutTradeNo: orderNo,
+		TradeType:  papayTradeType,
+		AppID:      contract.AppID,
+		MchID:      contract.MchID,
+		ContractID: contract.ContractID,
+	}
+	if err := tx.Create(wechatPayment).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("创建微信支付记录失败: %v", err)
+	}
+
+	transaction := &models.PaymentTransaction{
+		OrderID:       order.ID,
+		TransactionID: orderNo,
+		Provider:      models.PaymentProviderWeChat,
+		Type:          "PAYMENT",
+		Amount:        req.TotalAmount,
+		Currency:      "CNY",
+		Status:        models.PaymentStatusPending,
+		ProviderData:  models.JSON{},
+	}
+	if err := tx.Create(transaction).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("创建交易记录失败: %v", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("提交事务失败: %v", err)
+	}
+
+	applyReq := wechatPapayApplyReq{
+		AppID:       contract.AppID,
+		MchID:       contract.MchID,
+		Description: req.Description,
+		OutTradeNo:  orderNo,
+		NotifyURL:   s.config.NotifyURL,
+		ContractID:  contract.ContractID,
+		Amount: wechatAmount{
+			Total:    req.TotalAmount,
+			Currency: "CNY",
+		},
+	}
+	response := &ExecuteWechatPapayDeductResponse{
+		OrderNo:     orderNo,
+		ContractID:  contract.ContractID,
+		TotalAmount: req.TotalAmount,
+		TradeState:  "ACCEPT",
+	}
+
+	respBody, statusCode, err := s.wechatAPIRequest(ctx, "POST", "/v3/papay/pay/transactions/apply", applyReq)
+	if err != nil {
+		if papayApplyRejected(statusCode, respBody) {
+			// 微信明确拒绝受理（参数、协议、余额等业务错误），订单置为失败
+			errMsg := err.Error()
+			if dbErr := s.db.Model(order).Update("payment_status", models.PaymentStatusFailed).Error; dbErr != nil {
+				s.logger.Error("更新订单状态失败", zap.String("order_no", orderNo), zap.Error(dbErr))
+			}
+			if dbErr := s.db.Model(transaction).Updates(map[string]interface{}{
+				"status":        models.PaymentStatusFailed,
+				"error_message": errMsg,
+			}).Error; dbErr != nil {
+				s.logger.Error("更新交易记录失败", zap.String("order_no", orderNo), zap.Error(dbErr))
+			}
+			return nil, fmt.Errorf("申请扣款失败: %w", err)
+		}
+
+		// 超时或 5xx 时微信可能已受理，订单保持待支付，查询交易后再判断，避免重试导致重复扣款
+		s.logger.Warn("微信委托代扣扣款结果未知，查询交易状态",
+			zap.String("order_no", orderNo),
+			zap.Int("status", statusCode),
+			zap.Error(err))
+		response.TradeState = s.syncPapayTradeState(ctx, orderNo, contract.MchID)
+		return response, nil
+	}
+
+	s.logger.Info("微信委托代扣扣款申请已受理",
+		zap.String("order_no", orderNo),
+		zap.String("contract_id", contract.ContractID),
+		zap.Int64("total_amount", req.TotalAmount),
+	)
+
+	return response, nil
+}
+
+// papayApplyRejected 判断扣款申请是否被微信明确拒绝
+// 仅 4xx 业务错误视为失败；超时、5xx、系统错误及订单号已使用（可能已受理）均视为结果未知
+func papayApplyRejected(statusCode int, respBody []byte) bool {
+	if statusCode < 400 || statusCode >= 500 {
+		return false
+	}
+	var errResp struct {
+		Code string `json:"code"`
+	}
+	_ = json.Unmarshal(respBody, &errResp)
+	switch errResp.Code {
+	case "SYSTEM_ERROR", "OUT_TRADE_NO_USED", "ORDER_PAID":
+		return false
+	}
+	return true
+}
+
+// syncPapayTradeState 查询扣款交易状态并按支付通知的逻辑更新本地订单
+// 返回：交易状态，查询失败或交易不存在时返回 UNKNOWN，订单保持待支付，等待支付通知
+func (s *WechatService) syncPapayTradeState(ctx context.Context, orderNo, mchID string) string {
+	urlPath := fmt.Sprintf("/v3/pay/transactions/out-trade-no/%s?mchid=%s", url.PathEscape(orderNo), url.QueryEscape(mchID))
+	respBody, _, err := s.wechatAPIRequest(ctx, "GET", urlPath, nil)
+	if err != nil {
+		s.logger.Warn("查询微信委托代扣交易失败", zap.String("order_no", orderNo), zap.Error(err))
+		return papayTradeStateUnknown
+	}
+
+	var tradeData map[string]interface{}
+	if err := json.Unmarshal(respBody, &tradeData); err != nil {
+		s.logger.Warn("解析微信委托代扣交易失败", zap.String("order_no", orderNo), zap.Error(err))
+		return papayTradeStateUnknown
+	}
+	tradeState, _ := tradeData["trade_state"].(string)
+	if tradeState == "" {
+		return papayTradeStateUnknown
+	}
+	if err := s.HandleNotify(ctx, tradeData); err != nil {
+		s.logger.Error("同步微信委托代扣交易状态失败", zap.String("order_no", orderNo), zap.Error(err))
+	}
+	return tradeState
+}
+
+// buildPapayContractResponse 构建委托代扣签约查询响应
+func buildPapayContractResponse(contract *models.WechatPapayContract) *QueryWechatPapayContractResponse {
+	return &QueryWechatPapayContractResponse{
+		OutContractCode: contract.OutContractCode,
+		ContractID:      contract.ContractID,
+		PlanID:          contract.PlanID,
+		Status:          contract.Status,
+		SignedTime:      contract.SignedTime,
+		ExpiredTime:     contract.ExpiredTime,
+		TerminatedTime:  contract.TerminatedTime,
+	}
+}
+
+// parseWechatNotifyTime 解析通知中的 RFC3339 时间字段
+func parseWechatNotifyTime(notifyData map[string]interface{}, key string) *time.Time {
+	value, ok := notifyData[key].(string)
+	if !ok || value == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// 委托代扣 API 请求/响应结构
+type wechatPapayPreSignReq struct {
+	AppID                  string `json:"appid"`
+	MchID                  string `json:"mchid"`
+	PlanID                 string `json:"plan_id"`
+	OutContractCode        string `json:"out_contract_code"`
+	ContractDisplayAccount string `json:"contract_display_account"`
+	NotifyURL              string `json:"notify_url"`
+	OpenID                 string `json:"openid,omitempty"`
+}
+
+type wechatPapayPreSignResp struct {
+	PreEntrustwebID string `json:"pre_entrustweb_id"`
+	RedirectURL     string `json:"redirect_url"`
+}
+
+type wechatPapayContractResp struct {
+	ContractID             string `json:"contract_id"`
+	ContractState          string `json:"contract_state"`
+	ContractSignedTime     string `json:"contract_signed_time"`
+	ContractExpiredTime    string `json:"contract_expired_time"`
+	ContractTerminatedTime string `json:"contract_terminated_time"`
+}
+
+type wechatPapayTerminateReq struct {
+	AppID                     string `json:"appid"`
+	ContractTerminationRemark string `json:"contract_termination_remark"`
+}
+
+type wechatPapayApplyReq struct {
+	AppID       string       `json:"appid"`
+	MchID       string       `json:"mchid"`
+	Description string       `json:"description"`
+	OutTradeNo  string       `json:"out_trade_no"`
+	NotifyURL   string       `json:"notify_url"`
+	ContractID  string       `json:"contract_id"`
+	Amount      wechatAmount `json:"amount"`
+}
+
+// CreateWechatPapayContractRequest 发起委托代扣签约请求
+type CreateWechatPapayContractRequest struct {
+	UserID                 uint   `json:"user_id" binding:"required"`
+	PlanID                 string `json:"plan_id"` // 为空时使用配置的 papay_plan_id
+	SignType               string `json:"sign_type" binding:"required,oneof=APP JSAPI H5 MINIPROGRAM"`
+	OpenID                 string `json:"openid"` // JSAPI/小程序签约必填
+	ContractDisplayAccount string `json:"contract_display_account" binding:"required"`
+}
+
+// CreateWechatPapayContractResponse 发起委托代扣签约响应
+type CreateWechatPapayContractResponse struct {
+	OutContractCode string `json:"out_contract_code"`
+	PlanID          string `json:"plan_id"`
+	SignType        string `json:"sign_type"`
+	PreEntrustwebID string `json:"pre_entrustweb_id,omitempty"` // APP/JSAPI/小程序拉起签约页使用
+	RedirectURL     string `json:"redirect_url,omitempty"`      // H5 签约跳转链接
+	Status          string `json:"status"`
+}
+
+// QueryWechatPapayContractResponse 查询委托代扣签约响应
+type QueryWechatPapayContractResponse struct {
+	OutContractCode string     `json:"out_contract_code"`
+	ContractID      string     `json:"contract_id"`
+	PlanID          string     `json:"plan_id"`
+	Status          string     `json:"status"`
+	SignedTime      *time.Time `json:"signed_time,omitempty"`
+	ExpiredTime     *time.Time `json:"expired_time,omitempty"`
+	TerminatedTime  *time.Time `json:"terminated_time,omitempty"`
+}
+
+// TerminateWechatPapayContractRequest 委托代扣解约请求
+type TerminateWechatPapayContractRequest struct {
+	OutContractCode string `json:"-"`
+	Remark          string `json:"remark" binding:"required"`
+}
+
+// ExecuteWechatPapayDeductRequest 委托代扣扣款请求
+type ExecuteWechatPapayDeductRequest struct {
+	UserID      uint   `json:"user_id" binding:"required"`
+	ContractID  string `json:"contract_id" binding:"required"`
+	ProductID   string `json:"product_id" binding:"required"`
+	Description string `json:"description" binding:"required"`
+	Detail      string `json:"detail"`
+	TotalAmount int64  `json:"total_amount" binding:"required,min=1"`
+}
+
+// ExecuteWechatPapayDeductResponse 委托代扣扣款响应
+type ExecuteWechatPapayDeductResponse struct {
+	OrderNo     string `json:"order_no"`
+	ContractID  string `json:"contract_id"`
+	TotalAmount int64  `json:"total_amount"`
+	TradeState  string `json:"trade_state"` // ACCEPT-已受理，UNKNOWN-结果未知（勿重试），其他为查询到的交易状态；最终结果以支付通知为准
+}
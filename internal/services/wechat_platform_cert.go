@@ -0,0 +1,257 @@
+package services
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ==================== 平台证书 / 微信支付公钥 ====================
+
+const (
+	wechatPublicKeyIDPrefix = "PUB_KEY_ID_"
+	// 遇到未知序列号时按需刷新证书的最小间隔，防止伪造序列号触发频繁请求
+	platformCertMinRefreshInterval = time.Minute
+)
+
+// wechatPlatformKeys 回调验签公钥集合
+// 平台证书模式按证书序列号缓存公钥（支持新旧证书并存）；公钥模式按公钥ID选择
+type wechatPlatformKeys struct {
+	mu          sync.RWMutex
+	staticCerts map[string]*rsa.PublicKey // 本地配置的平台证书（platform_cert_path）
+	certs       map[string]*rsa.PublicKey // 从 /v3/certificates 下载的平台证书，证书序列号 -> 公钥
+	publicKeyID string                    // 微信支付公钥ID（PUB_KEY_ID_ 开头）
+	publicKey   *rsa.PublicKey            // 微信支付公钥
+	lastRefresh time.Time                 // 最近一次下载平台证书时间
+}
+
+// wechatCertificatesResp /v3/certificates 响应
+type wechatCertificatesResp struct {
+	Data []struct {
+		SerialNo           string               `json:"serial_no"`
+		EffectiveTime      string               `json:"effective_time"`
+		ExpireTime         string               `json:"expire_time"`
+		EncryptCertificate WechatNotifyResource `json:"encrypt_certificate"`
+	} `json:"data"`
+}
+
+// initPlatformKeys 加载本地配置的平台证书与微信支付公钥
+func (s *WechatService) initPlatformKeys() error {
+	s.platformKeys = &wechatPlatformKeys{
+		staticCerts: make(map[string]*rsa.PublicKey),
+		certs:       make(map[string]*rsa.PublicKey),
+	}
+
+	if s.config.PlatformCertPath != "" {
+		certPEM, err := os.ReadFile(s.config.PlatformCertPath)
+		if err != nil {
+			return fmt.Errorf("读取平台证书失败: %w", err)
+		}
+		serial, pubKey, err := parseWechatPlatformCert(certPEM)
+		if err != nil {
+			return err
+		}
+		s.platformKeys.staticCerts[wechatSerialKey(serial)] = pubKey
+	}
+
+	publicKeyStr := s.config.PublicKey
+	if publicKeyStr == "" && s.config.PublicKeyPath != "" {
+		keyContent, err := os.ReadFile(s.config.PublicKeyPath)
+		if err != nil {
+			return fmt.Errorf("读取微信支付公钥文件失败: %w", err)
+		}
+		publicKeyStr = string(keyContent)
+	}
+	if publicKeyStr != "" {
+		if s.config.PublicKeyID == "" {
+			return errors.New("配置了微信支付公钥但未配置 public_key_id")
+		}
+		pubKey, err := parseWechatPublicKey(publicKeyStr)
+		if err != nil {
+			return fmt.Errorf("解析微信支付公钥失败: %w", err)
+		}
+		s.platformKeys.publicKeyID = s.config.PublicKeyID
+		s.platformKeys.publicKey = pubKey
+	}
+
+	return nil
+}
+
+// hasPlatformKeySource 是否配置了任一验签公钥来源
+func (s *WechatService) hasPlatformKeySource() bool {
+	return s.config.PlatformCertPath != "" || s.platformKeys.publicKey != nil || s.config.PlatformCertAutoRefresh
+}
+
+// RefreshPlatformCertificates 从 /v3/certificates 下载平台证书，使用 APIv3Key 解密后按序列号缓存
+// 证书密文只有持有 APIv3Key 的商户能解开（AEAD 校验），可据此确认证书来自微信支付
+func (s *WechatService) RefreshPlatformCertificates(ctx context.Context) error {
+	respBody, _, err := s.wechatAPIRequest(ctx, "GET", "/v3/certificates", nil)
+	if err != nil {
+		return fmt.Errorf("下载平台证书失败: %w", err)
+	}
+
+	var certsResp wechatCertificatesResp
+	if err := json.Unmarshal(respBody, &certsResp); err != nil {
+		return fmt.Errorf("解析平台证书响应失败: %w", err)
+	}
+	if len(certsResp.Data) == 0 {
+		return errors.New("微信未返回平台证书")
+	}
+
+	certs := make(map[string]*rsa.PublicKey, len(certsResp.Data))
+	now := time.Now()
+	for _, item := range certsResp.Data {
+		if expireTime, err := time.Parse(time.RFC3339, item.ExpireTime); err == nil && expireTime.Before(now) {
+			continue
+		}
+		certPEM, err := s.decryptWechatResource(item.EncryptCertificate)
+		if err != nil {
+			return fmt.Errorf("解密平台证书失败: %w", err)
+		}
+		serial, pubKey, err := parseWechatPlatformCert(certPEM)
+		if err != nil {
+			return err
+		}
+		// 按数值比较序列号，证书 SerialNumber 转十六进制会丢失前导零
+		itemSerial, ok := parseWechatSerial(item.SerialNo)
+		if !ok || itemSerial.Cmp(serial) != 0 {
+			return fmt.Errorf("平台证书序列号不一致: %s != %s", wechatSerialKey(serial), item.SerialNo)
+		}
+		certs[wechatSerialKey(serial)] = pubKey
+	}
+
+	// 整体替换为最新证书集合，微信在证书切换期间会同时返回新旧证书
+	keys := s.platformKeys
+	keys.mu.Lock()
+	keys.certs = certs
+	keys.lastRefresh = now
+	keys.mu.Unlock()
+
+	serials := make([]string, 0, len(certs))
+	for serialNo := range certs {
+		serials = append(serials, serialNo)
+	}
+	s.logger.Info("微信平台证书已更新", zap.Strings("serial_nos", serials))
+	return nil
+}
+
+// platformPublicKey 按 Wechatpay-Serial 选择验签公钥
+// PUB_KEY_ID_ 开头为公钥模式；否则按平台证书序列号查找，未命中且开启自动下载时刷新一次证书
+func (s *WechatService) platformPublicKey(ctx context.Context, serial string) (*rsa.PublicKey, error) {
+	keys := s.platformKeys
+	if strings.HasPrefix(serial, wechatPublicKeyIDPrefix) {
+		if keys.publicKey == nil || keys.publicKeyID != serial {
+			return nil, fmt.Errorf("未配置微信支付公钥: %s", serial)
+		}
+		return keys.publicKey, nil
+	}
+
+	if serial == "" {
+		return nil, errors.New("缺少 Wechatpay-Serial 请求头")
+	}
+
+	if pubKey, ok := keys.lookupCert(serial); ok {
+		return pubKey, nil
+	}
+
+	if !s.config.PlatformCertAutoRefresh || !keys.tryAcquireRefresh() {
+		return nil, fmt.Errorf("未找到平台证书: %s", serial)
+	}
+	if err := s.RefreshPlatformCertificates(ctx); err != nil {
+		return nil, err
+	}
+
+	if pubKey, ok := keys.lookupCert(serial); ok {
+		return pubKey, nil
+	}
+	return nil, fmt.Errorf("未找到平台证书: %s", serial)
+}
+
+// tryAcquireRefresh 限制按需刷新频率，距上次刷新不足最小间隔时返回 false
+func (k *wechatPlatformKeys) tryAcquireRefresh() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if time.Since(k.lastRefresh) < platformCertMinRefreshInterval {
+		return false
+	}
+	k.lastRefresh = time.Now()
+	return true
+}
+
+// lookupCert 按序列号查找平台证书公钥，优先使用下载的证书
+// 请求头序列号可能带前导零，先规整为与缓存一致的键
+func (k *wechatPlatformKeys) lookupCert(serialNo string) (*rsa.PublicKey, bool) {
+	parsed, ok := parseWechatSerial(serialNo)
+	if !ok {
+		return nil, false
+	}
+	serial := wechatSerialKey(parsed)
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if pubKey, ok := k.certs[serial]; ok {
+		return pubKey, true
+	}
+	pubKey, ok := k.staticCerts[serial]
+	return pubKey, ok
+}
+
+// parseWechatSerial 解析十六进制证书序列号（大小写、前导零不敏感）
+func parseWechatSerial(serialNo string) (*big.Int, bool) {
+	return new(big.Int).SetString(serialNo, 16)
+}
+
+// wechatSerialKey 证书序列号的缓存键：无前导零的大写十六进制
+func wechatSerialKey(serial *big.Int) string {
+	return strings.ToUpper(serial.Text(16))
+}
+
+// parseWechatPlatformCert 解析平台证书 PEM，返回证书序列号与 RSA 公钥
+func parseWechatPlatformCert(certPEM []byte) (*big.Int, *rsa.PublicKey, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, nil, errors.New("解析平台证书失败")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("解析证书失败: %w", err)
+	}
+
+	pubKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, nil, errors.New("平台证书非RSA公钥")
+	}
+
+	return cert.SerialNumber, pubKey, nil
+}
+
+// parseWechatPublicKey 解析微信支付公钥（PKIX PEM）
+func parseWechatPublicKey(publicKeyStr string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyStr))
+	if block == nil {
+		return nil, errors.New("无法解析公钥")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("不是RSA公钥")
+	}
+	return pubKey, nil
+}
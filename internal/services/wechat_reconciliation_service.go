@@ -0,0 +1,743 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"pay-gateway/internal/cache"
+	"pay-gateway/internal/models"
+)
+
+// 微信支付账单类型
+const (
+	WechatBillTypeTrade    = "tradebill"    // 交易账单
+	WechatBillTypeFundFlow = "fundflowbill" // 资金账单（基本账户）
+)
+
+// WechatReconciliationBillTypes 每日对账需要核对的账单类型
+var WechatReconciliationBillTypes = []string{WechatBillTypeTrade, WechatBillTypeFundFlow}
+
+// wechatNoStatementCode 账单日无交易时申请账单返回的错误码
+const wechatNoStatementCode = "NO_STATEMENT_EXIST"
+
+// lockKeyPrefixWechatReconciliation 微信支付对账分布式锁前缀，按租户、账单日、账单类型加锁
+const lockKeyPrefixWechatReconciliation = "wechat:reconciliation:lock:"
+
+// WechatReconciliationService 微信支付对账服务，复用租户微信支付服务的商户号与请求签名
+type WechatReconciliationService struct {
+	wechat   *WechatService
+	db       *gorm.DB
+	redis    *cache.Redis // 分布式锁，多副本部署时避免同一账单并发对账（可选）
+	logger   *zap.Logger
+	tenantID string // 所属租户，对账报告与本地订单按租户隔离
+}
+
+// NewWechatReconciliationService 创建微信支付对账服务
+func NewWechatReconciliationService(wechatService *WechatService, db *gorm.DB, logger *zap.Logger) *WechatReconciliationService {
+	return &WechatReconciliationService{
+		wechat:   wechatService,
+		db:       db,
+		logger:   logger,
+		tenantID: wechatService.tenantID,
+	}
+}
+
+// SetRedis 设置 Redis，用于多副本部署时的对账分布式锁
+func (s *WechatReconciliationService) SetRedis(redis *cache.Redis) {
+	s.redis = redis
+}
+
+// WechatBillRecord 微信支付账单中的单笔记录
+type WechatBillRecord struct {
+	Kind          string     // 记录类型：payment-支付 refund-退款
+	OutTradeNo    string     // 商户订单号
+	TransactionID string     // 微信支付订单号（资金账单为微信支付业务单号）
+	OutRefundNo   string     // 商户退款单号
+	RefundID      string     // 微信退款单号
+	Status        string     // 交易状态（交易账单）或业务类型（资金账单）
+	Amount        string     // 核对金额（元）
+	BillTime      *time.Time // 交易时间或记账时间
+}
+
+// wechatBillResp 申请交易账单/资金账单的响应
+type wechatBillResp struct {
+	HashType    string `json:"hash_type"`
+	HashValue   string `json:"hash_value"`
+	DownloadURL string `json:"download_url"`
+}
+
+// wechatLocalEntry 参与对账的本地支付或退款记录
+type wechatLocalEntry struct {
+	Kind          string
+	OutTradeNo    string
+	TransactionID string
+	OutRefundNo   string
+	RefundID      string
+	AmountFen     int64
+	Status        string
+	matched       bool
+}
+
+// RunReconciliation 执行微信支付对账
+// 参数：
+//   - ctx: 上下文
+//   - billDate: 对账日期 yyyy-MM-dd（北京时间），微信支付次日 10 点后生成前一日账单
+//   - billType: 账单类型 tradebill/fundflowbill，为空时使用交易账单
+//
+// 返回：对账报告或错误；同一账单正在其他实例对账时返回 ErrReconciliationInProgress
+func (s *WechatReconciliationService) RunReconciliation(ctx context.Context, billDate, billType string) (*models.WechatReconciliationReport, error) {
+	if billType == "" {
+		billType = WechatBillTypeTrade
+	}
+	if billType != WechatBillTypeTrade && billType != WechatBillTypeFundFlow {
+		return nil, fmt.Errorf("不支持的账单类型: %s", billType)
+	}
+	dayStart, dayEnd, err := billDateRange(billDate)
+	if err != nil {
+		return nil, err
+	}
+
+	// 多副本部署时保证同一账单同一时刻只有一个实例在对账
+	if s.redis != nil {
+		lockKey := fmt.Sprintf("%s%s:%s:%s", lockKeyPrefixWechatReconciliation, s.tenantID, billDate, billType)
+		lockToken := uuid.NewString()
+		ok, lockErr := s.redis.SetNX(ctx, lockKey, lockToken, reconciliationLockExpiration)
+		if lockErr != nil {
+			return nil, fmt.Errorf("获取分布式锁失败: %w", lockErr)
+		}
+		if !ok {
+			return nil, ErrReconciliationInProgress
+		}
+		defer func() { _, _ = s.redis.DelIfValue(context.Background(), lockKey, lockToken) }()
+	}
+
+	// 创建对账任务
+	report := &models.WechatReconciliationReport{
+		TenantID:  s.tenantID,
+		BillDate:  billDate,
+		BillType:  billType,
+		Status:    "processing",
+		StartedAt: func() *time.Time { t := time.Now(); return &t }(),
+	}
+	if err := s.db.WithContext(ctx).Create(report).Error; err != nil {
+		return nil, fmt.Errorf("创建对账任务失败: %v", err)
+	}
+
+	// 1. 申请账单，获取下载地址与摘要
+	bill, err := s.applyBill(ctx, billDate, billType)
+	if err != nil {
+		s.failReport(report, fmt.Sprintf("申请账单失败: %v", err))
+		return report, err
+	}
+
+	// 2. 下载并校验账单，账单日无交易时按空账单比对
+	var records []WechatBillRecord
+	if bill != nil {
+		report.DownloadURL = bill.DownloadURL
+		report.HashType = bill.HashType
+		report.HashValue = bill.HashValue
+
+		body, err := s.downloadBill(ctx, bill)
+		if err != nil {
+			s.failReport(report, fmt.Sprintf("下载账单失败: %v", err))
+			return report, err
+		}
+
+		// 3. 解析账单
+		if billType == WechatBillTypeFundFlow {
+			records, err = parseWechatFundFlowBill(body)
+		} else {
+			records, err = parseWechatTradeBill(body)
+		}
+		if err != nil {
+			s.failReport(report, fmt.Sprintf("解析账单失败: %v", err))
+			return report, err
+		}
+	}
+
+	report.TotalCount = len(records)
+	if err := s.db.WithContext(ctx).Save(report).Error; err != nil {
+		s.failReport(report, fmt.Sprintf("保存账单笔数失败: %v", err))
+		return report, fmt.Errorf("保存账单笔数失败: %v", err)
+	}
+
+	// 4. 逐笔比对：支付按支付完成时间、退款按退款成功时间落在账单日内的本地记录参与比对
+	matchCount, diffCount, localOnlyCount, details, err := s.compareWithLocal(ctx, records, dayStart, dayEnd)
+	if err != nil {
+		s.failReport(report, fmt.Sprintf("比对本地记录失败: %v", err))
+		return report, err
+	}
+
+	report.MatchCount = matchCount
+	report.DiffCount = diffCount
+	report.LocalOnlyCount = localOnlyCount
+	if err := s.completeReport(ctx, report, details); err != nil {
+		s.failReport(report, fmt.Sprintf("保存对账结果失败: %v", err))
+		return report, fmt.Errorf("保存对账结果失败: %v", err)
+	}
+
+	s.logger.Info("微信支付对账完成",
+		zap.String("tenant_id", s.tenantID),
+		zap.String("bill_date", billDate),
+		zap.String("bill_type", billType),
+		zap.Int("total", report.TotalCount),
+		zap.Int("match", matchCount),
+		zap.Int("diff", diffCount),
+		zap.Int("local_only", localOnlyCount))
+
+	return report, nil
+}
+
+// RunDailyReconciliation 依次核对交易账单与资金账单，单个账单失败不影响其余账单
+// 返回：已生成的对账报告，以及各账单失败原因的合并错误
+func (s *WechatReconciliationService) RunDailyReconciliation(ctx context.Context, billDate string) ([]*models.WechatReconciliationReport, error) {
+	var reports []*models.WechatReconciliationReport
+	var errs []error
+	for _, billType := range WechatReconciliationBillTypes {
+		report, err := s.RunReconciliation(ctx, billDate, billType)
+		if report != nil {
+			reports = append(reports, report)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", billType, err))
+		}
+	}
+	return reports, errors.Join(errs...)
+}
+
+// completeReport 在同一事务内写入差异明细并完成报告，任一步骤失败整体回滚
+func (s *WechatReconciliationService) completeReport(ctx context.Context, report *models.WechatReconciliationReport, details []models.WechatReconciliationDetail) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i := range details {
+			details[i].ReportID = report.ID
+		}
+		if len(details) > 0 {
+			if err := tx.CreateInBatches(details, reconciliationDetailBatch).Error; err != nil {
+				return fmt.Errorf("写入差异明细失败: %w", err)
+			}
+		}
+
+		report.Status = "completed"
+		now := time.Now()
+		report.CompletedAt = &now
+		return tx.Save(report).Error
+	})
+}
+
+// failReport 将对账任务标记为失败，保存失败时记录日志（调用方已返回原始错误）
+func (s *WechatReconciliationService) failReport(report *models.WechatReconciliationReport, msg string) {
+	report.Status = "failed"
+	report.ErrorMessage = msg
+	now := time.Now()
+	report.CompletedAt = &now
+	if err := s.db.Save(report).Error; err != nil {
+		s.logger.Error("保存对账失败状态失败",
+			zap.String("tenant_id", s.tenantID),
+			zap.Uint("report_id", report.ID),
+			zap.String("reason", msg),
+			zap.Error(err))
+	}
+}
+
+// applyBill 调用 /v3/bill/tradebill 或 /v3/bill/fundflowbill 申请账单
+// 返回：账单下载信息，账单日无交易（NO_STATEMENT_EXIST）时返回 nil
+func (s *WechatReconciliationService) applyBill(ctx context.Context, billDate, billType string) (*wechatBillResp, error) {
+	query := url.Values{}
+	query.Set("bill_date", billDate)
+	query.Set("tar_type", "GZIP")
+	if billType == WechatBillTypeFundFlow {
+		query.Set("account_type", "BASIC")
+	} else {
+		query.Set("bill_type", "ALL")
+	}
+	urlPath := "/v3/bill/" + billType + "?" + query.Encode()
+
+	respBody, _, err := s.wechat.wechatAPIRequest(ctx, http.MethodGet, urlPath, nil)
+	if err != nil {
+		var errResp struct {
+			Code string `json:"code"`
+		}
+		if json.Unmarshal(respBody, &errResp) == nil && errResp.Code == wechatNoStatementCode {
+			s.logger.Info("微信支付账单日无交易", zap.String("bill_date", billDate), zap.String("bill_type", billType))
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var bill wechatBillResp
+	if err := json.Unmarshal(respBody, &bill); err != nil {
+		return nil, fmt.Errorf("解析账单响应失败: %w", err)
+	}
+	if bill.DownloadURL == "" {
+		return nil, errors.New("账单响应缺少 download_url")
+	}
+	return &bill, nil
+}
+
+// downloadBill 下载账单文件，解压 GZIP 后按 hash_type 校验摘要
+// 下载请求同样需要商户签名，响应不带微信支付签名，完整性依赖摘要校验
+func (s *WechatReconciliationService) downloadBill(ctx context.Context, bill *wechatBillResp) ([]byte, error) {
+	u, err := url.Parse(bill.DownloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("解析下载地址失败: %w", err)
+	}
+	auth, err := s.wechat.buildWechatAuthHeader(http.MethodGet, u.RequestURI(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bill.DownloadURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %w", err)
+	}
+	req.Header.Set("Authorization", auth)
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("下载失败: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("下载返回状态码: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取账单失败: %w", err)
+	}
+
+	// 摘要针对解压后的原始账单计算
+	if len(body) >= 2 && body[0] == 0x1f && body[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("解压账单失败: %w", err)
+		}
+		body, err = io.ReadAll(gz)
+		gz.Close()
+		if err != nil {
+			return nil, fmt.Errorf("解压账单失败: %w", err)
+		}
+	}
+
+	if err := verifyWechatBillHash(body, bill.HashType, bill.HashValue); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// verifyWechatBillHash 校验账单摘要，目前微信支付仅使用 SHA1
+func verifyWechatBillHash(body []byte, hashType, hashValue string) error {
+	if !strings.EqualFold(hashType, "SHA1") {
+		return fmt.Errorf("不支持的账单摘要算法: %s", hashType)
+	}
+	sum := sha1.Sum(body)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), hashValue) {
+		return errors.New("账单摘要校验失败，文件可能不完整或被篡改")
+	}
+	return nil
+}
+
+// readWechatBillCSV 读取账单 CSV，返回表头列索引与明细行
+// 账单字段以 ` 开头防止表格软件转换格式，明细之后的汇总部分（以「总」开头的表头行）不返回
+func readWechatBillCSV(body []byte) (map[string]int, [][]string, error) {
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("解析CSV失败: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil, errors.New("账单为空")
+	}
+
+	header := make(map[string]int, len(rows[0]))
+	for i, col := range rows[0] {
+		header[strings.TrimSpace(col)] = i
+	}
+
+	var data [][]string
+	for _, row := range rows[1:] {
+		if len(row) > 0 && strings.HasPrefix(strings.TrimSpace(row[0]), "总") {
+			break
+		}
+		for i := range row {
+			row[i] = strings.TrimPrefix(strings.TrimSpace(row[i]), "`")
+		}
+		data = append(data, row)
+	}
+	return header, data, nil
+}
+
+// wechatBillCell 按列名读取账单字段，列不存在时返回空
+func wechatBillCell(header map[string]int, row []string, names ...string) string {
+	for _, name := range names {
+		if idx, ok := header[name]; ok && idx < len(row) && row[idx] != "" {
+			return row[idx]
+		}
+	}
+	return ""
+}
+
+// parseWechatBillTime 解析账单时间（北京时间）
+func parseWechatBillTime(value string) *time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", value, billLocation)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// parseWechatTradeBill 解析交易账单（bill_type=ALL）
+// 交易状态 SUCCESS 为支付记录，REFUND 为退款记录，REVOKED（已撤销）不参与对账
+func parseWechatTradeBill(body []byte) ([]WechatBillRecord, error) {
+	header, rows, err := readWechatBillCSV(body)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := header["商户订单号"]; !ok {
+		return nil, errors.New("未找到交易账单表头，请检查文件格式")
+	}
+
+	var records []WechatBillRecord
+	for _, row := range rows {
+		rec := WechatBillRecord{
+			OutTradeNo:    wechatBillCell(header, row, "商户订单号"),
+			TransactionID: wechatBillCell(header, row, "微信订单号"),
+			Status:        wechatBillCell(header, row, "交易状态"),
+			BillTime:      parseWechatBillTime(wechatBillCell(header, row, "交易时间")),
+		}
+		if rec.OutTradeNo == "" {
+			continue
+		}
+		switch rec.Status {
+		case "SUCCESS":
+			rec.Kind = billRecordPayment
+			rec.Amount = wechatBillCell(header, row, "订单金额", "应结订单金额")
+		case "REFUND":
+			rec.Kind = billRecordRefund
+			rec.OutRefundNo = wechatBillCell(header, row, "商户退款单号")
+			rec.RefundID = wechatBillCell(header, row, "微信退款单号")
+			rec.Amount = wechatBillCell(header, row, "申请退款金额", "退款金额")
+		default:
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// parseWechatFundFlowBill 解析资金账单（基本账户）
+// 业务类型「交易」为支付记录、「退款」为退款记录，手续费、提现等资金流水不参与对账
+// 业务凭证号为商户订单号或商户退款单号，微信支付业务单号为微信订单号或微信退款单号
+func parseWechatFundFlowBill(body []byte) ([]WechatBillRecord, error) {
+	header, rows, err := readWechatBillCSV(body)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := header["业务凭证号"]; !ok {
+		return nil, errors.New("未找到资金账单表头，请检查文件格式")
+	}
+
+	var records []WechatBillRecord
+	for _, row := range rows {
+		bizType := wechatBillCell(header, row, "业务类型")
+		voucherNo := wechatBillCell(header, row, "业务凭证号")
+		bizNo := wechatBillCell(header, row, "微信支付业务单号")
+		if voucherNo == "" {
+			continue
+		}
+		rec := WechatBillRecord{
+			Status:   bizType,
+			Amount:   wechatBillCell(header, row, "收支金额(元)", "收支金额（元）"),
+			BillTime: parseWechatBillTime(wechatBillCell(header, row, "记账时间")),
+		}
+		switch {
+		case strings.Contains(bizType, "退款"):
+			rec.Kind = billRecordRefund
+			rec.OutRefundNo = voucherNo
+			rec.RefundID = bizNo
+		case bizType == "交易":
+			rec.Kind = billRecordPayment
+			rec.OutTradeNo = voucherNo
+			rec.TransactionID = bizNo
+		default:
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// compareWithLocal 将账单记录与本地 WechatPayment/WechatRefund 及订单逐笔比对
+// 支付按商户订单号或微信订单号匹配，退款按商户退款单号或微信退款单号匹配
+// 支付或退款时间跨越账单日边界的记录按单号补查，匹配后不计入差异
+func (s *WechatReconciliationService) compareWithLocal(ctx context.Context, records []WechatBillRecord, dayStart, dayEnd time.Time) (matchCount, diffCount, localOnlyCount int, details []models.WechatReconciliationDetail, err error) {
+	payments, err := s.loadLocalPayments(ctx,
+		"COALESCE(wechat_payments.success_time, orders.paid_at) >= ? AND COALESCE(wechat_payments.success_time, orders.paid_at) < ?",
+		dayStart, dayEnd)
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+	refunds, err := s.loadLocalRefunds(ctx,
+		"COALESCE(wechat_refunds.success_time, wechat_refunds.created_at) >= ? AND COALESCE(wechat_refunds.success_time, wechat_refunds.created_at) < ?",
+		dayStart, dayEnd)
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+
+	index := newWechatLocalIndex()
+	index.add(payments...)
+	index.add(refunds...)
+
+	// 补查账单日外的本地记录
+	var missingTradeNos, missingRefundNos []string
+	for _, rec := range records {
+		if index.lookup(rec) != nil {
+			continue
+		}
+		if rec.Kind == billRecordRefund {
+			missingRefundNos = append(missingRefundNos, rec.OutRefundNo)
+		} else {
+			missingTradeNos = append(missingTradeNos, rec.OutTradeNo)
+		}
+	}
+	if len(missingTradeNos) > 0 {
+		extra, err := s.loadLocalPayments(ctx, "wechat_payments.out_trade_no IN ?", missingTradeNos)
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		index.addOutOfRange(extra)
+	}
+	if len(missingRefundNos) > 0 {
+		extra, err := s.loadLocalRefunds(ctx, "wechat_refunds.out_refund_no IN ?", missingRefundNos)
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		index.addOutOfRange(extra)
+	}
+
+	for _, rec := range records {
+		billFen, _ := parseBillAmount(rec.Amount)
+		local := index.lookup(rec)
+		if local == nil {
+			details = append(details, models.WechatReconciliationDetail{
+				OutTradeNo:    rec.OutTradeNo,
+				TransactionID: firstNonEmpty(rec.TransactionID, rec.RefundID),
+				RecordType:    rec.Kind,
+				OutRefundNo:   rec.OutRefundNo,
+				DiffType:      "wechat_only",
+				WechatAmount:  rec.Amount,
+				WechatStatus:  rec.Status,
+				BillTime:      rec.BillTime,
+			})
+			diffCount++
+			continue
+		}
+		local.matched = true
+
+		if billFen != local.AmountFen {
+			details = append(details, models.WechatReconciliationDetail{
+				OutTradeNo:    local.OutTradeNo,
+				TransactionID: firstNonEmpty(rec.TransactionID, rec.RefundID),
+				RecordType:    local.Kind,
+				OutRefundNo:   local.OutRefundNo,
+				DiffType:      "amount_mismatch",
+				WechatAmount:  rec.Amount,
+				LocalAmount:   local.AmountFen,
+				WechatStatus:  rec.Status,
+				LocalStatus:   local.Status,
+				BillTime:      rec.BillTime,
+			})
+			diffCount++
+		} else {
+			matchCount++
+		}
+	}
+
+	for _, local := range append(payments, refunds...) {
+		if local.matched {
+			continue
+		}
+		details = append(details, models.WechatReconciliationDetail{
+			OutTradeNo:    local.OutTradeNo,
+			TransactionID: firstNonEmpty(local.TransactionID, local.RefundID),
+			RecordType:    local.Kind,
+			OutRefundNo:   local.OutRefundNo,
+			DiffType:      "local_only",
+			LocalAmount:   local.AmountFen,
+			LocalStatus:   local.Status,
+		})
+		localOnlyCount++
+	}
+
+	return matchCount, diffCount, localOnlyCount, details, nil
+}
+
+// wechatLocalIndex 按商户单号与微信单号索引本地记录
+type wechatLocalIndex struct {
+	payments map[string]*wechatLocalEntry
+	refunds  map[string]*wechatLocalEntry
+}
+
+func newWechatLocalIndex() *wechatLocalIndex {
+	return &wechatLocalIndex{
+		payments: make(map[string]*wechatLocalEntry),
+		refunds:  make(map[string]*wechatLocalEntry),
+	}
+}
+
+func (idx *wechatLocalIndex) add(entries ...*wechatLocalEntry) {
+	for _, e := range entries {
+		target := idx.payments
+		keys := []string{e.OutTradeNo, e.TransactionID}
+		if e.Kind == billRecordRefund {
+			target = idx.refunds
+			keys = []string{e.OutRefundNo, e.RefundID}
+		}
+		for _, key := range keys {
+			if key != "" && target[key] == nil {
+				target[key] = e
+			}
+		}
+	}
+}
+
+// addOutOfRange 登记账单日外的记录，只用于匹配，不参与仅本地有的统计
+func (idx *wechatLocalIndex) addOutOfRange(entries []*wechatLocalEntry) {
+	for _, e := range entries {
+		e.matched = true
+	}
+	idx.add(entries...)
+}
+
+func (idx *wechatLocalIndex) lookup(rec WechatBillRecord) *wechatLocalEntry {
+	target := idx.payments
+	keys := []string{rec.OutTradeNo, rec.TransactionID}
+	if rec.Kind == billRecordRefund {
+		target = idx.refunds
+		keys = []string{rec.OutRefundNo, rec.RefundID}
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if e := target[key]; e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// loadLocalPayments 查询本租户支付成功的微信支付记录，金额取订单金额
+func (s *WechatReconciliationService) loadLocalPayments(ctx context.Context, where string, args ...interface{}) ([]*wechatLocalEntry, error) {
+	var rows []struct {
+		OutTradeNo    string
+		TransactionID string
+		TotalAmount   int64
+		TradeState    string
+	}
+	if err := s.db.WithContext(ctx).Model(&models.WechatPayment{}).
+		Joins("JOIN orders ON orders.id = wechat_payments.order_id").
+		Where("orders.tenant_id = ? AND wechat_payments.trade_state = ?", s.tenantID, "SUCCESS").
+		Where(where, args...).
+		Select("wechat_payments.out_trade_no, wechat_payments.transaction_id, orders.total_amount, wechat_payments.trade_state").
+		Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("查询本地微信支付记录失败: %w", err)
+	}
+
+	entries := make([]*wechatLocalEntry, 0, len(rows))
+	for _, r := range rows {
+		entries = append(entries, &wechatLocalEntry{
+			Kind:          billRecordPayment,
+			OutTradeNo:    r.OutTradeNo,
+			TransactionID: r.TransactionID,
+			AmountFen:     r.TotalAmount,
+			Status:        r.TradeState,
+		})
+	}
+	return entries, nil
+}
+
+// loadLocalRefunds 查询本租户退款成功的微信退款记录
+func (s *WechatReconciliationService) loadLocalRefunds(ctx context.Context, where string, args ...interface{}) ([]*wechatLocalEntry, error) {
+	var refunds []models.WechatRefund
+	if err := s.db.WithContext(ctx).Model(&models.WechatRefund{}).
+		Joins("JOIN orders ON orders.id = wechat_refunds.order_id").
+		Where("orders.tenant_id = ? AND wechat_refunds.refund_status = ?", s.tenantID, "SUCCESS").
+		Where(where, args...).
+		Find(&refunds).Error; err != nil {
+		return nil, fmt.Errorf("查询本地微信退款记录失败: %w", err)
+	}
+
+	entries := make([]*wechatLocalEntry, 0, len(refunds))
+	for _, r := range refunds {
+		entries = append(entries, &wechatLocalEntry{
+			Kind:          billRecordRefund,
+			OutTradeNo:    r.OutTradeNo,
+			TransactionID: r.TransactionID,
+			OutRefundNo:   r.OutRefundNo,
+			RefundID:      r.RefundID,
+			AmountFen:     r.RefundAmount,
+			Status:        r.RefundStatus,
+		})
+	}
+	return entries, nil
+}
+
+// GetReconciliationReport 查询对账报告
+func (s *WechatReconciliationService) GetReconciliationReport(ctx context.Context, reportID uint) (*models.WechatReconciliationReport, []models.WechatReconciliationDetail, error) {
+	var report models.WechatReconciliationReport
+	if err := s.db.WithContext(ctx).Scopes(tenantScope(s.tenantID)).First(&report, reportID).Error; err != nil {
+		return nil, nil, fmt.Errorf("对账报告不存在: %v", err)
+	}
+	var details []models.WechatReconciliationDetail
+	if err := s.db.WithContext(ctx).Where("report_id = ?", reportID).Find(&details).Error; err != nil {
+		return nil, nil, fmt.Errorf("查询差异明细失败: %v", err)
+	}
+	return &report, details, nil
+}
+
+// ListReconciliationReports 列出对账报告
+func (s *WechatReconciliationService) ListReconciliationReports(ctx context.Context, billDate string, limit int) ([]models.WechatReconciliationReport, error) {
+	if limit <= 0 {
+		limit = 20
+	}
+	var reports []models.WechatReconciliationReport
+	query := s.db.Scopes(tenantScope(s.tenantID)).Order("created_at DESC").Limit(limit)
+	if billDate != "" {
+		query = query.Where("bill_date = ?", billDate)
+	}
+	if err := query.Find(&reports).Error; err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// firstNonEmpty 返回第一个非空字符串
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
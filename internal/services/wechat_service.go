@@ -32,13 +32,18 @@ import (
 
 const wechatAPIBaseURL = "https://api.mch.weixin.qq.com"
 
+// wechatAppTypeMiniProgram app_ids 中小程序应用ID的键
+const wechatAppTypeMiniProgram = "miniprogram"
+
 // WechatService 微信支付服务
 type WechatService struct {
 	db                       *gorm.DB
 	config                   *config.WechatConfig
 	logger                   *zap.Logger
 	privateKey               *rsa.PrivateKey
+	platformKeys             *wechatPlatformKeys // 回调验签公钥（平台证书/微信支付公钥）
 	orderDelayCancelProducer OrderDelayCancelSender
+	tenantID                 string // 所属租户，订单与签约记录按租户隔离
 }
 
 // SetOrderDelayCancelProducer 注入订单延迟取消消息生产者
@@ -71,22 +76,53 @@ func NewWechatService(db *gorm.DB, cfg *config.WechatConfig, logger *zap.Logger)
 		return nil, fmt.Errorf("解析微信私钥失败: %v", err)
 	}
 
-	return &WechatService{
+	s := &WechatService{
 		db:         db,
 		config:     cfg,
 		logger:     logger,
 		privateKey: privateKey,
-	}, nil
+		tenantID:   config.DefaultTenantID,
+	}
+	if err := s.initPlatformKeys(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// resolveAppID 按应用类型选择应用ID，未指定时使用默认 AppID
+func (s *WechatService) resolveAppID(appType string) (string, error) {
+	if appType == "" {
+		return s.config.AppID, nil
+	}
+	appID, ok := s.config.AppIDs[appType]
+	if !ok || appID == "" {
+		return "", fmt.Errorf("未配置应用类型 %s 的应用ID", appType)
+	}
+	return appID, nil
+}
+
+// paymentAppID 获取支付记录绑定的应用ID，历史记录为空时使用默认 AppID
+func (s *WechatService) paymentAppID(wechatPayment *models.WechatPayment) string {
+	if wechatPayment.AppID != "" {
+		return wechatPayment.AppID
+	}
+	return s.config.AppID
 }
 
 // CreateOrder 创建微信支付订单
 func (s *WechatService) CreateOrder(ctx context.Context, req *CreateWechatOrderRequest) (*CreateWechatOrderResponse, error) {
+	appID, err := s.resolveAppID(req.AppType)
+	if err != nil {
+		return nil, err
+	}
+
 	// 生成系统订单号
 	orderNo := generateWechatOrderNo()
 
 	// 创建订单
 	order := &models.Order{
 		OrderNo:       orderNo,
+		TenantID:      s.tenantID,
 		UserID:        req.UserID,
 		ProductID:     req.ProductID,
 		Type:          models.OrderTypePurchase,
@@ -113,7 +149,7 @@ func (s *WechatService) CreateOrder(ctx context.Context, req *CreateWechatOrderR
 		OrderID:    order.ID,
 		OutTradeNo: orderNo,
 		TradeType:  req.TradeType,
-		AppID:      s.config.AppID,
+		AppID:      appID,
 		MchID:      s.config.MchID,
 	}
 
@@ -167,11 +203,21 @@ func (s *WechatService) CreateOrder(ctx context.Context, req *CreateWechatOrderR
 	}, nil
 }
 
-// CreateJSAPIPayment 创建JSAPI支付（小程序、公众号）
+// CreateJSAPIPayment 创建JSAPI支付（小程序、公众号），使用下单时选择的应用ID
 func (s *WechatService) CreateJSAPIPayment(ctx context.Context, orderNo, openID string) (*JSAPIPaymentResponse, error) {
+	return s.createJSAPIPayment(ctx, orderNo, openID, "")
+}
+
+// CreateMiniProgramPayment 创建小程序支付，使用 app_ids 中 miniprogram 对应的小程序应用ID
+func (s *WechatService) CreateMiniProgramPayment(ctx context.Context, orderNo, openID string) (*JSAPIPaymentResponse, error) {
+	return s.createJSAPIPayment(ctx, orderNo, openID, wechatAppTypeMiniProgram)
+}
+
+// createJSAPIPayment 创建JSAPI预支付单，appType 非空时改用对应应用ID（openid 须属于该应用）
+func (s *WechatService) createJSAPIPayment(ctx context.Context, orderNo, openID, appType string) (*JSAPIPaymentResponse, error) {
 	// 查询订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", orderNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", orderNo).First(&order).Error; err != nil {
 		return nil, fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -181,13 +227,22 @@ func (s *WechatService) CreateJSAPIPayment(ctx context.Context, orderNo, openID
 		return nil, fmt.Errorf("微信支付记录不存在: %v", err)
 	}
 
+	appID := s.paymentAppID(&wechatPayment)
+	if appType != "" {
+		var err error
+		if appID, err = s.resolveAppID(appType); err != nil {
+			return nil, err
+		}
+		wechatPayment.AppID = appID
+	}
+
 	// 调用微信支付 API 创建预支付单
 	timeExpire := ""
 	if order.ExpiredAt != nil {
 		timeExpire = order.ExpiredAt.Format(time.RFC3339)
 	}
 	reqBody := wechatJSAPIReq{
-		AppID:       s.config.AppID,
+		AppID:       appID,
 		MchID:       s.config.MchID,
 		Description: order.Title,
 		OutTradeNo:  orderNo,
@@ -230,14 +285,14 @@ func (s *WechatService) CreateJSAPIPayment(ctx context.Context, orderNo, openID
 	nonceStr := generateNonceStr()
 	packageStr := fmt.Sprintf("prepay_id=%s", prepayID)
 
-	paySign, err := s.signPayParams(s.config.AppID, timestamp, nonceStr, packageStr)
+	paySign, err := s.signPayParams(appID, timestamp, nonceStr, packageStr)
 	if err != nil {
 		return nil, fmt.Errorf("生成pay_sign失败: %w", err)
 	}
 
 	return &JSAPIPaymentResponse{
 		PrepayID:  prepayID,
-		AppID:     s.config.AppID,
+		AppID:     appID,
 		TimeStamp: timestamp,
 		NonceStr:  nonceStr,
 		Package:   packageStr,
@@ -250,7 +305,7 @@ func (s *WechatService) CreateJSAPIPayment(ctx context.Context, orderNo, openID
 func (s *WechatService) CreateNativePayment(ctx context.Context, orderNo string) (*NativePaymentResponse, error) {
 	// 查询订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", orderNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", orderNo).First(&order).Error; err != nil {
 		return nil, fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -266,7 +321,7 @@ func (s *WechatService) CreateNativePayment(ctx context.Context, orderNo string)
 		timeExpire = order.ExpiredAt.Format(time.RFC3339)
 	}
 	reqBody := wechatNativeReq{
-		AppID:       s.config.AppID,
+		AppID:       s.paymentAppID(&wechatPayment),
 		MchID:       s.config.MchID,
 		Description: order.Title,
 		OutTradeNo:  orderNo,
@@ -310,7 +365,7 @@ func (s *WechatService) CreateNativePayment(ctx context.Context, orderNo string)
 func (s *WechatService) CreateAPPPayment(ctx context.Context, orderNo string) (*APPPaymentResponse, error) {
 	// 查询订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", orderNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", orderNo).First(&order).Error; err != nil {
 		return nil, fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -325,8 +380,9 @@ func (s *WechatService) CreateAPPPayment(ctx context.Context, orderNo string) (*
 	if order.ExpiredAt != nil {
 		timeExpire = order.ExpiredAt.Format(time.RFC3339)
 	}
+	appID := s.paymentAppID(&wechatPayment)
 	reqBody := wechatAPPReq{
-		AppID:       s.config.AppID,
+		AppID:       appID,
 		MchID:       s.config.MchID,
 		Description: order.Title,
 		OutTradeNo:  orderNo,
@@ -366,7 +422,7 @@ func (s *WechatService) CreateAPPPayment(ctx context.Context, orderNo string) (*
 	nonceStr := generateNonceStr()
 	packageStr := fmt.Sprintf("prepay_id=%s", prepayID)
 
-	sign, err := s.signPayParams(s.config.AppID, timestamp, nonceStr, packageStr)
+	sign, err := s.signPayParams(appID, timestamp, nonceStr, packageStr)
 	if err != nil {
 		return nil, fmt.Errorf("生成sign失败: %w", err)
 	}
@@ -374,7 +430,7 @@ func (s *WechatService) CreateAPPPayment(ctx context.Context, orderNo string) (*
 	return &APPPaymentResponse{
 		PrepayID:  prepayID,
 		PartnerID: s.config.MchID,
-		AppID:     s.config.AppID,
+		AppID:     appID,
 		TimeStamp: timestamp,
 		NonceStr:  nonceStr,
 		Package:   packageStr,
@@ -387,7 +443,7 @@ func (s *WechatService) CreateAPPPayment(ctx context.Context, orderNo string) (*
 func (s *WechatService) CreateH5Payment(ctx context.Context, orderNo string, sceneInfo map[string]interface{}) (*H5PaymentResponse, error) {
 	// 查询订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", orderNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", orderNo).First(&order).Error; err != nil {
 		return nil, fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -422,7 +478,7 @@ func (s *WechatService) CreateH5Payment(ctx context.Context, orderNo string, sce
 		timeExpire = order.ExpiredAt.Format(time.RFC3339)
 	}
 	reqBody := wechatH5Req{
-		AppID:       s.config.AppID,
+		AppID:       s.paymentAppID(&wechatPayment),
 		MchID:       s.config.MchID,
 		Description: order.Title,
 		OutTradeNo:  orderNo,
@@ -487,12 +543,12 @@ type WechatNotifyRequest struct {
 // 返回解密后的业务数据，供 HandleNotify 处理
 func (s *WechatService) VerifyAndDecryptNotify(headers map[string]string, body []byte) (map[string]interface{}, error) {
 	// 1. 验签
-	if s.config.PlatformCertPath != "" {
+	if s.hasPlatformKeySource() {
 		if err := s.verifyWechatSignature(headers, body); err != nil {
 			return nil, fmt.Errorf("验签失败: %w", err)
 		}
 	} else {
-		s.logger.Warn("未配置微信平台证书，跳过回调验签", zap.String("platform_cert_path", s.config.PlatformCertPath))
+		s.logger.Warn("未配置微信平台证书或微信支付公钥，跳过回调验签")
 	}
 
 	// 2. 解析请求体
@@ -519,7 +575,7 @@ func (s *WechatService) VerifyAndDecryptNotify(headers map[string]string, body [
 	return decrypted, nil
 }
 
-// verifyWechatSignature 验证微信回调签名
+// verifyWechatSignature 验证微信回调签名，按 Wechatpay-Serial 选择平台证书或微信支付公钥
 func (s *WechatService) verifyWechatSignature(headers map[string]string, body []byte) error {
 	timestamp := headers["Wechatpay-Timestamp"]
 	nonce := headers["Wechatpay-Nonce"]
@@ -538,25 +594,10 @@ func (s *WechatService) verifyWechatSignature(headers map[string]string, body []
 	// 构建验签串
 	message := fmt.Sprintf("%s\n%s\n%s\n", timestamp, nonce, string(body))
 
-	// 加载平台证书
-	certPEM, err := os.ReadFile(s.config.PlatformCertPath)
+	// 按序列号选择验签公钥
+	pubKey, err := s.platformPublicKey(context.Background(), headers["Wechatpay-Serial"])
 	if err != nil {
-		return fmt.Errorf("读取平台证书失败: %w", err)
-	}
-
-	block, _ := pem.Decode(certPEM)
-	if block == nil {
-		return errors.New("解析平台证书失败")
-	}
-
-	cert, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		return fmt.Errorf("解析证书失败: %w", err)
-	}
-
-	pubKey, ok := cert.PublicKey.(*rsa.PublicKey)
-	if !ok {
-		return errors.New("平台证书非RSA公钥")
+		return err
 	}
 
 	// 验签：SHA256WithRSA
@@ -573,13 +614,17 @@ func (s *WechatService) verifyWechatSignature(headers map[string]string, body []
 	return nil
 }
 
+// parseWechatpaySignature 解析 Wechatpay-Signature，兼容 signature="xxx" 形式与直接传 Base64 签名
 func parseWechatpaySignature(header string) (string, error) {
 	re := regexp.MustCompile(`signature="([^"]+)"`)
 	matches := re.FindStringSubmatch(header)
-	if len(matches) < 2 {
-		return "", errors.New("无法解析 Wechatpay-Signature")
+	if len(matches) >= 2 {
+		return strings.TrimSpace(matches[1]), nil
+	}
+	if header = strings.TrimSpace(header); header != "" && !strings.Contains(header, "=\"") {
+		return header, nil
 	}
-	return strings.TrimSpace(matches[1]), nil
+	return "", errors.New("无法解析 Wechatpay-Signature")
 }
 
 // buildWechatAuthHeader 构建微信支付 API v3 请求签名头
@@ -676,14 +721,14 @@ func (s *WechatService) wechatAPIRequest(ctx context.Context, method, urlPath st
 
 // 微信支付 API 请求/响应结构
 type wechatJSAPIReq struct {
-	AppID       string         `json:"appid"`
-	MchID       string         `json:"mchid"`
-	Description string         `json:"description"`
-	OutTradeNo  string         `json:"out_trade_no"`
-	TimeExpire  string         `json:"time_expire,omitempty"`
-	NotifyURL   string         `json:"notify_url"`
-	Amount      wechatAmount   `json:"amount"`
-	Payer       wechatPayer    `json:"payer"`
+	AppID       string       `json:"appid"`
+	MchID       string       `json:"mchid"`
+	Description string       `json:"description"`
+	OutTradeNo  string       `json:"out_trade_no"`
+	TimeExpire  string       `json:"time_expire,omitempty"`
+	NotifyURL   string       `json:"notify_url"`
+	Amount      wechatAmount `json:"amount"`
+	Payer       wechatPayer  `json:"payer"`
 }
 type wechatNativeReq struct {
 	AppID       string       `json:"appid"`
@@ -704,14 +749,14 @@ type wechatAPPReq struct {
 	Amount      wechatAmount `json:"amount"`
 }
 type wechatH5Req struct {
-	AppID       string              `json:"appid"`
-	MchID       string              `json:"mchid"`
-	Description string              `json:"description"`
-	OutTradeNo  string              `json:"out_trade_no"`
-	TimeExpire  string              `json:"time_expire,omitempty"`
-	NotifyURL   string              `json:"notify_url"`
-	Amount      wechatAmount        `json:"amount"`
-	SceneInfo   wechatH5SceneInfo    `json:"scene_info"`
+	AppID       string            `json:"appid"`
+	MchID       string            `json:"mchid"`
+	Description string            `json:"description"`
+	OutTradeNo  string            `json:"out_trade_no"`
+	TimeExpire  string            `json:"time_expire,omitempty"`
+	NotifyURL   string            `json:"notify_url"`
+	Amount      wechatAmount      `json:"amount"`
+	SceneInfo   wechatH5SceneInfo `json:"scene_info"`
 }
 type wechatAmount struct {
 	Total    int64  `json:"total"`
@@ -738,17 +783,17 @@ type wechatPrepayResp struct {
 
 // 微信退款 API 请求/响应
 type wechatRefundReq struct {
-	OutTradeNo  string            `json:"out_trade_no"`
-	OutRefundNo string            `json:"out_refund_no"`
-	Reason      string            `json:"reason,omitempty"`
+	OutTradeNo  string             `json:"out_trade_no"`
+	OutRefundNo string             `json:"out_refund_no"`
+	Reason      string             `json:"reason,omitempty"`
 	Amount      wechatRefundAmount `json:"amount"`
-	NotifyURL   string            `json:"notify_url,omitempty"`
+	NotifyURL   string             `json:"notify_url,omitempty"`
 }
 type wechatRefundReqWithTx struct {
 	TransactionID string             `json:"transaction_id"`
 	OutRefundNo   string             `json:"out_refund_no"`
 	Reason        string             `json:"reason,omitempty"`
-	Amount        wechatRefundAmount  `json:"amount"`
+	Amount        wechatRefundAmount `json:"amount"`
 	NotifyURL     string             `json:"notify_url,omitempty"`
 }
 type wechatRefundAmount struct {
@@ -757,15 +802,15 @@ type wechatRefundAmount struct {
 	Currency string `json:"currency"`
 }
 type wechatRefundResp struct {
-	RefundID            string               `json:"refund_id"`
-	OutRefundNo         string               `json:"out_refund_no"`
-	TransactionID       string               `json:"transaction_id"`
-	OutTradeNo          string               `json:"out_trade_no"`
-	Channel             string               `json:"channel"`
-	UserReceivedAccount string               `json:"user_received_account"`
-	CreateTime          string               `json:"create_time"`
-	Amount              wechatRefundRespAmt  `json:"amount"`
-	Status              string               `json:"status"` // SUCCESS, CLOSED, PROCESSING, ABNORMAL
+	RefundID            string              `json:"refund_id"`
+	OutRefundNo         string              `json:"out_refund_no"`
+	TransactionID       string              `json:"transaction_id"`
+	OutTradeNo          string              `json:"out_trade_no"`
+	Channel             string              `json:"channel"`
+	UserReceivedAccount string              `json:"user_received_account"`
+	CreateTime          string              `json:"create_time"`
+	Amount              wechatRefundRespAmt `json:"amount"`
+	Status              string              `json:"status"` // SUCCESS, CLOSED, PROCESSING, ABNORMAL
 }
 type wechatRefundRespAmt struct {
 	Total    int64  `json:"total"`
@@ -819,7 +864,7 @@ func (s *WechatService) HandleNotify(ctx context.Context, notifyData map[string]
 
 	// 查询订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", outTradeNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", outTradeNo).First(&order).Error; err != nil {
 		return fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -913,7 +958,7 @@ func (s *WechatService) HandleNotify(ctx context.Context, notifyData map[string]
 func (s *WechatService) QueryOrder(ctx context.Context, orderNo string) (*QueryWechatOrderResponse, error) {
 	// 查询本地订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", orderNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", orderNo).First(&order).Error; err != nil {
 		return nil, fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -952,7 +997,7 @@ func (s *WechatService) QueryOrder(ctx context.Context, orderNo string) (*QueryW
 func (s *WechatService) Refund(ctx context.Context, req *WechatRefundRequest) (*WechatRefundResponse, error) {
 	// 查询订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", req.OrderNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", req.OrderNo).First(&order).Error; err != nil {
 		return nil, fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -1091,7 +1136,7 @@ func (s *WechatService) Refund(ctx context.Context, req *WechatRefundRequest) (*
 func (s *WechatService) CloseOrder(ctx context.Context, orderNo string) error {
 	// 查询订单
 	var order models.Order
-	if err := s.db.Where("order_no = ?", orderNo).First(&order).Error; err != nil {
+	if err := s.db.Scopes(tenantScope(s.tenantID)).Where("order_no = ?", orderNo).First(&order).Error; err != nil {
 		return fmt.Errorf("订单不存在: %v", err)
 	}
 
@@ -1167,6 +1212,7 @@ type CreateWechatOrderRequest struct {
 	Detail      string `json:"detail"`
 	TotalAmount int64  `json:"total_amount" binding:"required,min=1"`
 	TradeType   string `json:"trade_type" binding:"required,oneof=JSAPI NATIVE APP MWEB"`
+	AppType     string `json:"app_type"` // 应用类型（对应 app_ids 的键，如 mp、miniprogram、app），为空时使用默认 AppID
 }
 
 // CreateWechatOrderResponse 创建微信订单响应